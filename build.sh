@@ -162,7 +162,7 @@ build_bin() {
   msg "Starting build for $goos"
   GOOS=$goos \
   go build \
-  -ldflags "-X main.VERSION=$VERSION" \
+  -ldflags "-X main.VERSION=$VERSION -X main.GitCommit=$(git rev-parse HEAD) -X main.BuildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)" \
   -a \
   -installsuffix cgo \
   -o $output
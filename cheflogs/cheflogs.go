@@ -2,9 +2,14 @@ package cheflogs
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/morfien101/chef-waiter/config"
 	"github.com/morfien101/chef-waiter/logs"
@@ -20,11 +25,21 @@ type WorkerReadWriter interface {
 type WorkerReader interface {
 	IsLogAvailable(string) error
 	GetLogPath(string) string
+	GetErrLogPath(string) string
+	DiskUsage() (DiskUsage, error)
+	SearchLogs(func(string) bool, int) ([]SearchResult, error)
+	ListLogs() ([]LogFile, error)
+	CheckLogDir() error
 }
 
 // WorkerWriter is used to describe the functuons that are used to write data to the Worker.
 type WorkerWriter interface {
 	RequestDelete(map[string]int64)
+	SweepLogs(map[string]int64) (int, error)
+	KeepToDiskBudget() int
+	PurgeLogs() (int, error)
+	CreateLog(string) (LogWriter, error)
+	CreateErrLog(string) (LogWriter, error)
 }
 
 // Worker will hold the configuration and logger for the logs worker functions.
@@ -32,14 +47,46 @@ type Worker struct {
 	LogWorkQ chan map[string]int64
 	logger   logs.SysLogger
 	config   config.Config
+
+	usageLock sync.Mutex
+	usage     DiskUsage
+	usageTime time.Time
+
+	// paths holds where the logs named with log_filename_template are, by guid.
+	pathsLock sync.Mutex
+	paths     map[string]string
+
+	// openLogs holds the cleaned paths of the logs that runs are still writing to.
+	openLock sync.Mutex
+	openLogs map[string]bool
+
+	// namePattern matches the log file names made from namePatternTemplate. It is only
+	// compiled again when log_filename_template changes.
+	namePatternLock     sync.Mutex
+	namePattern         *regexp.Regexp
+	namePatternTemplate string
+}
+
+// DiskUsage describes how much space the chef logs are taking up. BudgetBytes is the
+// log_disk_budget_mb in bytes, or 0 if there is no budget.
+type DiskUsage struct {
+	Bytes       int64 `json:"bytes"`
+	Files       int   `json:"files"`
+	BudgetBytes int64 `json:"budget_bytes"`
 }
 
+// diskUsageTTL is how long a disk usage calculation is reused for.
+// Walking the log directory on large servers is not cheap.
+const diskUsageTTL = 30 * time.Second
+
 // New will return a new Chef logs worker. These are responsible for log clearing.
 func New(config config.Config, logger logs.SysLogger) *Worker {
 	return &Worker{
 		logger:   logger,
 		config:   config,
 		LogWorkQ: make(chan map[string]int64, 10),
+		paths:    make(map[string]string),
+		openLogs: make(map[string]bool),
 	}
 }
 
@@ -52,23 +99,131 @@ func (w *Worker) IsLogAvailable(guid string) error {
 	return nil
 }
 
+// CreateLog will create the log file for a guid and return a writer for it.
+// Whole lines are written to the file as soon as they arrive so the log can be followed while chef runs.
+// The log stops growing at the configured max log size.
+// The caller is responsible for closing the writer.
+func (w *Worker) CreateLog(guid string) (LogWriter, error) {
+	path := w.logPath(w.logFileName(guid, time.Now()))
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	if w.config.LogFilenameTemplate() != "" {
+		w.rememberLogPath(guid, path)
+	}
+	return w.newLineWriter(f), nil
+}
+
+// CreateErrLog will create the stderr log for a guid and return a writer for it.
+// It is named after the log of the run so CreateLog must be called first.
+// The caller is responsible for closing the writer.
+func (w *Worker) CreateErrLog(guid string) (LogWriter, error) {
+	f, err := os.Create(w.GetErrLogPath(guid))
+	if err != nil {
+		return nil, err
+	}
+	return w.newLineWriter(f), nil
+}
+
+// newLineWriter will return a lineWriter for f. f is treated as open, and is never
+// removed to keep to the disk budget, until the writer is closed.
+func (w *Worker) newLineWriter(f *os.File) *lineWriter {
+	path := filepath.Clean(f.Name())
+	w.openLock.Lock()
+	w.openLogs[path] = true
+	w.openLock.Unlock()
+	return &lineWriter{
+		file:  f,
+		limit: w.config.MaxLogSize(),
+		onClose: func() {
+			w.openLock.Lock()
+			delete(w.openLogs, path)
+			w.openLock.Unlock()
+		},
+	}
+}
+
+// isOpen is true if a run is still writing to the log at path. The path is cleaned
+// as logs are created under the log_location as written, which may end in a slash.
+func (w *Worker) isOpen(path string) bool {
+	w.openLock.Lock()
+	defer w.openLock.Unlock()
+	return w.openLogs[filepath.Clean(path)]
+}
+
 // clearOldChefLogs will remove any logs that are deemed to be old
 func (w *Worker) clearOldChefLogs(guidsToKeep map[string]int64) {
+	if _, err := w.SweepLogs(guidsToKeep); err != nil {
+		w.logger.Error(err)
+	}
+}
+
+// SweepLogs will remove the logs that do not belong to one of guidsToKeep and return
+// how many were removed. The sweeper does this after the state is saved, calling it
+// directly removes old logs without waiting for that.
+func (w *Worker) SweepLogs(guidsToKeep map[string]int64) (int, error) {
 	allLogs, err := w.logsOnDisk()
 	if err != nil {
-		w.logger.Error(err)
+		return 0, err
 	}
-	// Delete the file if it needs to be removed.
-	// Dirty code refactor later.
-	// for each file in the <logs> check that it is not in the keep list
-	// If not delete the file.
+	removed := 0
 	for _, oldFile := range w.filesToDelete(guidsToKeep, allLogs) {
-		if os.Remove(oldFile); err != nil {
+		if err := os.Remove(oldFile); err != nil {
 			w.logger.Infof("Failed to delete %s. Error: %s", oldFile, err)
 			continue
 		}
 		w.logger.Infof("Deleted file: %s\n", oldFile)
+		w.forgetLogPaths(w.guidFromPath(oldFile))
+		removed++
+	}
+	if removed > 0 {
+		w.resetDiskUsage()
 	}
+	return removed + w.KeepToDiskBudget(), nil
+}
+
+// KeepToDiskBudget will remove the oldest logs until the logs take up no more than
+// log_disk_budget_mb and return how many were removed. Logs that runs are still writing
+// to are never removed, so the budget can be gone over while they run. SweepLogs does
+// this after removing the logs of old runs.
+func (w *Worker) KeepToDiskBudget() int {
+	budget := w.config.LogDiskBudget()
+	if budget <= 0 {
+		return 0
+	}
+	logFiles, err := w.logFilesOnDisk()
+	if err != nil {
+		w.logger.Errorf("Failed to read the logs to keep them to the disk budget. Error: %s", err)
+		return 0
+	}
+	var total int64
+	for _, logFile := range logFiles {
+		total += logFile.size
+	}
+	// Oldest first.
+	sort.Slice(logFiles, func(i, j int) bool { return logFiles[i].modTime.Before(logFiles[j].modTime) })
+	removed := 0
+	for _, logFile := range logFiles {
+		if total <= budget {
+			break
+		}
+		if w.isOpen(logFile.path) {
+			continue
+		}
+		if err := os.Remove(logFile.path); err != nil {
+			w.logger.Infof("Failed to delete %s. Error: %s", logFile.path, err)
+			continue
+		}
+		w.forgetLogPaths(w.guidFromPath(logFile.path))
+		total -= logFile.size
+		removed++
+	}
+	if removed > 0 {
+		w.logger.Infof("Deleted %d of the oldest logs to keep the logs under the disk budget of %d bytes", removed, budget)
+		w.resetDiskUsage()
+	}
+	return removed
 }
 
 func (w *Worker) logsOnDisk() ([]string, error) {
@@ -76,18 +231,36 @@ func (w *Worker) logsOnDisk() ([]string, error) {
 	return filepath.Glob(fmt.Sprintf("%s/*", w.config.LogLocation()))
 }
 
+// diskFile is a regular file in the log directory.
+type diskFile struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// logFilesOnDisk will return the regular files in the log directory.
+func (w *Worker) logFilesOnDisk() ([]diskFile, error) {
+	allLogs, err := w.logsOnDisk()
+	if err != nil {
+		return nil, err
+	}
+	files := make([]diskFile, 0, len(allLogs))
+	for _, path := range allLogs {
+		info, err := os.Lstat(path)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		files = append(files, diskFile{path: path, size: info.Size(), modTime: info.ModTime()})
+	}
+	return files, nil
+}
+
 func (w *Worker) filesToDelete(guidsToKeep map[string]int64, allLogs []string) []string {
 	oldFiles := make([]string, 0)
 	for _, currentFile := range allLogs {
-		del := true
-		// Get check if the log is in the list of files.
-		for guid := range guidsToKeep {
-			if w.GetLogPath(guid) == currentFile {
-				del = false
-				break
-			}
-		}
-		if del {
+		// Keep the log if it belongs to one of the guids.
+		guid, ok := w.guidFromFileName(filepath.Base(currentFile))
+		if _, keep := guidsToKeep[guid]; !ok || !keep {
 			oldFiles = append(oldFiles, currentFile)
 		}
 	}
@@ -95,6 +268,110 @@ func (w *Worker) filesToDelete(guidsToKeep map[string]int64, allLogs []string) [
 	return oldFiles
 }
 
+// PurgeLogs will remove every log file found in the log directory and return how
+// many were deleted. Only regular files directly inside the log directory are touched.
+// Logs that runs are still writing to are kept, so a run that starts during a purge
+// keeps its log.
+func (w *Worker) PurgeLogs() (int, error) {
+	allLogs, err := w.logsOnDisk()
+	if err != nil {
+		return 0, err
+	}
+	logDir := filepath.Clean(w.config.LogLocation())
+	removed := 0
+	for _, logFile := range allLogs {
+		if filepath.Dir(filepath.Clean(logFile)) != logDir {
+			continue
+		}
+		info, err := os.Lstat(logFile)
+		if err != nil || !info.Mode().IsRegular() || w.isOpen(logFile) {
+			continue
+		}
+		if err := os.Remove(logFile); err != nil {
+			w.logger.Errorf("Failed to purge %s. Error: %s", logFile, err)
+			continue
+		}
+		w.forgetLogPaths(w.guidFromPath(logFile))
+		removed++
+	}
+	w.logger.Infof("Purged %d log files from %s", removed, logDir)
+	return removed, nil
+}
+
+// CheckLogDir will return an error if a log can not be written to the log directory.
+// A temporary file is made and removed to be sure.
+func (w *Worker) CheckLogDir() error {
+	f, err := ioutil.TempFile(w.config.LogLocation(), ".chefwaiter-check-")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// LogFile describes a chef log on disk. Stderr is true for the log that holds only
+// the stderr of a run.
+type LogFile struct {
+	GUID       string `json:"guid"`
+	Size       int64  `json:"size"`
+	Modified   int64  `json:"modified"`
+	Compressed bool   `json:"compressed"`
+	Stderr     bool   `json:"stderr,omitempty"`
+}
+
+// ListLogs will return the log files in the log directory, most recently modified first.
+func (w *Worker) ListLogs() ([]LogFile, error) {
+	allLogs, err := w.logsOnDisk()
+	if err != nil {
+		return nil, err
+	}
+	logFiles := make([]LogFile, 0, len(allLogs))
+	for _, logFile := range allLogs {
+		info, err := os.Lstat(logFile)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		logFiles = append(logFiles, LogFile{
+			GUID:       w.guidFromPath(logFile),
+			Size:       info.Size(),
+			Modified:   info.ModTime().Unix(),
+			Compressed: strings.HasSuffix(logFile, ".gz"),
+			Stderr:     isErrLog(logFile),
+		})
+	}
+	sort.Slice(logFiles, func(i, j int) bool { return logFiles[i].Modified > logFiles[j].Modified })
+	return logFiles, nil
+}
+
+// DiskUsage will return the total size and number of the log files in the log directory.
+// The result is cached for a short time so it can be called often.
+func (w *Worker) DiskUsage() (DiskUsage, error) {
+	w.usageLock.Lock()
+	defer w.usageLock.Unlock()
+	if !w.usageTime.IsZero() && time.Since(w.usageTime) < diskUsageTTL {
+		return w.usage, nil
+	}
+	logFiles, err := w.logFilesOnDisk()
+	if err != nil {
+		return DiskUsage{}, err
+	}
+	usage := DiskUsage{BudgetBytes: w.config.LogDiskBudget()}
+	for _, logFile := range logFiles {
+		usage.Bytes += logFile.size
+		usage.Files++
+	}
+	w.usage = usage
+	w.usageTime = time.Now()
+	return usage, nil
+}
+
+// resetDiskUsage will make the next DiskUsage look at the disk again.
+func (w *Worker) resetDiskUsage() {
+	w.usageLock.Lock()
+	defer w.usageLock.Unlock()
+	w.usageTime = time.Time{}
+}
+
 // RequestDelete will add a guid map to a queue to have the chef files removed that are no
 // longer required.
 func (w *Worker) RequestDelete(GUIDmap map[string]int64) {
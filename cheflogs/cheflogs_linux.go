@@ -4,7 +4,7 @@ import (
 	"fmt"
 )
 
-// GetLogPath will return a string that points to the log for a guid on the disk.
-func (w *Worker) GetLogPath(guid string) (logPath string) {
-	return fmt.Sprintf("%s/%s.log", w.config.LogLocation(), guid)
+// logPath will return a string that points to a file called name in the log directory.
+func (w *Worker) logPath(name string) string {
+	return fmt.Sprintf("%s/%s", w.config.LogLocation(), name)
 }
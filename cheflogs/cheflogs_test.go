@@ -2,7 +2,9 @@ package cheflogs
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"runtime"
 	"strings"
 	"testing"
@@ -83,3 +85,450 @@ func TestDeleteOldLogs(t *testing.T) {
 		}
 	}
 }
+
+func TestSweepLogs(t *testing.T) {
+	logsPath, err := ioutil.TempDir("", "sweeplogs")
+	if err != nil {
+		t.Fatalf("Failed to create the fake logs directory. Error: %s", err)
+	}
+	defer os.RemoveAll(logsPath)
+
+	keep := map[string]int64{}
+	for i := 0; i < 3; i++ {
+		guid := uuid.NewV4().String()
+		f, err := os.Create(filepath.Join(logsPath, fmt.Sprintf("%s.log", guid)))
+		if err != nil {
+			t.Fatalf("Failed to create a test file. Error: %s", err)
+		}
+		f.Close()
+		if i == 0 {
+			keep[guid] = time.Now().Unix()
+		}
+	}
+
+	chefLogger := New(&config.ValuesContainer{InternalLogLocation: logsPath}, logs.NewFakeLogger(false))
+	removed, err := chefLogger.SweepLogs(keep)
+	if err != nil || removed != 2 {
+		t.Errorf("SweepLogs should remove the 2 logs not kept. Got: %d, Error: %v", removed, err)
+	}
+	for guid := range keep {
+		if err := chefLogger.IsLogAvailable(guid); err != nil {
+			t.Errorf("SweepLogs removed a log that should be kept. Error: %s", err)
+		}
+	}
+}
+
+func TestCheckLogDir(t *testing.T) {
+	logsPath, err := ioutil.TempDir("", "checklogdir")
+	if err != nil {
+		t.Fatalf("Failed to create the fake logs directory. Error: %s", err)
+	}
+	defer os.RemoveAll(logsPath)
+
+	if err := New(&config.ValuesContainer{InternalLogLocation: logsPath}, logs.NewFakeLogger(false)).CheckLogDir(); err != nil {
+		t.Errorf("CheckLogDir failed on a writable directory. Error: %s", err)
+	}
+	if files, _ := ioutil.ReadDir(logsPath); len(files) != 0 {
+		t.Errorf("CheckLogDir left %d files behind", len(files))
+	}
+	missing := filepath.Join(logsPath, "missing")
+	if err := New(&config.ValuesContainer{InternalLogLocation: missing}, logs.NewFakeLogger(false)).CheckLogDir(); err == nil {
+		t.Errorf("CheckLogDir should fail on a missing directory")
+	}
+}
+
+func TestPurgeLogs(t *testing.T) {
+	logsPath, err := ioutil.TempDir("", "purgelogs")
+	if err != nil {
+		t.Fatalf("Failed to create the fake logs directory. Error: %s", err)
+	}
+	defer os.RemoveAll(logsPath)
+
+	for i := 0; i < 3; i++ {
+		f, err := os.Create(filepath.Join(logsPath, fmt.Sprintf("%s.log", uuid.NewV4().String())))
+		if err != nil {
+			t.Fatalf("Failed to create a test file. Error: %s", err)
+		}
+		f.Close()
+	}
+	if err := os.Mkdir(filepath.Join(logsPath, "subdir"), 0755); err != nil {
+		t.Fatalf("Failed to create a test directory. Error: %s", err)
+	}
+
+	configContainer := &config.ValuesContainer{InternalLogLocation: logsPath}
+	chefLogger := New(configContainer, logs.NewFakeLogger(false))
+	// A run that started after the purge was asked for.
+	running := uuid.NewV4().String()
+	runningLog, err := chefLogger.CreateLog(running)
+	if err != nil {
+		t.Fatalf("CreateLog returned an error: %s", err)
+	}
+	defer runningLog.Close()
+
+	removed, err := chefLogger.PurgeLogs()
+	if err != nil {
+		t.Fatalf("PurgeLogs returned an error: %s", err)
+	}
+	if removed != 3 {
+		t.Errorf("PurgeLogs removed the wrong number of files. Got: %d, Want: 3", removed)
+	}
+	if _, err := os.Stat(filepath.Join(logsPath, "subdir")); err != nil {
+		t.Errorf("PurgeLogs removed a directory it should not have touched")
+	}
+	if err := chefLogger.IsLogAvailable(running); err != nil {
+		t.Errorf("PurgeLogs removed the log of a running run")
+	}
+}
+
+func TestCreateLogWritesWholeLines(t *testing.T) {
+	logsPath, err := ioutil.TempDir("", "createlog")
+	if err != nil {
+		t.Fatalf("Failed to create the fake logs directory. Error: %s", err)
+	}
+	defer os.RemoveAll(logsPath)
+
+	chefLogger := New(&config.ValuesContainer{InternalLogLocation: logsPath}, logs.NewFakeLogger(false))
+	guid := uuid.NewV4().String()
+	logFile, err := chefLogger.CreateLog(guid)
+	if err != nil {
+		t.Fatalf("CreateLog returned an error: %s", err)
+	}
+
+	readLog := func() string {
+		b, err := ioutil.ReadFile(chefLogger.GetLogPath(guid))
+		if err != nil {
+			t.Fatalf("Failed to read the log. Error: %s", err)
+		}
+		return string(b)
+	}
+
+	fmt.Fprint(logFile, "first line\nsecond ")
+	if got := readLog(); got != "first line\n" {
+		t.Errorf("Log should only contain whole lines. Got: %q", got)
+	}
+	fmt.Fprint(logFile, "line\nthird")
+	if got := readLog(); got != "first line\nsecond line\n" {
+		t.Errorf("Log did not get the second line. Got: %q", got)
+	}
+	if err := logFile.Close(); err != nil {
+		t.Fatalf("Close returned an error: %s", err)
+	}
+	if got := readLog(); got != "first line\nsecond line\nthird" {
+		t.Errorf("Close did not flush the partial line. Got: %q", got)
+	}
+}
+
+func TestLogSizeLimit(t *testing.T) {
+	f, err := ioutil.TempFile("", "logsizelimit")
+	if err != nil {
+		t.Fatalf("Failed to create the fake log. Error: %s", err)
+	}
+	defer os.Remove(f.Name())
+	logFile := &lineWriter{file: f, limit: 20}
+
+	fmt.Fprint(logFile, "0123456789\n")
+	if logFile.Truncated() {
+		t.Errorf("Log should not be truncated while under the limit")
+	}
+	fmt.Fprint(logFile, "abcdefghij\nmore")
+	if n, err := fmt.Fprint(logFile, "dropped\n"); err != nil || n != len("dropped\n") {
+		t.Errorf("Writes after the limit should be accepted and dropped. Got: %d, %v", n, err)
+	}
+	if err := logFile.Close(); err != nil {
+		t.Fatalf("Close returned an error: %s", err)
+	}
+	if !logFile.Truncated() {
+		t.Errorf("Log should be truncated once over the limit")
+	}
+
+	b, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatalf("Failed to read the log. Error: %s", err)
+	}
+	got := string(b)
+	if !strings.HasPrefix(got, "0123456789\n[chefwaiter] Log truncated at 20 bytes.") || strings.Contains(got, "abc") || strings.Contains(got, "dropped") {
+		t.Errorf("Log was not truncated correctly. Got: %q", got)
+	}
+}
+
+func TestDiskUsage(t *testing.T) {
+	logsPath, err := ioutil.TempDir("", "diskusage")
+	if err != nil {
+		t.Fatalf("Failed to create the fake logs directory. Error: %s", err)
+	}
+	defer os.RemoveAll(logsPath)
+
+	for i := 1; i <= 3; i++ {
+		content := strings.Repeat("x", i*100)
+		if err := ioutil.WriteFile(filepath.Join(logsPath, fmt.Sprintf("%s.log", uuid.NewV4().String())), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to create a test file. Error: %s", err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(logsPath, "subdir"), 0755); err != nil {
+		t.Fatalf("Failed to create a test directory. Error: %s", err)
+	}
+
+	chefLogger := New(&config.ValuesContainer{InternalLogLocation: logsPath}, logs.NewFakeLogger(false))
+	usage, err := chefLogger.DiskUsage()
+	if err != nil {
+		t.Fatalf("DiskUsage returned an error: %s", err)
+	}
+	if usage.Files != 3 || usage.Bytes != 600 {
+		t.Errorf("DiskUsage is wrong. Got: %+v, Want: 3 files and 600 bytes", usage)
+	}
+
+	// A new file should not show up until the cached value expires.
+	if err := ioutil.WriteFile(filepath.Join(logsPath, "new.log"), []byte("x"), 0644); err != nil {
+		t.Fatalf("Failed to create a test file. Error: %s", err)
+	}
+	if cached, _ := chefLogger.DiskUsage(); cached != usage {
+		t.Errorf("DiskUsage should be cached. Got: %+v, Want: %+v", cached, usage)
+	}
+}
+
+func TestLogDiskBudget(t *testing.T) {
+	tests := []struct {
+		name   string
+		suffix string
+	}{
+		{name: "Plain"},
+		// The logs are created under a path with a // in it, which the glob of the
+		// log directory cleans away.
+		{name: "Trailing slash", suffix: "/"},
+	}
+
+	for _, test := range tests {
+		logsPath, err := ioutil.TempDir("", "diskbudget")
+		if err != nil {
+			t.Fatalf("Failed to create the fake logs directory. Error: %s", err)
+		}
+		defer os.RemoveAll(logsPath)
+
+		configContainer := &config.ValuesContainer{InternalLogLocation: logsPath + test.suffix, InternalLogDiskBudgetMB: 1}
+		chefLogger := New(configContainer, logs.NewFakeLogger(false))
+		keep := map[string]int64{}
+		guids := make([]string, 4)
+		for i, size := range []int{400 * 1024, 400 * 1024, 400 * 1024, 100 * 1024} {
+			guids[i] = uuid.NewV4().String()
+			keep[guids[i]] = int64(i)
+			path := chefLogger.GetLogPath(guids[i])
+			if err := ioutil.WriteFile(path, []byte(strings.Repeat("x", size)), 0644); err != nil {
+				t.Fatalf("Failed to create a test file. Error: %s", err)
+			}
+			modified := time.Now().Add(time.Duration(i-10) * time.Minute)
+			os.Chtimes(path, modified, modified)
+		}
+		// The oldest log is still being written to by a run.
+		running, err := os.OpenFile(chefLogger.GetLogPath(guids[0]), os.O_WRONLY, 0644)
+		if err != nil {
+			t.Fatalf("Failed to open the running log. Error: %s", err)
+		}
+		runningLog := chefLogger.newLineWriter(running)
+
+		removed, err := chefLogger.SweepLogs(keep)
+		if err != nil || removed != 1 {
+			t.Errorf("%s: SweepLogs should have removed one log to get under the budget. Got: %d, Error: %v", test.name, removed, err)
+		}
+		if err := chefLogger.IsLogAvailable(guids[0]); err != nil {
+			t.Errorf("%s: The log of a running run was removed", test.name)
+		}
+		if err := chefLogger.IsLogAvailable(guids[1]); err == nil {
+			t.Errorf("%s: The oldest log that was not running was not removed", test.name)
+		}
+
+		runningLog.Close()
+		if removed, _ := chefLogger.SweepLogs(keep); removed != 0 {
+			t.Errorf("%s: Logs under the budget should not be removed. Got: %d", test.name, removed)
+		}
+		usage, err := chefLogger.DiskUsage()
+		if err != nil || usage.Files != 3 || usage.BudgetBytes != 1024*1024 {
+			t.Errorf("%s: DiskUsage should show the budget. Got: %+v, Error: %v", test.name, usage, err)
+		}
+	}
+}
+
+func TestSearchLogs(t *testing.T) {
+	logsPath, err := ioutil.TempDir("", "searchlogs")
+	if err != nil {
+		t.Fatalf("Failed to create the fake logs directory. Error: %s", err)
+	}
+	defer os.RemoveAll(logsPath)
+
+	logContent := map[string]string{
+		"failed": "Starting Chef\nERROR: something broke\nerror: still broken\n",
+		"passed": "Starting Chef\nChef Client finished\n",
+	}
+	for guid, content := range logContent {
+		if err := ioutil.WriteFile(filepath.Join(logsPath, guid+".log"), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to create a test file. Error: %s", err)
+		}
+	}
+
+	chefLogger := New(&config.ValuesContainer{InternalLogLocation: logsPath}, logs.NewFakeLogger(false))
+	results, err := chefLogger.SearchLogs(func(line string) bool {
+		return strings.Contains(strings.ToLower(line), "error")
+	}, 10)
+	if err != nil {
+		t.Fatalf("SearchLogs returned an error: %s", err)
+	}
+	if len(results) != 1 {
+		t.Fatalf("SearchLogs returned the wrong number of results. Got: %+v", results)
+	}
+	want := SearchResult{GUID: "failed", MatchingLines: 2, FirstMatch: "ERROR: something broke"}
+	if results[0] != want {
+		t.Errorf("SearchLogs returned the wrong result. Got: %+v, Want: %+v", results[0], want)
+	}
+
+	results, _ = chefLogger.SearchLogs(func(line string) bool { return strings.HasPrefix(line, "Starting") }, 1)
+	if len(results) != 1 {
+		t.Errorf("SearchLogs did not respect the limit. Got: %d results", len(results))
+	}
+}
+
+func TestListLogs(t *testing.T) {
+	logsPath, err := ioutil.TempDir("", "listlogs")
+	if err != nil {
+		t.Fatalf("Failed to create the fake logs directory. Error: %s", err)
+	}
+	defer os.RemoveAll(logsPath)
+
+	files := []struct {
+		name     string
+		modified time.Time
+	}{
+		{name: "old.log", modified: time.Unix(1000, 0)},
+		{name: "new.log.gz", modified: time.Unix(2000, 0)},
+	}
+	for _, file := range files {
+		path := filepath.Join(logsPath, file.name)
+		if err := ioutil.WriteFile(path, []byte("log"), 0644); err != nil {
+			t.Fatalf("Failed to create a test file. Error: %s", err)
+		}
+		if err := os.Chtimes(path, file.modified, file.modified); err != nil {
+			t.Fatalf("Failed to set the time on a test file. Error: %s", err)
+		}
+	}
+
+	chefLogger := New(&config.ValuesContainer{InternalLogLocation: logsPath}, logs.NewFakeLogger(false))
+	logFiles, err := chefLogger.ListLogs()
+	if err != nil {
+		t.Fatalf("ListLogs returned an error: %s", err)
+	}
+	want := []LogFile{
+		{GUID: "new", Size: 3, Modified: 2000, Compressed: true},
+		{GUID: "old", Size: 3, Modified: 1000, Compressed: false},
+	}
+	if len(logFiles) != len(want) {
+		t.Fatalf("ListLogs returned the wrong number of logs. Got: %+v", logFiles)
+	}
+	for i := range want {
+		if logFiles[i] != want[i] {
+			t.Errorf("ListLogs returned the wrong log. Got: %+v, Want: %+v", logFiles[i], want[i])
+		}
+	}
+}
+
+func TestLogFilenameTemplate(t *testing.T) {
+	logsPath, err := ioutil.TempDir("", "logtemplate")
+	if err != nil {
+		t.Fatalf("Failed to create the fake logs directory. Error: %s", err)
+	}
+	defer os.RemoveAll(logsPath)
+
+	configContainer := &config.ValuesContainer{
+		InternalLogLocation:         logsPath,
+		InternalLogFilenameTemplate: "{timestamp}-{guid}",
+	}
+	guid := uuid.NewV4().String()
+	chefLogger := New(configContainer, logs.NewFakeLogger(false))
+	lw, err := chefLogger.CreateLog(guid)
+	if err != nil {
+		t.Fatalf("CreateLog returned an error: %s", err)
+	}
+	lw.Close()
+
+	name := filepath.Base(chefLogger.GetLogPath(guid))
+	if ok, _ := filepath.Match("????-??-??T????-"+guid+".log", name); !ok {
+		t.Errorf("The log was not named from the template. Got: %s", name)
+	}
+
+	// A new worker, like after a restart, has to find the log on the disk.
+	restarted := New(configContainer, logs.NewFakeLogger(false))
+	if err := restarted.IsLogAvailable(guid); err != nil {
+		t.Errorf("The log could not be found by guid after a restart. Error: %s", err)
+	}
+	logFiles, err := restarted.ListLogs()
+	if err != nil || len(logFiles) != 1 || logFiles[0].GUID != guid {
+		t.Errorf("ListLogs did not show the guid of the log. Got: %+v, Error: %v", logFiles, err)
+	}
+
+	if removed, err := restarted.SweepLogs(map[string]int64{guid: time.Now().Unix()}); err != nil || removed != 0 {
+		t.Errorf("SweepLogs removed a log that should be kept. Got: %d, Error: %v", removed, err)
+	}
+	if removed, err := restarted.SweepLogs(map[string]int64{}); err != nil || removed != 1 {
+		t.Errorf("SweepLogs did not remove the log. Got: %d, Error: %v", removed, err)
+	}
+	if err := restarted.IsLogAvailable(guid); err == nil {
+		t.Errorf("The log is still available after it was swept")
+	}
+}
+
+func TestFileNamePattern(t *testing.T) {
+	configContainer := &config.ValuesContainer{InternalLogFilenameTemplate: "{timestamp}-{guid}"}
+	chefLogger := New(configContainer, logs.NewFakeLogger(false))
+	if guid, ok := chefLogger.guidFromFileName("2019-06-01T0315-1234.log"); !ok || guid != "1234" {
+		t.Errorf("The guid was not found in the file name. Got: %q, %t", guid, ok)
+	}
+	pattern := chefLogger.fileNamePattern()
+	if chefLogger.fileNamePattern() != pattern {
+		t.Errorf("The pattern should be reused while the template is the same")
+	}
+
+	configContainer.InternalLogFilenameTemplate = "chef-{guid}"
+	if chefLogger.fileNamePattern() == pattern {
+		t.Errorf("The pattern should be compiled again when the template changes")
+	}
+	if guid, ok := chefLogger.guidFromFileName("chef-1234.err.log"); !ok || guid != "1234" {
+		t.Errorf("The guid was not found with the new template. Got: %q, %t", guid, ok)
+	}
+}
+
+func TestErrLog(t *testing.T) {
+	for _, template := range []string{"", "{timestamp}-{guid}"} {
+		logsPath, err := ioutil.TempDir("", "errlog")
+		if err != nil {
+			t.Fatalf("Failed to create the fake logs directory. Error: %s", err)
+		}
+		defer os.RemoveAll(logsPath)
+
+		configContainer := &config.ValuesContainer{
+			InternalLogLocation:         logsPath,
+			InternalLogFilenameTemplate: template,
+		}
+		guid := uuid.NewV4().String()
+		chefLogger := New(configContainer, logs.NewFakeLogger(false))
+		for _, create := range []func(string) (LogWriter, error){chefLogger.CreateLog, chefLogger.CreateErrLog} {
+			lw, err := create(guid)
+			if err != nil {
+				t.Fatalf("Template %q: creating a log returned an error: %s", template, err)
+			}
+			lw.Close()
+		}
+
+		// A new worker, like after a restart, must not mistake the stderr log for the log.
+		restarted := New(configContainer, logs.NewFakeLogger(false))
+		if path := restarted.GetLogPath(guid); strings.HasSuffix(path, errLogSuffix) {
+			t.Errorf("Template %q: GetLogPath found the stderr log. Got: %s", template, path)
+		}
+		if path := restarted.GetErrLogPath(guid); !strings.HasSuffix(path, errLogSuffix) {
+			t.Errorf("Template %q: GetErrLogPath did not find the stderr log. Got: %s", template, path)
+		}
+		logFiles, err := restarted.ListLogs()
+		if err != nil || len(logFiles) != 2 || logFiles[0].GUID != guid || logFiles[1].GUID != guid || logFiles[0].Stderr == logFiles[1].Stderr {
+			t.Errorf("Template %q: ListLogs did not show both logs of the guid. Got: %+v, Error: %v", template, logFiles, err)
+		}
+		if removed, err := restarted.SweepLogs(map[string]int64{}); err != nil || removed != 2 {
+			t.Errorf("Template %q: SweepLogs did not remove both logs. Got: %d, Error: %v", template, removed, err)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package cheflogs
+
+import (
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// errLogSuffix ends the name of the log that holds the stderr of a run when
+// separate_stderr_log is on. The rest of the name is the same as the run's log.
+const errLogSuffix = ".err.log"
+
+// logTimestampFormat is how {timestamp} is written in log file names. It is UTC and sorts
+// in the order the runs started.
+const logTimestampFormat = "2006-01-02T1504"
+
+// logFileName returns the name of the log file for a run of guid that started at start.
+// Logs are named after their guid unless log_filename_template is set.
+func (w *Worker) logFileName(guid string, start time.Time) string {
+	template := w.config.LogFilenameTemplate()
+	if template == "" {
+		return guid + ".log"
+	}
+	return strings.NewReplacer(
+		"{guid}", guid,
+		"{timestamp}", start.UTC().Format(logTimestampFormat),
+	).Replace(template) + ".log"
+}
+
+// guidFromFileName returns the guid in the name of a log file. false is returned if
+// the name was not made by logFileName. The stderr log of a run has the same guid.
+func (w *Worker) guidFromFileName(name string) (string, bool) {
+	match := w.fileNamePattern().FindStringSubmatch(name)
+	if match == nil {
+		return "", false
+	}
+	return match[1], true
+}
+
+// fileNamePattern returns the pattern that matches the log file names made from the
+// log_filename_template. The guid is the first group.
+func (w *Worker) fileNamePattern() *regexp.Regexp {
+	template := w.config.LogFilenameTemplate()
+	if template == "" {
+		template = "{guid}"
+	}
+	w.namePatternLock.Lock()
+	defer w.namePatternLock.Unlock()
+	if w.namePattern != nil && w.namePatternTemplate == template {
+		return w.namePattern
+	}
+	pattern := strings.NewReplacer(
+		regexp.QuoteMeta("{guid}"), `(.+)`,
+		regexp.QuoteMeta("{timestamp}"), `\d{4}-\d{2}-\d{2}T\d{4}`,
+	).Replace(regexp.QuoteMeta(template))
+	w.namePattern = regexp.MustCompile(`^` + strings.Replace(pattern, `(.+)`, `(.+?)`, 1) + `(?:\.err)?\.log$`)
+	w.namePatternTemplate = template
+	return w.namePattern
+}
+
+// guidFromPath is guidFromFileName for a path. Files that do not match the template
+// use their name without the extension so that they can still be shown.
+func (w *Worker) guidFromPath(path string) string {
+	name := strings.TrimSuffix(filepath.Base(path), ".gz")
+	if guid, ok := w.guidFromFileName(name); ok {
+		return guid
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(name, ".log"), ".err")
+}
+
+// isErrLog returns true if path is the stderr log of a run.
+func isErrLog(path string) bool {
+	return strings.HasSuffix(strings.TrimSuffix(path, ".gz"), errLogSuffix)
+}
+
+// errLogPath returns the path of the stderr log that goes with the log at logPath.
+func errLogPath(logPath string) string {
+	return strings.TrimSuffix(logPath, ".log") + errLogSuffix
+}
+
+// GetErrLogPath will return a string that points to the stderr log for a guid on the
+// disk. There is only a stderr log if separate_stderr_log was on for the run.
+func (w *Worker) GetErrLogPath(guid string) string {
+	return errLogPath(w.GetLogPath(guid))
+}
+
+// GetLogPath will return a string that points to the log for a guid on the disk.
+// Logs named with a template are found by looking in the log directory the first
+// time they are asked for, after that the path is remembered.
+func (w *Worker) GetLogPath(guid string) string {
+	if w.config.LogFilenameTemplate() == "" {
+		return w.logPath(w.logFileName(guid, time.Time{}))
+	}
+	w.pathsLock.Lock()
+	defer w.pathsLock.Unlock()
+	if path, ok := w.paths[guid]; ok {
+		return path
+	}
+	if allLogs, err := w.logsOnDisk(); err == nil {
+		for _, logFile := range allLogs {
+			if isErrLog(logFile) {
+				continue
+			}
+			if found, ok := w.guidFromFileName(filepath.Base(logFile)); ok {
+				w.paths[found] = w.logPath(filepath.Base(logFile))
+			}
+		}
+	}
+	if path, ok := w.paths[guid]; ok {
+		return path
+	}
+	// There is no log yet. Give back a path that does not exist so that callers fail to find it.
+	return w.logPath(guid + ".log")
+}
+
+// rememberLogPath records the path a log was created at.
+func (w *Worker) rememberLogPath(guid, path string) {
+	w.pathsLock.Lock()
+	defer w.pathsLock.Unlock()
+	w.paths[guid] = path
+}
+
+// forgetLogPaths drops the remembered paths of the guids.
+func (w *Worker) forgetLogPaths(guids ...string) {
+	w.pathsLock.Lock()
+	defer w.pathsLock.Unlock()
+	for _, guid := range guids {
+		delete(w.paths, guid)
+	}
+}
@@ -0,0 +1,98 @@
+package cheflogs
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// LogWriter is the log of a single chef run.
+type LogWriter interface {
+	io.WriteCloser
+	// Truncated is true once output was dropped because the log reached its size limit.
+	Truncated() bool
+}
+
+// lineWriter writes to the log file a line at a time. Partial lines are held until
+// the rest of the line arrives so that anyone tailing the log only sees whole lines.
+// If limit is more than 0 the log stops growing once it reaches limit bytes. A marker
+// line is written and anything after that is thrown away so that chef can keep running.
+type lineWriter struct {
+	sync.Mutex
+	file      *os.File
+	pending   []byte
+	limit     int64
+	written   int64
+	truncated bool
+	// onClose is called once the file is closed.
+	onClose func()
+}
+
+// Write will write any complete lines in p to the log file straight away.
+func (lw *lineWriter) Write(p []byte) (int, error) {
+	lw.Lock()
+	defer lw.Unlock()
+	if lw.truncated {
+		return len(p), nil
+	}
+	lw.pending = append(lw.pending, p...)
+	if lw.limit > 0 && int64(len(lw.pending)) > lw.limit-lw.written {
+		return len(p), lw.truncate()
+	}
+	lastNewLine := bytes.LastIndexByte(lw.pending, '\n')
+	if lastNewLine < 0 {
+		return len(p), nil
+	}
+	if err := lw.write(lw.pending[:lastNewLine+1]); err != nil {
+		return 0, err
+	}
+	lw.pending = lw.pending[lastNewLine+1:]
+	return len(p), nil
+}
+
+// truncate will write the whole lines that still fit in the limit followed by
+// the truncation marker. Nothing else is written to the log after this.
+func (lw *lineWriter) truncate() error {
+	fits := lw.pending[:lw.limit-lw.written]
+	if lastNewLine := bytes.LastIndexByte(fits, '\n'); lastNewLine >= 0 {
+		if err := lw.write(fits[:lastNewLine+1]); err != nil {
+			return err
+		}
+	}
+	lw.pending = nil
+	lw.truncated = true
+	_, err := fmt.Fprintf(lw.file, "[chefwaiter] Log truncated at %d bytes. The rest of the output was discarded but the run carried on.\n", lw.limit)
+	return err
+}
+
+func (lw *lineWriter) write(p []byte) error {
+	n, err := lw.file.Write(p)
+	lw.written += int64(n)
+	return err
+}
+
+// Truncated is true once output was dropped because the log reached its size limit.
+func (lw *lineWriter) Truncated() bool {
+	lw.Lock()
+	defer lw.Unlock()
+	return lw.truncated
+}
+
+// Close will flush any partial line that is left and close the log file.
+func (lw *lineWriter) Close() error {
+	lw.Lock()
+	defer lw.Unlock()
+	if lw.onClose != nil {
+		defer lw.onClose()
+	}
+	if len(lw.pending) > 0 {
+		if err := lw.write(lw.pending); err != nil {
+			lw.file.Close()
+			return err
+		}
+		lw.pending = nil
+	}
+	return lw.file.Close()
+}
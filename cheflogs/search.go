@@ -0,0 +1,93 @@
+package cheflogs
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+const (
+	// searchMaxFiles is the most log files that a search will look at.
+	// Only the most recently written logs are searched.
+	searchMaxFiles = 100
+	// searchMaxLineLength is the longest line that will be read. A log is only searched
+	// up to the first line that is longer than this.
+	searchMaxLineLength = 1024 * 1024
+)
+
+// SearchResult describes a log that matched a search.
+type SearchResult struct {
+	GUID          string `json:"guid"`
+	MatchingLines int    `json:"matching_lines"`
+	FirstMatch    string `json:"first_match"`
+}
+
+// SearchLogs will look through the most recent logs for lines where match returns true.
+// At most limit results are returned, newest log first.
+func (w *Worker) SearchLogs(match func(line string) bool, limit int) ([]SearchResult, error) {
+	allLogs, err := w.logsOnDisk()
+	if err != nil {
+		return nil, err
+	}
+
+	type logFile struct {
+		path    string
+		modTime int64
+	}
+	files := make([]logFile, 0, len(allLogs))
+	for _, path := range allLogs {
+		info, err := os.Lstat(path)
+		if err != nil || !info.Mode().IsRegular() || filepath.Ext(path) != ".log" {
+			continue
+		}
+		files = append(files, logFile{path: path, modTime: info.ModTime().UnixNano()})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime > files[j].modTime })
+	if len(files) > searchMaxFiles {
+		files = files[:searchMaxFiles]
+	}
+
+	results := make([]SearchResult, 0)
+	for _, file := range files {
+		if len(results) >= limit {
+			break
+		}
+		result, err := searchLog(file.path, w.guidFromPath(file.path), match)
+		if err != nil {
+			w.logger.Warningf("Failed to search %s. Error: %s", file.path, err)
+			continue
+		}
+		if result.MatchingLines > 0 {
+			results = append(results, result)
+		}
+	}
+	return results, nil
+}
+
+// searchLog will count the lines in a single log that match.
+func searchLog(path, guid string, match func(line string) bool) (SearchResult, error) {
+	result := SearchResult{GUID: guid}
+	f, err := os.Open(path)
+	if err != nil {
+		return result, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), searchMaxLineLength)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !match(line) {
+			continue
+		}
+		if result.MatchingLines == 0 {
+			result.FirstMatch = line
+		}
+		result.MatchingLines++
+	}
+	if err := scanner.Err(); err != nil && err != bufio.ErrTooLong {
+		return result, err
+	}
+	return result, nil
+}
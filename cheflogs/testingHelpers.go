@@ -1,6 +1,11 @@
 package cheflogs
 
-import "os"
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
 
 type ChefLogsTest struct {
 	FakeLogPath string
@@ -18,6 +23,10 @@ func (c *ChefLogsTest) GetLogPath(path string) string {
 	return c.FakeLogPath
 }
 
+func (c *ChefLogsTest) GetErrLogPath(path string) string {
+	return c.FakeLogPath + errLogSuffix
+}
+
 func dummyChefLogContent() string {
 	return `
 This is a test chef waiter log.
@@ -25,8 +34,52 @@ chef exited or something.
 `
 }
 
+func (c *ChefLogsTest) DiskUsage() (DiskUsage, error) {
+	return DiskUsage{}, nil
+}
+
+func (c *ChefLogsTest) SearchLogs(match func(string) bool, limit int) ([]SearchResult, error) {
+	results := make([]SearchResult, 0)
+	for _, line := range strings.Split(dummyChefLogContent(), "\n") {
+		if match(line) {
+			results = append(results, SearchResult{GUID: "fake", MatchingLines: 1, FirstMatch: line})
+			break
+		}
+	}
+	return results, nil
+}
+
+func (c *ChefLogsTest) ListLogs() ([]LogFile, error) {
+	return []LogFile{
+		{GUID: "newest", Size: 10, Modified: 200},
+		{GUID: "oldest", Size: 10, Modified: 100},
+	}, nil
+}
+
+func (c *ChefLogsTest) CheckLogDir() error { return nil }
+
 func (c ChefLogsTest) RequestDelete(map[string]int64) {}
 
+func (c ChefLogsTest) SweepLogs(map[string]int64) (int, error) { return 0, nil }
+
+func (c ChefLogsTest) KeepToDiskBudget() int { return 0 }
+
+func (c ChefLogsTest) PurgeLogs() (int, error) { return 0, nil }
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+func (nopWriteCloser) Truncated() bool { return false }
+
+func (c ChefLogsTest) CreateLog(string) (LogWriter, error) {
+	return nopWriteCloser{ioutil.Discard}, nil
+}
+
+func (c ChefLogsTest) CreateErrLog(string) (LogWriter, error) {
+	return nopWriteCloser{ioutil.Discard}, nil
+}
+
 // NewFakeChefLogWorker will return a thing that represents a chef log worker.
 // It would be able to read a single log. You can supply the text you want in
 // the log as content.
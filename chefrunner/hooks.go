@@ -0,0 +1,40 @@
+package chefrunner
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/morfien101/chef-waiter/cmd"
+	"github.com/morfien101/chef-waiter/logs"
+)
+
+// runHook will run a pre or post run hook command if one is configured.
+// env is added to the environment of the hook command.
+// A hook that is not configured is treated as a success.
+func runHook(logger logs.SysLogger, hookName string, command []string, env []string) (exitCode int, stderr string) {
+	if len(command) == 0 {
+		return 0, ""
+	}
+	logs.DebugMessage(fmt.Sprintf("runHook(%s): %s", hookName, strings.Join(command, " ")))
+	stdout, stderr, exitCode := cmd.RunCommandWithEnv(context.Background(), env, command[0], command[1:]...)
+	if stdout != "" {
+		logs.DebugMessage(fmt.Sprintf("%s output: %s", hookName, stdout))
+	}
+	if exitCode != 0 {
+		logger.Warningf("%s command failed with exit code %d: %s", hookName, exitCode, strings.TrimSpace(stderr))
+	}
+	return exitCode, strings.TrimSpace(stderr)
+}
+
+// environmentList turns the configured environment variables into key=value pairs.
+// The pairs are sorted so that the environment is the same for every run.
+func environmentList(env map[string]string) []string {
+	list := make([]string, 0, len(env))
+	for key, value := range env {
+		list = append(list, key+"="+value)
+	}
+	sort.Strings(list)
+	return list
+}
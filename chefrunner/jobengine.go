@@ -1,25 +1,42 @@
 package chefrunner
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/morfien101/chef-waiter/cheflogs"
 	"github.com/morfien101/chef-waiter/cmd"
+	"github.com/morfien101/chef-waiter/config"
 	"github.com/morfien101/chef-waiter/internalstate"
 	"github.com/morfien101/chef-waiter/logs"
 	"github.com/morfien101/chef-waiter/metrics"
+	"github.com/morfien101/chef-waiter/tracing"
 )
 
 // Request is a RunRequest that is used to push messaged to a queue which will trigger runs.
 var Request RunRequest
 
 // Worker is what is needed to register runs of 2 types.
+// OnDemandRun and CustomRun also report if the request was coalesced into a run that
+// already existed rather than creating a new one.
 type Worker interface {
-	OnDemandRun() string
+	OnDemandRun(internalstate.RunOptions) (string, bool)
 	PeriodicRun() string
-	CustomRun(string) string
+	CustomRun(string, internalstate.RunOptions) (string, bool)
+	QueueDepth() int
+	PlanCustomRun(string, internalstate.RunOptions) CommandPlan
+}
+
+// CommandPlan describes how chef would be run for a request.
+// Only the names of the environment variables are given as their values can hold secrets.
+type CommandPlan struct {
+	Command     []string `json:"command"`
+	Environment []string `json:"environment"`
+	RunAs       string   `json:"run_as,omitempty"`
 }
 
 // RunRequest holds 2 channels for on demand runs and periodic runs. It also has the functions to add jobs to the queues.
@@ -27,35 +44,54 @@ type RunRequest struct {
 	onDemandWorkQ chan string
 	periodicWorkQ chan string
 	logger        logs.SysLogger
+	config        config.Config
 	state         internalstate.StateTableReadWriter
-	chefLogWorker cheflogs.WorkerReader
+	chefLogWorker cheflogs.WorkerReadWriter
+	// maintenanceSeen is set when the periodic engine saw maintenance mode on its last tick.
+	maintenanceSeen bool
 }
 
 // OnDemandRun will return a string guid for a on demand scheduled run.
-func (r *RunRequest) OnDemandRun() string {
-	ok, guid := r.state.RegisterRun(true, false, "")
+// coalesced is true if the guid belongs to a run that was already registered.
+func (r *RunRequest) OnDemandRun(options internalstate.RunOptions) (guid string, coalesced bool) {
+	ok, guid := r.state.RegisterRun(true, false, "", options)
 	if ok {
 		logs.DebugMessage(fmt.Sprintf("New GUID Generated: %s, submitting a new job for onDemand", guid))
-		r.onDemandWorkQ <- guid
+		r.queueOnDemand(guid, options.ScheduledStart)
 	}
 	logs.DebugMessage(fmt.Sprintf("Returning GUID:%s from OnDemandRun()", guid))
-	return guid
+	return guid, !ok
 }
 
 // CustomRun will return a guid of a custom run that has been scheduled.
-func (r *RunRequest) CustomRun(runDetails string) string {
-	ok, guid := r.state.RegisterRun(true, true, runDetails)
+// coalesced is true if the guid belongs to a run that was already registered.
+func (r *RunRequest) CustomRun(runDetails string, options internalstate.RunOptions) (guid string, coalesced bool) {
+	ok, guid := r.state.RegisterRun(true, true, runDetails, options)
 	if ok {
 		logs.DebugMessage(fmt.Sprintf("New GUID Generated: %s, submitting a new job for CustomRun with text: %s", guid, runDetails))
-		r.onDemandWorkQ <- guid
+		r.queueOnDemand(guid, options.ScheduledStart)
 	}
 	logs.DebugMessage(fmt.Sprintf("Returning GUID:%s from CustomRun()", guid))
-	return guid
+	return guid, !ok
+}
+
+// queueOnDemand will queue an on demand or custom run. A run with a scheduled start is
+// held back until then and is only queued if it was not cancelled while it waited.
+func (r *RunRequest) queueOnDemand(guid string, scheduledStart int64) {
+	if scheduledStart == 0 {
+		r.onDemandWorkQ <- guid
+		return
+	}
+	time.AfterFunc(time.Until(time.Unix(scheduledStart, 0)), func() {
+		if r.state.ReleaseDelayedRun(guid) {
+			r.onDemandWorkQ <- guid
+		}
+	})
 }
 
 // PeriodicRun will return a string guid for a scheduled run.
 func (r *RunRequest) PeriodicRun() string {
-	ok, guid := r.state.RegisterRun(false, false, "")
+	ok, guid := r.state.RegisterRun(false, false, "", internalstate.RunOptions{})
 	if ok {
 		logs.DebugMessage(fmt.Sprintf("New GUID Generated: %s, submitting a new job for periodic", guid))
 		r.periodicWorkQ <- guid
@@ -64,22 +100,65 @@ func (r *RunRequest) PeriodicRun() string {
 	return guid
 }
 
-// New - Runs the worker process that will run the commands one at a time.
-func New(state *internalstate.StateTable, chefLogWorker cheflogs.WorkerReader, logger logs.SysLogger) *RunRequest {
+// QueueDepth will return how many runs are waiting to start.
+func (r *RunRequest) QueueDepth() int {
+	return len(r.onDemandWorkQ) + len(r.periodicWorkQ)
+}
+
+// New - Runs the worker processes that will run the commands. There is a supervisor for each
+// of the max_concurrent_runs so that many runs can happen at once.
+func New(config config.Config, state *internalstate.StateTable, chefLogWorker cheflogs.WorkerReadWriter, logger logs.SysLogger) *RunRequest {
 	logs.DebugMessage("StartWorker()")
 	worker := &RunRequest{
 		onDemandWorkQ: make(chan string, 10),
 		periodicWorkQ: make(chan string, 10),
 		state:         state,
 		logger:        logger,
+		config:        config,
 		chefLogWorker: chefLogWorker,
 	}
 
-	go worker.supervisor()
+	supervisors := config.MaxConcurrentRuns()
+	if supervisors < 1 {
+		supervisors = 1
+	}
+	for i := 0; i < supervisors; i++ {
+		go worker.supervisor()
+	}
+	go worker.requeuePendingRuns()
 	go worker.periodicRunEngine()
 	return worker
 }
 
+// RunOnce will make a single on demand run and wait for it to finish. No workers are
+// started so nothing else will run. The guid of the run and the exit code of chef are
+// returned. The run is recorded in the state table and its log written as normal.
+func RunOnce(config config.Config, state internalstate.StateTableReadWriter, chefLogWorker cheflogs.WorkerReadWriter, logger logs.SysLogger) (guid string, exitCode int) {
+	r := &RunRequest{
+		state:         state,
+		logger:        logger,
+		config:        config,
+		chefLogWorker: chefLogWorker,
+	}
+	_, guid = state.RegisterRun(true, false, "", internalstate.RunOptions{})
+	r.startChefRunProcess(guid)
+	return guid, state.Read(guid)[guid].ExitCode
+}
+
+// requeuePendingRuns will queue the runs that were registered but had not started when
+// chef waiter last stopped, oldest first, so that requested work is not lost. Delayed
+// runs wait for what is left of their delay.
+func (r *RunRequest) requeuePendingRuns() {
+	for _, guid := range r.state.ReadPendingRuns() {
+		r.logger.Infof("Queuing run %s again as it had not started when chef waiter stopped", guid)
+		if r.state.IsDemandJob(guid) {
+			r.queueOnDemand(guid, r.state.ReadRunOptions(guid).ScheduledStart)
+			continue
+		}
+		r.periodicWorkQ <- guid
+	}
+}
+
 func (r *RunRequest) supervisor() {
 	// Preamble for metrics shipping
 	start := func(jobType string) {
@@ -95,16 +174,25 @@ func (r *RunRequest) supervisor() {
 		start := time.Now()
 		f(guid)
 		metrics.Timing("chef_run_time", int64(time.Since(start)/time.Millisecond), map[string]string{"type": jobType})
+		if details := r.state.Read(guid)[guid]; details != nil {
+			metrics.Timing("chef_queue_time", details.QueuedDurationSeconds*1000, map[string]string{"type": jobType})
+		}
 		finished(jobType)
 	}
 
 	for {
 		select {
 		case guid := <-r.periodicWorkQ:
-			//run chef as periodic job
-			if r.state.ReadPeriodicRuns() {
-				timer(r.startChefRunProcess, guid, "periodic")
+			// The run is marked as abandoned if it can no longer start so that it does
+			// not sit as registered and block the next periodic run from being queued.
+			if reason := r.periodicSkipReason(); reason != "" {
+				logs.DebugMessage(fmt.Sprintf("Skipping periodic run %s: %s", guid, reason))
+				r.state.UpdateStatusReason(guid, reason)
+				r.state.UpdateStatus(guid, "abandoned")
+				continue
 			}
+			//run chef as periodic job
+			timer(r.startChefRunProcess, guid, "periodic")
 		case guid := <-r.onDemandWorkQ:
 			timer(r.startChefRunProcess, guid, "demand")
 		}
@@ -113,80 +201,354 @@ func (r *RunRequest) supervisor() {
 
 func (r *RunRequest) startChefRunProcess(guid string) {
 	ondemand := r.state.IsDemandJob(guid)
-	var lmsg string
+	var lmsg, source string
 	if ondemand {
 		lmsg = "on demand"
+		source = "demand"
 	} else {
 		lmsg = "periodic"
+		source = "periodic"
 	}
 	custom, arg := r.state.IsCustomJob(guid)
 	if custom {
-		r.logger.Infof("Starting %s chef custom run with argument '%s': %s", lmsg, arg, guid)
+		source = "custom"
+	}
+	runLogger := logs.WithFields(r.logger, logs.Fields{"guid": guid, "source": source})
+	if custom {
+		runLogger.Infof("Starting %s chef custom run with argument '%s': %s", lmsg, arg, guid)
 	} else {
-		r.logger.Infof("Starting %s chef run: %s", lmsg, guid)
+		runLogger.Infof("Starting %s chef run: %s", lmsg, guid)
 	}
 
+	span := tracing.StartSpan("chef_run", tracing.SpanContext{}, tracing.SpanKindInternal)
+	span.SetAttribute("chefwaiter.guid", guid)
+	span.SetAttribute("chefwaiter.source", source)
+	defer span.End()
+
+	r.state.UpdatelastRunStartTime(time.Now().Unix())
 	if ondemand == false {
-		r.state.UpdatelastRunStartTime(time.Now().Unix())
+		r.state.UpdateLastPeriodicRunStartTime(time.Now().Unix())
 	}
 
 	r.state.UpdateStatus(guid, "running")
 
-	exitCode := r.runChef(guid)
+	if r.chefLockConflict(runLogger, guid) {
+		span.SetStatus(tracing.StatusError)
+		metrics.Incr("run_conflicted", 1, map[string]string{"source": source})
+		r.runFinishedMetrics(source, 0)
+		return
+	}
+
+	hookEnv := append(environmentList(r.config.ChefEnvironment()), "CHEFWAITER_GUID="+guid)
+	if hookExitCode, stderr := runHook(runLogger, "pre-run", r.config.PreRunCommand(), hookEnv); hookExitCode != 0 {
+		// chef is not run if the pre-run command fails.
+		r.state.UpdateExitCode(guid, hookExitCode)
+		r.state.UpdateStatusReason(guid, fmt.Sprintf("pre-run command failed with exit code %d: %s", hookExitCode, stderr))
+		r.state.UpdateStatus(guid, "failed")
+		r.state.WriteLastRunGUID(guid)
+		span.SetAttribute("chefwaiter.exit_code", hookExitCode)
+		span.SetStatus(tracing.StatusError)
+		logs.ErrorEvent(logs.WithField(runLogger, "exit_code", hookExitCode), logs.EventRunFailed, "Skipped %s run with guid: %s, the pre-run command failed", lmsg, guid)
+		r.checkAutoLock(true, time.Now())
+		r.runFinishedMetrics(source, hookExitCode)
+		return
+	}
+
+	exitCode, timedOut := r.runChef(guid)
 	r.state.UpdateExitCode(guid, exitCode)
 
-	if exitCode != 0 {
+	// The post-run command can not change the outcome of the run.
+	runHook(runLogger, "post-run", r.config.PostRunCommand(), append(hookEnv, fmt.Sprintf("CHEFWAITER_EXIT_CODE=%d", exitCode)))
+
+	span.SetAttribute("chefwaiter.exit_code", exitCode)
+	if timedOut {
+		span.SetStatus(tracing.StatusError)
+		r.state.UpdateStatus(guid, "timed_out")
+	} else if exitCode != 0 {
+		span.SetStatus(tracing.StatusError)
 		r.state.UpdateStatus(guid, "failed")
 	} else {
+		span.SetStatus(tracing.StatusOK)
 		r.state.UpdateStatus(guid, "complete")
+		r.state.WriteLastSuccessfulRun(guid, time.Now().Unix())
 	}
 
 	r.state.WriteLastRunGUID(guid)
 
-	r.logger.Infof("Finished %s run with guid: %s, exit code was: %d", lmsg, guid, exitCode)
+	logs.WithField(runLogger, "exit_code", exitCode).Infof("Finished %s run with guid: %s, exit code was: %d", lmsg, guid, exitCode)
+	if timedOut || exitCode != 0 {
+		// Monitoring alerts on the event, eg from the Windows event log.
+		logs.ErrorEvent(logs.WithField(runLogger, "exit_code", exitCode), logs.EventRunFailed, "Chef %s run with guid: %s failed, exit code was: %d", lmsg, guid, exitCode)
+	}
+	r.checkAutoLock(exitCode != 0, time.Now())
+	r.runFinishedMetrics(source, exitCode)
+}
+
+// chefLockConflict returns true, and marks the run as conflicted, if chef_lock_file is
+// set and a chef-client that chef waiter did not start holds the lock. The run is not
+// counted towards the auto lock as chef was never run.
+func (r *RunRequest) chefLockConflict(runLogger logs.SysLogger, guid string) bool {
+	lockFile := r.config.ChefLockFile()
+	if lockFile == "" {
+		return false
+	}
+	held, err := chefLockHeld(lockFile)
+	if err != nil {
+		// chef-client will report its own error if it can not use the lock file either.
+		runLogger.Errorf("Failed to check the chef lock file %s, running chef anyway. Error: %s", lockFile, err)
+		return false
+	}
+	if !held {
+		return false
+	}
+	r.state.UpdateStatusReason(guid, fmt.Sprintf("another chef-client holds the lock file %s", lockFile))
+	r.state.UpdateStatus(guid, "conflicted")
+	r.state.WriteLastRunGUID(guid)
+	runLogger.Warningf("Skipped run with guid: %s, another chef-client holds the lock file %s", guid, lockFile)
+	return true
+}
+
+// checkAutoLock keeps track of runs that fail one after another. If auto_lock_failures
+// runs in a row fail inside of auto_lock_window the runs are locked so that a broken
+// node stops running chef until someone has looked at it.
+// The streak is kept in the state table so that it can be shown and reset.
+func (r *RunRequest) checkAutoLock(failed bool, now time.Time) {
+	if !failed {
+		r.state.ResetFailureStreak()
+		return
+	}
+	window := r.config.AutoLockWindow()
+	failures := r.state.RecordRunFailure(now, window)
+	threshold := r.config.AutoLockFailures()
+	if threshold <= 0 || failures < threshold {
+		return
+	}
+	r.state.AutoLockRuns(fmt.Sprintf("auto-locked after failures: %d runs in a row failed within %s", failures, window))
+	r.state.ResetFailureStreak()
+}
+
+// runFinishedMetrics sends the metrics that describe a run and the worker once a run has finished.
+func (r *RunRequest) runFinishedMetrics(source string, exitCode int) {
+	if exitCode != 0 {
+		metrics.Incr("run_failed", 1, map[string]string{"source": source})
+	}
+	metrics.Gauge("queue_depth", int64(len(r.onDemandWorkQ)), map[string]string{"type": "demand"})
+	metrics.Gauge("queue_depth", int64(len(r.periodicWorkQ)), map[string]string{"type": "periodic"})
+	periodicEnabled := int64(0)
+	if r.state.ReadPeriodicRuns() {
+		periodicEnabled = 1
+	}
+	metrics.Gauge("periodic_runs_enabled", periodicEnabled, nil)
 }
 
 // PeriodicRunEngine - checks if we need to run chef and sends a request to run chef on a interval of 1 minute.
 func (r *RunRequest) periodicRunEngine() {
 	logs.DebugMessage("periodicRunEngine()")
 	trigger := time.NewTicker(time.Minute * 1)
-	for _ = range trigger.C {
-		if r.timeToRunChef() && r.state.ReadPeriodicRuns() {
-			r.PeriodicRun()
-		}
+	for now := range trigger.C {
+		r.periodicTick(now)
+	}
+}
+
+// periodicTick will request a periodic run if one is due and returns true if it did.
+// Nothing is requested during maintenance. As the last run start time does not move
+// during maintenance a run that fell due in the window is requested on the first tick
+// after the window ends rather than waiting for another interval.
+func (r *RunRequest) periodicTick(now time.Time) bool {
+	if r.state.InMaintenceMode() {
+		r.maintenanceSeen = true
+		return false
+	}
+	resumed := r.maintenanceSeen
+	r.maintenanceSeen = false
+	if !r.timeToRunChef(now) || !r.state.ReadPeriodicRuns() {
+		return false
 	}
+	if resumed {
+		r.logger.Info("Maintenance has ended. Requesting the periodic run that is due.")
+	}
+	r.PeriodicRun()
+	return true
 }
 
 // timeToRunChef - checks if it is time to run chef.
-// True if the time now is later than the last run + the interval that we have currently.
+// True if the time now is later than the next periodic run time. That is the last run + the
+// interval that we have currently or the next time the run schedule fires after the last run.
 // Also true if there is not a maintenance window active.
 // We also check to see if the jobs have been locked which would stop anything further being
 // registered.
-func (r *RunRequest) timeToRunChef() bool {
+func (r *RunRequest) timeToRunChef(now time.Time) bool {
 	if r.state.ReadRunLock() {
 		return false
 	}
-	return (time.Now().Unix() > r.state.GetlastRunStartTime()+r.state.ReadChefRunTimer()) && !r.state.InMaintenceMode()
+	return (now.Unix() > r.state.NextPeriodicRunTime()) && !r.state.InMaintenceMode()
 }
 
-// runChef will run the command based on the OS
-func (r *RunRequest) runChef(guid string) (exitCode int) {
-	command := chefClientCommand
+// periodicSkipReason returns why a queued periodic run should not start, or an empty
+// string if it can start. Things may have changed since the run was queued.
+func (r *RunRequest) periodicSkipReason() string {
+	if !r.state.ReadPeriodicRuns() {
+		return "periodic runs were disabled before the run started"
+	}
+	if r.state.InMaintenceMode() {
+		return "maintenance mode started before the run started"
+	}
+	return ""
+}
+
+// runChef will run the command based on the OS.
+// The output of chef is streamed into the log for the guid while it runs. With
+// separate_stderr_log on, stderr goes to a log of its own.
+// The configured chef environment variables are only given to chef, not chef waiter.
+// timedOut is true if chef was killed because the run went on for longer than its timeout.
+func (r *RunRequest) runChef(guid string) (exitCode int, timedOut bool) {
+	command := append([]string{}, chefClientCommand...)
 	command = append(command, r.chefClientArguments(guid)...)
 	logs.DebugMessage(fmt.Sprintf("runChef(%s): %s %s", guid, command[0], strings.Join(command[1:], " ")))
-	stdout, stderr, exitCode := cmd.RunCommand(command[0], command[1:]...)
-	logs.DebugMessage(fmt.Sprintf("STDOUT %s: %s", guid, stdout))
-	logs.DebugMessage(fmt.Sprintf("STDERR %s: %s", guid, stderr))
-	return
+	r.state.UpdateExecutedCommand(guid, command)
+	logFile, err := r.chefLogWorker.CreateLog(guid)
+	if err != nil {
+		r.logger.Errorf("Failed to create the log file for %s. Error: %s", guid, err)
+		return 1, false
+	}
+	defer logFile.Close()
+	// The summary is checked first so that it is still found if the log can not be written.
+	summary := &summaryWriter{}
+	stdout := io.MultiWriter(summary, logFile)
+	stderr := stdout
+	if r.config.SeparateStderrLog() {
+		errFile, err := r.chefLogWorker.CreateErrLog(guid)
+		if err != nil {
+			r.logger.Errorf("Failed to create the stderr log for %s, stderr will go to the log. Error: %s", guid, err)
+		} else {
+			defer errFile.Close()
+			stderr = errFile
+		}
+	}
+	env := environmentList(r.config.ChefEnvironment())
+	runAs := r.state.ReadRunOptions(guid).RunAs
+	if runAs != "" {
+		r.logger.Infof("Running %s as %s", guid, runAs)
+	}
+	// The timeout covers every attempt of the run.
+	ctx := context.Background()
+	timeout := r.runTimeout(guid)
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	attempts := r.runAttempts(guid)
+	// Every attempt writes to the same log so that the failed attempts can be seen.
+	for attempt := 1; ; attempt++ {
+		if attempts > 1 {
+			r.state.UpdateAttempt(guid, attempt)
+		}
+		exitCode = cmd.RunCommandStreamsAs(ctx, stdout, stderr, env, runAs, command[0], command[1:]...)
+		if attempts > 1 {
+			r.state.AddAttemptExitCode(guid, exitCode)
+		}
+		if ctx.Err() != nil {
+			timedOut = true
+			break
+		}
+		if exitCode == 0 || attempt >= attempts {
+			break
+		}
+		delay := r.config.RunRetryDelay()
+		r.logger.Warningf("Attempt %d of %d for %s failed with exit code %d. Retrying in %s", attempt, attempts, guid, exitCode, delay)
+		fmt.Fprintf(logFile, "[chefwaiter] Attempt %d of %d failed with exit code %d. Retrying in %s\n", attempt, attempts, exitCode, delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			timedOut = true
+			break
+		}
+	}
+	if timedOut {
+		r.logger.Warningf("Run %s was stopped as it took longer than %s", guid, timeout)
+		fmt.Fprintf(logFile, "[chefwaiter] Run stopped as it took longer than %s\n", timeout)
+		r.state.UpdateStatusReason(guid, fmt.Sprintf("run took longer than %s", timeout))
+	}
+	updated, total, found := summary.Resources()
+	if !found {
+		logs.DebugMessage(fmt.Sprintf("runChef(%s): no chef-client summary found in the output", guid))
+	}
+	r.state.UpdateResources(guid, updated, total)
+	if logFile.Truncated() {
+		r.logger.Warningf("The log for %s reached the max log size of %d bytes and was truncated", guid, r.config.MaxLogSize())
+		r.state.UpdateLogTruncated(guid, true)
+	}
+	return exitCode, timedOut
+}
+
+// runTimeout returns how long a run can go on for before chef is killed. Custom runs
+// have their own timeout as they are often much quicker than a full converge.
+// 0 means no timeout.
+func (r *RunRequest) runTimeout(guid string) time.Duration {
+	if custom, _ := r.state.IsCustomJob(guid); custom {
+		return r.config.CustomRunTimeout()
+	}
+	return r.config.RunTimeout()
+}
+
+// runAttempts returns how many times chef can be run for a run that fails.
+// Periodic runs are always retried. On demand and custom runs are only retried
+// if it was asked for when they were requested.
+func (r *RunRequest) runAttempts(guid string) int {
+	if r.state.IsDemandJob(guid) && !r.state.ReadRunOptions(guid).Retry {
+		return 1
+	}
+	return 1 + r.config.RunRetries()
 }
 
 // chefClientArguments will compile the arguments and return them as a []string
 func (r *RunRequest) chefClientArguments(guid string) []string {
-	arguments := make([]string, 0)
-	arguments = append(arguments, "-L", r.chefLogWorker.GetLogPath(guid))
 	customJob, strValue := r.state.IsCustomJob(guid)
-	if customJob {
-		arguments = append(arguments, "-o", fmt.Sprintf(`%s`, strValue))
+	if !customJob {
+		strValue = ""
+	}
+	return r.buildChefClientArguments(strValue, r.state.ReadRunOptions(guid))
+}
+
+// buildChefClientArguments will return the arguments for chef-client. The run list
+// is only overridden when customRunList is not empty.
+func (r *RunRequest) buildChefClientArguments(customRunList string, options internalstate.RunOptions) []string {
+	arguments := make([]string, 0)
+	// chef-client uses its default config file unless one is set.
+	if configPath := r.config.ChefConfigPath(); configPath != "" {
+		arguments = append(arguments, "-c", configPath)
+	}
+	// chef-client holds the same lock as chef waiter checks for the whole run. With a run
+	// lock timeout of 0 it fails straight away, rather than waiting, if another chef-client
+	// took the lock after chef waiter checked it.
+	if lockFile := r.config.ChefLockFile(); lockFile != "" {
+		arguments = append(arguments, "--lockfile", lockFile, "--run-lock-timeout", "0")
+	}
+	if customRunList != "" {
+		arguments = append(arguments, "-o", customRunList)
+	}
+	if options.NodeName != "" {
+		arguments = append(arguments, "-N", options.NodeName)
+	}
+	// An allowed flag can carry its value, eg "-l debug".
+	for _, flag := range options.ExtraFlags {
+		arguments = append(arguments, strings.Fields(flag)...)
 	}
 	return arguments
 }
+
+// PlanCustomRun will return how a custom run of runList would be run, without
+// registering or running anything. The options are expected to have been checked.
+func (r *RunRequest) PlanCustomRun(runList string, options internalstate.RunOptions) CommandPlan {
+	command := append([]string{}, chefClientCommand...)
+	command = append(command, r.buildChefClientArguments(runList, options)...)
+	environment := make([]string, 0)
+	for name := range r.config.ChefEnvironment() {
+		environment = append(environment, name)
+	}
+	sort.Strings(environment)
+	return CommandPlan{Command: command, Environment: environment, RunAs: options.RunAs}
+}
@@ -0,0 +1,26 @@
+package chefrunner
+
+import (
+	"os"
+	"syscall"
+)
+
+// chefLockHeld tries to take the lock on path without waiting, like chef-client does with
+// its lockfile, and returns true if another process already holds it. The lock is let go
+// straight away as chef-client takes it for the run. It can not be held on to as
+// chef-client would then wait on chef waiter. chef-client is started with a run lock
+// timeout of 0 so that it fails rather than waits if the lock is taken in between.
+func chefLockHeld(path string) (bool, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		if err == syscall.EWOULDBLOCK {
+			return true, nil
+		}
+		return false, err
+	}
+	return false, syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
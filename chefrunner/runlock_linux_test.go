@@ -0,0 +1,74 @@
+package chefrunner
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/Flaque/filet"
+
+	"github.com/morfien101/chef-waiter/cheflogs"
+	"github.com/morfien101/chef-waiter/config"
+	"github.com/morfien101/chef-waiter/internalstate"
+	"github.com/morfien101/chef-waiter/logs"
+)
+
+func TestChefLockFile(t *testing.T) {
+	testDir := filet.TmpDir(t, "")
+	defer os.RemoveAll(testDir)
+
+	oldCommand := chefClientCommand
+	chefClientCommand = []string{"true"}
+	defer func() { chefClientCommand = oldCommand }()
+
+	lockFile := filepath.Join(testDir, "chef-client-running.pid")
+	configContainer := &config.ValuesContainer{
+		InternalStateFileLocation: testDir,
+		InternalLogLocation:       testDir,
+		InternalChefLockFile:      lockFile,
+	}
+	fakelogger := logs.NewFakeLogger(false)
+	chefLogger := cheflogs.New(configContainer, fakelogger)
+	st := internalstate.New(configContainer, chefLogger, fakelogger)
+	rr := &RunRequest{
+		state:         st,
+		config:        configContainer,
+		logger:        fakelogger,
+		chefLogWorker: chefLogger,
+	}
+
+	_, guid := st.RegisterRun(true, false, "", internalstate.RunOptions{})
+	rr.startChefRunProcess(guid)
+	job := st.Read(guid)[guid]
+	if job.Status != "complete" {
+		t.Errorf("A run with a free lock file should complete. Got: %s", job.Status)
+	}
+	if got := strings.Join(job.ExecutedCommand, " "); got != "true --lockfile "+lockFile+" --run-lock-timeout 0" {
+		t.Errorf("The lock file was not passed to chef-client. Got: %q", got)
+	}
+
+	// Stand in for a chef-client started outside of chef waiter.
+	other, err := os.OpenFile(lockFile, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatalf("Failed to open the lock file. Error: %s", err)
+	}
+	defer other.Close()
+	if err := syscall.Flock(int(other.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		t.Fatalf("Failed to lock the lock file. Error: %s", err)
+	}
+
+	_, guid = st.RegisterRun(true, false, "", internalstate.RunOptions{})
+	rr.startChefRunProcess(guid)
+	job = st.Read(guid)[guid]
+	if job.Status != "conflicted" || job.StatusReason == "" {
+		t.Errorf("A run with a held lock file should be conflicted with a reason. Got: %s, %q", job.Status, job.StatusReason)
+	}
+	if job.RunEndTime == 0 {
+		t.Errorf("A conflicted run should have an end time")
+	}
+	if st.ReadFailureStreak() != 0 {
+		t.Errorf("A conflicted run should not count towards the auto lock")
+	}
+}
@@ -0,0 +1,25 @@
+package chefrunner
+
+import (
+	"syscall"
+)
+
+// errorSharingViolation is returned by windows when a file is already open elsewhere.
+const errorSharingViolation = syscall.Errno(32)
+
+// chefLockHeld opens path without sharing it and returns true if another process, like
+// a chef-client that is running, already has it open.
+func chefLockHeld(path string) (bool, error) {
+	name, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return false, err
+	}
+	handle, err := syscall.CreateFile(name, syscall.GENERIC_READ|syscall.GENERIC_WRITE, 0, nil, syscall.OPEN_ALWAYS, syscall.FILE_ATTRIBUTE_NORMAL, 0)
+	if err != nil {
+		if err == errorSharingViolation {
+			return true, nil
+		}
+		return false, err
+	}
+	return false, syscall.CloseHandle(handle)
+}
@@ -0,0 +1,77 @@
+package chefrunner
+
+import (
+	"bytes"
+	"regexp"
+	"strconv"
+	"sync"
+)
+
+// summaryPattern matches the line that chef-client writes at the end of a run.
+// Newer clients write "Chef Infra Client finished, 3/120 resources updated in 10 seconds"
+// or "Infra Phase complete, 3/120 resources updated in 10 seconds".
+// Older clients write "Chef Client finished, 3/120 resources updated in 10 seconds" or,
+// before the total was added, "Chef Client finished, 3 resources updated".
+// Failed runs write "Chef Infra Client failed. 2 resources updated in 3 seconds".
+var summaryPattern = regexp.MustCompile(`(?:finished,|complete,|failed\.) (\d+)(?:/(\d+))? resources? updated`)
+
+// maxSummaryLineLength is the longest partial line that is held while looking for the
+// summary. Longer lines can not be the summary so they are dropped.
+const maxSummaryLineLength = 4096
+
+// summaryWriter looks for the chef-client summary line in the output of a run.
+// The last summary seen wins as a run can have more than one phase.
+type summaryWriter struct {
+	sync.Mutex
+	pending []byte
+	found   bool
+	updated int
+	total   int
+}
+
+// Write will check each complete line in p for the summary.
+func (sw *summaryWriter) Write(p []byte) (int, error) {
+	sw.Lock()
+	defer sw.Unlock()
+	sw.pending = append(sw.pending, p...)
+	for {
+		newLine := bytes.IndexByte(sw.pending, '\n')
+		if newLine < 0 {
+			break
+		}
+		sw.checkLine(sw.pending[:newLine])
+		sw.pending = sw.pending[newLine+1:]
+	}
+	if len(sw.pending) > maxSummaryLineLength {
+		sw.pending = nil
+	}
+	return len(p), nil
+}
+
+func (sw *summaryWriter) checkLine(line []byte) {
+	match := summaryPattern.FindSubmatch(line)
+	if match == nil {
+		return
+	}
+	updated, err := strconv.Atoi(string(match[1]))
+	if err != nil {
+		return
+	}
+	// Old clients did not report the total.
+	total, _ := strconv.Atoi(string(match[2]))
+	sw.found = true
+	sw.updated = updated
+	sw.total = total
+}
+
+// Resources returns the resources updated and the total resources from the summary.
+// Both are 0 if no summary was found. Any partial last line is checked first.
+func (sw *summaryWriter) Resources() (updated, total int, found bool) {
+	sw.Lock()
+	defer sw.Unlock()
+	if len(sw.pending) > 0 {
+		sw.checkLine(sw.pending)
+		sw.pending = nil
+	}
+	return sw.updated, sw.total, sw.found
+}
@@ -1,5 +1,7 @@
 package chefrunner
 
+import "github.com/morfien101/chef-waiter/internalstate"
+
 // This is a basic implementation of the chef worker that can assit in testing in other package.
 
 //FakeChefRunnerWorker used for testing
@@ -10,8 +12,8 @@ type FakeChefRunnerWorker struct {
 
 // OnDemandRun will return a static string with onde to identify that it was a on demand job.
 // The string will statify the regex for guids
-func (c *FakeChefRunnerWorker) OnDemandRun() string {
-	return `onde-1234-1234-1234-1234`
+func (c *FakeChefRunnerWorker) OnDemandRun(options internalstate.RunOptions) (string, bool) {
+	return `onde-1234-1234-1234-1234`, false
 }
 
 // PeriodicRun will return a static string with onde to identify that it was a periodic job.
@@ -22,8 +24,22 @@ func (c *FakeChefRunnerWorker) PeriodicRun() string {
 
 // CustomRun will return a static string with onde to identify that it was a periodic job.
 // The string will statify the regex for guids
-func (c *FakeChefRunnerWorker) CustomRun(jobDetails string) string {
-	return `cust-1234-1234-1234-1234`
+func (c *FakeChefRunnerWorker) CustomRun(jobDetails string, options internalstate.RunOptions) (string, bool) {
+	return `cust-1234-1234-1234-1234`, false
+}
+
+// QueueDepth will return 0 as the fake does not queue runs.
+func (c *FakeChefRunnerWorker) QueueDepth() int {
+	return 0
+}
+
+// PlanCustomRun will return a plan that runs chef-client with the run list and extra flags.
+func (c *FakeChefRunnerWorker) PlanCustomRun(runList string, options internalstate.RunOptions) CommandPlan {
+	return CommandPlan{
+		Command:     append([]string{"chef-client", "-o", runList}, options.ExtraFlags...),
+		Environment: []string{},
+		RunAs:       options.RunAs,
+	}
 }
 
 // InMaintenanceMode will return the maintenace value
@@ -0,0 +1,335 @@
+// Package client is a Go client for the chef waiter API.
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/morfien101/chef-waiter/cheflogs"
+	"github.com/morfien101/chef-waiter/internalstate"
+)
+
+// ErrNotFound is returned when the run or log asked for is not known to chef waiter.
+var ErrNotFound = errors.New("not found")
+
+// APIError is returned when chef waiter answers a request with an error.
+// Code is the stable error code, eg locked or not_whitelisted.
+type APIError struct {
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("chef waiter returned %d", e.StatusCode)
+	}
+	return fmt.Sprintf("chef waiter returned %d: %s", e.StatusCode, e.Message)
+}
+
+// Run is a chef run and its guid.
+type Run struct {
+	GUID string
+	internalstate.JobDetails
+}
+
+// Maintenance describes the maintenance window.
+type Maintenance struct {
+	EndTime       string `json:"end_time"`
+	InMaintenance bool   `json:"in_maintenance"`
+}
+
+// Lock describes the run lock.
+type Lock struct {
+	Locked        bool    `json:"Locked"`
+	LockedBy      *string `json:"locked_by"`
+	LockedTime    int64   `json:"locked_time"`
+	LockedTimeStr *string `json:"locked_time_human"`
+	Reason        string  `json:"reason"`
+	AutoLocked    bool    `json:"auto_locked"`
+}
+
+// NextRun describes when the next periodic run will happen.
+type NextRun struct {
+	Scheduled bool   `json:"scheduled"`
+	Reason    string `json:"reason"`
+	Epoch     int64  `json:"epoch"`
+	Str       string `json:"human"`
+	// Schedule is the cron schedule for periodic runs. It is empty when runs happen on the interval.
+	Schedule string `json:"schedule"`
+}
+
+// Version holds the versions that chef waiter reports.
+type Version struct {
+	Version     string `json:"version"`
+	GitCommit   string `json:"git_commit"`
+	BuildDate   string `json:"build_date"`
+	ChefVersion string `json:"chef_version"`
+	GoVersion   string `json:"go_version"`
+}
+
+// Client talks to a single chef waiter.
+type Client struct {
+	baseURL    string
+	token      string
+	httpClient *http.Client
+}
+
+// Option changes how a Client is set up.
+type Option func(*Client)
+
+// WithToken sets the bearer token sent with every request.
+// It is needed for the administrative endpoints.
+func WithToken(token string) Option {
+	return func(c *Client) {
+		c.token = token
+	}
+}
+
+// WithHTTPClient sets the http.Client used to make requests.
+// Use this to set up TLS or timeouts.
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+// New returns a Client for the chef waiter at baseURL, eg https://node1:8901.
+func New(baseURL string, options ...Option) *Client {
+	c := &Client{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		httpClient: http.DefaultClient,
+	}
+	for _, option := range options {
+		option(c)
+	}
+	return c
+}
+
+// TriggerRun requests an on demand run. force runs even if chef waiter is locked.
+func (c *Client) TriggerRun(force bool) (*Run, error) {
+	return c.run(http.MethodGet, "/chefclient"+forceQuery(force), nil, "")
+}
+
+// TriggerCustomRun requests a run of runList. extraFlags must be allowed by the
+// chef waiter configuration. force runs even if chef waiter is locked.
+func (c *Client) TriggerCustomRun(runList string, extraFlags []string, force bool) (*Run, error) {
+	body, err := json.Marshal(map[string]interface{}{
+		"run_list":    runList,
+		"extra_flags": extraFlags,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c.run(http.MethodPost, "/chefclient"+forceQuery(force), bytes.NewReader(body), "application/json")
+}
+
+// GetStatus returns the run with the given guid.
+func (c *Client) GetStatus(guid string) (*Run, error) {
+	return c.run(http.MethodGet, "/chefclient/"+url.PathEscape(guid), nil, "")
+}
+
+// GetStatuses returns the runs with the given guids. Unknown guids are left out.
+func (c *Client) GetStatuses(guids []string) (map[string]internalstate.JobDetails, error) {
+	body, err := json.Marshal(guids)
+	if err != nil {
+		return nil, err
+	}
+	statuses := make(map[string]internalstate.JobDetails)
+	if err := c.doJSON(http.MethodPost, "/chefclient/status", bytes.NewReader(body), "application/json", &statuses); err != nil {
+		return nil, err
+	}
+	for guid, details := range statuses {
+		if details.Status == "not_found" {
+			delete(statuses, guid)
+		}
+	}
+	return statuses, nil
+}
+
+// GetAllRuns returns all the runs that chef waiter knows about.
+func (c *Client) GetAllRuns() (map[string]internalstate.JobDetails, error) {
+	runs := make(map[string]internalstate.JobDetails)
+	return runs, c.doJSON(http.MethodGet, "/chef/allruns", nil, "", &runs)
+}
+
+// GetLastRunGUID returns the guid of the last run that finished.
+func (c *Client) GetLastRunGUID() (string, error) {
+	lastRun := &struct {
+		GUID string `json:"last_run_guid"`
+	}{}
+	if err := c.doJSON(http.MethodGet, "/chef/lastrun", nil, "", lastRun); err != nil {
+		return "", err
+	}
+	return lastRun.GUID, nil
+}
+
+// GetNextRun returns when the next periodic run will happen.
+func (c *Client) GetNextRun() (*NextRun, error) {
+	next := &NextRun{}
+	return next, c.doJSON(http.MethodGet, "/chef/nextrun", nil, "", next)
+}
+
+// GetLogs returns the chef log of a run.
+func (c *Client) GetLogs(guid string) (string, error) {
+	resp, err := c.do(http.MethodGet, "/cheflogs/"+url.PathEscape(guid), nil, "")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	logs, err := ioutil.ReadAll(resp.Body)
+	return string(logs), err
+}
+
+// ListLogs returns the chef logs on disk, newest first.
+func (c *Client) ListLogs() ([]cheflogs.LogFile, error) {
+	logFiles := make([]cheflogs.LogFile, 0)
+	if err := c.doJSON(http.MethodGet, "/cheflogs", nil, "", &logFiles); err != nil {
+		return nil, err
+	}
+	return logFiles, nil
+}
+
+// SetInterval sets the time between periodic runs. It must be a whole number of minutes.
+func (c *Client) SetInterval(interval time.Duration) error {
+	body, err := json.Marshal(map[string]string{"duration": interval.String()})
+	if err != nil {
+		return err
+	}
+	return c.doJSON(http.MethodPost, "/chef/interval", bytes.NewReader(body), "application/json", nil)
+}
+
+// EnablePeriodicRuns turns periodic runs on.
+func (c *Client) EnablePeriodicRuns() error {
+	return c.doJSON(http.MethodPost, "/chef/on", nil, "", nil)
+}
+
+// DisablePeriodicRuns turns periodic runs off.
+func (c *Client) DisablePeriodicRuns() error {
+	return c.doJSON(http.MethodPost, "/chef/off", nil, "", nil)
+}
+
+// GetMaintenance returns the maintenance window.
+func (c *Client) GetMaintenance() (*Maintenance, error) {
+	maintenance := &Maintenance{}
+	return maintenance, c.doJSON(http.MethodGet, "/chef/maintenance", nil, "", maintenance)
+}
+
+// EnterMaintenance puts chef waiter into maintenance mode for the given minutes.
+func (c *Client) EnterMaintenance(minutes int) error {
+	return c.doJSON(http.MethodPost, fmt.Sprintf("/chef/maintenance/start/%d", minutes), nil, "", nil)
+}
+
+// EndMaintenance ends maintenance mode.
+func (c *Client) EndMaintenance() error {
+	return c.doJSON(http.MethodPost, "/chef/maintenance/end", nil, "", nil)
+}
+
+// GetLock returns the run lock.
+func (c *Client) GetLock() (*Lock, error) {
+	lock := &Lock{}
+	return lock, c.doJSON(http.MethodGet, "/chef/lock", nil, "", lock)
+}
+
+// SetLock stops any runs from starting.
+func (c *Client) SetLock() error {
+	return c.doJSON(http.MethodPost, "/chef/lock/set", nil, "", nil)
+}
+
+// RemoveLock allows runs to start again.
+func (c *Client) RemoveLock() error {
+	return c.doJSON(http.MethodPost, "/chef/lock/remove", nil, "", nil)
+}
+
+// GetVersion returns the versions that chef waiter reports.
+func (c *Client) GetVersion() (*Version, error) {
+	version := &Version{}
+	return version, c.doJSON(http.MethodGet, "/version", nil, "", version)
+}
+
+// Healthcheck returns nil if chef waiter is up.
+func (c *Client) Healthcheck() error {
+	return c.doJSON(http.MethodGet, "/healthcheck", nil, "", nil)
+}
+
+// run makes a request that returns a single run.
+func (c *Client) run(method, path string, body io.Reader, contentType string) (*Run, error) {
+	runs := make(map[string]*internalstate.JobDetails)
+	if err := c.doJSON(method, path, body, contentType, &runs); err != nil {
+		return nil, err
+	}
+	for guid, details := range runs {
+		// Unknown guids come back as null.
+		if details == nil {
+			return nil, ErrNotFound
+		}
+		return &Run{GUID: guid, JobDetails: *details}, nil
+	}
+	return nil, ErrNotFound
+}
+
+// doJSON makes a request and decodes the JSON response into out if out is not nil.
+func (c *Client) doJSON(method, path string, body io.Reader, contentType string, out interface{}) error {
+	resp, err := c.do(method, path, body, contentType)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if out == nil {
+		_, err = io.Copy(ioutil.Discard, resp.Body)
+		return err
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// do makes a request. Responses that are not a 2xx are turned into errors.
+func (c *Client) do(method, path string, body io.Reader, contentType string) (*http.Response, error) {
+	req, err := http.NewRequest(method, c.baseURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNotFound
+	}
+	apiErr := &APIError{StatusCode: resp.StatusCode}
+	errBody := &struct {
+		Error struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}{}
+	if json.NewDecoder(resp.Body).Decode(errBody) == nil {
+		apiErr.Code = errBody.Error.Code
+		apiErr.Message = errBody.Error.Message
+	}
+	return nil, apiErr
+}
+
+func forceQuery(force bool) string {
+	if force {
+		return "?force=true"
+	}
+	return ""
+}
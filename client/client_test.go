@@ -0,0 +1,116 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClient(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/chefclient", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			body := map[string]interface{}{}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body["run_list"] != "recipe[test]" {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, `{"error":{"code":"invalid_json","message":"bad body"}}`)
+				return
+			}
+		}
+		if r.URL.Query().Get("force") != "true" {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `{"error":{"code":"locked","message":"Chefwaiter is locked"}}`)
+			return
+		}
+		fmt.Fprint(w, `{"1234":{"status":"registered","exitcode":99,"ondemand":true,"source":"demand"}}`)
+	})
+	mux.HandleFunc("/chefclient/missing", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"missing":null}`)
+	})
+	mux.HandleFunc("/cheflogs/1234", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "chef log\n")
+	})
+	mux.HandleFunc("/chef/lastrun", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"last_run_guid":"1234"}`)
+	})
+	mux.HandleFunc("/cheflogs", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `[{"guid":"1234","size":9,"modified":1,"compressed":false}]`)
+	})
+	mux.HandleFunc("/chef/lock/set", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"error":{"code":"unauthorized","message":"Unauthorized"}}`)
+			return
+		}
+		fmt.Fprint(w, `{"Locked": true}`)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	c := New(server.URL+"/", WithToken("secret"), WithHTTPClient(server.Client()))
+
+	run, err := c.TriggerRun(true)
+	if err != nil {
+		t.Fatalf("TriggerRun failed. Error: %s", err)
+	}
+	if run.GUID != "1234" || run.Status != "registered" || run.Source != "demand" {
+		t.Errorf("TriggerRun returned the wrong run. Got: %+v", run)
+	}
+
+	if _, err := c.TriggerRun(false); err == nil {
+		t.Errorf("TriggerRun should return the error from chef waiter")
+	} else if apiErr, ok := err.(*APIError); !ok || apiErr.StatusCode != http.StatusForbidden || apiErr.Code != "locked" || apiErr.Message != "Chefwaiter is locked" {
+		t.Errorf("TriggerRun returned the wrong error. Got: %#v", err)
+	}
+
+	if _, err := c.TriggerCustomRun("recipe[test]", []string{"--no-fork"}, true); err != nil {
+		t.Errorf("TriggerCustomRun failed. Error: %s", err)
+	}
+
+	if _, err := c.GetStatus("missing"); err != ErrNotFound {
+		t.Errorf("GetStatus should return ErrNotFound for unknown runs. Got: %v", err)
+	}
+
+	logs, err := c.GetLogs("1234")
+	if err != nil || logs != "chef log\n" {
+		t.Errorf("GetLogs returned the wrong log. Got: %q, Error: %v", logs, err)
+	}
+	if _, err := c.GetLogs("nope"); err != ErrNotFound {
+		t.Errorf("GetLogs should return ErrNotFound for unknown logs. Got: %v", err)
+	}
+
+	guid, err := c.GetLastRunGUID()
+	if err != nil || guid != "1234" {
+		t.Errorf("GetLastRunGUID returned the wrong guid. Got: %q, Error: %v", guid, err)
+	}
+
+	logFiles, err := c.ListLogs()
+	if err != nil || len(logFiles) != 1 || logFiles[0].GUID != "1234" {
+		t.Errorf("ListLogs returned the wrong logs. Got: %+v, Error: %v", logFiles, err)
+	}
+
+	if err := c.SetLock(); err != nil {
+		t.Errorf("SetLock should send the token. Error: %s", err)
+	}
+	if err := New(server.URL).SetLock(); err == nil {
+		t.Errorf("SetLock should fail without the token")
+	}
+}
+
+func TestAPIErrorWithoutMessage(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	err := New(server.URL).Healthcheck()
+	apiErr, ok := err.(*APIError)
+	if !ok || apiErr.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("Healthcheck returned the wrong error. Got: %#v", err)
+	}
+	if apiErr.Message != "" {
+		t.Errorf("APIError should have no message when the body is empty. Got: %q", apiErr.Message)
+	}
+}
@@ -2,6 +2,10 @@ package cmd
 
 import (
 	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
 	"os/exec"
 	"syscall"
 )
@@ -10,8 +14,22 @@ const defaultFailedCode = 1
 
 // RunCommand will run the shell command with the supplied arguments
 func RunCommand(name string, args ...string) (stdout string, stderr string, exitCode int) {
+	return RunCommandContext(context.Background(), name, args...)
+}
+
+// RunCommandContext will run the shell command with the supplied arguments.
+// The process is killed if the context is cancelled before the command completes.
+func RunCommandContext(ctx context.Context, name string, args ...string) (stdout string, stderr string, exitCode int) {
+	return RunCommandWithEnv(ctx, nil, name, args...)
+}
+
+// RunCommandWithEnv will run the shell command with the supplied arguments. The env
+// values, in the form key=value, are added to the environment of the command only.
+// The process is killed if the context is cancelled before the command completes.
+func RunCommandWithEnv(ctx context.Context, env []string, name string, args ...string) (stdout string, stderr string, exitCode int) {
 	var outbuf, errbuf bytes.Buffer
-	cmd := exec.Command(name, args...)
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Env = commandEnv(env)
 	cmd.Stdout = &outbuf
 	cmd.Stderr = &errbuf
 
@@ -19,20 +37,83 @@ func RunCommand(name string, args ...string) (stdout string, stderr string, exit
 	stdout = outbuf.String()
 	stderr = errbuf.String()
 
+	exitCode, errMsg := exitStatus(ctx, cmd, err)
+	if errMsg != "" && (stderr == "" || ctx.Err() != nil) {
+		stderr = stderr + errMsg
+	}
+	return
+}
+
+// RunCommandStream will run the shell command with the supplied arguments and write
+// both stdout and stderr to output as it is produced rather than when the command finishes.
+// The env values, in the form key=value, are added to the environment of the command only.
+// The process is killed if the context is cancelled before the command completes.
+func RunCommandStream(ctx context.Context, output io.Writer, env []string, name string, args ...string) (exitCode int) {
+	return RunCommandStreamAs(ctx, output, env, "", name, args...)
+}
+
+// RunCommandStreamAs is RunCommandStream with the command run as the user runAs.
+// An empty runAs runs the command as the user that chef waiter runs as.
+// If the command can not be started as the user the reason is written to output.
+func RunCommandStreamAs(ctx context.Context, output io.Writer, env []string, runAs string, name string, args ...string) (exitCode int) {
+	return RunCommandStreamsAs(ctx, output, output, env, runAs, name, args...)
+}
+
+// RunCommandStreamsAs is RunCommandStreamAs with stdout and stderr written to their own
+// writers. Messages from chef waiter about the command, like why it could not be
+// started, are written to stdout so that they sit with the rest of the output.
+func RunCommandStreamsAs(ctx context.Context, stdout, stderr io.Writer, env []string, runAs string, name string, args ...string) (exitCode int) {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Env = commandEnv(env)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if runAs != "" {
+		if err := setRunAs(cmd, runAs); err != nil {
+			fmt.Fprintln(stdout, err)
+			return defaultFailedCode
+		}
+	}
+
+	err := cmd.Run()
+	exitCode, errMsg := exitStatus(ctx, cmd, err)
+	if errMsg != "" {
+		fmt.Fprintln(stdout, errMsg)
+	}
+	return exitCode
+}
+
+// commandEnv will return the environment for a command. Extra values are added on top
+// of the environment of chef waiter itself. A nil slice is returned when there are no
+// extra values so that the command simply inherits the environment.
+func commandEnv(extra []string) []string {
+	if len(extra) == 0 {
+		return nil
+	}
+	return append(os.Environ(), extra...)
+}
+
+// exitStatus works out the exit code of a finished command. It also returns a message
+// describing why the command failed when the command itself could not report it.
+func exitStatus(ctx context.Context, cmd *exec.Cmd, err error) (exitCode int, errMsg string) {
 	if err != nil {
 		// try to get the exit code
 		if exitError, ok := err.(*exec.ExitError); ok {
 			ws := exitError.Sys().(syscall.WaitStatus)
 			exitCode = ws.ExitStatus()
+			// A process killed by the context has no exit code of its own.
+			if ctx.Err() != nil {
+				if exitCode < 0 {
+					exitCode = defaultFailedCode
+				}
+				errMsg = ctx.Err().Error()
+			}
 		} else {
 			// This will happen (in OSX) if `name` is not available in $PATH,
 			// in this situation, exit code could not be get, and stderr will be
 			// empty string very likely, so we use the default fail code, and format err
 			// to string and set to stderr
 			exitCode = defaultFailedCode
-			if stderr == "" {
-				stderr = err.Error()
-			}
+			errMsg = err.Error()
 		}
 	} else {
 		// success, exitCode should be 0 if go is ok
@@ -0,0 +1,106 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/user"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestRunCommandContext(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Test relies on unix shell commands")
+	}
+
+	_, _, exitCode := RunCommand("sh", "-c", "exit 3")
+	if exitCode != 3 {
+		t.Errorf("RunCommand returned the wrong exit code. Got: %d, Want: 3", exitCode)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, stderr, exitCode := RunCommandContext(ctx, "sleep", "5")
+	if time.Since(start) > 2*time.Second {
+		t.Errorf("RunCommandContext did not kill the command when the context was cancelled")
+	}
+	if exitCode == 0 {
+		t.Errorf("RunCommandContext returned a 0 exit code for a killed command")
+	}
+	if stderr == "" {
+		t.Errorf("RunCommandContext did not report why the command was stopped")
+	}
+}
+
+func TestRunCommandStream(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Test relies on unix shell commands")
+	}
+
+	output := &bytes.Buffer{}
+	exitCode := RunCommandStream(context.Background(), output, nil, "sh", "-c", "echo out; echo err 1>&2; exit 2")
+	if exitCode != 2 {
+		t.Errorf("RunCommandStream returned the wrong exit code. Got: %d, Want: 2", exitCode)
+	}
+	if output.String() != "out\nerr\n" {
+		t.Errorf("RunCommandStream did not write stdout and stderr to the output. Got: %q", output.String())
+	}
+}
+
+func TestRunCommandStreamsAs(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Test relies on unix shell commands")
+	}
+
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	exitCode := RunCommandStreamsAs(context.Background(), stdout, stderr, nil, "", "sh", "-c", "echo out; echo err 1>&2; exit 2")
+	if exitCode != 2 {
+		t.Errorf("RunCommandStreamsAs returned the wrong exit code. Got: %d, Want: 2", exitCode)
+	}
+	if stdout.String() != "out\n" || stderr.String() != "err\n" {
+		t.Errorf("RunCommandStreamsAs did not keep stdout and stderr apart. Got: %q and %q", stdout.String(), stderr.String())
+	}
+}
+
+func TestRunCommandStreamEnv(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Test relies on unix shell commands")
+	}
+
+	output := &bytes.Buffer{}
+	RunCommandStream(context.Background(), output, []string{"CHEFWAITER_TEST_VALUE=proxy"}, "sh", "-c", "echo $CHEFWAITER_TEST_VALUE")
+	if output.String() != "proxy\n" {
+		t.Errorf("RunCommandStream did not pass the environment to the command. Got: %q", output.String())
+	}
+	if os.Getenv("CHEFWAITER_TEST_VALUE") != "" {
+		t.Errorf("The command environment leaked into this process")
+	}
+}
+
+func TestRunCommandStreamAs(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Test relies on unix shell commands")
+	}
+	if os.Getuid() != 0 {
+		t.Skip("Test needs to run as root to change user")
+	}
+	nobody, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skip("Test needs the nobody user")
+	}
+
+	output := &bytes.Buffer{}
+	exitCode := RunCommandStreamAs(context.Background(), output, nil, "nobody", "sh", "-c", "id -u; echo $USER")
+	if exitCode != 0 || output.String() != nobody.Uid+"\nnobody\n" {
+		t.Errorf("RunCommandStreamAs did not run as nobody. Exit code: %d, Output: %q", exitCode, output.String())
+	}
+
+	output.Reset()
+	exitCode = RunCommandStreamAs(context.Background(), output, nil, "chefwaiter-no-such-user", "sh", "-c", "exit 0")
+	if exitCode == 0 || output.String() == "" {
+		t.Errorf("RunCommandStreamAs should fail for an unknown user. Exit code: %d, Output: %q", exitCode, output.String())
+	}
+}
@@ -0,0 +1,11 @@
+package cmd
+
+import (
+	"errors"
+	"os/exec"
+)
+
+// setRunAs is not supported on windows as a password is needed to start a process as another user.
+func setRunAs(cmd *exec.Cmd, username string) error {
+	return errors.New("running as another user is not supported on windows")
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"sync"
+	"time"
 
 	"github.com/morfien101/chef-waiter/logs"
 )
@@ -24,6 +25,59 @@ type Config interface {
 	KeyPath() string
 	WhiteListCustomRuns() bool
 	AllowedCustomRuns() []string
+	ReasonRequiredCustomRuns() []string
+	AdminToken() string
+	ListenTransport() string
+	ListenSocket() string
+	TracingEndpoint() string
+	LogLevel() string
+	LogFormat() string
+	PreRunCommand() []string
+	PostRunCommand() []string
+	ChefEnvironment() map[string]string
+	ChefConfigPath() string
+	RunCoalesceWindow() int64
+	ShutdownTimeout() time.Duration
+	ChefVersionRefreshInterval() time.Duration
+	AllowedExtraFlags() []string
+	FailedStateTableSize() int
+	MaxLogSize() int64
+	ReadAllowedNetworks() []string
+	ReadDeniedNetworks() []string
+	WriteAllowedNetworks() []string
+	WriteDeniedNetworks() []string
+	TrustedProxies() []string
+	RunSchedule() string
+	RunRetries() int
+	RunRetryDelay() time.Duration
+	AutoLockFailures() int
+	AutoLockWindow() time.Duration
+	MaxRequestBodyBytes() int64
+	MaxConcurrentRuns() int
+	Tags() map[string]string
+	AllowedRunAsUsers() []string
+	StartupDelay() time.Duration
+	StartupSplay() time.Duration
+	HideWhiteListInStatus() bool
+	MaxRunAge() time.Duration
+	DisabledEndpointGroups() []string
+	SelfTestInterval() time.Duration
+	LogFilenameTemplate() string
+	SyslogTag() string
+	SyslogFacility() string
+	ReadOnlyListenPort() int
+	ReadOnlyListenAddress() string
+	RunTimeout() time.Duration
+	CustomRunTimeout() time.Duration
+	StateSweepInterval() time.Duration
+	StateSweepLimit() int
+	BlockOnDemandInMaintenance() bool
+	SeparateStderrLog() bool
+	ChefLockFile() string
+	RunAtMinute() (int, bool)
+	PeriodicSchedule() string
+	LogDiskBudget() int64
+	PeriodicCooldown() time.Duration
 }
 
 func (vc *ValuesContainer) StateTableSize() int {
@@ -104,42 +158,492 @@ func (vc *ValuesContainer) AllowedCustomRuns() []string {
 	return vc.InternalAllowedCustomRuns
 }
 
+func (vc *ValuesContainer) ReasonRequiredCustomRuns() []string {
+	vc.RLock()
+	defer vc.RUnlock()
+	return vc.InternalReasonRequiredRuns
+}
+
+func (vc *ValuesContainer) AdminToken() string {
+	vc.RLock()
+	defer vc.RUnlock()
+	return vc.InternalAdminToken
+}
+
+func (vc *ValuesContainer) ListenTransport() string {
+	vc.RLock()
+	defer vc.RUnlock()
+	return vc.InternalListenTransport
+}
+
+func (vc *ValuesContainer) ListenSocket() string {
+	vc.RLock()
+	defer vc.RUnlock()
+	return vc.InternalListenSocket
+}
+
+func (vc *ValuesContainer) TracingEndpoint() string {
+	vc.RLock()
+	defer vc.RUnlock()
+	return vc.InternalTracingEndpoint
+}
+
 // ValuesContainer is a struct that holds the values of the configuration file.
+// Values are resolved in the following order, the last one found wins:
+//   - Default values
+//   - The configuration file
+//   - CHEFWAITER_* environment variables named after the json name, eg: CHEFWAITER_LISTEN_PORT
 type ValuesContainer struct {
-	InternalStateTableSize      int               `json:"state_table_size"`
-	InternalControlChefRun      bool              `json:"periodic_chef_runs"`
-	InternalPeriodicTimer       int64             `json:"run_interval"`
-	InternalDebug               bool              `json:"debug"`
-	InternalLogLocation         string            `json:"logs_location"`
-	InternalStateFileLocation   string            `json:"state_location"`
-	InternalListenPort          int               `json:"listen_port"`
-	InternalListenAddress       string            `json:"listen_address"`
-	InternalTLSEnabled          bool              `json:"enable_tls"`
-	InternalCertPath            string            `json:"certificate_path"`
-	InternalKeyPath             string            `json:"key_path"`
-	MetricsEnabled              bool              `json:"metrics_enabled"`
-	MetricsHost                 string            `json:"metrics_host"`
-	MetricsDefaultTags          map[string]string `json:"metrics_default_tags"`
-	InternalWhiteListCustomRuns bool              `json:"whitelist_custom_runs"`
-	InternalAllowedCustomRuns   []string          `json:"allowed_custom_runs"`
+	InternalStateTableSize       int               `json:"state_table_size"`
+	InternalControlChefRun       bool              `json:"periodic_chef_runs"`
+	InternalPeriodicTimer        int64             `json:"run_interval"`
+	InternalDebug                bool              `json:"debug"`
+	InternalLogLevel             string            `json:"log_level"`
+	InternalLogFormat            string            `json:"log_format"`
+	InternalLogLocation          string            `json:"logs_location"`
+	InternalStateFileLocation    string            `json:"state_location"`
+	InternalListenPort           int               `json:"listen_port"`
+	InternalListenAddress        string            `json:"listen_address"`
+	InternalListenTransport      string            `json:"listen_transport"`
+	InternalListenSocket         string            `json:"listen_socket"`
+	InternalTLSEnabled           bool              `json:"enable_tls"`
+	InternalCertPath             string            `json:"certificate_path"`
+	InternalKeyPath              string            `json:"key_path"`
+	MetricsEnabled               bool              `json:"metrics_enabled"`
+	MetricsHost                  string            `json:"metrics_host"`
+	MetricsPrefix                string            `json:"metrics_prefix"`
+	MetricsDefaultTags           map[string]string `json:"metrics_default_tags"`
+	InternalWhiteListCustomRuns  bool              `json:"whitelist_custom_runs"`
+	InternalAllowedCustomRuns    []string          `json:"allowed_custom_runs"`
+	InternalReasonRequiredRuns   []string          `json:"reason_required_custom_runs"`
+	InternalAllowedExtraFlags    []string          `json:"allowed_extra_flags"`
+	InternalAdminToken           string            `json:"admin_token"`
+	InternalTracingEndpoint      string            `json:"tracing_endpoint"`
+	InternalPreRunCommand        []string          `json:"pre_run_command"`
+	InternalPostRunCommand       []string          `json:"post_run_command"`
+	InternalChefEnvironment      map[string]string `json:"chef_environment"`
+	InternalChefConfigPath       string            `json:"chef_config_path"`
+	InternalRunCoalesceWindow    int64             `json:"run_coalesce_window"`
+	InternalShutdownTimeout      int64             `json:"shutdown_timeout"`
+	InternalChefVersionRefresh   int64             `json:"chef_version_refresh_interval"`
+	InternalFailedStateTableSize int               `json:"failed_state_table_size"`
+	InternalMaxLogSizeMB         int64             `json:"max_log_size_mb"`
+	InternalReadAllowedNetworks  []string          `json:"read_allowed_networks"`
+	InternalReadDeniedNetworks   []string          `json:"read_denied_networks"`
+	InternalWriteAllowedNetworks []string          `json:"write_allowed_networks"`
+	InternalWriteDeniedNetworks  []string          `json:"write_denied_networks"`
+	InternalTrustedProxies       []string          `json:"trusted_proxies"`
+	InternalRunSchedule          string            `json:"run_schedule"`
+	InternalRunRetries           int               `json:"run_retries"`
+	InternalRunRetryDelay        int64             `json:"run_retry_delay"`
+	InternalAutoLockFailures     int               `json:"auto_lock_failures"`
+	InternalAutoLockWindow       int64             `json:"auto_lock_window"`
+	InternalMaxRequestBodyBytes  int64             `json:"max_request_body_bytes"`
+	InternalMaxConcurrentRuns    int               `json:"max_concurrent_runs"`
+	InternalTags                 map[string]string `json:"tags"`
+	InternalAllowedRunAsUsers    []string          `json:"allowed_run_as_users"`
+	InternalStartupDelay         int64             `json:"startup_delay"`
+	InternalStartupSplay         int64             `json:"startup_splay"`
+	InternalHideWhiteList        bool              `json:"hide_whitelist_in_status"`
+	InternalMaxRunAge            int64             `json:"max_run_age"`
+	InternalDisabledEndpoints    []string          `json:"disabled_endpoint_groups"`
+	InternalSelfTestInterval     int64             `json:"self_test_interval"`
+	InternalLogFilenameTemplate  string            `json:"log_filename_template"`
+	InternalSyslogTag            string            `json:"syslog_tag"`
+	InternalSyslogFacility       string            `json:"syslog_facility"`
+	InternalReadOnlyListenPort   int               `json:"read_only_listen_port"`
+	InternalReadOnlyListenAddr   string            `json:"read_only_listen_address"`
+	InternalRunTimeout           int64             `json:"run_timeout"`
+	InternalCustomRunTimeout     int64             `json:"custom_run_timeout"`
+	InternalStateSweepInterval   int64             `json:"state_sweep_interval"`
+	InternalStateSweepLimit      int               `json:"state_sweep_limit"`
+	InternalBlockOnDemandInMaint bool              `json:"block_ondemand_in_maintenance"`
+	InternalSeparateStderrLog    bool              `json:"separate_stderr_log"`
+	InternalChefLockFile         string            `json:"chef_lock_file"`
+	InternalRunAtMinute          *int              `json:"run_at_minute"`
+	InternalLogDiskBudgetMB      int64             `json:"log_disk_budget_mb"`
+	InternalPeriodicCooldown     int64             `json:"periodic_cooldown"`
 	sync.RWMutex
 }
 
+func (vc *ValuesContainer) LogLevel() string {
+	vc.RLock()
+	defer vc.RUnlock()
+	return vc.InternalLogLevel
+}
+
+func (vc *ValuesContainer) LogFormat() string {
+	vc.RLock()
+	defer vc.RUnlock()
+	return vc.InternalLogFormat
+}
+
+func (vc *ValuesContainer) PreRunCommand() []string {
+	vc.RLock()
+	defer vc.RUnlock()
+	return vc.InternalPreRunCommand
+}
+
+func (vc *ValuesContainer) PostRunCommand() []string {
+	vc.RLock()
+	defer vc.RUnlock()
+	return vc.InternalPostRunCommand
+}
+
+func (vc *ValuesContainer) ChefEnvironment() map[string]string {
+	vc.RLock()
+	defer vc.RUnlock()
+	return vc.InternalChefEnvironment
+}
+
+func (vc *ValuesContainer) ChefConfigPath() string {
+	vc.RLock()
+	defer vc.RUnlock()
+	return vc.InternalChefConfigPath
+}
+
+func (vc *ValuesContainer) RunCoalesceWindow() int64 {
+	vc.RLock()
+	defer vc.RUnlock()
+	return vc.InternalRunCoalesceWindow
+}
+
+func (vc *ValuesContainer) ShutdownTimeout() time.Duration {
+	vc.RLock()
+	defer vc.RUnlock()
+	return time.Duration(vc.InternalShutdownTimeout) * time.Second
+}
+
+func (vc *ValuesContainer) ChefVersionRefreshInterval() time.Duration {
+	vc.RLock()
+	defer vc.RUnlock()
+	return time.Duration(vc.InternalChefVersionRefresh) * time.Minute
+}
+
+func (vc *ValuesContainer) AllowedExtraFlags() []string {
+	vc.RLock()
+	defer vc.RUnlock()
+	return vc.InternalAllowedExtraFlags
+}
+
+// FailedStateTableSize is how many failed runs, and their logs, are kept. It is the
+// state_table_size unless failed_state_table_size is set.
+func (vc *ValuesContainer) FailedStateTableSize() int {
+	vc.RLock()
+	defer vc.RUnlock()
+	if vc.InternalFailedStateTableSize == 0 {
+		return vc.InternalStateTableSize
+	}
+	return vc.InternalFailedStateTableSize
+}
+
+func (vc *ValuesContainer) MaxLogSize() int64 {
+	vc.RLock()
+	defer vc.RUnlock()
+	return vc.InternalMaxLogSizeMB * 1024 * 1024
+}
+
+func (vc *ValuesContainer) ReadAllowedNetworks() []string {
+	vc.RLock()
+	defer vc.RUnlock()
+	return vc.InternalReadAllowedNetworks
+}
+
+func (vc *ValuesContainer) ReadDeniedNetworks() []string {
+	vc.RLock()
+	defer vc.RUnlock()
+	return vc.InternalReadDeniedNetworks
+}
+
+func (vc *ValuesContainer) WriteAllowedNetworks() []string {
+	vc.RLock()
+	defer vc.RUnlock()
+	return vc.InternalWriteAllowedNetworks
+}
+
+func (vc *ValuesContainer) WriteDeniedNetworks() []string {
+	vc.RLock()
+	defer vc.RUnlock()
+	return vc.InternalWriteDeniedNetworks
+}
+
+func (vc *ValuesContainer) TrustedProxies() []string {
+	vc.RLock()
+	defer vc.RUnlock()
+	return vc.InternalTrustedProxies
+}
+
+func (vc *ValuesContainer) RunSchedule() string {
+	vc.RLock()
+	defer vc.RUnlock()
+	return vc.InternalRunSchedule
+}
+
+func (vc *ValuesContainer) RunRetries() int {
+	vc.RLock()
+	defer vc.RUnlock()
+	return vc.InternalRunRetries
+}
+
+func (vc *ValuesContainer) RunRetryDelay() time.Duration {
+	vc.RLock()
+	defer vc.RUnlock()
+	return time.Duration(vc.InternalRunRetryDelay) * time.Second
+}
+
+func (vc *ValuesContainer) AutoLockFailures() int {
+	vc.RLock()
+	defer vc.RUnlock()
+	return vc.InternalAutoLockFailures
+}
+
+func (vc *ValuesContainer) AutoLockWindow() time.Duration {
+	vc.RLock()
+	defer vc.RUnlock()
+	return time.Duration(vc.InternalAutoLockWindow) * time.Minute
+}
+
+func (vc *ValuesContainer) MaxRequestBodyBytes() int64 {
+	vc.RLock()
+	defer vc.RUnlock()
+	return vc.InternalMaxRequestBodyBytes
+}
+
+func (vc *ValuesContainer) MaxConcurrentRuns() int {
+	vc.RLock()
+	defer vc.RUnlock()
+	return vc.InternalMaxConcurrentRuns
+}
+
+func (vc *ValuesContainer) Tags() map[string]string {
+	vc.RLock()
+	defer vc.RUnlock()
+	return vc.InternalTags
+}
+
+func (vc *ValuesContainer) AllowedRunAsUsers() []string {
+	vc.RLock()
+	defer vc.RUnlock()
+	return vc.InternalAllowedRunAsUsers
+}
+
+func (vc *ValuesContainer) StartupDelay() time.Duration {
+	vc.RLock()
+	defer vc.RUnlock()
+	return time.Duration(vc.InternalStartupDelay) * time.Second
+}
+
+func (vc *ValuesContainer) StartupSplay() time.Duration {
+	vc.RLock()
+	defer vc.RUnlock()
+	return time.Duration(vc.InternalStartupSplay) * time.Second
+}
+
+func (vc *ValuesContainer) HideWhiteListInStatus() bool {
+	vc.RLock()
+	defer vc.RUnlock()
+	return vc.InternalHideWhiteList
+}
+
+func (vc *ValuesContainer) MaxRunAge() time.Duration {
+	vc.RLock()
+	defer vc.RUnlock()
+	return time.Duration(vc.InternalMaxRunAge) * time.Minute
+}
+
+func (vc *ValuesContainer) DisabledEndpointGroups() []string {
+	vc.RLock()
+	defer vc.RUnlock()
+	return vc.InternalDisabledEndpoints
+}
+
+func (vc *ValuesContainer) SelfTestInterval() time.Duration {
+	vc.RLock()
+	defer vc.RUnlock()
+	return time.Duration(vc.InternalSelfTestInterval) * time.Minute
+}
+
+func (vc *ValuesContainer) LogFilenameTemplate() string {
+	vc.RLock()
+	defer vc.RUnlock()
+	return vc.InternalLogFilenameTemplate
+}
+
+func (vc *ValuesContainer) SyslogTag() string {
+	vc.RLock()
+	defer vc.RUnlock()
+	return vc.InternalSyslogTag
+}
+
+func (vc *ValuesContainer) SyslogFacility() string {
+	vc.RLock()
+	defer vc.RUnlock()
+	return vc.InternalSyslogFacility
+}
+
+func (vc *ValuesContainer) ReadOnlyListenPort() int {
+	vc.RLock()
+	defer vc.RUnlock()
+	return vc.InternalReadOnlyListenPort
+}
+
+// ReadOnlyListenAddress falls back to the listen address when it is not set.
+func (vc *ValuesContainer) ReadOnlyListenAddress() string {
+	vc.RLock()
+	defer vc.RUnlock()
+	if vc.InternalReadOnlyListenAddr == "" {
+		return vc.InternalListenAddress
+	}
+	return vc.InternalReadOnlyListenAddr
+}
+
+func (vc *ValuesContainer) RunTimeout() time.Duration {
+	vc.RLock()
+	defer vc.RUnlock()
+	return time.Duration(vc.InternalRunTimeout) * time.Minute
+}
+
+// CustomRunTimeout falls back to the run timeout when it is not set.
+func (vc *ValuesContainer) CustomRunTimeout() time.Duration {
+	vc.RLock()
+	defer vc.RUnlock()
+	if vc.InternalCustomRunTimeout == 0 {
+		return time.Duration(vc.InternalRunTimeout) * time.Minute
+	}
+	return time.Duration(vc.InternalCustomRunTimeout) * time.Minute
+}
+
+func (vc *ValuesContainer) StateSweepInterval() time.Duration {
+	vc.RLock()
+	defer vc.RUnlock()
+	return time.Duration(vc.InternalStateSweepInterval) * time.Second
+}
+
+func (vc *ValuesContainer) StateSweepLimit() int {
+	vc.RLock()
+	defer vc.RUnlock()
+	return vc.InternalStateSweepLimit
+}
+
+func (vc *ValuesContainer) BlockOnDemandInMaintenance() bool {
+	vc.RLock()
+	defer vc.RUnlock()
+	return vc.InternalBlockOnDemandInMaint
+}
+
+func (vc *ValuesContainer) SeparateStderrLog() bool {
+	vc.RLock()
+	defer vc.RUnlock()
+	return vc.InternalSeparateStderrLog
+}
+
+func (vc *ValuesContainer) ChefLockFile() string {
+	vc.RLock()
+	defer vc.RUnlock()
+	return vc.InternalChefLockFile
+}
+
+// RunAtMinute will return the minute of the hour that periodic runs are pinned to.
+// ok is false if run_at_minute is not set. 0 is a valid minute.
+func (vc *ValuesContainer) RunAtMinute() (minute int, ok bool) {
+	vc.RLock()
+	defer vc.RUnlock()
+	if vc.InternalRunAtMinute == nil {
+		return 0, false
+	}
+	return *vc.InternalRunAtMinute, true
+}
+
+// PeriodicSchedule will return the cron schedule for periodic runs. run_at_minute is
+// turned into a schedule that fires at that minute of every hour. It is empty when
+// the run interval is used.
+func (vc *ValuesContainer) PeriodicSchedule() string {
+	if minute, ok := vc.RunAtMinute(); ok && vc.RunSchedule() == "" {
+		return fmt.Sprintf("%d * * * *", minute)
+	}
+	return vc.RunSchedule()
+}
+
+func (vc *ValuesContainer) LogDiskBudget() int64 {
+	vc.RLock()
+	defer vc.RUnlock()
+	return vc.InternalLogDiskBudgetMB * 1024 * 1024
+}
+
+func (vc *ValuesContainer) PeriodicCooldown() time.Duration {
+	vc.RLock()
+	defer vc.RUnlock()
+	return time.Duration(vc.InternalPeriodicCooldown) * time.Second
+}
+
+// secretSettings holds the json names of settings that must not be shown to users.
+var secretSettings = []string{"admin_token"}
+
+// secretMapSettings holds the json names of settings whose values may hold secrets,
+// like a proxy password in the chef environment. Only their keys are shown.
+var secretMapSettings = []string{"chef_environment"}
+
+// Redacted will return the resolved configuration keyed by setting name with any secret values replaced.
+func (vc *ValuesContainer) Redacted() (map[string]interface{}, error) {
+	vc.RLock()
+	raw, err := json.Marshal(vc)
+	vc.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]interface{})
+	if err := json.Unmarshal(raw, &values); err != nil {
+		return nil, err
+	}
+	for _, secret := range secretSettings {
+		if value, ok := values[secret]; ok && value != "" {
+			values[secret] = "REDACTED"
+		}
+	}
+	for _, secret := range secretMapSettings {
+		if value, ok := values[secret].(map[string]interface{}); ok {
+			for k := range value {
+				value[k] = "REDACTED"
+			}
+		}
+	}
+	return values, nil
+}
+
+// RedactedJSON will return the resolved configuration as JSON with any secret values replaced.
+func (vc *ValuesContainer) RedactedJSON() ([]byte, error) {
+	values, err := vc.Redacted()
+	if err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(values, "", "  ")
+}
+
 // New creates a configuration container and returns it. It will return an error if something goes wrong while reading the configuration.
 func New(fileLocation string, logger logs.SysLogger) (*ValuesContainer, error) {
 	// Create a new config container
 	// setup defaults
 	nc := &ValuesContainer{
-		InternalStateTableSize: 20,
-		InternalControlChefRun: true,
-		InternalPeriodicTimer:  30,
-		InternalDebug:          false,
-		InternalListenPort:     8901,
-		InternalListenAddress:  "0.0.0.0",
-		InternalCertPath:       "./cert.crt",
-		InternalKeyPath:        "./key.key",
-		MetricsHost:            "127.0.0.1:8125",
-		MetricsDefaultTags:     make(map[string]string),
+		InternalStateTableSize:      20,
+		InternalControlChefRun:      true,
+		InternalPeriodicTimer:       30,
+		InternalDebug:               false,
+		InternalListenPort:          8901,
+		InternalListenAddress:       "0.0.0.0",
+		InternalListenTransport:     "tcp",
+		InternalShutdownTimeout:     5,
+		InternalChefVersionRefresh:  15,
+		InternalRunRetryDelay:       60,
+		InternalAutoLockWindow:      60,
+		InternalMaxRequestBodyBytes: 64 * 1024,
+		InternalMaxConcurrentRuns:   1,
+		InternalStateSweepInterval:  60,
+		InternalStateSweepLimit:     500,
+		InternalCertPath:            "./cert.crt",
+		InternalKeyPath:             "./key.key",
+		MetricsHost:                 "127.0.0.1:8125",
+		MetricsPrefix:               "chefwaiter.",
+		MetricsDefaultTags:          make(map[string]string),
 	}
 	// Call OS_default for config files
 	nc.writeConfigFileOSDefaults()
@@ -150,6 +654,11 @@ func New(fileLocation string, logger logs.SysLogger) (*ValuesContainer, error) {
 		return nil, err
 	}
 
+	// Environment variables override anything in the configuration file.
+	if err := nc.loadEnvironment(); err != nil {
+		return nil, err
+	}
+
 	return nc, nil
 }
 
@@ -5,4 +5,5 @@ var defaultFileLocation = "/etc/chefwaiter/config.json"
 func (vc *ValuesContainer) writeConfigFileOSDefaults() {
 	vc.InternalLogLocation = "/var/log/chefwaiter"
 	vc.InternalStateFileLocation = "/etc/chefwaiter"
+	vc.InternalListenSocket = "/var/run/chefwaiter.sock"
 }
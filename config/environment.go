@@ -0,0 +1,100 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// envPrefix is put in front of the upper cased json name of a setting to make
+// the environment variable that overrides it. eg: listen_port -> CHEFWAITER_LISTEN_PORT
+const envPrefix = "CHEFWAITER_"
+
+// EnvironmentName will return the environment variable that overrides the setting
+// with the supplied json name.
+func EnvironmentName(jsonName string) string {
+	return envPrefix + strings.ToUpper(jsonName)
+}
+
+// loadEnvironment will override any setting that has a matching CHEFWAITER_* environment
+// variable set. Lists are comma separated and maps are comma separated key=value pairs.
+func (vc *ValuesContainer) loadEnvironment() error {
+	vc.Lock()
+	defer vc.Unlock()
+	values := reflect.ValueOf(vc).Elem()
+	valuesType := values.Type()
+	for i := 0; i < valuesType.NumField(); i++ {
+		jsonName := strings.Split(valuesType.Field(i).Tag.Get("json"), ",")[0]
+		if jsonName == "" || jsonName == "-" {
+			continue
+		}
+		envName := EnvironmentName(jsonName)
+		envValue, ok := os.LookupEnv(envName)
+		if !ok {
+			continue
+		}
+		if err := setFromString(values.Field(i), envValue); err != nil {
+			return fmt.Errorf("Environment variable %s is not valid. Error: %s", envName, err)
+		}
+	}
+	return nil
+}
+
+// setFromString will convert the string value into the type of the field and set it.
+func setFromString(field reflect.Value, value string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("expected true or false, got %q", value)
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		i, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("expected a whole number, got %q", value)
+		}
+		field.SetInt(i)
+	case reflect.Slice:
+		if field.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported list type %s", field.Type())
+		}
+		list := make([]string, 0)
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		field.Set(reflect.ValueOf(list))
+	case reflect.Map:
+		if field.Type().Key().Kind() != reflect.String || field.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported map type %s", field.Type())
+		}
+		m := make(map[string]string)
+		for _, pair := range strings.Split(value, ",") {
+			if pair = strings.TrimSpace(pair); pair == "" {
+				continue
+			}
+			kv := strings.SplitN(pair, "=", 2)
+			if len(kv) != 2 {
+				return fmt.Errorf("expected key=value pairs, got %q", pair)
+			}
+			m[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+		}
+		field.Set(reflect.ValueOf(m))
+	case reflect.Ptr:
+		// Optional settings are pointers so that they can be told apart from zero.
+		optional := reflect.New(field.Type().Elem())
+		if err := setFromString(optional.Elem(), value); err != nil {
+			return err
+		}
+		field.Set(optional)
+	default:
+		return fmt.Errorf("unsupported setting type %s", field.Type())
+	}
+	return nil
+}
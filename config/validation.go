@@ -0,0 +1,307 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/robfig/cron/v3"
+
+	"github.com/morfien101/chef-waiter/logs"
+)
+
+// Validate will check that the values in the configuration can be used to run chef waiter.
+// All the problems found are returned together in a single error.
+func (vc *ValuesContainer) Validate() error {
+	problems := make([]string, 0)
+
+	if vc.ListenTransport() == "unix" {
+		if vc.ListenSocket() == "" {
+			problems = append(problems, "listen_socket must be set when listen_transport is unix")
+		}
+	} else if vc.ListenTransport() != "tcp" {
+		problems = append(problems, fmt.Sprintf("listen_transport must be tcp or unix, got %q", vc.ListenTransport()))
+	} else if vc.ListenPort() < 1 || vc.ListenPort() > 65535 {
+		problems = append(problems, fmt.Sprintf("listen_port must be between 1 and 65535, got %d", vc.ListenPort()))
+	}
+
+	if port := vc.ReadOnlyListenPort(); port < 0 || port > 65535 {
+		problems = append(problems, fmt.Sprintf("read_only_listen_port must be between 1 and 65535, or 0 to turn it off, got %d", port))
+	} else if port != 0 && vc.ListenTransport() == "tcp" && port == vc.ListenPort() && vc.ReadOnlyListenAddress() == vc.ListenAddress() {
+		problems = append(problems, fmt.Sprintf("read_only_listen_port must not be the same as listen_port, got %d", port))
+	}
+
+	if vc.TLSEnabled() {
+		for _, file := range []struct{ setting, path string }{
+			{setting: "certificate_path", path: vc.CertPath()},
+			{setting: "key_path", path: vc.KeyPath()},
+		} {
+			if err := checkReadableFile(file.path); err != nil {
+				problems = append(problems, fmt.Sprintf("%s is not readable: %s", file.setting, err))
+			}
+		}
+	}
+
+	if _, err := logs.ParseLevel(vc.LogLevel()); err != nil {
+		problems = append(problems, fmt.Sprintf("log_level is not valid: %s", err))
+	}
+
+	if _, err := logs.ParseFormat(vc.LogFormat()); err != nil {
+		problems = append(problems, fmt.Sprintf("log_format is not valid: %s", err))
+	}
+
+	if _, err := logs.ParseSyslogFacility(vc.SyslogFacility()); err != nil {
+		problems = append(problems, fmt.Sprintf("syslog_facility is not valid: %s", err))
+	}
+
+	if vc.PeriodicTimer() <= 0 {
+		problems = append(problems, fmt.Sprintf("run_interval must be a positive number of minutes, got %d", vc.PeriodicTimer()))
+	}
+
+	if vc.RunSchedule() != "" {
+		if _, err := cron.ParseStandard(vc.RunSchedule()); err != nil {
+			problems = append(problems, fmt.Sprintf("run_schedule is not a valid cron schedule: %s", err))
+		}
+	}
+
+	if minute, ok := vc.RunAtMinute(); ok {
+		switch {
+		case minute < 0 || minute > 59:
+			problems = append(problems, fmt.Sprintf("run_at_minute must be from 0 to 59, got %d", minute))
+		case vc.RunSchedule() != "":
+			problems = append(problems, "run_at_minute and run_schedule can not both be set")
+		}
+	}
+
+	if vc.RunRetries() < 0 {
+		problems = append(problems, fmt.Sprintf("run_retries must not be negative, got %d", vc.RunRetries()))
+	}
+
+	if vc.RunRetryDelay() < 0 {
+		problems = append(problems, fmt.Sprintf("run_retry_delay must not be a negative number of seconds, got %d", vc.InternalRunRetryDelay))
+	}
+
+	if vc.AutoLockFailures() < 0 {
+		problems = append(problems, fmt.Sprintf("auto_lock_failures must not be negative, got %d", vc.AutoLockFailures()))
+	} else if vc.AutoLockFailures() > 0 && vc.AutoLockWindow() <= 0 {
+		problems = append(problems, fmt.Sprintf("auto_lock_window must be a positive number of minutes when auto_lock_failures is set, got %d", vc.InternalAutoLockWindow))
+	}
+
+	if vc.MaxRequestBodyBytes() <= 0 {
+		problems = append(problems, fmt.Sprintf("max_request_body_bytes must be a positive number of bytes, got %d", vc.MaxRequestBodyBytes()))
+	}
+
+	if vc.StartupDelay() < 0 {
+		problems = append(problems, fmt.Sprintf("startup_delay must not be a negative number of seconds, got %d", vc.InternalStartupDelay))
+	}
+
+	if vc.StartupSplay() < 0 {
+		problems = append(problems, fmt.Sprintf("startup_splay must not be a negative number of seconds, got %d", vc.InternalStartupSplay))
+	}
+
+	if vc.MaxRunAge() < 0 {
+		problems = append(problems, fmt.Sprintf("max_run_age must not be a negative number of minutes, got %d", vc.InternalMaxRunAge))
+	}
+
+	if vc.RunTimeout() < 0 {
+		problems = append(problems, fmt.Sprintf("run_timeout must not be a negative number of minutes, got %d", vc.InternalRunTimeout))
+	}
+
+	if vc.InternalCustomRunTimeout < 0 {
+		problems = append(problems, fmt.Sprintf("custom_run_timeout must not be a negative number of minutes, got %d", vc.InternalCustomRunTimeout))
+	}
+
+	if vc.SelfTestInterval() < 0 {
+		problems = append(problems, fmt.Sprintf("self_test_interval must not be a negative number of minutes, got %d", vc.InternalSelfTestInterval))
+	}
+
+	if template := vc.LogFilenameTemplate(); template != "" {
+		placeholders := strings.NewReplacer("{guid}", "", "{timestamp}", "").Replace(template)
+		switch {
+		case strings.Count(template, "{guid}") != 1:
+			problems = append(problems, fmt.Sprintf("log_filename_template must contain {guid} once, got %q", template))
+		case strings.ContainsAny(template, `/\`):
+			problems = append(problems, fmt.Sprintf("log_filename_template must not contain a path separator, got %q", template))
+		case strings.ContainsAny(placeholders, "{}"):
+			problems = append(problems, fmt.Sprintf("log_filename_template can only use {guid} and {timestamp}, got %q", template))
+		}
+	}
+
+	if vc.MaxConcurrentRuns() < 1 {
+		problems = append(problems, fmt.Sprintf("max_concurrent_runs must be at least 1, got %d", vc.MaxConcurrentRuns()))
+	}
+
+	if vc.ShutdownTimeout() <= 0 {
+		problems = append(problems, fmt.Sprintf("shutdown_timeout must be a positive number of seconds, got %d", vc.InternalShutdownTimeout))
+	}
+
+	if vc.StateSweepInterval() <= 0 {
+		problems = append(problems, fmt.Sprintf("state_sweep_interval must be a positive number of seconds, got %d", vc.InternalStateSweepInterval))
+	}
+
+	if vc.StateSweepLimit() < 0 {
+		problems = append(problems, fmt.Sprintf("state_sweep_limit must not be negative, got %d", vc.StateSweepLimit()))
+	}
+
+	if lockFile := vc.ChefLockFile(); lockFile != "" && !filepath.IsAbs(lockFile) {
+		problems = append(problems, fmt.Sprintf("chef_lock_file must be an absolute path, got %q", lockFile))
+	}
+
+	if vc.ChefVersionRefreshInterval() <= 0 {
+		problems = append(problems, fmt.Sprintf("chef_version_refresh_interval must be a positive number of minutes, got %d", vc.InternalChefVersionRefresh))
+	}
+
+	if vc.FailedStateTableSize() < 0 {
+		problems = append(problems, fmt.Sprintf("failed_state_table_size must not be negative, got %d", vc.FailedStateTableSize()))
+	}
+
+	if vc.MaxLogSize() < 0 {
+		problems = append(problems, fmt.Sprintf("max_log_size_mb must not be negative, got %d", vc.InternalMaxLogSizeMB))
+	}
+
+	if vc.LogDiskBudget() < 0 {
+		problems = append(problems, fmt.Sprintf("log_disk_budget_mb must not be negative, got %d", vc.InternalLogDiskBudgetMB))
+	}
+
+	if vc.PeriodicCooldown() < 0 {
+		problems = append(problems, fmt.Sprintf("periodic_cooldown must not be negative, got %d", vc.InternalPeriodicCooldown))
+	}
+
+	for _, list := range []struct {
+		setting  string
+		networks []string
+	}{
+		{setting: "read_allowed_networks", networks: vc.ReadAllowedNetworks()},
+		{setting: "read_denied_networks", networks: vc.ReadDeniedNetworks()},
+		{setting: "write_allowed_networks", networks: vc.WriteAllowedNetworks()},
+		{setting: "write_denied_networks", networks: vc.WriteDeniedNetworks()},
+		{setting: "trusted_proxies", networks: vc.TrustedProxies()},
+	} {
+		for _, network := range list.networks {
+			if !validNetwork(network) {
+				problems = append(problems, fmt.Sprintf("%s has %q which is not a valid IP or CIDR", list.setting, network))
+			}
+		}
+	}
+
+	if vc.RunCoalesceWindow() < 0 {
+		problems = append(problems, fmt.Sprintf("run_coalesce_window must not be negative, got %d", vc.RunCoalesceWindow()))
+	}
+
+	// These match the endpoint groups in the webengine.
+	endpointGroups := []string{"read", "trigger", "admin"}
+	for _, group := range vc.DisabledEndpointGroups() {
+		if !inList(group, endpointGroups) {
+			problems = append(problems, fmt.Sprintf("disabled_endpoint_groups has %q, it must be one of %s", group, strings.Join(endpointGroups, ", ")))
+		}
+	}
+
+	for _, run := range vc.ReasonRequiredCustomRuns() {
+		if !inList(run, vc.AllowedCustomRuns()) {
+			problems = append(problems, fmt.Sprintf("reason_required_custom_runs has %q which is not in allowed_custom_runs", run))
+		}
+	}
+
+	for name := range vc.ChefEnvironment() {
+		if name == "" || strings.ContainsAny(name, "=\x00") {
+			problems = append(problems, fmt.Sprintf("chef_environment has an invalid variable name %q", name))
+		}
+	}
+
+	for _, dir := range []struct{ setting, path string }{
+		{setting: "logs_location", path: vc.LogLocation()},
+		{setting: "state_location", path: vc.StateFileLocation()},
+	} {
+		if err := checkWritableDir(dir.path); err != nil {
+			problems = append(problems, fmt.Sprintf("%s is not writable: %s", dir.setting, err))
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("Configuration is not valid: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// Warnings will return problems with the configuration that do not stop chef waiter from
+// starting but are likely to make chef runs fail. They are checked along with Validate.
+func (vc *ValuesContainer) Warnings() []string {
+	warnings := make([]string, 0)
+	if vc.ChefConfigPath() != "" {
+		if err := checkReadableFile(vc.ChefConfigPath()); err != nil {
+			warnings = append(warnings, fmt.Sprintf("chef_config_path is not readable, chef runs will fail until it is: %s", err))
+		}
+	}
+	return warnings
+}
+
+// checkReadableFile will return an error if the path is not a file that can be read.
+func checkReadableFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fmt.Errorf("%s is a directory", path)
+	}
+	return nil
+}
+
+// checkWritableDir will return an error if files can not be written into the directory.
+// Directories that don't exist yet are checked by looking at the closest parent that does
+// exist as chef waiter will create the rest on start up.
+func checkWritableDir(path string) error {
+	if path == "" {
+		return fmt.Errorf("no directory set")
+	}
+	dir := filepath.Clean(path)
+	for {
+		info, err := os.Stat(dir)
+		if err == nil {
+			if !info.IsDir() {
+				return fmt.Errorf("%s is not a directory", dir)
+			}
+			break
+		}
+		if !os.IsNotExist(err) {
+			return err
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return err
+		}
+		dir = parent
+	}
+	f, err := ioutil.TempFile(dir, ".chefwaiter_write_test")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+func inList(value string, list []string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// validNetwork returns true for a CIDR, eg 10.0.0.0/8, or a single IP.
+func validNetwork(network string) bool {
+	if strings.Contains(network, "/") {
+		_, _, err := net.ParseCIDR(network)
+		return err == nil
+	}
+	return net.ParseIP(network) != nil
+}
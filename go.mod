@@ -7,6 +7,7 @@ require (
 	github.com/gorilla/mux v1.7.3
 	github.com/morfien101/go-statsd v1.2.2
 	github.com/morfien101/service v1.0.4
+	github.com/robfig/cron/v3 v3.0.1
 	github.com/satori/go.uuid v1.2.0
 	github.com/spf13/afero v1.2.2 // indirect
 )
@@ -0,0 +1,22 @@
+package internalstate
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// bootTimeFromUptime works out the epoch time of boot from the contents of /proc/uptime,
+// which starts with the seconds since boot, eg "350735.47 234388.90".
+func bootTimeFromUptime(now time.Time, uptime string) (int64, error) {
+	fields := strings.Fields(uptime)
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("uptime is empty")
+	}
+	seconds, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0, fmt.Errorf("could not read uptime %q: %s", fields[0], err)
+	}
+	return now.Add(-time.Duration(seconds * float64(time.Second))).Unix(), nil
+}
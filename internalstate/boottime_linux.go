@@ -0,0 +1,15 @@
+package internalstate
+
+import (
+	"io/ioutil"
+	"time"
+)
+
+// bootTime returns the epoch time that the server booted.
+func bootTime() (int64, error) {
+	uptime, err := ioutil.ReadFile("/proc/uptime")
+	if err != nil {
+		return 0, err
+	}
+	return bootTimeFromUptime(time.Now(), string(uptime))
+}
@@ -0,0 +1,27 @@
+package internalstate
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBootTimeFromUptime(t *testing.T) {
+	now := time.Unix(1000000, 0)
+	tests := []struct {
+		uptime    string
+		expect    int64
+		expectErr bool
+	}{
+		{uptime: "350.47 234388.90\n", expect: 999649},
+		{uptime: "60", expect: 999940},
+		{uptime: "", expectErr: true},
+		{uptime: "soon 1.0", expectErr: true},
+	}
+
+	for _, test := range tests {
+		boot, err := bootTimeFromUptime(now, test.uptime)
+		if (err != nil) != test.expectErr || boot != test.expect {
+			t.Errorf("bootTimeFromUptime(%q) got %d, error %v. Want %d, error %v", test.uptime, boot, err, test.expect, test.expectErr)
+		}
+	}
+}
@@ -0,0 +1,18 @@
+package internalstate
+
+import (
+	"syscall"
+	"time"
+)
+
+var getTickCount64 = syscall.NewLazyDLL("kernel32.dll").NewProc("GetTickCount64")
+
+// bootTime returns the epoch time that the server booted. GetTickCount64 is the
+// milliseconds since boot.
+func bootTime() (int64, error) {
+	if err := getTickCount64.Find(); err != nil {
+		return 0, err
+	}
+	ticks, _, _ := getTickCount64.Call()
+	return time.Now().Add(-time.Duration(ticks) * time.Millisecond).Unix(), nil
+}
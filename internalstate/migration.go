@@ -0,0 +1,76 @@
+package internalstate
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/morfien101/chef-waiter/logs"
+)
+
+// currentSchemaVersion is the version of the state layout written by this chef waiter.
+// Bump it and add a migration to stateMigrations when the persisted state changes.
+const currentSchemaVersion = 2
+
+// stateMigrations upgrade the state one version at a time. The migration at index i
+// upgrades a state at version i to version i+1.
+// State files written before versioning was added have no SchemaVersion and decode as 0.
+var stateMigrations = []func(st *StateTable){
+	// 0 -> 1: jobs gain a source and run start/end times.
+	// The times of old runs are not known so they are left as 0.
+	func(st *StateTable) {
+		for _, job := range st.Status {
+			if job.Source == "" {
+				job.Source = jobSource(job.OnDemand, job.CustomRun)
+			}
+		}
+	},
+	// 1 -> 2: the last periodic run start time is kept apart from the last run start time.
+	// Only periodic runs set the last run start time before this.
+	func(st *StateTable) {
+		st.LastPeriodicRunStartTime = st.LastRunStartTime
+	},
+}
+
+// migrateState will upgrade a state read from disk to the current schema version.
+// It returns true if any migrations were run.
+func migrateState(st *StateTable) (bool, error) {
+	if st.SchemaVersion > currentSchemaVersion {
+		return false, fmt.Errorf(
+			"state file schema version %d is newer than this chef waiter supports (%d)",
+			st.SchemaVersion,
+			currentSchemaVersion,
+		)
+	}
+	if st.Status == nil {
+		st.Status = make(map[string]*JobDetails)
+	}
+	migrated := false
+	for st.SchemaVersion < currentSchemaVersion {
+		logs.DebugMessage(fmt.Sprintf("Migrating state from schema version %d to %d", st.SchemaVersion, st.SchemaVersion+1))
+		stateMigrations[st.SchemaVersion](st)
+		st.SchemaVersion++
+		migrated = true
+	}
+	return migrated, nil
+}
+
+// backupStateFile will copy the state file before it is overwritten with a newer schema.
+// The copy is named after the schema version that it holds.
+func backupStateFile(stateFile string, version int) (string, error) {
+	backupPath := fmt.Sprintf("%s.v%d.bak", stateFile, version)
+	src, err := os.Open(stateFile)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	dst, err := os.Create(backupPath)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return "", err
+	}
+	return backupPath, dst.Close()
+}
@@ -2,10 +2,13 @@ package internalstate
 
 import (
 	"encoding/json"
+	"fmt"
 	"os"
 	"sync"
 	"time"
 
+	"github.com/morfien101/chef-waiter/cheflogs"
+	"github.com/morfien101/chef-waiter/config"
 	"github.com/morfien101/chef-waiter/logs"
 )
 
@@ -14,6 +17,14 @@ type AppStatusHandler struct {
 	sync.RWMutex
 	state  *AppStatus
 	logger logs.SysLogger
+	// currentState is read for the values that need to be up to date in the status.
+	currentState *StateTable
+	// maxRunAge is how long after the last successful run the node is overdue. 0 turns it off.
+	maxRunAge time.Duration
+	// hideWhiteList stops the whitelist entries being shown, only how many there are.
+	hideWhiteList bool
+	// findChefVersion is how the version of chef is found. Tests can swap it out.
+	findChefVersion func() (string, error)
 }
 
 // AppStatus - Holds status information about the chef waiter itself.
@@ -22,27 +33,76 @@ type AppStatus struct {
 	HostName    string `json:"hostname"`
 	StartTime   int64  `json:"start_time"`
 	// Uptime is to be deprecated 19/03/2019
-	Uptime            int64    `json:"uptime"`
-	StartTimeHuman    string   `json:"start_time_human_readable"`
-	Version           string   `json:"version"`
-	ChefVersion       string   `json:"chef_version"`
-	Healthy           bool     `json:"healthy"`
-	InMaintenance     bool     `json:"in_maintenance_mode"`
-	LastRunGUID       string   `json:"last_run_id"`
-	Locked            bool     `json:"locked"`
-	WhiteListsEnabled bool     `json:"whitelisting_enabled"`
-	WhiteList         []string `json:"whitelisted_payloads"`
+	Uptime         int64  `json:"uptime"`
+	StartTimeHuman string `json:"start_time_human_readable"`
+	Version        string `json:"version"`
+	GitCommit      string `json:"git_commit"`
+	BuildDate      string `json:"build_date"`
+	ChefVersion    string `json:"chef_version"`
+	Healthy        bool   `json:"healthy"`
+	InMaintenance  bool   `json:"in_maintenance_mode"`
+	LastRunGUID    string `json:"last_run_id"`
+	// The last successful run is empty and 0 if no run has succeeded.
+	LastSuccessfulRunGUID string `json:"last_successful_run_id"`
+	LastSuccessfulRunTime int64  `json:"last_successful_run_time"`
+	Locked                bool   `json:"locked"`
+	// BootTime is the epoch time that the server booted. It is 0 if it could not be found.
+	// ConvergedSinceBoot is true once a run has succeeded since then.
+	BootTime           int64 `json:"boot_time"`
+	ConvergedSinceBoot bool  `json:"converged_since_boot"`
+	// RunOverdue is true when no run has succeeded within max_run_age.
+	RunOverdue bool `json:"run_overdue"`
+	// ActiveRuns and ConsecutiveFailures are read from the state table when the status is asked for.
+	ActiveRuns          int  `json:"active_runs"`
+	ConsecutiveFailures int  `json:"consecutive_failures"`
+	WhiteListsEnabled   bool `json:"whitelisting_enabled"`
+	// WhiteListMatchMode is how custom runs are matched to the whitelist. Only exact
+	// matches are supported. WhiteList is left out if hide_whitelist_in_status is set.
+	WhiteListMatchMode string   `json:"whitelist_match_mode,omitempty"`
+	WhiteListCount     int      `json:"whitelist_count"`
+	WhiteList          []string `json:"whitelisted_payloads"`
+	// LogDiskUsage is refreshed periodically so it can lag behind what is on disk.
+	LogDiskUsage cheflogs.DiskUsage `json:"log_disk_usage"`
+	// Tags are the static tags from the configuration. They are only there to describe the node.
+	Tags map[string]string `json:"tags"`
+	// SelfTest is nil unless the self test is turned on.
+	SelfTest *SelfTest `json:"chef_self_test,omitempty"`
+	PersistStatus
+	SweepStatus
 }
 
+// SelfTest is the result of the periodic check that chef-client can still be run.
+type SelfTest struct {
+	LastRunTime         int64  `json:"last_run_time"`
+	Passing             bool   `json:"passing"`
+	ConsecutiveFailures int    `json:"consecutive_failures"`
+	LastError           string `json:"last_error,omitempty"`
+}
+
+// selfTestFailureLimit is how many self tests in a row must fail before chef waiter
+// is no longer ready. A single failure could be chef-client being upgraded.
+const selfTestFailureLimit = 3
+
 // AppStatusReader will show how to use the AppStatusHandler
 type AppStatusReader interface {
 	JSONEncoded() ([]byte, error)
+	Version() string
+	GitCommit() string
+	BuildDate() string
+	ChefVersion() string
+	SelfTestFailure() string
 }
 
 // NewAppStatus - creates a new appStatusHandler struct. It requires a version
 // number to be passed in. This is because the version is held outside of
 // internalstate.
-func NewAppStatus(version string, currentState *StateTable, logger logs.SysLogger) *AppStatusHandler {
+func NewAppStatus(
+	version string,
+	config config.Config,
+	currentState *StateTable,
+	chefLogsWorker cheflogs.WorkerReader,
+	logger logs.SysLogger,
+) *AppStatusHandler {
 	logs.DebugMessage("NewAppStatus()")
 	hn, err := os.Hostname()
 	if err != nil {
@@ -51,25 +111,70 @@ func NewAppStatus(version string, currentState *StateTable, logger logs.SysLogge
 	}
 	appStatus := new(AppStatusHandler)
 	appStatus.logger = logger
+	appStatus.currentState = currentState
+	appStatus.hideWhiteList = config.HideWhiteListInStatus()
+	appStatus.maxRunAge = config.MaxRunAge()
+	appStatus.findChefVersion = chefVersion
 	appStatus.state = &AppStatus{
 		ServiceName: "ChefWaiter",
 		Version:     version,
+		GitCommit:   unknownBuildValue,
+		BuildDate:   unknownBuildValue,
 		Healthy:     true,
 		HostName:    hn,
+		Tags:        make(map[string]string),
+	}
+	for key, value := range config.Tags() {
+		appStatus.state.Tags[key] = value
 	}
 	appStatus.setTime()
-	go appStatus.reconcileChefVersion()
+	if boot, err := bootTime(); err != nil {
+		logger.Errorf("Failed to find when the server booted. Error: %s", err)
+	} else {
+		appStatus.state.BootTime = boot
+	}
+	go appStatus.reconcileChefVersion(config.ChefVersionRefreshInterval())
 	go appStatus.maintenanceMode(currentState)
 	go appStatus.lastRun(currentState)
 	go appStatus.locked(currentState)
+	go appStatus.logDiskUsage(chefLogsWorker)
+	go appStatus.persistStatus(currentState)
+	if interval := config.SelfTestInterval(); interval > 0 {
+		appStatus.state.SelfTest = &SelfTest{}
+		go appStatus.selfTest(interval)
+	}
 	return appStatus
 }
 
+// unknownBuildValue is shown for build details that were not set when chef waiter was built.
+const unknownBuildValue = "unknown"
+
+// SetBuildInfo is used to show the git commit and date that chef waiter was built from.
+// Empty values are shown as unknown.
+func (as *AppStatusHandler) SetBuildInfo(gitCommit, buildDate string) {
+	as.Lock()
+	defer as.Unlock()
+	as.state.GitCommit = unknownBuildValue
+	if gitCommit != "" {
+		as.state.GitCommit = gitCommit
+	}
+	as.state.BuildDate = unknownBuildValue
+	if buildDate != "" {
+		as.state.BuildDate = buildDate
+	}
+}
+
 // SetWhiteListing is used to display the whitelist out to the status page.
 func (as *AppStatusHandler) SetWhiteListing(enabled bool, currentList []string) {
+	as.Lock()
+	defer as.Unlock()
 	as.state.WhiteListsEnabled = enabled
 	if enabled {
-		as.state.WhiteList = currentList
+		as.state.WhiteListMatchMode = "exact"
+		as.state.WhiteListCount = len(currentList)
+		if !as.hideWhiteList {
+			as.state.WhiteList = currentList
+		}
 	}
 }
 
@@ -85,10 +190,11 @@ func (as *AppStatusHandler) setTime() {
 }
 
 // This is a looping function that will try to update chef waiter status with the version of chef.
-func (as *AppStatusHandler) reconcileChefVersion() {
-	// do it now and then again every 15 mins.s
+// The version is cached so that reading the status never has to wait for chef.
+func (as *AppStatusHandler) reconcileChefVersion(interval time.Duration) {
+	// do it now and then again every interval.
 	as.updateChefVersion()
-	ticker := time.NewTicker(time.Minute * 15)
+	ticker := time.NewTicker(interval)
 	for {
 		select {
 		case <-ticker.C:
@@ -97,16 +203,70 @@ func (as *AppStatusHandler) reconcileChefVersion() {
 	}
 }
 
+// updateChefVersion will look up the version of chef. If that fails the last version
+// found is kept and the status is only unhealthy if chef has never been found.
 func (as *AppStatusHandler) updateChefVersion() {
-	version, err := chefVersion()
+	version, err := as.findChefVersion()
 	as.Lock()
 	defer as.Unlock()
 	if err != nil {
-		as.logger.Error("Failed to determine chef version.")
-		as.state.Healthy = false
+		as.logger.Warningf("Failed to determine chef version, keeping '%s'. Error: %s", as.state.ChefVersion, err)
+		if as.state.ChefVersion == "" {
+			as.state.Healthy = false
+		}
 		return
 	}
 	as.state.ChefVersion = version
+	as.state.Healthy = true
+}
+
+// selfTest will check that chef-client can be run now and then again every interval.
+// chef-client -v loads chef so a missing gem or bad permissions are found before the
+// next run fails.
+func (as *AppStatusHandler) selfTest(interval time.Duration) {
+	as.runSelfTest(time.Now())
+	ticker := time.NewTicker(interval)
+	for {
+		select {
+		case now := <-ticker.C:
+			as.runSelfTest(now)
+		}
+	}
+}
+
+func (as *AppStatusHandler) runSelfTest(now time.Time) {
+	_, err := as.findChefVersion()
+	as.Lock()
+	defer as.Unlock()
+	result := *as.state.SelfTest
+	result.LastRunTime = now.Unix()
+	if err != nil {
+		result.Passing = false
+		result.ConsecutiveFailures++
+		result.LastError = err.Error()
+		as.logger.Warningf("The chef-client self test failed %d times in a row. Error: %s", result.ConsecutiveFailures, err)
+	} else {
+		result.Passing = true
+		result.ConsecutiveFailures = 0
+		result.LastError = ""
+	}
+	// The status that is being encoded may still point to the old result.
+	as.state.SelfTest = &result
+}
+
+// SelfTestFailure returns why chef waiter is not ready when the self test has failed
+// too many times in a row. It is empty otherwise.
+func (as *AppStatusHandler) SelfTestFailure() string {
+	as.RLock()
+	defer as.RUnlock()
+	if as.state.SelfTest == nil || as.state.SelfTest.ConsecutiveFailures < selfTestFailureLimit {
+		return ""
+	}
+	return fmt.Sprintf(
+		"the chef-client self test has failed %d times in a row: %s",
+		as.state.SelfTest.ConsecutiveFailures,
+		as.state.SelfTest.LastError,
+	)
 }
 
 func (as *AppStatusHandler) maintenanceMode(cs *StateTable) {
@@ -129,14 +289,24 @@ func (as *AppStatusHandler) lastRun(cs *StateTable) {
 	// Do it once then loop
 	as.Lock()
 	as.state.LastRunGUID = cs.ReadLastRunGUID()
+	as.state.LastSuccessfulRunGUID = cs.ReadLastSuccessfulRunGUID()
+	as.state.LastSuccessfulRunTime = cs.ReadLastSuccessfulRunTime()
 	as.Unlock()
 	ticker := time.NewTicker(time.Second * 10)
 	for {
 		select {
 		case <-ticker.C:
+			lastRunGUID := cs.ReadLastRunGUID()
 			as.Lock()
-			as.state.LastRunGUID = cs.ReadLastRunGUID()
+			changed := as.state.LastRunGUID != lastRunGUID
+			as.state.LastRunGUID = lastRunGUID
+			as.state.LastSuccessfulRunGUID = cs.ReadLastSuccessfulRunGUID()
+			as.state.LastSuccessfulRunTime = cs.ReadLastSuccessfulRunTime()
 			as.Unlock()
+			// Chef can upgrade itself during a run so check the version again.
+			if changed {
+				as.updateChefVersion()
+			}
 		}
 	}
 }
@@ -159,9 +329,111 @@ func (as *AppStatusHandler) locked(cs *StateTable) {
 	}
 }
 
+func (as *AppStatusHandler) persistStatus(cs *StateTable) {
+	// Do it once then loop
+	persistFunc := func() {
+		as.Lock()
+		as.state.PersistStatus = cs.ReadPersistStatus()
+		as.Unlock()
+	}
+
+	persistFunc()
+	ticker := time.NewTicker(time.Second * 10)
+	for {
+		select {
+		case <-ticker.C:
+			persistFunc()
+		}
+	}
+}
+
+func (as *AppStatusHandler) logDiskUsage(lw cheflogs.WorkerReader) {
+	// Do it once then loop
+	usageFunc := func() {
+		usage, err := lw.DiskUsage()
+		if err != nil {
+			as.logger.Errorf("Failed to read the disk usage of the chef logs. Error: %s", err)
+			return
+		}
+		as.Lock()
+		as.state.LogDiskUsage = usage
+		as.Unlock()
+	}
+
+	usageFunc()
+	ticker := time.NewTicker(time.Minute)
+	for {
+		select {
+		case <-ticker.C:
+			usageFunc()
+		}
+	}
+}
+
+// Version returns the version of chef waiter.
+func (as *AppStatusHandler) Version() string {
+	as.RLock()
+	defer as.RUnlock()
+	return as.state.Version
+}
+
+// GitCommit returns the git commit that chef waiter was built from.
+func (as *AppStatusHandler) GitCommit() string {
+	as.RLock()
+	defer as.RUnlock()
+	return as.state.GitCommit
+}
+
+// BuildDate returns when chef waiter was built.
+func (as *AppStatusHandler) BuildDate() string {
+	as.RLock()
+	defer as.RUnlock()
+	return as.state.BuildDate
+}
+
+// ChefVersion returns the last version of chef that was found.
+func (as *AppStatusHandler) ChefVersion() string {
+	as.RLock()
+	defer as.RUnlock()
+	return as.state.ChefVersion
+}
+
 // JSONEncoded returns the JSON encoded state with an error if anything goes wrong.
 func (as *AppStatusHandler) JSONEncoded() ([]byte, error) {
 	as.RLock()
 	defer as.RUnlock()
-	return json.MarshalIndent(as.state, "", "  ")
+	status := *as.state
+	if as.currentState != nil {
+		status.ActiveRuns = as.currentState.CountRunningRuns()
+		status.ConsecutiveFailures = as.currentState.ReadFailureStreak()
+		status.SweepStatus = as.currentState.ReadSweepStatus()
+		status.RunOverdue = runOverdue(
+			as.maxRunAge,
+			status.LastSuccessfulRunTime,
+			status.StartTime,
+			as.currentState.ReadMaintenanceTimeEnd(),
+			time.Now(),
+		)
+	}
+	// A run that finished after boot must have started after it too.
+	status.ConvergedSinceBoot = status.BootTime > 0 && status.LastSuccessfulRunTime > status.BootTime
+	return json.MarshalIndent(status, "", "  ")
+}
+
+// runOverdue reports if more than maxRunAge has passed without a successful run.
+// Time in maintenance does not count so the age is taken from the latest of the last
+// successful run, the end of the last maintenance window and, if no run has succeeded
+// yet, when chef waiter started.
+func runOverdue(maxRunAge time.Duration, lastSuccess, startTime, maintenanceEnd int64, now time.Time) bool {
+	if maxRunAge <= 0 || now.Unix() < maintenanceEnd {
+		return false
+	}
+	since := lastSuccess
+	if since == 0 {
+		since = startTime
+	}
+	if maintenanceEnd > since {
+		since = maintenanceEnd
+	}
+	return now.Sub(time.Unix(since, 0)) > maxRunAge
 }
@@ -1,9 +1,15 @@
 package internalstate
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"regexp"
 	"testing"
+	"time"
 
+	"github.com/morfien101/chef-waiter/cheflogs"
+	"github.com/morfien101/chef-waiter/config"
 	"github.com/morfien101/chef-waiter/logs"
 )
 
@@ -21,7 +27,13 @@ func TestWhiteList(t *testing.T) {
 		Status: make(map[string]*JobDetails),
 	}
 	logger := logs.NewFakeLogger(false)
-	appState := NewAppStatus("0.0.1", stateTableMock, logger)
+	appState := NewAppStatus(
+		"0.0.1",
+		&config.ValuesContainer{InternalChefVersionRefresh: 15},
+		stateTableMock,
+		cheflogs.NewFakeChefLogWorker(""),
+		logger,
+	)
 	appState.SetWhiteListing(fc.whitelist, fc.whitelistItems)
 	b, err := appState.JSONEncoded()
 	if err != nil {
@@ -31,6 +43,8 @@ func TestWhiteList(t *testing.T) {
 
 	matchers := []string{
 		`whitelisting_enabled": true`,
+		`whitelist_match_mode": "exact"`,
+		`whitelist_count": 2`,
 		`"recipe\[test\]"`,
 		`"role\[test::something\]"`,
 	}
@@ -48,3 +62,220 @@ func TestWhiteList(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestHideWhiteList(t *testing.T) {
+	appState := NewAppStatus(
+		"0.0.1",
+		&config.ValuesContainer{InternalChefVersionRefresh: 15, InternalHideWhiteList: true},
+		&StateTable{Status: make(map[string]*JobDetails)},
+		cheflogs.NewFakeChefLogWorker(""),
+		logs.NewFakeLogger(false),
+	)
+	appState.SetWhiteListing(true, []string{"recipe[secret]"})
+	b, err := appState.JSONEncoded()
+	if err != nil {
+		t.Fatalf("Failed to JSON encode app state, Error: %s", err)
+	}
+	if bytes.Contains(b, []byte("recipe[secret]")) {
+		t.Errorf("The whitelist entries should be hidden. Current State:\n%s", string(b))
+	}
+	if !regexp.MustCompile(`whitelist_count": 1`).Match(b) {
+		t.Errorf("The whitelist count should still be shown. Current State:\n%s", string(b))
+	}
+}
+
+func TestTags(t *testing.T) {
+	tests := []struct {
+		name string
+		tags map[string]string
+		want string
+	}{
+		{name: "Unconfigured", want: `{}`},
+		{name: "Configured", tags: map[string]string{"dc": "eu-west", "role": "web"}, want: `{"dc":"eu-west","role":"web"}`},
+	}
+
+	for _, test := range tests {
+		appState := NewAppStatus(
+			"0.0.1",
+			&config.ValuesContainer{InternalChefVersionRefresh: 15, InternalTags: test.tags},
+			&StateTable{Status: make(map[string]*JobDetails)},
+			cheflogs.NewFakeChefLogWorker(""),
+			logs.NewFakeLogger(false),
+		)
+		b, err := appState.JSONEncoded()
+		if err != nil {
+			t.Fatalf("%s: failed to JSON encode app state. Error: %s", test.name, err)
+		}
+		status := struct {
+			Tags json.RawMessage `json:"tags"`
+		}{}
+		if err := json.Unmarshal(b, &status); err != nil {
+			t.Fatalf("%s: failed to read the app state. Error: %s", test.name, err)
+		}
+		compact := &bytes.Buffer{}
+		json.Compact(compact, status.Tags)
+		if compact.String() != test.want {
+			t.Errorf("%s: got tags %s, want %s", test.name, compact, test.want)
+		}
+	}
+}
+
+func TestRunCounters(t *testing.T) {
+	st := &StateTable{Status: make(map[string]*JobDetails)}
+	appState := NewAppStatus(
+		"0.0.1",
+		&config.ValuesContainer{InternalChefVersionRefresh: 15},
+		st,
+		cheflogs.NewFakeChefLogWorker(""),
+		logs.NewFakeLogger(false),
+	)
+	st.Status["running"] = &JobDetails{Status: "running"}
+	st.Status["complete"] = &JobDetails{Status: "complete"}
+	st.RecordRunFailure(time.Now(), time.Hour)
+
+	status := &AppStatus{}
+	b, _ := appState.JSONEncoded()
+	if err := json.Unmarshal(b, status); err != nil {
+		t.Fatalf("Failed to read the app state. Error: %s", err)
+	}
+	if status.ActiveRuns != 1 || status.ConsecutiveFailures != 1 {
+		t.Errorf("Status should show 1 active run and 1 failure. Got: %d active, %d failures", status.ActiveRuns, status.ConsecutiveFailures)
+	}
+
+	// The status shows a reset straight away.
+	st.ResetFailureStreak()
+	b, _ = appState.JSONEncoded()
+	if err := json.Unmarshal(b, status); err != nil {
+		t.Fatalf("Failed to read the app state. Error: %s", err)
+	}
+	if status.ConsecutiveFailures != 0 {
+		t.Errorf("Status should show the failures were reset. Got: %d", status.ConsecutiveFailures)
+	}
+}
+
+func TestConvergedSinceBoot(t *testing.T) {
+	tests := []struct {
+		name              string
+		bootTime          int64
+		lastSuccessfulRun int64
+		expect            bool
+	}{
+		{name: "No run since boot", bootTime: 2000, lastSuccessfulRun: 1000},
+		{name: "Run since boot", bootTime: 2000, lastSuccessfulRun: 3000, expect: true},
+		{name: "Boot time unknown", lastSuccessfulRun: 3000},
+	}
+
+	for _, test := range tests {
+		as := &AppStatusHandler{
+			state:  &AppStatus{BootTime: test.bootTime, LastSuccessfulRunTime: test.lastSuccessfulRun},
+			logger: logs.NewFakeLogger(false),
+		}
+		b, err := as.JSONEncoded()
+		if err != nil {
+			t.Fatalf("%s: failed to JSON encode app state. Error: %s", test.name, err)
+		}
+		status := &AppStatus{}
+		if err := json.Unmarshal(b, status); err != nil {
+			t.Fatalf("%s: failed to read the app state. Error: %s", test.name, err)
+		}
+		if status.ConvergedSinceBoot != test.expect {
+			t.Errorf("%s: got converged_since_boot %v, want %v", test.name, status.ConvergedSinceBoot, test.expect)
+		}
+	}
+}
+
+func TestRunOverdue(t *testing.T) {
+	now := time.Unix(100000, 0)
+	hour := int64(time.Hour / time.Second)
+	tests := []struct {
+		name           string
+		maxRunAge      time.Duration
+		lastSuccess    int64
+		startTime      int64
+		maintenanceEnd int64
+		expect         bool
+	}{
+		{name: "Turned off", lastSuccess: now.Unix() - 10*hour},
+		{name: "Recent run", maxRunAge: 2 * time.Hour, lastSuccess: now.Unix() - hour},
+		{name: "Old run", maxRunAge: 2 * time.Hour, lastSuccess: now.Unix() - 3*hour, expect: true},
+		{name: "Never run, just started", maxRunAge: 2 * time.Hour, startTime: now.Unix() - hour},
+		{name: "Never run, started long ago", maxRunAge: 2 * time.Hour, startTime: now.Unix() - 3*hour, expect: true},
+		{name: "In maintenance", maxRunAge: 2 * time.Hour, lastSuccess: now.Unix() - 3*hour, maintenanceEnd: now.Unix() + hour},
+		{name: "Maintenance just ended", maxRunAge: 2 * time.Hour, lastSuccess: now.Unix() - 5*hour, maintenanceEnd: now.Unix() - hour},
+		{name: "Maintenance ended long ago", maxRunAge: 2 * time.Hour, lastSuccess: now.Unix() - 5*hour, maintenanceEnd: now.Unix() - 3*hour, expect: true},
+	}
+
+	for _, test := range tests {
+		if got := runOverdue(test.maxRunAge, test.lastSuccess, test.startTime, test.maintenanceEnd, now); got != test.expect {
+			t.Errorf("%s: got run_overdue %v, want %v", test.name, got, test.expect)
+		}
+	}
+}
+
+func TestUpdateChefVersion(t *testing.T) {
+	as := &AppStatusHandler{
+		state:  &AppStatus{},
+		logger: logs.NewFakeLogger(false),
+	}
+
+	as.findChefVersion = func() (string, error) { return "", errors.New("chef-client not found") }
+	as.updateChefVersion()
+	if as.state.Healthy || as.state.ChefVersion != "" {
+		t.Errorf("Status should be unhealthy when chef has never been found. Got: %+v", as.state)
+	}
+
+	as.findChefVersion = func() (string, error) { return "15.9.100", nil }
+	as.updateChefVersion()
+	if !as.state.Healthy || as.state.ChefVersion != "15.9.100" {
+		t.Errorf("Chef version was not recorded. Got: %+v", as.state)
+	}
+
+	as.findChefVersion = func() (string, error) { return "", errors.New("chef-client timed out") }
+	as.updateChefVersion()
+	if !as.state.Healthy || as.state.ChefVersion != "15.9.100" {
+		t.Errorf("The last known chef version should be kept after a failure. Got: %+v", as.state)
+	}
+}
+
+func TestSelfTest(t *testing.T) {
+	as := &AppStatusHandler{
+		state:  &AppStatus{SelfTest: &SelfTest{}},
+		logger: logs.NewFakeLogger(false),
+	}
+	now := time.Unix(1000, 0)
+
+	as.findChefVersion = func() (string, error) { return "", errors.New("cannot load such file -- chef") }
+	for i := 1; i < selfTestFailureLimit; i++ {
+		as.runSelfTest(now)
+		if reason := as.SelfTestFailure(); reason != "" {
+			t.Errorf("Chef waiter should stay ready after %d failures. Got: %s", i, reason)
+		}
+	}
+	as.runSelfTest(now)
+	if reason := as.SelfTestFailure(); reason == "" {
+		t.Errorf("Chef waiter should not be ready after %d failures", selfTestFailureLimit)
+	}
+	if as.state.SelfTest.Passing || as.state.SelfTest.LastError == "" || as.state.SelfTest.LastRunTime != 1000 {
+		t.Errorf("The failure was not recorded. Got: %+v", as.state.SelfTest)
+	}
+
+	as.findChefVersion = func() (string, error) { return "15.9.100", nil }
+	as.runSelfTest(now)
+	if reason := as.SelfTestFailure(); reason != "" || !as.state.SelfTest.Passing || as.state.SelfTest.ConsecutiveFailures != 0 {
+		t.Errorf("A passing self test should reset the failures. Got: %+v, reason: %s", as.state.SelfTest, reason)
+	}
+
+	off := &AppStatusHandler{state: &AppStatus{}}
+	if reason := off.SelfTestFailure(); reason != "" {
+		t.Errorf("The self test should not fail while it is turned off. Got: %s", reason)
+	}
+}
+
+func TestSetBuildInfo(t *testing.T) {
+	as := &AppStatusHandler{state: &AppStatus{}}
+
+	as.SetBuildInfo("0123abc", "")
+	if as.GitCommit() != "0123abc" || as.BuildDate() != "unknown" {
+		t.Errorf("Build info is wrong. Got commit: %q, date: %q", as.GitCommit(), as.BuildDate())
+	}
+}
@@ -0,0 +1,99 @@
+package internalstate
+
+import (
+	"sort"
+	"time"
+)
+
+// RunStats sums up the runs in the state table that were registered inside of a window.
+// SuccessRate and the durations only count runs that have finished. SuccessRate and
+// LastSuccessAgeSeconds are nil when there is nothing to work them out from.
+type RunStats struct {
+	WindowSeconds          int64          `json:"window_seconds"`
+	Runs                   map[string]int `json:"runs"`
+	TotalRuns              int            `json:"total_runs"`
+	Succeeded              int            `json:"succeeded"`
+	Failed                 int            `json:"failed"`
+	SuccessRate            *float64       `json:"success_rate"`
+	AverageDurationSeconds float64        `json:"average_duration_seconds"`
+	P95DurationSeconds     int64          `json:"p95_duration_seconds"`
+	ConsecutiveFailures    int            `json:"consecutive_failures"`
+	LastSuccessTime        int64          `json:"last_success_time"`
+	LastSuccessAgeSeconds  *int64         `json:"last_success_age_seconds"`
+}
+
+// ReadRunStats will work out the RunStats of the runs registered in the window before now.
+// It is a single pass over the state table under the read lock without copying it. The
+// sweeper holds every run that has ended to state_table_size or failed_state_table_size,
+// so the cost is bounded by those and the runs that are queued or running.
+// ConsecutiveFailures counts the failed runs that finished after the last successful run,
+// whether they are in the window or not.
+func (st *StateTable) ReadRunStats(now time.Time, window time.Duration) RunStats {
+	st.rLock()
+	defer st.rUnlock()
+	stats := RunStats{
+		WindowSeconds:   int64(window / time.Second),
+		Runs:            map[string]int{"demand": 0, "periodic": 0, "custom": 0},
+		LastSuccessTime: st.LastSuccessfulRunTime,
+	}
+	since := now.Add(-window).Unix()
+	lastSuccess := st.LastSuccessfulRunTime
+	failedEndTimes := make([]int64, 0)
+	durations := make([]int64, 0)
+	var totalDuration int64
+	for _, job := range st.Status {
+		switch {
+		case job.Status == "complete" && job.RunEndTime > lastSuccess:
+			lastSuccess = job.RunEndTime
+		case failedRun(job.Status):
+			failedEndTimes = append(failedEndTimes, job.RunEndTime)
+		}
+		if job.RegisteredTime < since {
+			continue
+		}
+		stats.Runs[job.Source]++
+		stats.TotalRuns++
+		switch {
+		case job.Status == "complete":
+			stats.Succeeded++
+		case failedRun(job.Status):
+			stats.Failed++
+		default:
+			continue
+		}
+		if job.RunStartTime > 0 {
+			durations = append(durations, job.DurationSeconds)
+			totalDuration += job.DurationSeconds
+		}
+	}
+
+	for _, end := range failedEndTimes {
+		if end > lastSuccess {
+			stats.ConsecutiveFailures++
+		}
+	}
+	if finished := stats.Succeeded + stats.Failed; finished > 0 {
+		rate := float64(stats.Succeeded) / float64(finished)
+		stats.SuccessRate = &rate
+	}
+	if len(durations) > 0 {
+		stats.AverageDurationSeconds = float64(totalDuration) / float64(len(durations))
+		stats.P95DurationSeconds = percentile(durations, 95)
+	}
+	if st.LastSuccessfulRunTime > 0 {
+		age := now.Unix() - st.LastSuccessfulRunTime
+		stats.LastSuccessAgeSeconds = &age
+	}
+	return stats
+}
+
+// percentile returns the nearest rank percentile p of values. values is sorted in place
+// and must not be empty.
+func percentile(values []int64, p int) int64 {
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+	rank := (p*len(values) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return values[rank-1]
+}
@@ -16,6 +16,16 @@ const statefile = "stateTable.db"
 // GetOldStates - returns all the old state uuids.
 func (st *StateTable) GetOldStates(originalMap map[string]int64) (del []string) {
 	logs.DebugMessage("GetOldStates()")
+	del = oldestStates(originalMap, st.readStateTableSize())
+	logs.DebugMessage(fmt.Sprintf("GetOldStates() returned: %v", del))
+	return del
+}
+
+// oldestStates - returns the guids in originalMap that are older than the newest keep guids.
+func oldestStates(originalMap map[string]int64, keep int) []string {
+	if len(originalMap) <= keep {
+		return []string{}
+	}
 	var states = []Run{}
 	for k, v := range originalMap {
 		states = append(states, Run{k, v})
@@ -33,64 +43,259 @@ func (st *StateTable) GetOldStates(originalMap map[string]int64) (del []string)
 	for i := 0; i <= len(states)-1; i++ {
 		guidSlice = append(guidSlice, states[i].guid)
 	}
-	// return the from position 10
-	// This would give us the 11th+ guids
-	logs.DebugMessage(fmt.Sprintf("GetOldStates() returned: %v", guidSlice[st.readStateTableSize():]))
-	return guidSlice[st.readStateTableSize():]
+	// return the from position keep
+	// This would give us the keep+1th guids onwards
+	return guidSlice[keep:]
+}
+
+// failedRun - returns true for the statuses of runs that did not succeed.
+func failedRun(status string) bool {
+	return status == "failed" || status == "timed_out" || status == "conflicted"
+}
+
+// keptWithFailedRuns - returns true for the statuses of runs that are counted against
+// failed_state_table_size. These are the failed runs along with the runs that never
+// got to finish, as they are all of use for postmortems.
+func keptWithFailedRuns(status string) bool {
+	return failedRun(status) || status == "interrupted" || status == "abandoned"
+}
+
+// sweptRun - returns true for the statuses of runs that are counted against
+// state_table_size and removed once they are too old. A cancelled delayed run never
+// started, so it is kept as long as a run that passed.
+func sweptRun(status string) bool {
+	return status == "complete" || status == "cancelled"
+}
+
+// SweepStatus describes the last time old runs were cleared from the state table.
+// Limited is true when the sweep hit the state_sweep_limit and left old runs for
+// the next sweep.
+type SweepStatus struct {
+	LastSweepTime  int64 `json:"last_state_sweep_time"`
+	RecordsRemoved int   `json:"last_state_sweep_records_removed"`
+	LogsRemoved    int   `json:"last_state_sweep_logs_removed"`
+	Limited        bool  `json:"last_state_sweep_limited"`
 }
 
 // ClearOldRuns - Is used to prevent memory leaking by deleting unneeded states.
 func (st *StateTable) ClearOldRuns() {
-	ticker := time.Tick(1 * time.Minute)
+	if st.inMemory {
+		return
+	}
+	interval := st.sweepInterval
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	ticker := time.Tick(interval)
 	for _ = range ticker {
-		if st.len() > st.readStateTableSize() {
-			logs.DebugMessage(fmt.Sprintf("State Table too large. currently: %d/%d", st.len(), st.readStateTableSize()))
-			oldstates := st.GetOldStates(st.GetAllStateTimes())
-			for _, v := range oldstates {
-				st.RemoveState(v)
-			}
-			// Trigger a log sweep up now that we have removed old states
-			// Should this be passed in to the function rather than be a global
-			st.chefLogsWorker.RequestDelete(st.GetAllStateTimes())
-		} else {
-			logs.DebugMessage(fmt.Sprintf("State Table size: %d/%d", st.len(), st.readStateTableSize()))
-		}
+		st.clearOldRuns(time.Now())
 		metrics.Gauge("state_table_size", int64(st.len()), nil)
 	}
 
 }
 
+// clearOldRuns - removes the oldest states once there are too many of them and then
+// sweeps up their logs, which are only kept for the runs left in the state table.
+// The retention is keyed off the status of each run: failed, interrupted and abandoned
+// runs are counted against failed_state_table_size and the others against
+// state_table_size. Both are the
+// state_table_size unless failed_state_table_size is set.
+// No more than the sweep limit are removed so that a huge state table does not hold
+// the lock for long. What is left is removed by the following sweeps.
+func (st *StateTable) clearOldRuns(now time.Time) {
+	succeeded, failed := st.getStateTimesByResult()
+	oldStates := st.GetOldStates(succeeded)
+	oldFailedStates := oldestStates(failed, st.readFailedStateTableSize())
+	// Only these are removed so the limit is only spent on them.
+	oldStates = st.withStatus(oldStates, sweptRun)
+	oldFailedStates = st.withStatus(oldFailedStates, keptWithFailedRuns)
+	sweep := SweepStatus{LastSweepTime: now.Unix()}
+	if limit := st.sweepLimit; limit > 0 && len(oldStates)+len(oldFailedStates) > limit {
+		sweep.Limited = true
+		// The lists are newest first so the oldest are kept for removal. Runs that passed
+		// go before failed runs as the failed runs are more use for postmortems.
+		if len(oldStates) > limit {
+			oldStates = oldStates[len(oldStates)-limit:]
+		}
+		limit -= len(oldStates)
+		oldFailedStates = oldFailedStates[len(oldFailedStates)-limit:]
+	}
+	defer func() { st.setSweepStatus(sweep) }()
+	if len(oldStates)+len(oldFailedStates) == 0 {
+		logs.DebugMessage(fmt.Sprintf("State Table size: %d/%d", st.len(), st.readStateTableSize()))
+		// The logs can go over the disk budget without any runs being old.
+		sweep.LogsRemoved = st.chefLogsWorker.KeepToDiskBudget()
+		return
+	}
+
+	before := st.len()
+	logs.DebugMessage(fmt.Sprintf("State Table too large. currently: %d/%d", before, st.readStateTableSize()))
+	for _, v := range oldStates {
+		st.RemoveState(v)
+	}
+	for _, v := range oldFailedStates {
+		st.removeFailedState(v)
+	}
+	sweep.RecordsRemoved = before - st.len()
+	if sweep.Limited {
+		st.logger.Warningf("Removed %d old runs from the state table. More are left for the next sweep as the state_sweep_limit was reached", sweep.RecordsRemoved)
+	}
+	// Sweep up the logs now that we have removed old states
+	removed, err := st.chefLogsWorker.SweepLogs(st.GetAllStateTimes())
+	if err != nil {
+		st.logger.Errorf("Failed to sweep the logs of old runs. Error: %s", err)
+	}
+	sweep.LogsRemoved = removed
+}
+
+// withStatus - returns the guids, in the same order, of the runs whose status passes check.
+func (st *StateTable) withStatus(guids []string, check func(status string) bool) []string {
+	st.rLock()
+	defer st.rUnlock()
+	matched := []string{}
+	for _, guid := range guids {
+		if job, ok := st.Status[guid]; ok && check(job.Status) {
+			matched = append(matched, guid)
+		}
+	}
+	return matched
+}
+
+func (st *StateTable) setSweepStatus(sweep SweepStatus) {
+	st.lock()
+	defer st.unlock()
+	st.sweepStatus = sweep
+}
+
+// ReadSweepStatus will return how the last sweep of old runs went.
+func (st *StateTable) ReadSweepStatus() SweepStatus {
+	st.rLock()
+	defer st.rUnlock()
+	return st.sweepStatus
+}
+
+const (
+	// persistInterval is how often the state is saved to disk.
+	persistInterval = time.Minute
+	// persistRetryDelay is how long to wait before the first retry of a failed save.
+	// Each retry after that waits twice as long, up to persistInterval.
+	persistRetryDelay = 5 * time.Second
+	// persistUnreadyAfter is how long saves have to keep failing before chef waiter
+	// reports that it is not ready.
+	persistUnreadyAfter = 5 * time.Minute
+)
+
+// PersistStatus describes how saving the state to disk is going.
+type PersistStatus struct {
+	LastError     string `json:"last_persist_error"`
+	LastErrorTime int64  `json:"last_persist_error_time"`
+	// FailingSince is the epoch time of the first failure in the current run of
+	// failures. It is 0 when the last save worked.
+	FailingSince int64 `json:"persist_failing_since"`
+}
+
 // PersistState - will call the SaveStateToDisk at a time interval.
+// Failed saves are retried sooner with a backoff.
 // This is designed to be run as a go func
 func (st *StateTable) PersistState() {
-	ticker := time.Tick(1 * time.Minute)
-	for _ = range ticker {
-		err := st.SaveStateToDisk()
-		if err != nil {
-			st.logger.Errorf("SaveStateToDisk error: %s", err)
+	if st.inMemory {
+		return
+	}
+	delay := persistInterval
+	var retryDelay time.Duration
+	for {
+		time.Sleep(delay)
+		if err := st.SaveStateToDisk(); err != nil {
+			retryDelay = nextPersistRetry(retryDelay)
+			delay = retryDelay
+			continue
 		}
+		retryDelay = 0
+		delay = persistInterval
+	}
+}
+
+// nextPersistRetry - returns how long to wait before retrying a failed save given
+// how long was waited before the last retry. 0 means that there has not been a retry yet.
+func nextPersistRetry(lastRetry time.Duration) time.Duration {
+	if lastRetry == 0 {
+		return persistRetryDelay
 	}
+	if lastRetry*2 > persistInterval {
+		return persistInterval
+	}
+	return lastRetry * 2
 }
 
 // SaveStateToDisk - will save the CurrentState to a file on disk.
+// The outcome is recorded so that it can be seen with ReadPersistStatus.
+// In memory state tables are not saved.
 func (st *StateTable) SaveStateToDisk() error {
+	if st.inMemory {
+		return nil
+	}
+	err := st.saveStateToDisk()
+	st.recordPersistResult(err, time.Now())
+	return err
+}
+
+func (st *StateTable) saveStateToDisk() error {
 	logs.DebugMessage(fmt.Sprintf("SaveStateToDisk(%s)", st.readStateFilePath()))
 	f, err := os.Create(st.readStateFilePath())
 	if err != nil {
 		st.logger.Errorf("Failed to create the statefile. Error was: %s", err)
 		return err
 	}
-	defer f.Close()
 	err = st.flushToDisk(f)
 	if err != nil {
-		st.logger.Error(err)
+		f.Close()
+		st.logger.Errorf("Failed to write the statefile. Error was: %s", err)
+		return err
+	}
+	// A full disk can only show up when the file is closed.
+	if err := f.Close(); err != nil {
+		st.logger.Errorf("Failed to write the statefile. Error was: %s", err)
 		return err
 	}
 	return nil
 }
 
+// recordPersistResult - keeps track of failed saves.
+func (st *StateTable) recordPersistResult(err error, now time.Time) {
+	st.lock()
+	defer st.unlock()
+	if err == nil {
+		if st.persistStatus.FailingSince != 0 {
+			st.logger.Info("Saving the state to disk is working again")
+		}
+		st.persistStatus.FailingSince = 0
+		return
+	}
+	st.persistStatus.LastError = err.Error()
+	st.persistStatus.LastErrorTime = now.Unix()
+	if st.persistStatus.FailingSince == 0 {
+		st.persistStatus.FailingSince = now.Unix()
+	}
+}
+
+// ReadPersistStatus - returns how saving the state to disk is going.
+func (st *StateTable) ReadPersistStatus() PersistStatus {
+	st.rLock()
+	defer st.rUnlock()
+	return st.persistStatus
+}
+
+// PersistFailing - returns true if saving the state to disk has been failing for
+// long enough that history is at risk.
+func (st *StateTable) PersistFailing(now time.Time) bool {
+	status := st.ReadPersistStatus()
+	return status.FailingSince != 0 && now.Sub(time.Unix(status.FailingSince, 0)) >= persistUnreadyAfter
+}
+
 // readStateFromDisk - Will read the state from the disk if the file is there.
+// Older state files are migrated to the current schema version.
 // It will then pass it to the linter and then put the state in the StateTable.
+// Registered runs are left as they are so that they can be queued again.
 // It will be a copy of the current state from the reboot.
 func readStateFromDisk(stateFile string, logger logs.SysLogger) (*StateTable, error) {
 	// Open the file and check if it exists.
@@ -99,6 +304,7 @@ func readStateFromDisk(stateFile string, logger logs.SysLogger) (*StateTable, er
 		logger.Error(err)
 		return nil, err
 	}
+	defer f.Close()
 	// Decode the file and check if the decodeing works.
 	dec := gob.NewDecoder(f)
 	var data *StateTable
@@ -106,6 +312,29 @@ func readStateFromDisk(stateFile string, logger logs.SysLogger) (*StateTable, er
 	if err != nil {
 		return nil, err
 	}
+	// Upgrade state written by older versions of chef waiter. The file on disk is
+	// backed up first as it will be overwritten in the new layout on the next save.
+	fileVersion := data.SchemaVersion
+	migrated, err := migrateState(data)
+	if err != nil {
+		if backupPath, backupErr := backupStateFile(stateFile, fileVersion); backupErr == nil {
+			logger.Warningf("The state file was backed up to %s", backupPath)
+		}
+		return nil, err
+	}
+	if migrated {
+		backupPath, err := backupStateFile(stateFile, fileVersion)
+		if err != nil {
+			logger.Warningf("Failed to back up the state file before upgrading it. Error: %s", err)
+		} else {
+			logger.Infof(
+				"Upgraded the state file from schema version %d to %d. The old state file was backed up to %s",
+				fileVersion,
+				data.SchemaVersion,
+				backupPath,
+			)
+		}
+	}
 	// Pass the data to the linter to check for running jobs.
 	data.Status = lintState(data.Status)
 	// We need to inject a mutex into it as it is not exported when we encode it to disk
@@ -117,13 +346,14 @@ func readStateFromDisk(stateFile string, logger logs.SysLogger) (*StateTable, er
 	return data, nil
 }
 
+// lintState marks the runs that were running when chef waiter stopped as interrupted.
+// They are not run again as it is not known how far they got. Older versions left these
+// runs as unknown. The sweeper keeps interrupted runs with the failed runs.
 func lintState(statusList map[string]*JobDetails) map[string]*JobDetails {
 	for k := range statusList {
-		if statusList[k].Status == "running" {
-			statusList[k].Status = "unknown"
-		}
-		if statusList[k].Status == "registered" {
-			statusList[k].Status = "abandoned"
+		if statusList[k].Status == "running" || statusList[k].Status == "unknown" {
+			statusList[k].Status = "interrupted"
+			statusList[k].StatusReason = "chef waiter stopped while the run was running"
 		}
 	}
 	return statusList
@@ -1,8 +1,19 @@
 package internalstate
 
 import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
 	"testing"
+	"time"
 
+	"github.com/morfien101/chef-waiter/cheflogs"
+	"github.com/morfien101/chef-waiter/config"
 	"github.com/morfien101/chef-waiter/logs"
 	uuid "github.com/satori/go.uuid"
 )
@@ -38,6 +49,73 @@ func TestGetOldStates(t *testing.T) {
 	}
 }
 
+func TestClearOldRuns(t *testing.T) {
+	newState := func(failedSize, sweepLimit int) *StateTable {
+		st := &StateTable{
+			Status:               make(map[string]*JobDetails),
+			StateTableSize:       2,
+			failedStateTableSize: failedSize,
+			sweepLimit:           sweepLimit,
+			chefLogsWorker:       cheflogs.NewFakeChefLogWorker(""),
+			logger:               logs.NewFakeLogger(false),
+		}
+		for i := 1; i <= 4; i++ {
+			st.Status[fmt.Sprintf("complete%d", i)] = &JobDetails{Status: "complete", RegisteredTime: int64(i + 10)}
+			st.Status[fmt.Sprintf("failed%d", i)] = &JobDetails{Status: "failed", RegisteredTime: int64(i + 2)}
+		}
+		// An old cancelled run is counted with the runs that passed and old interrupted
+		// and abandoned runs with the failed runs.
+		st.Status["cancelled"] = &JobDetails{Status: "cancelled", RegisteredTime: 5}
+		st.Status["interrupted"] = &JobDetails{Status: "interrupted", RegisteredTime: 1}
+		st.Status["abandoned"] = &JobDetails{Status: "abandoned", RegisteredTime: 2}
+		return st
+	}
+
+	tests := []struct {
+		name        string
+		failedSize  int
+		sweepLimit  int
+		want        []string
+		wantLimited bool
+	}{
+		{
+			name:       "Failed retention defaults to the state table size",
+			failedSize: 0,
+			want:       []string{"complete3", "complete4", "failed3", "failed4"},
+		},
+		{
+			name:       "Failed retention",
+			failedSize: 3,
+			want:       []string{"complete3", "complete4", "failed2", "failed3", "failed4"},
+		},
+		{
+			name:        "Limited sweep",
+			failedSize:  1,
+			sweepLimit:  5,
+			want:        []string{"complete3", "complete4", "failed1", "failed2", "failed3", "failed4"},
+			wantLimited: true,
+		},
+	}
+
+	now := time.Unix(1500000000, 0)
+	for _, test := range tests {
+		st := newState(test.failedSize, test.sweepLimit)
+		st.clearOldRuns(now)
+		got := []string{}
+		for guid := range st.Status {
+			got = append(got, guid)
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s kept the wrong runs. Got: %v, Want: %v", test.name, got, test.want)
+		}
+		sweep := st.ReadSweepStatus()
+		if sweep.LastSweepTime != now.Unix() || sweep.RecordsRemoved != 11-len(test.want) || sweep.Limited != test.wantLimited {
+			t.Errorf("%s recorded the wrong sweep status. Got: %+v", test.name, sweep)
+		}
+	}
+}
+
 func TestReadAllJobs(t *testing.T) {
 	st := &StateTable{
 		Status: map[string]*JobDetails{
@@ -75,3 +153,214 @@ func TestReadAllJobs(t *testing.T) {
 		t.Fail()
 	}
 }
+
+// jobDetailsV0 and stateTableV0 are the layout of the state file before it was versioned.
+func TestLintState(t *testing.T) {
+	st := &StateTable{
+		Status: map[string]*JobDetails{
+			"running":    {Status: "running", RegisteredTime: 1},
+			"unknown":    {Status: "unknown", RegisteredTime: 2},
+			"registered": {Status: "registered", RegisteredTime: 3},
+			"failed":     {Status: "failed", RegisteredTime: 4},
+		},
+		StateTableSize:       1,
+		failedStateTableSize: 1,
+		chefLogsWorker:       cheflogs.NewFakeChefLogWorker(""),
+		logger:               logs.NewFakeLogger(false),
+	}
+	st.Status = lintState(st.Status)
+	for guid, want := range map[string]string{"running": "interrupted", "unknown": "interrupted", "registered": "registered", "failed": "failed"} {
+		if got := st.Status[guid].Status; got != want {
+			t.Errorf("%s has the wrong status after linting. Got: %s, Want: %s", guid, got, want)
+		}
+	}
+
+	// The interrupted runs are swept like the failed runs.
+	st.clearOldRuns(time.Unix(1500000000, 0))
+	got := []string{}
+	for guid := range st.Status {
+		got = append(got, guid)
+	}
+	sort.Strings(got)
+	if want := []string{"failed", "registered"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Interrupted runs were not swept. Got: %v, Want: %v", got, want)
+	}
+}
+
+type jobDetailsV0 struct {
+	Status          string
+	ExitCode        int
+	RegisteredTime  int64
+	OnDemand        bool
+	CustomRun       bool
+	CustomRunString string
+}
+
+type stateTableV0 struct {
+	Status             map[string]*jobDetailsV0
+	LastRunStartTime   int64
+	LastRunGUID        string
+	ChefRunTimer       int64
+	PeriodicRuns       bool
+	StateTableSize     int
+	MaintenanceTimeEnd int64
+	Locked             bool
+	StateFilePath      string
+}
+
+func TestMigrateV0StateFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chefwaiter_state")
+	if err != nil {
+		t.Fatalf("Failed to create a temp directory. Error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	stateFile := filepath.Join(dir, statefile)
+
+	v0 := &stateTableV0{
+		Status: map[string]*jobDetailsV0{
+			"periodic": &jobDetailsV0{Status: "complete", ExitCode: 0, RegisteredTime: 10},
+			"demand":   &jobDetailsV0{Status: "running", ExitCode: 99, RegisteredTime: 20, OnDemand: true},
+			"custom":   &jobDetailsV0{Status: "failed", ExitCode: 1, RegisteredTime: 30, OnDemand: true, CustomRun: true, CustomRunString: "recipe[test]"},
+		},
+		LastRunStartTime: 1500000000,
+		LastRunGUID:      "custom",
+		StateTableSize:   20,
+		Locked:           true,
+	}
+	buf := &bytes.Buffer{}
+	if err := gob.NewEncoder(buf).Encode(v0); err != nil {
+		t.Fatalf("Failed to encode a v0 state. Error: %s", err)
+	}
+	if err := ioutil.WriteFile(stateFile, buf.Bytes(), 0644); err != nil {
+		t.Fatalf("Failed to write a v0 state file. Error: %s", err)
+	}
+
+	st, err := readStateFromDisk(stateFile, logs.NewFakeLogger(false))
+	if err != nil {
+		t.Fatalf("Failed to read a v0 state file. Error: %s", err)
+	}
+	if st.SchemaVersion != currentSchemaVersion {
+		t.Errorf("State was not upgraded. Got version: %d, Want: %d", st.SchemaVersion, currentSchemaVersion)
+	}
+	if st.LastRunGUID != "custom" || !st.Locked || len(st.Status) != 3 {
+		t.Errorf("State was lost during the upgrade. Got: %+v", st)
+	}
+	if st.LastPeriodicRunStartTime != 1500000000 {
+		t.Errorf("Periodic runs should be scheduled from the old last run start time. Got: %d", st.LastPeriodicRunStartTime)
+	}
+	for guid, want := range map[string]string{"periodic": "periodic", "demand": "demand", "custom": "custom"} {
+		if st.Status[guid].Source != want {
+			t.Errorf("%s has the wrong source. Got: %q, Want: %q", guid, st.Status[guid].Source, want)
+		}
+	}
+	if st.Status["demand"].Status != "interrupted" {
+		t.Errorf("Running jobs should still be linted. Got: %s", st.Status["demand"].Status)
+	}
+	if st.Status["custom"].CustomRunString != "recipe[test]" || st.Status["custom"].ExitCode != 1 {
+		t.Errorf("Job details were lost during the upgrade. Got: %+v", st.Status["custom"])
+	}
+
+	backup, err := ioutil.ReadFile(stateFile + ".v0.bak")
+	if err != nil {
+		t.Fatalf("The v0 state file was not backed up. Error: %s", err)
+	}
+	if !bytes.Equal(backup, buf.Bytes()) {
+		t.Errorf("The backup does not match the original state file")
+	}
+}
+
+func TestMigrateNewerState(t *testing.T) {
+	st := &StateTable{SchemaVersion: currentSchemaVersion + 1}
+	if _, err := migrateState(st); err == nil {
+		t.Errorf("State from a newer chef waiter should not be loaded")
+	}
+
+	st = &StateTable{SchemaVersion: currentSchemaVersion}
+	migrated, err := migrateState(st)
+	if err != nil || migrated {
+		t.Errorf("Current state should not be migrated. Got migrated: %t, error: %v", migrated, err)
+	}
+}
+
+func TestPersistStatus(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chefwaiter_state")
+	if err != nil {
+		t.Fatalf("Failed to create a temp directory. Error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	st := &StateTable{
+		Status:        make(map[string]*JobDetails),
+		StateFilePath: filepath.Join(dir, "missing", statefile),
+		logger:        logs.NewFakeLogger(false),
+	}
+
+	if err := st.SaveStateToDisk(); err == nil {
+		t.Fatalf("Saving to a directory that does not exist should fail")
+	}
+	status := st.ReadPersistStatus()
+	if status.LastError == "" || status.FailingSince == 0 {
+		t.Errorf("The failure was not recorded. Got: %+v", status)
+	}
+	failedAt := time.Unix(status.FailingSince, 0)
+	if st.PersistFailing(failedAt.Add(time.Minute)) {
+		t.Errorf("A short run of failures should not count as failing")
+	}
+	if !st.PersistFailing(failedAt.Add(persistUnreadyAfter)) {
+		t.Errorf("A long run of failures should count as failing")
+	}
+
+	st.StateFilePath = filepath.Join(dir, statefile)
+	if err := st.SaveStateToDisk(); err != nil {
+		t.Fatalf("Failed to save the state. Error: %s", err)
+	}
+	status = st.ReadPersistStatus()
+	if status.FailingSince != 0 || status.LastError == "" {
+		t.Errorf("A working save should clear FailingSince but keep the last error. Got: %+v", status)
+	}
+	if st.PersistFailing(failedAt.Add(persistUnreadyAfter)) {
+		t.Errorf("Saving should not count as failing once it works again")
+	}
+}
+
+func TestInMemoryStateTable(t *testing.T) {
+	st := NewInMemory(
+		&config.ValuesContainer{InternalStateTableSize: 10, InternalPeriodicTimer: 30},
+		cheflogs.NewFakeChefLogWorker(""),
+		logs.NewFakeLogger(false),
+	)
+	_, guid := st.RegisterRun(true, false, "", RunOptions{})
+	if len(st.Read(guid)) != 1 {
+		t.Fatalf("The run was not registered")
+	}
+	if st.ReadChefRunTimer() != 30*60 {
+		t.Errorf("The config was not used. Got run timer: %d", st.ReadChefRunTimer())
+	}
+
+	// None of these should block or touch the disk.
+	st.PersistState()
+	st.ClearOldRuns()
+	if err := st.SaveStateToDisk(); err != nil {
+		t.Errorf("Saving an in memory state table should do nothing. Error: %s", err)
+	}
+	if st.Dump().StateFilePath != "" {
+		t.Errorf("An in memory state table should not have a state file. Got: %s", st.Dump().StateFilePath)
+	}
+}
+
+func TestNextPersistRetry(t *testing.T) {
+	tests := []struct {
+		name      string
+		lastRetry time.Duration
+		want      time.Duration
+	}{
+		{name: "First failure", lastRetry: 0, want: persistRetryDelay},
+		{name: "Second failure", lastRetry: persistRetryDelay, want: 2 * persistRetryDelay},
+		{name: "Capped", lastRetry: 40 * time.Second, want: persistInterval},
+		{name: "Stays capped", lastRetry: persistInterval, want: persistInterval},
+	}
+	for _, test := range tests {
+		if got := nextPersistRetry(test.lastRetry); got != test.want {
+			t.Errorf("%s: got delay %s, want %s", test.name, got, test.want)
+		}
+	}
+}
@@ -4,9 +4,12 @@ import (
 	"encoding/gob"
 	"fmt"
 	"io"
+	"math/rand"
+	"sort"
 	"sync"
 	"time"
 
+	"github.com/robfig/cron/v3"
 	uuid "github.com/satori/go.uuid"
 
 	"github.com/morfien101/chef-waiter/cheflogs"
@@ -15,11 +18,16 @@ import (
 )
 
 // JobDetails - Holds data about individual runs.
-// Status can be one of the following: registered, running, complete, unknown, abandoned
-// unknown: is set if the data is read from a static state file on start up and the
-// job was previously set to running.
-// abandoned: is set if the data is read from a static state file on start up and the
-// job was previously set to registered.
+// Status can be one of the following: registered, running, complete, failed, timed_out,
+// conflicted, interrupted, abandoned, cancelled
+// interrupted: is set if the data is read from a static state file on start up and the
+// job was previously set to running. It is not run again.
+// abandoned: is set if a queued periodic run could no longer start.
+// conflicted: is set if another chef-client held the chef_lock_file when the run started.
+// cancelled: is set if a delayed run was cancelled before it started.
+// Jobs that are still registered when read from a static state file on start up are
+// queued again. State files from older versions can also hold unknown jobs, which were
+// running when chef waiter stopped. They are marked as interrupted too.
 type JobDetails struct {
 	Status          string `json:"status"`
 	ExitCode        int    `json:"exitcode"`
@@ -27,6 +35,74 @@ type JobDetails struct {
 	OnDemand        bool   `json:"ondemand"`
 	CustomRun       bool   `json:"custom_run"`
 	CustomRunString string `json:"custom_run_string"`
+	StatusReason    string `json:"status_reason,omitempty"`
+	// Source is one of demand, periodic or custom.
+	Source string `json:"source"`
+	// RunStartTime and RunEndTime are epoch times of when the run started and finished.
+	// They are 0 until the run gets to that point.
+	RunStartTime int64 `json:"run_start_time"`
+	RunEndTime   int64 `json:"run_end_time"`
+	// QueuedDurationSeconds is how long the run waited to start after it was registered.
+	// DurationSeconds is how long the run took from starting to finishing.
+	// They tell a backed up node apart from a slow chef run.
+	QueuedDurationSeconds int64 `json:"queued_duration_seconds"`
+	DurationSeconds       int64 `json:"duration_seconds"`
+	// ResourcesUpdated and ResourcesTotal come from the chef-client summary at the end
+	// of the run. They are 0 if the summary could not be found.
+	ResourcesUpdated int `json:"resources_updated"`
+	ResourcesTotal   int `json:"resources_total"`
+	// Attempt is the attempt that chef is on, or finished on, for runs that can be retried.
+	// AttemptExitCodes holds the exit code of each attempt that has finished.
+	Attempt          int   `json:"attempt,omitempty"`
+	AttemptExitCodes []int `json:"attempt_exit_codes,omitempty"`
+	// LogTruncated is true if the log hit max_log_size_mb and the rest of the output was dropped.
+	LogTruncated bool `json:"log_truncated,omitempty"`
+	// ExecutedCommand is the command and arguments that were run. The environment given
+	// to the command is not part of it so that secrets in it are not shown.
+	ExecutedCommand []string `json:"executed_command,omitempty"`
+	RunOptions
+	// released is set once a delayed run is due and has been queued. It can not be
+	// cancelled after that.
+	released bool
+}
+
+// RunOptions holds settings that a caller asked for on a single run.
+type RunOptions struct {
+	// ExtraFlags are passed to chef-client after the other arguments.
+	// They have been checked against the allowed extra flags before getting here.
+	ExtraFlags []string `json:"extra_flags,omitempty"`
+	// Label is free form text, like a change ticket number, to tie the run to
+	// something outside of chef waiter. It does not change how the run is made.
+	Label string `json:"label,omitempty"`
+	// Retry asks for a failed on demand or custom run to be retried like a periodic run.
+	Retry bool `json:"retry,omitempty"`
+	// RunAs is the user that a custom run is run as. It has been checked against the
+	// allowed run as users. Empty means the user that chef waiter runs as.
+	RunAs string `json:"run_as,omitempty"`
+	// Reason is why a custom run was asked for. Some whitelisted custom runs require one.
+	// Like the label it does not change how the run is made.
+	Reason string `json:"reason,omitempty"`
+	// NodeName is passed to chef-client with -N so that a custom run is made as a
+	// different node. Empty means the node name from the chef configuration.
+	NodeName string `json:"node_name,omitempty"`
+	// ScheduledStart is the epoch time that a delayed run is held back until. It is 0
+	// for runs that start as soon as they can.
+	ScheduledStart int64 `json:"scheduled_start,omitempty"`
+}
+
+// equal reports if two sets of options would make the same run.
+// The label and reason are not compared as they do not change the run.
+func (o RunOptions) equal(other RunOptions) bool {
+	if len(o.ExtraFlags) != len(other.ExtraFlags) {
+		return false
+	}
+	for i := range o.ExtraFlags {
+		if o.ExtraFlags[i] != other.ExtraFlags[i] {
+			return false
+		}
+	}
+	return o.Retry == other.Retry && o.RunAs == other.RunAs && o.NodeName == other.NodeName &&
+		o.ScheduledStart == other.ScheduledStart
 }
 
 // TODO - Switch to using this for status of runs.
@@ -41,22 +117,99 @@ type JobDetails struct {
 // StateTable - holds the state map and sync functions.
 type StateTable struct {
 	mutexLock sync.RWMutex
-	Status    map[string]*JobDetails
+	// SchemaVersion is the version of the layout of the persisted state.
+	// See migrateState for how older state files are upgraded.
+	SchemaVersion int
+	Status        map[string]*JobDetails
 	// Used to hold the epoch time when chef last run and completed good or bad.
 	LastRunStartTime int64
-	LastRunGUID      string
-	ChefRunTimer     int64
-	PeriodicRuns     bool
+	// LastPeriodicRunStartTime is when the last periodic run started. Periodic runs are
+	// scheduled from it so that on demand and custom runs do not move them.
+	LastPeriodicRunStartTime int64
+	LastRunGUID              string
+	// The last run that exited with 0. Both are empty if no run has succeeded.
+	LastSuccessfulRunGUID string
+	LastSuccessfulRunTime int64
+	ChefRunTimer          int64
+	PeriodicRuns          bool
 	// This should be changed to StateTableMaxSize
 	StateTableSize     int
 	MaintenanceTimeEnd int64
 	Locked             bool
-	StateFilePath      string
+	LockedBy           string
+	LockedTime         int64
+	// LockReason says why the lock was set. AutoLocked is true if chef waiter set
+	// the lock itself after runs kept failing.
+	LockReason    string
+	AutoLocked    bool
+	StateFilePath string
 
+	// coalesceWindow is how many seconds after being registered a running job can
+	// be handed out again for an identical run request.
+	coalesceWindow int64
+	// failedStateTableSize is how many failed runs are kept. StateTableSize is how
+	// many of the other finished runs are kept. 0 means the same as StateTableSize.
+	failedStateTableSize int
+	// runSchedule is when periodic runs happen if a run_schedule is configured.
+	// It is nil when periodic runs happen on the ChefRunTimer interval.
+	runSchedule     cron.Schedule
+	runScheduleSpec string
+	// firstPeriodicRunTime is the epoch time before which no periodic run starts after
+	// chef waiter starts. It comes from the startup delay and splay.
+	firstPeriodicRunTime int64
+	// periodicCooldown is the seconds after any run finishes before a periodic run can start.
+	periodicCooldown int64
+	// failureStreak holds when the runs in the current streak of failures finished.
+	// It is used to lock runs automatically and is not saved to disk.
+	failureStreak []time.Time
+	// persistStatus tracks failures to save the state to disk.
+	persistStatus PersistStatus
+	// sweepInterval is how often old runs are cleared and sweepLimit is the most that
+	// are removed in one go. 0 means there is no limit.
+	sweepInterval time.Duration
+	sweepLimit    int
+	sweepStatus   SweepStatus
+	// inMemory state tables are never saved to disk or swept. See NewInMemory.
+	inMemory       bool
 	chefLogsWorker cheflogs.WorkerWriter
 	logger         logs.SysLogger
 }
 
+// LockDetails describes who set the run lock and when.
+type LockDetails struct {
+	Locked     bool
+	LockedBy   string
+	LockedTime int64
+	Reason     string
+	AutoLocked bool
+}
+
+// StateDump is a copy of everything held in the state table. It is used to debug state issues.
+type StateDump struct {
+	SchemaVersion            int                   `json:"schema_version"`
+	Runs                     map[string]JobDetails `json:"runs"`
+	LastRunStartTime         int64                 `json:"last_run_start_time"`
+	LastPeriodicRunStartTime int64                 `json:"last_periodic_run_start_time"`
+	LastRunGUID              string                `json:"last_run_guid"`
+	LastSuccessfulRunGUID    string                `json:"last_successful_run_guid"`
+	LastSuccessfulRunTime    int64                 `json:"last_successful_run_time"`
+	ChefRunTimer             int64                 `json:"chef_run_timer"`
+	RunSchedule              string                `json:"run_schedule"`
+	PeriodicRuns             bool                  `json:"periodic_runs"`
+	StateTableSize           int                   `json:"state_table_size"`
+	FailedStateTableSize     int                   `json:"failed_state_table_size"`
+	CoalesceWindow           int64                 `json:"coalesce_window"`
+	MaintenanceTimeEnd       int64                 `json:"maintenance_time_end"`
+	Locked                   bool                  `json:"locked"`
+	LockedBy                 string                `json:"locked_by"`
+	LockedTime               int64                 `json:"locked_time"`
+	LockReason               string                `json:"lock_reason"`
+	AutoLocked               bool                  `json:"auto_locked"`
+	ConsecutiveFailures      int                   `json:"consecutive_failures"`
+	StateFilePath            string                `json:"state_file_path"`
+	PersistStatus
+}
+
 // StateTableReadWriter describes functions that both read and write on the statetable
 type StateTableReadWriter interface {
 	StateTableReader
@@ -69,30 +222,59 @@ type StateTableReader interface {
 	ReadAll() map[string]*JobDetails
 	IsDemandJob(string) bool
 	IsCustomJob(string) (bool, string)
+	ReadRunOptions(string) RunOptions
 	GetAllStateTimes() map[string]int64
 	GetlastRunStartTime() int64
 	ReadChefRunTimer() int64
+	ReadRunSchedule() string
+	NextPeriodicRunTime() int64
 	ReadPeriodicRuns() bool
 	ReadLastRunGUID() string
+	ReadLastSuccessfulRunGUID() string
+	ReadLastSuccessfulRunTime() int64
 	ReadAllJobs() map[string]JobDetails
+	ReadPendingRuns() []string
+	CountRunningRuns() int
 	ReadRunLock() bool
+	ReadLockDetails() LockDetails
+	ReadFailureStreak() int
 	InMaintenceMode() bool
 	ReadMaintenanceTimeEnd() int64
+	ReadPersistStatus() PersistStatus
+	ReadSweepStatus() SweepStatus
+	ReadRunStats(time.Time, time.Duration) RunStats
+	PersistFailing(time.Time) bool
+	Dump() StateDump
 }
 
 // StateTableWriter describes the functions to write data to the state table.
 type StateTableWriter interface {
 	Add(string, bool)
-	RegisterRun(bool, bool, string) (bool, string)
+	RegisterRun(bool, bool, string, RunOptions) (bool, string)
 	UpdateStatus(string, string)
 	UpdateExitCode(string, int)
+	UpdateStatusReason(string, string)
+	UpdateLogTruncated(string, bool)
+	UpdateResources(string, int, int)
+	UpdateExecutedCommand(string, []string)
+	UpdateAttempt(string, int)
+	AddAttemptExitCode(string, int)
 	RemoveState(string)
+	RemoveFinishedStates() int
 	UpdatelastRunStartTime(int64)
+	UpdateLastPeriodicRunStartTime(int64)
 	WriteChefRunTimer(int64)
 	WritePeriodicRuns(bool)
 	WriteLastRunGUID(string)
+	WriteLastSuccessfulRun(string, int64)
 	WriteMaintenanceTimeEnd(int64)
 	LockRuns(bool)
+	LockRunsBy(string)
+	AutoLockRuns(string)
+	RecordRunFailure(time.Time, time.Duration) int
+	ResetFailureStreak()
+	ReleaseDelayedRun(string) bool
+	CancelDelayedRun(string, string) (bool, bool)
 }
 
 // New will initialize a new state table either empty or with the saved state if found.
@@ -114,21 +296,46 @@ func New(
 	return diskState
 }
 
+// NewInMemory will initialize a new empty state table that lives only in memory.
+// No state file is read or written and old runs are not swept, so PersistState and
+// ClearOldRuns return straight away. It is meant for tests that drive the web engine
+// or the chef runner without a state directory or background goroutines.
+func NewInMemory(
+	config config.Config,
+	chefLogsWorker cheflogs.WorkerWriter,
+	logger logs.SysLogger,
+) *StateTable {
+	st := defaultStateTable(config, chefLogsWorker, logger)
+	st.StateFilePath = ""
+	st.inMemory = true
+	return st
+}
+
 // newStateTable - Constructs a new state table with Zero values.
 func defaultStateTable(config config.Config, chefLogsWorker cheflogs.WorkerWriter, logger logs.SysLogger) (st *StateTable) {
 	logs.DebugMessage("run newStateTable()")
-	return &StateTable{
-		Status:             make(map[string]*JobDetails),
-		LastRunStartTime:   int64(1257894000),
-		ChefRunTimer:       config.PeriodicTimer() * 60,
-		PeriodicRuns:       config.ControlChefRun(),
-		StateTableSize:     config.StateTableSize(),
-		MaintenanceTimeEnd: 0,
-		Locked:             false,
-		StateFilePath:      getStatePath(config.StateFileLocation(), statefile),
-		chefLogsWorker:     chefLogsWorker,
-		logger:             logger,
+	st = &StateTable{
+		SchemaVersion:        currentSchemaVersion,
+		Status:               make(map[string]*JobDetails),
+		LastRunStartTime:     int64(1257894000),
+		ChefRunTimer:         config.PeriodicTimer() * 60,
+		PeriodicRuns:         config.ControlChefRun(),
+		StateTableSize:       config.StateTableSize(),
+		MaintenanceTimeEnd:   0,
+		Locked:               false,
+		StateFilePath:        getStatePath(config.StateFileLocation(), statefile),
+		coalesceWindow:       config.RunCoalesceWindow(),
+		failedStateTableSize: config.FailedStateTableSize(),
+		sweepInterval:        config.StateSweepInterval(),
+		sweepLimit:           config.StateSweepLimit(),
+		periodicCooldown:     int64(config.PeriodicCooldown() / time.Second),
+		chefLogsWorker:       chefLogsWorker,
+		logger:               logger,
 	}
+	st.LastPeriodicRunStartTime = st.LastRunStartTime
+	st.setRunSchedule(config.PeriodicSchedule())
+	st.setFirstPeriodicRunTime(time.Now(), config.StartupDelay(), config.StartupSplay())
+	return st
 }
 
 // resetStateTable is used to reset the values stored in the State Table to those
@@ -139,8 +346,49 @@ func (st *StateTable) resetStateTable(config config.Config, chefLogsWorker chefl
 	st.ChefRunTimer = config.PeriodicTimer() * 60
 	st.PeriodicRuns = config.ControlChefRun()
 	st.StateTableSize = config.StateTableSize()
+	st.coalesceWindow = config.RunCoalesceWindow()
+	st.failedStateTableSize = config.FailedStateTableSize()
+	st.sweepInterval = config.StateSweepInterval()
+	st.sweepLimit = config.StateSweepLimit()
+	st.periodicCooldown = int64(config.PeriodicCooldown() / time.Second)
 	st.chefLogsWorker = chefLogsWorker
 	st.logger = logger
+	st.setRunSchedule(config.PeriodicSchedule())
+	st.setFirstPeriodicRunTime(time.Now(), config.StartupDelay(), config.StartupSplay())
+}
+
+// setFirstPeriodicRunTime - holds back periodic runs until delay, plus a random part
+// of splay, after now. The splay spreads out the first runs of many servers that
+// start at the same time.
+func (st *StateTable) setFirstPeriodicRunTime(now time.Time, delay, splay time.Duration) {
+	wait := delay
+	if splay > 0 {
+		wait += time.Duration(rand.New(rand.NewSource(now.UnixNano())).Int63n(int64(splay)))
+	}
+	st.firstPeriodicRunTime = 0
+	if wait <= 0 {
+		return
+	}
+	st.firstPeriodicRunTime = now.Add(wait).Unix()
+	st.logger.Infof("Periodic runs will not start before %s", time.Unix(st.firstPeriodicRunTime, 0).String())
+}
+
+// setRunSchedule - sets the cron schedule for periodic runs. An empty spec means
+// that the interval is used. The spec has been validated with the configuration
+// so a bad spec is only logged and the interval is used.
+func (st *StateTable) setRunSchedule(spec string) {
+	st.runSchedule = nil
+	st.runScheduleSpec = ""
+	if spec == "" {
+		return
+	}
+	schedule, err := cron.ParseStandard(spec)
+	if err != nil {
+		st.logger.Errorf("The run schedule %q is not valid, using the run interval instead. Error: %s", spec, err)
+		return
+	}
+	st.runSchedule = schedule
+	st.runScheduleSpec = spec
 }
 
 // Lock - locks the mutex for writing to the state table.
@@ -180,6 +428,11 @@ func (st *StateTable) flushToDisk(sf io.Writer) error {
 
 // Add - Allows us to add a guid to the state table with default values.
 func (st *StateTable) Add(id string, ondemand bool) {
+	st.addRun(id, ondemand, RunOptions{})
+}
+
+// addRun - adds a guid to the state table along with the options asked for on the run.
+func (st *StateTable) addRun(id string, ondemand bool, options RunOptions) {
 	st.lock()
 	defer st.unlock()
 	st.Status[id] = &JobDetails{
@@ -187,12 +440,14 @@ func (st *StateTable) Add(id string, ondemand bool) {
 		ExitCode:       99,
 		RegisteredTime: time.Now().Unix(),
 		OnDemand:       ondemand,
+		Source:         jobSource(ondemand, false),
+		RunOptions:     options,
 	}
 }
 
 // AddCustom - Allows the caller to add a guid to the state table with details of a
 // custom job.
-func (st *StateTable) AddCustom(id string, customString string) {
+func (st *StateTable) AddCustom(id string, customString string, options RunOptions) {
 	st.lock()
 	defer st.unlock()
 	st.Status[id] = &JobDetails{
@@ -202,32 +457,48 @@ func (st *StateTable) AddCustom(id string, customString string) {
 		OnDemand:        true,
 		CustomRun:       true,
 		CustomRunString: customString,
+		Source:          jobSource(true, true),
+		RunOptions:      options,
+	}
+}
+
+// jobSource works out what started a job.
+func jobSource(onDemand, customRun bool) string {
+	switch {
+	case customRun:
+		return "custom"
+	case onDemand:
+		return "demand"
+	default:
+		return "periodic"
 	}
 }
 
 // RegisterRun - Allows us to check if a on demand run is registered and to register one
 // if there is not. It will return a bool true to signal that a new run was created and also
 // return a string of the guid that this run is associated with. The run could be a copy
-// of a previos run that is still queuing to run.
-func (st *StateTable) RegisterRun(onDemand, customRun bool, customString string) (ok bool, guid string) {
+// of a previos run that is still queuing to run. A run that is reused keeps its own label.
+// If a coalesce window is configured an identical run that is already running is also
+// reused as long as it was registered within the window.
+func (st *StateTable) RegisterRun(onDemand, customRun bool, customString string, options RunOptions) (ok bool, guid string) {
 	// check if there is a on demand chef run already waiting.
 	// if so collect the guid
 	// else create a run and make a guid
 
 	st.rLock()
+	coalesceAfter := time.Now().Unix() - st.coalesceWindow
 	for id := range st.Status {
 		i := st.Status[id]
+		// Only the same kind of run with the same custom run string and options can be reused.
+		if i.OnDemand != onDemand || i.CustomRun != customRun || i.CustomRunString != customString || !i.RunOptions.equal(options) {
+			continue
+		}
 		if i.Status == "registered" {
-			// Determin if i is also a custom run if so match the strings.
-			if customRun && i.CustomRun && i.CustomRunString == customString {
-				guid = id
-			} else {
-				// If its not a custom run then it can either be onDemand or periodic.
-				// Either way if the values match then return a guid.
-				if i.OnDemand == onDemand {
-					guid = id
-				}
-			}
+			guid = id
+			break
+		}
+		if st.coalesceWindow > 0 && i.Status == "running" && i.RegisteredTime >= coalesceAfter {
+			guid = id
 		}
 	}
 	st.rUnlock()
@@ -236,9 +507,9 @@ func (st *StateTable) RegisterRun(onDemand, customRun bool, customString string)
 	if len(guid) < 1 {
 		guid = uuid.NewV4().String()
 		if customRun {
-			st.AddCustom(guid, customString)
+			st.AddCustom(guid, customString, options)
 		} else {
-			st.Add(guid, onDemand)
+			st.addRun(guid, onDemand, options)
 		}
 		return true, guid
 	}
@@ -246,12 +517,30 @@ func (st *StateTable) RegisterRun(onDemand, customRun bool, customString string)
 	return false, guid
 }
 
-// UpdateStatus - Updates the states of an ID with the given status string
+// UpdateStatus - Updates the states of an ID with the given status string.
+// The run start and end times, and the time spent in each, are recorded as the job
+// moves through its states.
 func (st *StateTable) UpdateStatus(guid string, state string) {
 	logs.DebugMessage(fmt.Sprintf("UpdateStatus(%s,%s)", guid, state))
 	st.lock()
 	defer st.unlock()
-	st.Status[guid].Status = state
+	job := st.Status[guid]
+	job.Status = state
+	switch state {
+	case "running":
+		job.RunStartTime = time.Now().Unix()
+		// A delayed run is only queued from its scheduled start.
+		queuedFrom := job.RegisteredTime
+		if job.ScheduledStart > queuedFrom {
+			queuedFrom = job.ScheduledStart
+		}
+		job.QueuedDurationSeconds = job.RunStartTime - queuedFrom
+	case "complete", "failed", "timed_out", "conflicted":
+		job.RunEndTime = time.Now().Unix()
+		if job.RunStartTime > 0 {
+			job.DurationSeconds = job.RunEndTime - job.RunStartTime
+		}
+	}
 }
 
 // UpdateExitCode - Updates the ExitCode of an ID with the given int.
@@ -262,6 +551,55 @@ func (st *StateTable) UpdateExitCode(guid string, code int) {
 	st.Status[guid].ExitCode = code
 }
 
+// UpdateStatusReason - Records why a job ended up in its current status.
+func (st *StateTable) UpdateStatusReason(guid string, reason string) {
+	logs.DebugMessage(fmt.Sprintf("UpdateStatusReason(%s,%s)", guid, reason))
+	st.lock()
+	defer st.unlock()
+	st.Status[guid].StatusReason = reason
+}
+
+// UpdateLogTruncated - Records if the log of a run was cut short.
+func (st *StateTable) UpdateLogTruncated(guid string, truncated bool) {
+	logs.DebugMessage(fmt.Sprintf("UpdateLogTruncated(%s,%v)", guid, truncated))
+	st.lock()
+	defer st.unlock()
+	st.Status[guid].LogTruncated = truncated
+}
+
+// UpdateResources - Records how many resources chef updated out of the total.
+func (st *StateTable) UpdateResources(guid string, updated, total int) {
+	logs.DebugMessage(fmt.Sprintf("UpdateResources(%s,%d,%d)", guid, updated, total))
+	st.lock()
+	defer st.unlock()
+	st.Status[guid].ResourcesUpdated = updated
+	st.Status[guid].ResourcesTotal = total
+}
+
+// UpdateExecutedCommand - Records the command and arguments that were run for the guid.
+func (st *StateTable) UpdateExecutedCommand(guid string, command []string) {
+	logs.DebugMessage(fmt.Sprintf("UpdateExecutedCommand(%s,%q)", guid, command))
+	st.lock()
+	defer st.unlock()
+	st.Status[guid].ExecutedCommand = append([]string(nil), command...)
+}
+
+// UpdateAttempt - Records which attempt of a run chef is on.
+func (st *StateTable) UpdateAttempt(guid string, attempt int) {
+	logs.DebugMessage(fmt.Sprintf("UpdateAttempt(%s,%d)", guid, attempt))
+	st.lock()
+	defer st.unlock()
+	st.Status[guid].Attempt = attempt
+}
+
+// AddAttemptExitCode - Records the exit code of an attempt of a run.
+func (st *StateTable) AddAttemptExitCode(guid string, code int) {
+	logs.DebugMessage(fmt.Sprintf("AddAttemptExitCode(%s,%d)", guid, code))
+	st.lock()
+	defer st.unlock()
+	st.Status[guid].AttemptExitCodes = append(st.Status[guid].AttemptExitCodes, code)
+}
+
 // IsDemandJob will return the value of a JobDetails OnDemand value. This
 // will let the caller know if it is a on demand job.
 func (st *StateTable) IsDemandJob(guid string) bool {
@@ -286,12 +624,29 @@ func (st *StateTable) IsCustomJob(guid string) (bool, string) {
 	return value.CustomRun, value.CustomRunString
 }
 
+// ReadRunOptions will return the options that were asked for on a job.
+func (st *StateTable) ReadRunOptions(guid string) RunOptions {
+	st.rLock()
+	defer st.rUnlock()
+	value, ok := st.Status[guid]
+	if !ok {
+		return RunOptions{}
+	}
+	return value.RunOptions
+}
+
 // Read - Creates a copy of the current state and returns it. This makes it thread safe.
 func (st *StateTable) Read(guid string) (status map[string]*JobDetails) {
 	status = make(map[string]*JobDetails)
 	st.rLock()
-	status[guid] = st.Status[guid]
-	st.rUnlock()
+	defer st.rUnlock()
+	// A copy is returned as runs can be updated by a supervisor while it is being read.
+	if job, ok := st.Status[guid]; ok {
+		copied := *job
+		status[guid] = &copied
+		return status
+	}
+	status[guid] = nil
 	return status
 }
 
@@ -303,15 +658,57 @@ func (st *StateTable) ReadAll() (status map[string]*JobDetails) {
 	return st.Status
 }
 
-// RemoveState - removes a guid from the Statetable.
+// RemoveState - removes a guid from the Statetable if the run completed or was cancelled.
 func (st *StateTable) RemoveState(guid string) {
 	st.lock()
 	defer st.unlock()
-	if st.Status[guid].Status == "complete" {
+	if job, ok := st.Status[guid]; ok && sweptRun(job.Status) {
 		delete(st.Status, guid)
 	}
 }
 
+// RemoveFinishedStates - removes every run that is not registered or running, whatever it
+// ended with, and returns how many were removed.
+func (st *StateTable) RemoveFinishedStates() (removed int) {
+	st.lock()
+	defer st.unlock()
+	for guid, job := range st.Status {
+		if job.Status == "registered" || job.Status == "running" {
+			continue
+		}
+		delete(st.Status, guid)
+		removed++
+	}
+	return removed
+}
+
+// removeFailedState - removes a guid from the Statetable if the run is kept with the
+// failed runs.
+func (st *StateTable) removeFailedState(guid string) {
+	st.lock()
+	defer st.unlock()
+	if job, ok := st.Status[guid]; ok && keptWithFailedRuns(job.Status) {
+		delete(st.Status, guid)
+	}
+}
+
+// getStateTimesByResult - Returns the guids and times of the runs that are counted
+// against state_table_size and of those counted against failed_state_table_size.
+func (st *StateTable) getStateTimesByResult() (succeeded, failed map[string]int64) {
+	st.rLock()
+	defer st.rUnlock()
+	succeeded = make(map[string]int64)
+	failed = make(map[string]int64)
+	for k, v := range st.Status {
+		if keptWithFailedRuns(v.Status) {
+			failed[k] = v.RegisteredTime
+			continue
+		}
+		succeeded[k] = v.RegisteredTime
+	}
+	return succeeded, failed
+}
+
 // GetAllStateTimes - Returns all the status guids and times
 func (st *StateTable) GetAllStateTimes() (statusMap map[string]int64) {
 	st.rLock()
@@ -344,6 +741,14 @@ func (st *StateTable) UpdatelastRunStartTime(t int64) {
 	st.LastRunStartTime = t
 }
 
+// UpdateLastPeriodicRunStartTime will set the last time that a periodic run started to
+// the supplied epoch time.
+func (st *StateTable) UpdateLastPeriodicRunStartTime(t int64) {
+	st.lock()
+	defer st.unlock()
+	st.LastPeriodicRunStartTime = t
+}
+
 // ReadChefRunTimer will return an int64 with represents in minutes how often we run chef.
 func (st *StateTable) ReadChefRunTimer() int64 {
 	st.rLock()
@@ -351,6 +756,40 @@ func (st *StateTable) ReadChefRunTimer() int64 {
 	return st.ChefRunTimer
 }
 
+// ReadRunSchedule will return the cron schedule for periodic runs.
+// It is empty when periodic runs happen on the interval.
+func (st *StateTable) ReadRunSchedule() string {
+	st.rLock()
+	defer st.rUnlock()
+	return st.runScheduleSpec
+}
+
+// NextPeriodicRunTime will return the epoch time when the next periodic run is due.
+// With a run schedule this is the first time the schedule fires after the last periodic
+// run started, otherwise it is the last periodic run start time plus the interval.
+// It can be in the past if a run is waiting to be requested. It is never before the
+// first periodic run time set by the startup delay, or before the periodic cooldown
+// has passed since the last run of any kind finished.
+func (st *StateTable) NextPeriodicRunTime() int64 {
+	st.rLock()
+	defer st.rUnlock()
+	next := st.LastPeriodicRunStartTime + st.ChefRunTimer
+	if st.runSchedule != nil {
+		next = st.runSchedule.Next(time.Unix(st.LastPeriodicRunStartTime, 0)).Unix()
+	}
+	if st.periodicCooldown > 0 {
+		for _, job := range st.Status {
+			if job.RunEndTime > 0 && job.RunEndTime+st.periodicCooldown > next {
+				next = job.RunEndTime + st.periodicCooldown
+			}
+		}
+	}
+	if next < st.firstPeriodicRunTime {
+		return st.firstPeriodicRunTime
+	}
+	return next
+}
+
 // WriteChefRunTimer will update the chef runner trigger timer to be the supplied int64 * 60
 // to represent minutes.
 func (st *StateTable) WriteChefRunTimer(i int64) {
@@ -385,6 +824,15 @@ func (st *StateTable) readStateTableSize() int {
 	return st.StateTableSize
 }
 
+func (st *StateTable) readFailedStateTableSize() int {
+	st.rLock()
+	defer st.rUnlock()
+	if st.failedStateTableSize == 0 {
+		return st.StateTableSize
+	}
+	return st.failedStateTableSize
+}
+
 // ReadLastRunGUID will return the last guid that was linked to a chef run.
 func (st *StateTable) ReadLastRunGUID() string {
 	st.rLock()
@@ -392,6 +840,22 @@ func (st *StateTable) ReadLastRunGUID() string {
 	return st.LastRunGUID
 }
 
+// ReadLastSuccessfulRunGUID will return the guid of the last run that exited with 0.
+// It is empty if no run has succeeded.
+func (st *StateTable) ReadLastSuccessfulRunGUID() string {
+	st.rLock()
+	defer st.rUnlock()
+	return st.LastSuccessfulRunGUID
+}
+
+// ReadLastSuccessfulRunTime will return the epoch time when the last successful run finished.
+// It is 0 if no run has succeeded.
+func (st *StateTable) ReadLastSuccessfulRunTime() int64 {
+	st.rLock()
+	defer st.rUnlock()
+	return st.LastSuccessfulRunTime
+}
+
 // ReadAllJobs will create a copy of the jobs as they are and return them to the caller.
 func (st *StateTable) ReadAllJobs() map[string]JobDetails {
 	st.rLock()
@@ -403,6 +867,101 @@ func (st *StateTable) ReadAllJobs() map[string]JobDetails {
 	return retVal
 }
 
+// Dump will return a copy of the whole state table as it is now.
+func (st *StateTable) Dump() StateDump {
+	st.rLock()
+	defer st.rUnlock()
+	runs := make(map[string]JobDetails)
+	for guid, job := range st.Status {
+		runs[guid] = *job
+	}
+	return StateDump{
+		SchemaVersion:            st.SchemaVersion,
+		Runs:                     runs,
+		LastRunStartTime:         st.LastRunStartTime,
+		LastPeriodicRunStartTime: st.LastPeriodicRunStartTime,
+		LastRunGUID:              st.LastRunGUID,
+		LastSuccessfulRunGUID:    st.LastSuccessfulRunGUID,
+		LastSuccessfulRunTime:    st.LastSuccessfulRunTime,
+		ChefRunTimer:             st.ChefRunTimer,
+		RunSchedule:              st.runScheduleSpec,
+		PeriodicRuns:             st.PeriodicRuns,
+		StateTableSize:           st.StateTableSize,
+		FailedStateTableSize:     st.failedStateTableSize,
+		CoalesceWindow:           st.coalesceWindow,
+		MaintenanceTimeEnd:       st.MaintenanceTimeEnd,
+		Locked:                   st.Locked,
+		LockedBy:                 st.LockedBy,
+		LockedTime:               st.LockedTime,
+		LockReason:               st.LockReason,
+		AutoLocked:               st.AutoLocked,
+		ConsecutiveFailures:      len(st.failureStreak),
+		StateFilePath:            st.StateFilePath,
+		PersistStatus:            st.persistStatus,
+	}
+}
+
+// ReadPendingRuns will return the guids of the runs that are registered but have not
+// started, oldest first.
+func (st *StateTable) ReadPendingRuns() []string {
+	st.rLock()
+	defer st.rUnlock()
+	pending := make([]string, 0)
+	for guid, job := range st.Status {
+		if job.Status == "registered" {
+			pending = append(pending, guid)
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		return st.Status[pending[i]].RegisteredTime < st.Status[pending[j]].RegisteredTime
+	})
+	return pending
+}
+
+// ReleaseDelayedRun will mark a delayed run as due so that it can be queued. It returns
+// false if the run is no longer waiting to start, eg as it was cancelled.
+func (st *StateTable) ReleaseDelayedRun(guid string) bool {
+	st.lock()
+	defer st.unlock()
+	job, ok := st.Status[guid]
+	if !ok || job.Status != "registered" || job.released {
+		return false
+	}
+	job.released = true
+	return true
+}
+
+// CancelDelayedRun will cancel a delayed run that is still waiting for its scheduled
+// start. found is false if there is no run with the guid and cancelled is false if the
+// run is not a delayed run that is still waiting.
+func (st *StateTable) CancelDelayedRun(guid, reason string) (found, cancelled bool) {
+	st.lock()
+	defer st.unlock()
+	job, ok := st.Status[guid]
+	if !ok {
+		return false, false
+	}
+	if job.Status != "registered" || job.ScheduledStart == 0 || job.released {
+		return true, false
+	}
+	job.Status = "cancelled"
+	job.StatusReason = reason
+	return true, true
+}
+
+// CountRunningRuns will return how many runs are running right now.
+func (st *StateTable) CountRunningRuns() int {
+	st.rLock()
+	defer st.rUnlock()
+	running := 0
+	for _, job := range st.Status {
+		if job.Status == "running" {
+			running++
+		}
+	}
+	return running
+}
+
 // WriteLastRunGUID will write to the state table the guid passed in.
 func (st *StateTable) WriteLastRunGUID(guid string) {
 	st.lock()
@@ -410,6 +969,14 @@ func (st *StateTable) WriteLastRunGUID(guid string) {
 	st.LastRunGUID = guid
 }
 
+// WriteLastSuccessfulRun will record the guid of a run that exited with 0 and the epoch time it finished.
+func (st *StateTable) WriteLastSuccessfulRun(guid string, epoch int64) {
+	st.lock()
+	defer st.unlock()
+	st.LastSuccessfulRunGUID = guid
+	st.LastSuccessfulRunTime = epoch
+}
+
 // WriteMaintenanceTimeEnd will write when Maintenance must end. It takes an int64 as and assumes this is an epoch
 func (st *StateTable) WriteMaintenanceTimeEnd(epoch int64) {
 	st.lock()
@@ -438,15 +1005,79 @@ func (st *StateTable) readStateFilePath() string {
 
 // LockRuns will lock the chef waiter to stop accepting runs
 func (st *StateTable) LockRuns(lock bool) {
+	if lock {
+		st.LockRunsBy("")
+		return
+	}
 	st.lock()
 	defer st.unlock()
-	if lock {
+	st.logger.Info("Chefwaiter has just been unlocked. New runs can now be scheduled.")
+	st.Locked = false
+	st.LockedBy = ""
+	st.LockedTime = 0
+	st.LockReason = ""
+	st.AutoLocked = false
+}
+
+// LockRunsBy will lock the chef waiter to stop accepting runs and record who locked it.
+func (st *StateTable) LockRunsBy(owner string) {
+	st.lock()
+	defer st.unlock()
+	if owner == "" {
 		st.logger.Info("Chefwaiter has just been locked. No new runs can be scheduled.")
-		st.Locked = true
 	} else {
-		st.logger.Info("Chefwaiter has just been unlocked. New runs can now be scheduled.")
-		st.Locked = false
+		st.logger.Infof("Chefwaiter has just been locked by %s. No new runs can be scheduled.", owner)
 	}
+	st.Locked = true
+	st.LockedBy = owner
+	st.LockedTime = time.Now().Unix()
+	st.LockReason = ""
+	st.AutoLocked = false
+}
+
+// AutoLockRuns will lock the chef waiter because runs keep failing. The lock stays
+// until it is removed by hand. A lock that is already set is left as it is.
+func (st *StateTable) AutoLockRuns(reason string) {
+	st.lock()
+	defer st.unlock()
+	if st.Locked {
+		return
+	}
+	st.logger.Warningf("Chefwaiter has locked itself, %s. No new runs can be scheduled until it is unlocked.", reason)
+	st.Locked = true
+	st.LockedBy = "chefwaiter"
+	st.LockedTime = time.Now().Unix()
+	st.LockReason = reason
+	st.AutoLocked = true
+}
+
+// RecordRunFailure will add a failed run that finished at now to the streak of failures.
+// Failures older than window are dropped. It returns how many failures are in the streak.
+func (st *StateTable) RecordRunFailure(now time.Time, window time.Duration) int {
+	st.lock()
+	defer st.unlock()
+	inWindow := make([]time.Time, 0, len(st.failureStreak)+1)
+	for _, failure := range st.failureStreak {
+		if now.Sub(failure) < window {
+			inWindow = append(inWindow, failure)
+		}
+	}
+	st.failureStreak = append(inWindow, now)
+	return len(st.failureStreak)
+}
+
+// ResetFailureStreak will clear the streak of failures. This happens when a run passes.
+func (st *StateTable) ResetFailureStreak() {
+	st.lock()
+	defer st.unlock()
+	st.failureStreak = nil
+}
+
+// ReadFailureStreak will return how many runs have failed in a row.
+func (st *StateTable) ReadFailureStreak() int {
+	st.rLock()
+	defer st.rUnlock()
+	return len(st.failureStreak)
 }
 
 // ReadRunLock will return the value of the state tables Lock value.
@@ -455,3 +1086,16 @@ func (st *StateTable) ReadRunLock() bool {
 	defer st.rUnlock()
 	return st.Locked
 }
+
+// ReadLockDetails will return the lock value along with who set it and when.
+func (st *StateTable) ReadLockDetails() LockDetails {
+	st.rLock()
+	defer st.rUnlock()
+	return LockDetails{
+		Locked:     st.Locked,
+		LockedBy:   st.LockedBy,
+		LockedTime: st.LockedTime,
+		Reason:     st.LockReason,
+		AutoLocked: st.AutoLocked,
+	}
+}
@@ -0,0 +1,243 @@
+package internalstate
+
+import (
+	"testing"
+	"time"
+
+	"github.com/morfien101/chef-waiter/config"
+	"github.com/morfien101/chef-waiter/logs"
+)
+
+func TestRegisterRunCoalesce(t *testing.T) {
+	newState := func(window int64) *StateTable {
+		return &StateTable{
+			Status:         make(map[string]*JobDetails),
+			coalesceWindow: window,
+			logger:         logs.NewFakeLogger(false),
+		}
+	}
+
+	tests := []struct {
+		name           string
+		window         int64
+		status         string
+		registeredAgo  time.Duration
+		customString   string
+		expectCoalesce bool
+	}{
+		{name: "Queued run is reused", status: "registered", expectCoalesce: true},
+		{name: "Running run without window", status: "running", expectCoalesce: false},
+		{name: "Running run inside window", window: 30, status: "running", registeredAgo: 10 * time.Second, expectCoalesce: true},
+		{name: "Running run outside window", window: 30, status: "running", registeredAgo: time.Minute, expectCoalesce: false},
+		{name: "Finished run inside window", window: 30, status: "complete", registeredAgo: 10 * time.Second, expectCoalesce: false},
+		{name: "Different custom run", window: 30, status: "registered", customString: "recipe[other]", expectCoalesce: false},
+	}
+
+	for _, test := range tests {
+		st := newState(test.window)
+		_, existing := st.RegisterRun(true, true, "recipe[test]", RunOptions{})
+		st.Status[existing].Status = test.status
+		st.Status[existing].RegisteredTime = time.Now().Add(-test.registeredAgo).Unix()
+
+		customString := "recipe[test]"
+		if test.customString != "" {
+			customString = test.customString
+		}
+		ok, guid := st.RegisterRun(true, true, customString, RunOptions{})
+		if coalesced := !ok && guid == existing; coalesced != test.expectCoalesce {
+			t.Errorf("%s: got coalesced %t, want %t", test.name, coalesced, test.expectCoalesce)
+		}
+	}
+}
+
+func TestRegisterRunKeepsRunTypesApart(t *testing.T) {
+	st := &StateTable{Status: make(map[string]*JobDetails), logger: logs.NewFakeLogger(false)}
+	_, custom := st.RegisterRun(true, true, "recipe[test]", RunOptions{})
+	_, onDemand := st.RegisterRun(true, false, "", RunOptions{})
+	_, periodic := st.RegisterRun(false, false, "", RunOptions{})
+	if custom == onDemand || onDemand == periodic || custom == periodic {
+		t.Errorf("Different kinds of runs should not share a guid. Got: %s, %s, %s", custom, onDemand, periodic)
+	}
+}
+
+func TestRegisterRunLabel(t *testing.T) {
+	st := &StateTable{Status: make(map[string]*JobDetails), logger: logs.NewFakeLogger(false)}
+	_, guid := st.RegisterRun(true, false, "", RunOptions{Label: "CHG-1"})
+	if label := st.Status[guid].Label; label != "CHG-1" {
+		t.Errorf("The run should carry its label. Got: %q", label)
+	}
+	// The label does not change the run so a queued run is still reused.
+	ok, reused := st.RegisterRun(true, false, "", RunOptions{Label: "CHG-2"})
+	if ok || reused != guid {
+		t.Errorf("A run with a different label should reuse the queued run. Got: %s, want %s", reused, guid)
+	}
+	if label := st.Status[guid].Label; label != "CHG-1" {
+		t.Errorf("A reused run should keep its own label. Got: %q", label)
+	}
+}
+
+func TestRunDurations(t *testing.T) {
+	st := &StateTable{Status: make(map[string]*JobDetails), logger: logs.NewFakeLogger(false)}
+	_, guid := st.RegisterRun(true, false, "", RunOptions{})
+	st.Status[guid].RegisteredTime = time.Now().Add(-30 * time.Second).Unix()
+
+	st.UpdateStatus(guid, "running")
+	if queued := st.Status[guid].QueuedDurationSeconds; queued < 30 || queued > 31 {
+		t.Errorf("The time spent queued is wrong. Got: %d, Want: 30", queued)
+	}
+	if st.Status[guid].DurationSeconds != 0 {
+		t.Errorf("A running run should not have a duration. Got: %d", st.Status[guid].DurationSeconds)
+	}
+
+	st.Status[guid].RunStartTime = time.Now().Add(-90 * time.Second).Unix()
+	st.UpdateStatus(guid, "complete")
+	if duration := st.Status[guid].DurationSeconds; duration < 90 || duration > 91 {
+		t.Errorf("The time spent running is wrong. Got: %d, Want: 90", duration)
+	}
+	if queued := st.Status[guid].QueuedDurationSeconds; queued < 30 || queued > 31 {
+		t.Errorf("Finishing the run changed the time spent queued. Got: %d, Want: 30", queued)
+	}
+}
+
+func TestNextPeriodicRunTime(t *testing.T) {
+	lastRun := time.Date(2019, 6, 1, 3, 15, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		schedule string
+		want     time.Time
+	}{
+		{name: "Interval", want: lastRun.Add(30 * time.Minute)},
+		{name: "Schedule", schedule: "CRON_TZ=UTC 0 2,14 * * *", want: time.Date(2019, 6, 1, 14, 0, 0, 0, time.UTC)},
+		{name: "Schedule next day", schedule: "CRON_TZ=UTC 0 2 * * *", want: time.Date(2019, 6, 2, 2, 0, 0, 0, time.UTC)},
+		{name: "Bad schedule uses the interval", schedule: "at 2am", want: lastRun.Add(30 * time.Minute)},
+	}
+
+	for _, test := range tests {
+		st := &StateTable{
+			LastPeriodicRunStartTime: lastRun.Unix(),
+			ChefRunTimer:             30 * 60,
+			logger:                   logs.NewFakeLogger(false),
+		}
+		st.setRunSchedule(test.schedule)
+		if got := st.NextPeriodicRunTime(); got != test.want.Unix() {
+			t.Errorf("%s: got next run %s, want %s", test.name, time.Unix(got, 0).UTC(), test.want)
+		}
+	}
+}
+
+func TestRunAtMinute(t *testing.T) {
+	minute := 17
+	schedule := (&config.ValuesContainer{InternalRunAtMinute: &minute}).PeriodicSchedule()
+	lastPeriodicRun := time.Date(2019, 6, 1, 3, 15, 0, 0, time.UTC)
+	st := &StateTable{
+		// An on demand run after the last periodic run does not move the schedule.
+		LastRunStartTime:         lastPeriodicRun.Add(10 * time.Minute).Unix(),
+		LastPeriodicRunStartTime: lastPeriodicRun.Unix(),
+		ChefRunTimer:             30 * 60,
+		logger:                   logs.NewFakeLogger(false),
+	}
+	st.setRunSchedule(schedule)
+	// The schedule is in local time so the minute is checked rather than the time.
+	next := time.Unix(st.NextPeriodicRunTime(), 0)
+	if next.Minute() != minute || !next.After(lastPeriodicRun) || next.Sub(lastPeriodicRun) > time.Hour {
+		t.Errorf("The next run should be the first minute %d after the last periodic run at %s. Got: %s", minute, lastPeriodicRun, next.UTC())
+	}
+}
+
+func TestFirstPeriodicRunTime(t *testing.T) {
+	lastRun := time.Date(2019, 6, 1, 3, 15, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		started time.Time
+		delay   time.Duration
+		splay   time.Duration
+		min     time.Time
+		max     time.Time
+	}{
+		{name: "No delay", started: lastRun.Add(time.Hour), min: lastRun.Add(30 * time.Minute), max: lastRun.Add(30 * time.Minute)},
+		{name: "Delay after the run is due", started: lastRun.Add(time.Hour), delay: 5 * time.Minute, min: lastRun.Add(65 * time.Minute), max: lastRun.Add(65 * time.Minute)},
+		{name: "Delay before the run is due", started: lastRun.Add(time.Minute), delay: 5 * time.Minute, min: lastRun.Add(30 * time.Minute), max: lastRun.Add(30 * time.Minute)},
+		{name: "Splay", started: lastRun.Add(time.Hour), delay: 5 * time.Minute, splay: 10 * time.Minute, min: lastRun.Add(65 * time.Minute), max: lastRun.Add(75 * time.Minute)},
+	}
+
+	for _, test := range tests {
+		st := &StateTable{
+			LastPeriodicRunStartTime: lastRun.Unix(),
+			ChefRunTimer:             30 * 60,
+			logger:                   logs.NewFakeLogger(false),
+		}
+		st.setFirstPeriodicRunTime(test.started, test.delay, test.splay)
+		got := st.NextPeriodicRunTime()
+		if got < test.min.Unix() || got > test.max.Unix() {
+			t.Errorf("%s: got next run %s, want between %s and %s", test.name, time.Unix(got, 0).UTC(), test.min, test.max)
+		}
+	}
+}
+
+func TestPeriodicCooldown(t *testing.T) {
+	lastRun := time.Date(2019, 6, 1, 3, 15, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		cooldown int64
+		endTime  time.Time
+		want     time.Time
+	}{
+		{name: "No cooldown", endTime: lastRun.Add(25 * time.Minute), want: lastRun.Add(30 * time.Minute)},
+		{name: "Cooldown over before the run is due", cooldown: 600, endTime: lastRun.Add(10 * time.Minute), want: lastRun.Add(30 * time.Minute)},
+		{name: "Cooldown pushes out the run", cooldown: 600, endTime: lastRun.Add(25 * time.Minute), want: lastRun.Add(35 * time.Minute)},
+	}
+
+	for _, test := range tests {
+		st := &StateTable{
+			Status: map[string]*JobDetails{
+				"demand":  {Status: "complete", Source: "demand", RunEndTime: test.endTime.Unix()},
+				"running": {Status: "running", Source: "demand"},
+			},
+			LastPeriodicRunStartTime: lastRun.Unix(),
+			ChefRunTimer:             30 * 60,
+			periodicCooldown:         test.cooldown,
+			logger:                   logs.NewFakeLogger(false),
+		}
+		if got := st.NextPeriodicRunTime(); got != test.want.Unix() {
+			t.Errorf("%s: got next run %s, want %s", test.name, time.Unix(got, 0).UTC(), test.want)
+		}
+	}
+}
+
+func TestReadRunStats(t *testing.T) {
+	now := time.Now()
+	ago := func(d time.Duration) int64 { return now.Add(-d).Unix() }
+	st := &StateTable{
+		Status: map[string]*JobDetails{
+			"old":       {Status: "failed", Source: "periodic", RegisteredTime: ago(48 * time.Hour), RunStartTime: ago(48 * time.Hour), RunEndTime: ago(47 * time.Hour), DurationSeconds: 3600},
+			"passed":    {Status: "complete", Source: "periodic", RegisteredTime: ago(5 * time.Hour), RunStartTime: ago(5 * time.Hour), RunEndTime: ago(4 * time.Hour), DurationSeconds: 10},
+			"custom":    {Status: "complete", Source: "custom", RegisteredTime: ago(4 * time.Hour), RunStartTime: ago(4 * time.Hour), RunEndTime: ago(4 * time.Hour), DurationSeconds: 20},
+			"failed":    {Status: "failed", Source: "demand", RegisteredTime: ago(3 * time.Hour), RunStartTime: ago(3 * time.Hour), RunEndTime: ago(2 * time.Hour), DurationSeconds: 30},
+			"timed_out": {Status: "timed_out", Source: "periodic", RegisteredTime: ago(2 * time.Hour), RunStartTime: ago(2 * time.Hour), RunEndTime: ago(time.Hour), DurationSeconds: 100},
+			"running":   {Status: "running", Source: "demand", RegisteredTime: ago(time.Minute), RunStartTime: ago(time.Minute)},
+		},
+		LastSuccessfulRunTime: ago(4 * time.Hour),
+	}
+
+	stats := st.ReadRunStats(now, 24*time.Hour)
+	if stats.TotalRuns != 5 || stats.Runs["periodic"] != 2 || stats.Runs["demand"] != 2 || stats.Runs["custom"] != 1 {
+		t.Errorf("The runs in the window were not counted by source. Got: %d, %v", stats.TotalRuns, stats.Runs)
+	}
+	if stats.Succeeded != 2 || stats.Failed != 2 || stats.SuccessRate == nil || *stats.SuccessRate != 0.5 {
+		t.Errorf("The success rate is wrong. Got: %d passed, %d failed, %v", stats.Succeeded, stats.Failed, stats.SuccessRate)
+	}
+	if stats.AverageDurationSeconds != 40 || stats.P95DurationSeconds != 100 {
+		t.Errorf("The durations are wrong. Got average: %v, p95: %d", stats.AverageDurationSeconds, stats.P95DurationSeconds)
+	}
+	if stats.ConsecutiveFailures != 2 {
+		t.Errorf("The failures since the last success are wrong. Got: %d", stats.ConsecutiveFailures)
+	}
+	if stats.LastSuccessAgeSeconds == nil || *stats.LastSuccessAgeSeconds != 4*3600 {
+		t.Errorf("The age of the last success is wrong. Got: %v", stats.LastSuccessAgeSeconds)
+	}
+
+	empty := (&StateTable{Status: map[string]*JobDetails{}}).ReadRunStats(now, 24*time.Hour)
+	if empty.TotalRuns != 0 || empty.SuccessRate != nil || empty.LastSuccessAgeSeconds != nil {
+		t.Errorf("Stats without runs should be empty. Got: %+v", empty)
+	}
+}
@@ -2,7 +2,6 @@ package logs
 
 type debugLogger struct {
 	logger SysLogger
-	debug  bool
 }
 
 var debuglogger debugLogger
@@ -10,16 +9,26 @@ var debuglogger debugLogger
 // TurnDebuggingOn will tell the logger to log debug messages.
 // They appear as info messages due to limits in the logging engine
 // used to run the service.
+// Turning debugging on is the same as setting the level to debug.
 func TurnDebuggingOn(logger SysLogger, debugging bool) {
 	debuglogger = debugLogger{
 		logger: logger,
-		debug:  debugging,
+	}
+	if debugging {
+		SetLevel(LevelDebug)
+	} else if CurrentLevel() == LevelDebug {
+		SetLevel(LevelInfo)
 	}
 }
 
 // DebugMessage send a debug message to the systems logger.
 func DebugMessage(msg string) {
-	if debuglogger.debug {
-		debuglogger.logger.Info("[DEBUG]", msg)
+	if !enabled(LevelDebug) || debuglogger.logger == nil {
+		return
+	}
+	if sl, ok := debuglogger.logger.(*StructuredLogger); ok {
+		sl.debug(msg)
+		return
 	}
+	debuglogger.logger.Info("[DEBUG]", msg)
 }
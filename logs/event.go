@@ -0,0 +1,50 @@
+package logs
+
+import "fmt"
+
+// Event IDs are stable so that monitoring can alert on them. The Windows event log uses
+// them as the event ID. They are kept within 1 to 1000 as that is all the message file
+// registered for the service covers.
+const (
+	// EventRunFailed is logged when a chef run fails or times out.
+	EventRunFailed uint32 = 100
+)
+
+// eventLogger is a SysLogger that can give an error an event ID, like the service
+// logger on Windows which writes to the event log.
+type eventLogger interface {
+	NError(eventID uint32, v ...interface{}) error
+}
+
+// ErrorEvent logs a formatted message at the error level with the event ID. The event
+// log on Windows gets it as the event ID. Every logger also gets it as the event_id
+// field so syslog entries can be matched on it in the same way.
+func ErrorEvent(logger SysLogger, eventID uint32, format string, a ...interface{}) error {
+	sl, ok := logger.(*StructuredLogger)
+	if !ok {
+		sl = NewStructuredLogger(logger)
+	}
+	msg := sl.WithField("event_id", eventID).format("error", fmt.Sprintf(format, a...))
+	// Errors are never dropped by the level so the wrappers can be skipped.
+	if el, ok := findEventLogger(sl.logger); ok {
+		return el.NError(eventID, msg)
+	}
+	return sl.logger.Error(msg)
+}
+
+// findEventLogger looks through the loggers that wrap logger for one that can take an event ID.
+func findEventLogger(logger SysLogger) (eventLogger, bool) {
+	for {
+		if el, ok := logger.(eventLogger); ok {
+			return el, true
+		}
+		switch wrapper := logger.(type) {
+		case *StructuredLogger:
+			logger = wrapper.logger
+		case *LeveledLogger:
+			logger = wrapper.logger
+		default:
+			return nil, false
+		}
+	}
+}
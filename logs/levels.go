@@ -0,0 +1,109 @@
+package logs
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Level is the minimum severity of message that will be logged.
+type Level int
+
+// The available log levels from the most chatty to the least.
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var (
+	levelLock    sync.RWMutex
+	currentLevel = LevelInfo
+)
+
+// ParseLevel will convert a level name into a Level.
+// Valid names are debug, info, warn and error.
+func ParseLevel(name string) (Level, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "debug":
+		return LevelDebug, nil
+	case "", "info":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	}
+	return LevelInfo, fmt.Errorf("%q is not a valid log level. Use debug, info, warn or error", name)
+}
+
+// SetLevel will set the minimum level of messages that are logged.
+func SetLevel(level Level) {
+	levelLock.Lock()
+	defer levelLock.Unlock()
+	currentLevel = level
+}
+
+// CurrentLevel will return the minimum level of messages that are logged.
+func CurrentLevel() Level {
+	levelLock.RLock()
+	defer levelLock.RUnlock()
+	return currentLevel
+}
+
+func enabled(level Level) bool {
+	return CurrentLevel() <= level
+}
+
+// LeveledLogger wraps a SysLogger and drops any messages below the current level.
+type LeveledLogger struct {
+	logger SysLogger
+}
+
+// NewLeveledLogger will return a SysLogger that respects the current log level.
+func NewLeveledLogger(logger SysLogger) *LeveledLogger {
+	return &LeveledLogger{logger: logger}
+}
+
+// Error will always be logged.
+func (ll *LeveledLogger) Error(v ...interface{}) error {
+	return ll.logger.Error(v...)
+}
+
+// Warning is logged when the level is warn or lower.
+func (ll *LeveledLogger) Warning(v ...interface{}) error {
+	if !enabled(LevelWarn) {
+		return nil
+	}
+	return ll.logger.Warning(v...)
+}
+
+// Info is logged when the level is info or lower.
+func (ll *LeveledLogger) Info(v ...interface{}) error {
+	if !enabled(LevelInfo) {
+		return nil
+	}
+	return ll.logger.Info(v...)
+}
+
+// Errorf will always be logged.
+func (ll *LeveledLogger) Errorf(format string, a ...interface{}) error {
+	return ll.logger.Errorf(format, a...)
+}
+
+// Warningf is logged when the level is warn or lower.
+func (ll *LeveledLogger) Warningf(format string, a ...interface{}) error {
+	if !enabled(LevelWarn) {
+		return nil
+	}
+	return ll.logger.Warningf(format, a...)
+}
+
+// Infof is logged when the level is info or lower.
+func (ll *LeveledLogger) Infof(format string, a ...interface{}) error {
+	if !enabled(LevelInfo) {
+		return nil
+	}
+	return ll.logger.Infof(format, a...)
+}
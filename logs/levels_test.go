@@ -0,0 +1,60 @@
+package logs
+
+import "testing"
+
+// countingLogger counts how many messages reach it at each level.
+type countingLogger struct {
+	FakeLogger
+	errors, warnings, infos int
+}
+
+func (cl *countingLogger) Error(v ...interface{}) error   { cl.errors++; return nil }
+func (cl *countingLogger) Warning(v ...interface{}) error { cl.warnings++; return nil }
+func (cl *countingLogger) Info(v ...interface{}) error    { cl.infos++; return nil }
+
+func TestLeveledLogger(t *testing.T) {
+	defer SetLevel(LevelInfo)
+	tests := []struct {
+		level                   string
+		errors, warnings, infos int
+	}{
+		{level: "debug", errors: 1, warnings: 1, infos: 2},
+		{level: "info", errors: 1, warnings: 1, infos: 1},
+		{level: "warn", errors: 1, warnings: 1, infos: 0},
+		{level: "error", errors: 1, warnings: 0, infos: 0},
+	}
+
+	for _, test := range tests {
+		level, err := ParseLevel(test.level)
+		if err != nil {
+			t.Fatalf("ParseLevel(%s) returned an error: %s", test.level, err)
+		}
+		counter := &countingLogger{}
+		logger := NewLeveledLogger(counter)
+		SetLevel(level)
+		debuglogger = debugLogger{logger: logger}
+
+		logger.Error("error")
+		logger.Warning("warning")
+		logger.Info("info")
+		DebugMessage("debug")
+
+		if counter.errors != test.errors || counter.warnings != test.warnings || counter.infos != test.infos {
+			t.Errorf("Level %s let the wrong messages through. Got: %d/%d/%d, Want: %d/%d/%d",
+				test.level,
+				counter.errors, counter.warnings, counter.infos,
+				test.errors, test.warnings, test.infos,
+			)
+		}
+	}
+
+	if _, err := ParseLevel("loud"); err == nil {
+		t.Errorf("ParseLevel should reject unknown levels")
+	}
+
+	SetLevel(LevelError)
+	TurnDebuggingOn(NewFakeLogger(false), true)
+	if CurrentLevel() != LevelDebug {
+		t.Errorf("TurnDebuggingOn(true) should set the level to debug")
+	}
+}
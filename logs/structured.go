@@ -0,0 +1,167 @@
+package logs
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Fields are key value pairs that are attached to a log entry.
+type Fields map[string]interface{}
+
+// Format is how log entries are written out.
+type Format int
+
+// The available log formats.
+const (
+	FormatText Format = iota
+	FormatJSON
+)
+
+var (
+	formatLock    sync.RWMutex
+	currentFormat = FormatText
+)
+
+// ParseFormat will convert a format name into a Format. Valid names are text and json.
+func ParseFormat(name string) (Format, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "", "text":
+		return FormatText, nil
+	case "json":
+		return FormatJSON, nil
+	}
+	return FormatText, fmt.Errorf("%q is not a valid log format. Use text or json", name)
+}
+
+// SetFormat will set how log entries are written out.
+func SetFormat(format Format) {
+	formatLock.Lock()
+	defer formatLock.Unlock()
+	currentFormat = format
+}
+
+func readFormat() Format {
+	formatLock.RLock()
+	defer formatLock.RUnlock()
+	return currentFormat
+}
+
+// StructuredLogger is a SysLogger that can carry fields with it. The fields are
+// added to every message that it logs. In the json format each entry is written
+// as a json object with the level, message, timestamp and fields.
+type StructuredLogger struct {
+	logger SysLogger
+	fields Fields
+}
+
+// NewStructuredLogger will wrap a SysLogger so that fields can be attached to its messages.
+func NewStructuredLogger(logger SysLogger) *StructuredLogger {
+	return &StructuredLogger{logger: logger, fields: Fields{}}
+}
+
+// WithField will return a logger that adds the key and value to every message.
+func WithField(logger SysLogger, key string, value interface{}) SysLogger {
+	return WithFields(logger, Fields{key: value})
+}
+
+// WithFields will return a logger that adds the fields to every message.
+func WithFields(logger SysLogger, fields Fields) SysLogger {
+	sl, ok := logger.(*StructuredLogger)
+	if !ok {
+		sl = NewStructuredLogger(logger)
+	}
+	return sl.WithFields(fields)
+}
+
+// WithFields will return a copy of the logger with the extra fields added.
+func (sl *StructuredLogger) WithFields(fields Fields) *StructuredLogger {
+	newFields := make(Fields, len(sl.fields)+len(fields))
+	for k, v := range sl.fields {
+		newFields[k] = v
+	}
+	for k, v := range fields {
+		newFields[k] = v
+	}
+	return &StructuredLogger{logger: sl.logger, fields: newFields}
+}
+
+// WithField will return a copy of the logger with the extra field added.
+func (sl *StructuredLogger) WithField(key string, value interface{}) *StructuredLogger {
+	return sl.WithFields(Fields{key: value})
+}
+
+// format will create the message that is sent to the underlying logger.
+func (sl *StructuredLogger) format(level, msg string) string {
+	msg = strings.TrimRight(msg, "\n")
+	if readFormat() == FormatJSON {
+		entry := make(map[string]interface{}, len(sl.fields)+3)
+		for k, v := range sl.fields {
+			if err, ok := v.(error); ok {
+				v = err.Error()
+			}
+			entry[k] = v
+		}
+		entry["level"] = level
+		entry["message"] = msg
+		entry["timestamp"] = time.Now().UTC().Format(time.RFC3339Nano)
+		b, err := json.Marshal(entry)
+		if err == nil {
+			return string(b)
+		}
+	}
+	if len(sl.fields) == 0 {
+		return msg
+	}
+	keys := make([]string, 0, len(sl.fields))
+	for k := range sl.fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, fmt.Sprintf("%s=%v", k, sl.fields[k]))
+	}
+	return msg + " " + strings.Join(pairs, " ")
+}
+
+// debug is used by DebugMessage so that debug entries carry the debug level.
+func (sl *StructuredLogger) debug(msg string) error {
+	if readFormat() == FormatJSON {
+		return sl.logger.Info(sl.format("debug", msg))
+	}
+	return sl.logger.Info("[DEBUG]", sl.format("debug", msg))
+}
+
+// Error logs a message at the error level.
+func (sl *StructuredLogger) Error(v ...interface{}) error {
+	return sl.logger.Error(sl.format("error", fmt.Sprint(v...)))
+}
+
+// Warning logs a message at the warning level.
+func (sl *StructuredLogger) Warning(v ...interface{}) error {
+	return sl.logger.Warning(sl.format("warning", fmt.Sprint(v...)))
+}
+
+// Info logs a message at the info level.
+func (sl *StructuredLogger) Info(v ...interface{}) error {
+	return sl.logger.Info(sl.format("info", fmt.Sprint(v...)))
+}
+
+// Errorf logs a formatted message at the error level.
+func (sl *StructuredLogger) Errorf(format string, a ...interface{}) error {
+	return sl.logger.Error(sl.format("error", fmt.Sprintf(format, a...)))
+}
+
+// Warningf logs a formatted message at the warning level.
+func (sl *StructuredLogger) Warningf(format string, a ...interface{}) error {
+	return sl.logger.Warning(sl.format("warning", fmt.Sprintf(format, a...)))
+}
+
+// Infof logs a formatted message at the info level.
+func (sl *StructuredLogger) Infof(format string, a ...interface{}) error {
+	return sl.logger.Info(sl.format("info", fmt.Sprintf(format, a...)))
+}
@@ -0,0 +1,87 @@
+package logs
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+// capturingLogger keeps the last message that it was sent.
+type capturingLogger struct {
+	FakeLogger
+	last string
+}
+
+func (cl *capturingLogger) Info(v ...interface{}) error { cl.last = fmt.Sprint(v...); return nil }
+
+func TestStructuredLogger(t *testing.T) {
+	defer SetFormat(FormatText)
+	capture := &capturingLogger{}
+	logger := WithField(NewStructuredLogger(capture), "guid", "1234")
+	logger = WithFields(logger, Fields{"request_id": "abc"})
+
+	SetFormat(FormatText)
+	logger.Infof("Run %s started", "now")
+	if capture.last != "Run now started guid=1234 request_id=abc" {
+		t.Errorf("Text format is not correct. Got: %s", capture.last)
+	}
+
+	SetFormat(FormatJSON)
+	logger.Info("Run started")
+	entry := make(map[string]interface{})
+	if err := json.Unmarshal([]byte(capture.last), &entry); err != nil {
+		t.Fatalf("JSON format did not produce json. Got: %s", capture.last)
+	}
+	for key, want := range map[string]string{"level": "info", "message": "Run started", "guid": "1234", "request_id": "abc"} {
+		if entry[key] != want {
+			t.Errorf("JSON entry %s is wrong. Got: %v, Want: %s", key, entry[key], want)
+		}
+	}
+	if _, ok := entry["timestamp"]; !ok {
+		t.Errorf("JSON entry is missing the timestamp. Got: %s", capture.last)
+	}
+
+	if _, err := ParseFormat("xml"); err == nil {
+		t.Errorf("ParseFormat should reject unknown formats")
+	}
+}
+
+// errorCapturingLogger keeps the last error that it was sent.
+type errorCapturingLogger struct {
+	FakeLogger
+	last string
+}
+
+func (el *errorCapturingLogger) Error(v ...interface{}) error { el.last = fmt.Sprint(v...); return nil }
+
+// eventCapturingLogger keeps the last error and the event ID it was sent with.
+type eventCapturingLogger struct {
+	FakeLogger
+	last    string
+	eventID uint32
+}
+
+func (el *eventCapturingLogger) Error(v ...interface{}) error { el.last = fmt.Sprint(v...); return nil }
+func (el *eventCapturingLogger) NError(eventID uint32, v ...interface{}) error {
+	el.eventID = eventID
+	el.last = fmt.Sprint(v...)
+	return nil
+}
+
+func TestErrorEvent(t *testing.T) {
+	defer SetFormat(FormatText)
+	SetFormat(FormatText)
+
+	events := &eventCapturingLogger{}
+	logger := WithField(NewStructuredLogger(NewLeveledLogger(events)), "guid", "1234")
+	ErrorEvent(logger, EventRunFailed, "Run %s failed", "1234")
+	if events.eventID != EventRunFailed || events.last != "Run 1234 failed event_id=100 guid=1234" {
+		t.Errorf("The event log did not get the event ID. Got: %d, %q", events.eventID, events.last)
+	}
+
+	plain := &errorCapturingLogger{}
+	ErrorEvent(NewLeveledLogger(plain), EventRunFailed, "Run failed")
+	if plain.last != "Run failed event_id=100" {
+		t.Errorf("A logger without events should get the event ID as a field. Got: %q", plain.last)
+	}
+}
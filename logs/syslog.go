@@ -0,0 +1,47 @@
+package logs
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DefaultSyslogTag is the tag that the service writes to syslog with.
+const DefaultSyslogTag = "chefwaiter"
+
+// syslogFacilities maps the syslog facility names to their codes.
+var syslogFacilities = map[string]int{
+	"kern":     0,
+	"user":     1,
+	"mail":     2,
+	"daemon":   3,
+	"auth":     4,
+	"syslog":   5,
+	"lpr":      6,
+	"news":     7,
+	"uucp":     8,
+	"cron":     9,
+	"authpriv": 10,
+	"ftp":      11,
+	"local0":   16,
+	"local1":   17,
+	"local2":   18,
+	"local3":   19,
+	"local4":   20,
+	"local5":   21,
+	"local6":   22,
+	"local7":   23,
+}
+
+// ParseSyslogFacility will convert a facility name, eg daemon or local0, into its code.
+// An empty name is 0, the facility used when none is set.
+func ParseSyslogFacility(name string) (int, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" {
+		return 0, nil
+	}
+	facility, ok := syslogFacilities[name]
+	if !ok {
+		return 0, fmt.Errorf("%q is not a valid syslog facility. Use a name like daemon or local0", name)
+	}
+	return facility, nil
+}
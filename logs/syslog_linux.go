@@ -0,0 +1,51 @@
+package logs
+
+import (
+	"fmt"
+	"log/syslog"
+)
+
+// NewSyslogLogger will return a SysLogger that writes to the local syslog with the
+// tag and facility. The tag defaults to DefaultSyslogTag.
+func NewSyslogLogger(tag, facility string) (SysLogger, error) {
+	code, err := ParseSyslogFacility(facility)
+	if err != nil {
+		return nil, err
+	}
+	if tag == "" {
+		tag = DefaultSyslogTag
+	}
+	w, err := syslog.New(syslog.Priority(code<<3)|syslog.LOG_INFO, tag)
+	if err != nil {
+		return nil, err
+	}
+	return syslogLogger{w}, nil
+}
+
+type syslogLogger struct {
+	*syslog.Writer
+}
+
+func (s syslogLogger) Error(v ...interface{}) error {
+	return s.Writer.Err(fmt.Sprint(v...))
+}
+
+func (s syslogLogger) Warning(v ...interface{}) error {
+	return s.Writer.Warning(fmt.Sprint(v...))
+}
+
+func (s syslogLogger) Info(v ...interface{}) error {
+	return s.Writer.Info(fmt.Sprint(v...))
+}
+
+func (s syslogLogger) Errorf(format string, a ...interface{}) error {
+	return s.Writer.Err(fmt.Sprintf(format, a...))
+}
+
+func (s syslogLogger) Warningf(format string, a ...interface{}) error {
+	return s.Writer.Warning(fmt.Sprintf(format, a...))
+}
+
+func (s syslogLogger) Infof(format string, a ...interface{}) error {
+	return s.Writer.Info(fmt.Sprintf(format, a...))
+}
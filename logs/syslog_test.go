@@ -0,0 +1,28 @@
+package logs
+
+import "testing"
+
+func TestParseSyslogFacility(t *testing.T) {
+	tests := []struct {
+		name      string
+		expected  int
+		expectErr bool
+	}{
+		{name: "", expected: 0},
+		{name: "daemon", expected: 3},
+		{name: " Local0 ", expected: 16},
+		{name: "local7", expected: 23},
+		{name: "local8", expectErr: true},
+	}
+
+	for _, test := range tests {
+		facility, err := ParseSyslogFacility(test.name)
+		if (err != nil) != test.expectErr {
+			t.Errorf("ParseSyslogFacility(%q) returned the wrong error. Got: %v, Want error: %t", test.name, err, test.expectErr)
+			continue
+		}
+		if facility != test.expected {
+			t.Errorf("ParseSyslogFacility(%q) returned the wrong facility. Got: %d, Want: %d", test.name, facility, test.expected)
+		}
+	}
+}
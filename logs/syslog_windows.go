@@ -0,0 +1,8 @@
+package logs
+
+import "errors"
+
+// NewSyslogLogger always fails as there is no syslog on Windows. The event log is used instead.
+func NewSyslogLogger(tag, facility string) (SysLogger, error) {
+	return nil, errors.New("syslog is not available on Windows")
+}
@@ -6,6 +6,7 @@ import (
 	"log"
 	"os"
 
+	"github.com/morfien101/chef-waiter/config"
 	"github.com/morfien101/chef-waiter/logs"
 	"github.com/morfien101/service"
 )
@@ -14,11 +15,20 @@ import (
 // Don't change this as the build server tags the builds.
 var VERSION = "1.0.0"
 
+// GitCommit and BuildDate are set by the build server with -ldflags, eg:
+// -X main.GitCommit=$(git rev-parse HEAD) -X main.BuildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)
+var (
+	GitCommit = "unknown"
+	BuildDate = "unknown"
+)
+
 // Flags for the application launch
 var (
 	versionCheck = flag.Bool("v", false, "Outputs the version of the program.")
 	helpFlag     = flag.Bool("h", false, "Shows the help menu")
 	svcFlag      = flag.String("service", "", "Control the system service.")
+	checkConfig  = flag.Bool("check-config", false, "Validates the configuration found in CHEFWAITER_CONFIG, prints it and exits.")
+	runOnce      = flag.Bool("run-once", false, "Makes a single chef run without starting the API, prints the result and exits with the chef exit code.")
 	logger       logs.SysLogger
 )
 
@@ -84,4 +94,33 @@ func digestFlags() {
 		flag.PrintDefaults()
 		os.Exit(0)
 	}
+
+	if *checkConfig {
+		os.Exit(checkConfiguration())
+	}
+
+	if *runOnce {
+		os.Exit(runOnceAndExit())
+	}
+}
+
+// checkConfiguration will load and validate the configuration and print the resolved values.
+// It returns the exit code that the program should use.
+func checkConfiguration() int {
+	runningConfig, err := config.New(os.Getenv("CHEFWAITER_CONFIG"), service.ConsoleLogger)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	resolved, err := runningConfig.RedactedJSON()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Println(string(resolved))
+	if err := runningConfig.Validate(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
 }
@@ -0,0 +1,64 @@
+package metrics
+
+import "sync"
+
+var (
+	fakeLock sync.RWMutex
+	fake     *FakeMetrics
+)
+
+// FakeMetric is a metric that was sent to a FakeMetrics.
+// Kind is the name of the function used to send it, eg Timing.
+type FakeMetric struct {
+	Kind  string
+	Stat  string
+	Value int64
+	Tags  map[string]string
+}
+
+// FakeMetrics can be used in tests to see the metrics that are sent.
+type FakeMetrics struct {
+	lock sync.Mutex
+	sent []FakeMetric
+}
+
+// SetupFake sends all the metrics to a new FakeMetrics in place of statsd until
+// StopFake is called.
+func SetupFake() *FakeMetrics {
+	fakeLock.Lock()
+	defer fakeLock.Unlock()
+	fake = &FakeMetrics{}
+	return fake
+}
+
+// StopFake stops sending metrics to the FakeMetrics.
+func StopFake() {
+	fakeLock.Lock()
+	defer fakeLock.Unlock()
+	fake = nil
+}
+
+// Sent returns the metrics sent so far, oldest first.
+func (fm *FakeMetrics) Sent() []FakeMetric {
+	fm.lock.Lock()
+	defer fm.lock.Unlock()
+	return append([]FakeMetric{}, fm.sent...)
+}
+
+// recordFake keeps the metric in the FakeMetrics and returns true if one is set up.
+func recordFake(kind, stat string, value int64, tagsInput map[string]string) bool {
+	fakeLock.RLock()
+	fm := fake
+	fakeLock.RUnlock()
+	if fm == nil {
+		return false
+	}
+	tags := make(map[string]string, len(tagsInput))
+	for k, v := range tagsInput {
+		tags[k] = v
+	}
+	fm.lock.Lock()
+	defer fm.lock.Unlock()
+	fm.sent = append(fm.sent, FakeMetric{Kind: kind, Stat: stat, Value: value, Tags: tags})
+	return true
+}
@@ -12,12 +12,13 @@ var (
 )
 
 // Setup will start the statsd client and enable the functions for it.
-func Setup(stastdHost string, tagsInput map[string]string) {
+// All metric names are prefixed with prefix.
+func Setup(stastdHost, prefix string, tagsInput map[string]string) {
 	stdClient = statsd.NewClient(
 		stastdHost,
 		statsd.MaxPacketSize(1400),
 		statsd.ReconnectInterval(time.Second*60),
-		statsd.MetricPrefix("chefwaiter."),
+		statsd.MetricPrefix(prefix),
 		statsd.TagStyle(statsd.TagFormatDatadog),
 		statsd.DefaultTags(
 			convertTags(tagsInput)...,
@@ -46,6 +47,9 @@ func convertTags(tagsInput map[string]string) []statsd.Tag {
 //
 // Often used to note a particular event, for example incoming web request.
 func Incr(stat string, count int64, tagsInput map[string]string) {
+	if recordFake("Incr", stat, count, tagsInput) {
+		return
+	}
 	if on {
 		stdClient.Incr(stat, count, convertTags(tagsInput)...)
 	}
@@ -55,6 +59,9 @@ func Incr(stat string, count int64, tagsInput map[string]string) {
 //
 // Often used to note a particular event
 func Decr(stat string, count int64, tagsInput map[string]string) {
+	if recordFake("Decr", stat, count, tagsInput) {
+		return
+	}
 	if on {
 		stdClient.Decr(stat, count, convertTags(tagsInput)...)
 	}
@@ -62,6 +69,9 @@ func Decr(stat string, count int64, tagsInput map[string]string) {
 
 // Timing tracks a duration event, the time delta must be given in milliseconds
 func Timing(stat string, delta int64, tagsInput map[string]string) {
+	if recordFake("Timing", stat, delta, tagsInput) {
+		return
+	}
 	if on {
 		stdClient.Timing(stat, delta, convertTags(tagsInput)...)
 	}
@@ -76,6 +86,9 @@ func Timing(stat string, delta int64, tagsInput map[string]string) {
 // underlying protocol, you can't explicitly set a gauge to a negative number without
 // first setting it to zero.
 func Gauge(stat string, value int64, tagsInput map[string]string) {
+	if recordFake("Gauge", stat, value, tagsInput) {
+		return
+	}
 	if on {
 		stdClient.Gauge(stat, value, convertTags(tagsInput)...)
 	}
@@ -83,6 +96,9 @@ func Gauge(stat string, value int64, tagsInput map[string]string) {
 
 // GaugeDelta sends a change for a gauge
 func GaugeDelta(stat string, value int64, tagsInput map[string]string) {
+	if recordFake("GaugeDelta", stat, value, tagsInput) {
+		return
+	}
 	if on {
 		stdClient.GaugeDelta(stat, value, convertTags(tagsInput)...)
 	}
@@ -0,0 +1,40 @@
+package metrics
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestConvertTags(t *testing.T) {
+	if tags := convertTags(nil); tags != nil {
+		t.Errorf("No tags should convert to nil. Got: %v", tags)
+	}
+	if tags := convertTags(map[string]string{"route": "/healthcheck", "method": "GET"}); len(tags) != 2 {
+		t.Errorf("Each tag should be converted. Got: %d tags", len(tags))
+	}
+}
+
+func TestFakeMetrics(t *testing.T) {
+	// Nothing is sent, and nothing fails, before Setup is called.
+	Incr("dropped", 1, nil)
+
+	fake := SetupFake()
+	Incr("runs", 1, map[string]string{"source": "demand"})
+	Decr("runs", 1, nil)
+	Timing("http_request_time", 12, map[string]string{"route": "/cheflogs/{guid}"})
+	Gauge("state_table_size", 20, nil)
+	GaugeDelta("running_jobs", -1, nil)
+	StopFake()
+	Incr("dropped", 1, nil)
+
+	want := []FakeMetric{
+		{Kind: "Incr", Stat: "runs", Value: 1, Tags: map[string]string{"source": "demand"}},
+		{Kind: "Decr", Stat: "runs", Value: 1, Tags: map[string]string{}},
+		{Kind: "Timing", Stat: "http_request_time", Value: 12, Tags: map[string]string{"route": "/cheflogs/{guid}"}},
+		{Kind: "Gauge", Stat: "state_table_size", Value: 20, Tags: map[string]string{}},
+		{Kind: "GaugeDelta", Stat: "running_jobs", Value: -1, Tags: map[string]string{}},
+	}
+	if got := fake.Sent(); !reflect.DeepEqual(got, want) {
+		t.Errorf("The wrong metrics were sent. Got: %+v, Want: %+v", got, want)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/morfien101/chef-waiter/cheflogs"
+	"github.com/morfien101/chef-waiter/chefrunner"
+	"github.com/morfien101/chef-waiter/config"
+	"github.com/morfien101/chef-waiter/internalstate"
+	"github.com/morfien101/service"
+)
+
+// runOnceAndExit will make a single chef run without starting the API or periodic runs.
+// The run is recorded in the state file and its log written as it would be by the service.
+// It returns the exit code of chef, or 1 if the run could not be made.
+func runOnceAndExit() int {
+	runningConfig, err := config.New(os.Getenv("CHEFWAITER_CONFIG"), service.ConsoleLogger)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if err := runningConfig.Validate(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	for _, dir := range []string{runningConfig.LogLocation(), runningConfig.StateFileLocation()} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to make directory %s. Error: %s\n", dir, err)
+			return 1
+		}
+	}
+
+	chefLogWorker := cheflogs.New(runningConfig, service.ConsoleLogger)
+	state := internalstate.New(runningConfig, chefLogWorker, service.ConsoleLogger)
+	guid, exitCode := chefrunner.RunOnce(runningConfig, state, chefLogWorker, service.ConsoleLogger)
+	if err := state.SaveStateToDisk(); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to save the state file. Error: %s\n", err)
+	}
+
+	result, err := json.MarshalIndent(state.Read(guid), "", "  ")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Println(string(result))
+	fmt.Printf("Log: %s\n", chefLogWorker.GetLogPath(guid))
+	return exitCode
+}
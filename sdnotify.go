@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// sdNotify sends a state message, eg READY=1, to systemd.
+// Nothing is sent when chef waiter was not started by systemd with a notify socket.
+func sdNotify(state string) error {
+	socketPath := os.Getenv("NOTIFY_SOCKET")
+	if socketPath == "" {
+		return nil
+	}
+	// Sockets starting with @ are in the abstract namespace.
+	if socketPath[0] == '@' {
+		socketPath = "\x00" + socketPath[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// sdWatchdogInterval returns how often systemd should be told that we are still alive.
+// This is half of WATCHDOG_USEC as systemd recommends. 0 is returned if the watchdog is
+// not enabled for this process.
+func sdWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// sdWatchdog will keep telling systemd that we are alive until stop is closed.
+// healthy is called before each ping. If it returns false, or never returns because
+// something has wedged, systemd stops hearing from us and will restart the service.
+func sdWatchdog(interval time.Duration, healthy func() bool, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if !healthy() {
+				logger.Warning("Health check failed. Not notifying the systemd watchdog.")
+				continue
+			}
+			if err := sdNotify("WATCHDOG=1"); err != nil {
+				logger.Warningf("Failed to notify the systemd watchdog. Error: %s", err)
+			}
+		}
+	}
+}
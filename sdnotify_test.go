@@ -0,0 +1,75 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSdNotify(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("systemd is not available on windows")
+	}
+	os.Unsetenv("NOTIFY_SOCKET")
+	if err := sdNotify("READY=1"); err != nil {
+		t.Errorf("sdNotify should do nothing without NOTIFY_SOCKET. Got error: %s", err)
+	}
+
+	dir, err := ioutil.TempDir("", "chefwaiter_sdnotify")
+	if err != nil {
+		t.Fatalf("Failed to create a temp directory. Error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	socketPath := filepath.Join(dir, "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("Failed to create a notify socket. Error: %s", err)
+	}
+	defer conn.Close()
+
+	os.Setenv("NOTIFY_SOCKET", socketPath)
+	defer os.Unsetenv("NOTIFY_SOCKET")
+	if err := sdNotify("READY=1"); err != nil {
+		t.Fatalf("sdNotify failed. Error: %s", err)
+	}
+	buf := make([]byte, 64)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("Failed to read the notification. Error: %s", err)
+	}
+	if string(buf[:n]) != "READY=1" {
+		t.Errorf("Got the wrong notification. Got: %q, Want: %q", buf[:n], "READY=1")
+	}
+}
+
+func TestSdWatchdogInterval(t *testing.T) {
+	defer os.Unsetenv("WATCHDOG_USEC")
+	defer os.Unsetenv("WATCHDOG_PID")
+
+	tests := []struct {
+		name string
+		usec string
+		pid  string
+		want time.Duration
+	}{
+		{name: "Not set", want: 0},
+		{name: "Half of the timeout", usec: "30000000", want: 15 * time.Second},
+		{name: "Our pid", usec: "2000000", pid: strconv.Itoa(os.Getpid()), want: time.Second},
+		{name: "Another pid", usec: "2000000", pid: "1", want: 0},
+		{name: "Rubbish", usec: "soon", want: 0},
+	}
+
+	for _, test := range tests {
+		os.Setenv("WATCHDOG_USEC", test.usec)
+		os.Setenv("WATCHDOG_PID", test.pid)
+		if got := sdWatchdogInterval(); got != test.want {
+			t.Errorf("%s: got interval %s, want %s", test.name, got, test.want)
+		}
+	}
+}
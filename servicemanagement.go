@@ -3,6 +3,8 @@ package main
 import (
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/morfien101/service"
 
@@ -12,6 +14,7 @@ import (
 	"github.com/morfien101/chef-waiter/internalstate"
 	"github.com/morfien101/chef-waiter/logs"
 	"github.com/morfien101/chef-waiter/metrics"
+	"github.com/morfien101/chef-waiter/tracing"
 	"github.com/morfien101/chef-waiter/webengine"
 )
 
@@ -52,7 +55,7 @@ func (p *program) run() error {
 	errChan := make(chan error, 20)
 	// read the file from the standard locations
 	//   - We could use an environment variable here as there is no other way we know anything yet.
-	logger.Infof("Starting Chefwaiter with version: %s", VERSION)
+	logger.Infof("Starting Chefwaiter with version: %s, git commit: %s, build date: %s", VERSION, GitCommit, BuildDate)
 	// read the file from the standard locations
 	// Use an environment variable here as there is no other way we know anything yet.
 	runningConfig, err := config.New(os.Getenv("CHEFWAITER_CONFIG"), logger)
@@ -60,7 +63,45 @@ func (p *program) run() error {
 		logger.Error(err)
 		terminate(2)
 	}
+	// The syslog tag and facility can only be changed once the configuration is read.
+	// Interactive runs log to the console and Windows uses the event log so they are left alone.
+	if (runningConfig.SyslogTag() != "" || runningConfig.SyslogFacility() != "") && !service.Interactive() {
+		syslogLogger, err := logs.NewSyslogLogger(runningConfig.SyslogTag(), runningConfig.SyslogFacility())
+		if err != nil {
+			logger.Warningf("Failed to use the configured syslog tag and facility, logging as before. Error: %s", err)
+		} else {
+			logger = syslogLogger
+		}
+	}
+	// Only show messages at or above the configured level, in the configured format, from here on.
+	// Debug in the configuration file still turns on debug messages.
+	logLevel, err := logs.ParseLevel(runningConfig.LogLevel())
+	if err != nil {
+		logger.Error(err)
+		terminate(2)
+	}
+	logFormat, err := logs.ParseFormat(runningConfig.LogFormat())
+	if err != nil {
+		logger.Error(err)
+		terminate(2)
+	}
+	logs.SetLevel(logLevel)
+	logs.SetFormat(logFormat)
+	logger = logs.NewStructuredLogger(logs.NewLeveledLogger(logger))
 	logs.TurnDebuggingOn(logger, runningConfig.Debug())
+	if err := runningConfig.Validate(); err != nil {
+		logger.Error(err)
+		terminate(2)
+	}
+	for _, warning := range runningConfig.Warnings() {
+		logger.Warning(warning)
+	}
+	// Record what this node booted with. Secrets are redacted.
+	if effectiveConfig, err := runningConfig.Redacted(); err != nil {
+		logger.Warningf("Failed to read the effective configuration. Error: %s", err)
+	} else {
+		logs.WithFields(logger, logs.Fields(effectiveConfig)).Info("Effective configuration")
+	}
 	// This is the first place that we can actually send a metric because we now know
 	// if we need to.
 	if runningConfig.MetricsEnabled {
@@ -72,7 +113,13 @@ func (p *program) run() error {
 			}
 			runningConfig.MetricsDefaultTags["host"] = hostname
 		}
-		metrics.Setup(runningConfig.MetricsHost, runningConfig.MetricsDefaultTags)
+		metrics.Setup(runningConfig.MetricsHost, runningConfig.MetricsPrefix, runningConfig.MetricsDefaultTags)
+	}
+	if runningConfig.TracingEndpoint() != "" {
+		logs.DebugMessage("Starting trace exporter.")
+		tracing.Setup(runningConfig.TracingEndpoint(), "chefwaiter", func(err error) {
+			logger.Warningf("Failed to export traces. Error: %s", err)
+		})
 	}
 	metrics.Incr("starting", 1, map[string]string{"version": VERSION})
 	logs.DebugMessage("Starting Service run() function.")
@@ -93,10 +140,13 @@ func (p *program) run() error {
 	go chefLogWorker.LogSweepEngine()
 	// Initialize a new state tables
 	state := internalstate.New(runningConfig, chefLogWorker, logger)
-	appState := internalstate.NewAppStatus(VERSION, state, logger)
-	appState.SetWhiteListing(runningConfig.InternalWhiteListCustomRuns, runningConfig.InternalAllowedCustomRuns)
+	appState := internalstate.NewAppStatus(VERSION, runningConfig, state, chefLogWorker, logger)
+	appState.SetBuildInfo(GitCommit, BuildDate)
+	// The whitelist is only used when it has entries so the status shows the same.
+	whiteListInUse := runningConfig.WhiteListCustomRuns() && len(runningConfig.AllowedCustomRuns()) > 0
+	appState.SetWhiteListing(whiteListInUse, runningConfig.AllowedCustomRuns())
 	// start the job engine that runs the commands.
-	workers := chefrunner.New(state, chefLogWorker, logger)
+	workers := chefrunner.New(runningConfig, state, chefLogWorker, logger)
 
 	// Start the sweeper process to keep state tables clean.
 	go state.ClearOldRuns()
@@ -104,14 +154,33 @@ func (p *program) run() error {
 	go state.PersistState()
 
 	// Start the HTTP Engine
-	httpEngine := webengine.New(state, appState, workers, chefLogWorker, logger)
-	if runningConfig.WhiteListCustomRuns() {
-		if len(runningConfig.AllowedCustomRuns()) > 0 {
-			httpEngine.SetWhitelist(runningConfig.AllowedCustomRuns())
-		}
+	httpEngine := webengine.New(state, appState, workers, chefLogWorker, logger, runningConfig.DisabledEndpointGroups())
+	if whiteListInUse {
+		httpEngine.SetWhitelist(runningConfig.AllowedCustomRuns())
+		httpEngine.SetReasonRequiredRuns(runningConfig.ReasonRequiredCustomRuns())
+	}
+	httpEngine.SetAllowedExtraFlags(runningConfig.AllowedExtraFlags())
+	httpEngine.SetAllowedRunAsUsers(runningConfig.AllowedRunAsUsers())
+	httpEngine.SetBlockOnDemandInMaintenance(runningConfig.BlockOnDemandInMaintenance())
+	httpEngine.SetAdminToken(runningConfig.AdminToken())
+	httpEngine.SetMaxRequestBodyBytes(runningConfig.MaxRequestBodyBytes())
+	if err := httpEngine.SetNetworkPolicy(webengine.NetworkPolicy{
+		ReadAllowed:    runningConfig.ReadAllowedNetworks(),
+		ReadDenied:     runningConfig.ReadDeniedNetworks(),
+		WriteAllowed:   runningConfig.WriteAllowedNetworks(),
+		WriteDenied:    runningConfig.WriteDeniedNetworks(),
+		TrustedProxies: runningConfig.TrustedProxies(),
+	}); err != nil {
+		logger.Errorf("Failed to set the network policy. Error: %s", err)
+		terminate(2)
 	}
 	listenString := fmt.Sprintf("%s:%d", runningConfig.ListenAddress(), runningConfig.ListenPort())
-	if runningConfig.TLSEnabled() {
+	if runningConfig.ListenTransport() == "unix" {
+		logs.DebugMessage("Starting Web Server on a unix socket with StartHTTPEngineUnix() function.")
+		go func() {
+			errChan <- httpEngine.StartHTTPEngineUnix(runningConfig.ListenSocket())
+		}()
+	} else if runningConfig.TLSEnabled() {
 		logs.DebugMessage("Starting Web Server with TLS Supported StartHTTPSEngine() function.")
 		go func() {
 			errChan <- httpEngine.StartHTTPSEngine(listenString, runningConfig.CertPath(), runningConfig.KeyPath())
@@ -123,6 +192,76 @@ func (p *program) run() error {
 		}()
 	}
 
+	// The read only listener serves the endpoints that only show state, eg to a monitoring network.
+	if port := runningConfig.ReadOnlyListenPort(); port != 0 {
+		readOnlyListenString := fmt.Sprintf("%s:%d", runningConfig.ReadOnlyListenAddress(), port)
+		certPath, keyPath := "", ""
+		if runningConfig.TLSEnabled() {
+			certPath, keyPath = runningConfig.CertPath(), runningConfig.KeyPath()
+		}
+		logs.DebugMessage(fmt.Sprintf("Starting the read only Web Server on %s.", readOnlyListenString))
+		go func() {
+			errChan <- httpEngine.StartReadOnlyHTTPEngine(readOnlyListenString, certPath, keyPath)
+		}()
+	}
+
+	// A SIGHUP loads the TLS certificate again, eg after it has been renewed.
+	hangUp := make(chan os.Signal, 1)
+	signal.Notify(hangUp, syscall.SIGHUP)
+	go func() {
+		for range hangUp {
+			logger.Info("Got SIGHUP. Reloading the TLS certificate.")
+			if err := httpEngine.ReloadCertificates(); err != nil {
+				logger.Errorf("Failed to reload the TLS certificate, the old one is still in use. Error: %s", err)
+			}
+		}
+	}()
+
+	// Tell systemd that we are up once the web server is listening and keep
+	// the watchdog fed if it is turned on. These do nothing outside of systemd.
+	watchdogStop := make(chan struct{})
+	go func() {
+		select {
+		case <-httpEngine.Ready():
+		case <-watchdogStop:
+			return
+		}
+		if err := sdNotify("READY=1"); err != nil {
+			logger.Warningf("Failed to notify systemd that we are ready. Error: %s", err)
+		}
+		if interval := sdWatchdogInterval(); interval > 0 {
+			logs.DebugMessage(fmt.Sprintf("Notifying the systemd watchdog every %s.", interval))
+			sdWatchdog(interval, func() bool {
+				// This blocks if the state table lock has wedged, which stops the pings.
+				state.ReadRunLock()
+				return true
+			}, watchdogStop)
+		}
+	}()
+
+	// The API can ask for the same clean shut down as the service manager.
+	adminShutdown := make(chan struct{})
+	httpEngine.SetShutdownFunc(func() { close(adminShutdown) })
+
+	// shutdown tears down the service and saves any state that needs it.
+	shutdown := func() {
+		close(watchdogStop)
+		if err := sdNotify("STOPPING=1"); err != nil {
+			logger.Warningf("Failed to notify systemd that we are stopping. Error: %s", err)
+		}
+		err := httpEngine.StopHTTPEngine(runningConfig.ShutdownTimeout())
+		if err != nil {
+			logger.Errorf("Failed to shutdown HTTP service. Error: %s", err)
+		}
+		err = state.SaveStateToDisk()
+		if err != nil {
+			logger.Error(err)
+		}
+		metrics.Incr("shutting_down", 1, map[string]string{"exitCode": fmt.Sprintf("%d", 0), "version": VERSION})
+		metrics.Shutdown()
+		tracing.Shutdown()
+	}
+
 	// We need to gather errors and return them to the service
 	// controller. We will implement this later.
 	// return errors
@@ -137,21 +276,15 @@ func (p *program) run() error {
 		terminate(1)
 		return nil
 	case <-p.exit:
-		// This case statement can be used to tear down the service and save
-		// any state the needs it.
 		logs.DebugMessage("Got exit message. Shutting down.")
-		err := httpEngine.StopHTTPEngine()
-		if err != nil {
-			logger.Errorf("Failed to shutdown HTTP service. Error: %s", err)
-		}
-		err = state.SaveStateToDisk()
-		if err != nil {
-			logger.Error(err)
-		}
-		metrics.Incr("shutting_down", 1, map[string]string{"exitCode": fmt.Sprintf("%d", 0), "version": VERSION})
-		metrics.Shutdown()
+		shutdown()
 		p.finshed <- true
 		return nil
+	case <-adminShutdown:
+		logger.Info("Shut down requested through the API. Shutting down.")
+		shutdown()
+		os.Exit(0)
+		return nil
 	}
 }
 
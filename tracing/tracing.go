@@ -0,0 +1,315 @@
+package tracing
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Span kinds as described by OpenTelemetry.
+const (
+	SpanKindInternal = 1
+	SpanKindServer   = 2
+)
+
+// Span status codes as described by OpenTelemetry.
+const (
+	StatusUnset = 0
+	StatusOK    = 1
+	StatusError = 2
+)
+
+const (
+	exportBatchSize = 100
+	exportInterval  = 5 * time.Second
+	queueSize       = 1000
+)
+
+var (
+	on       = false
+	onLock   sync.RWMutex
+	exporter *otlpExporter
+)
+
+// SpanContext carries the ids that tie a span to its trace.
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+}
+
+// IsValid will return true if the SpanContext has a trace id and span id.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+// Span is a single timed operation. All the functions on a nil Span do nothing
+// which is what is returned when tracing is not configured.
+type Span struct {
+	sync.Mutex
+	context    SpanContext
+	parentID   [8]byte
+	name       string
+	kind       int
+	start      time.Time
+	end        time.Time
+	statusCode int
+	attributes map[string]interface{}
+}
+
+// Setup will start the exporter that ships spans to the OTLP/HTTP endpoint supplied.
+// The endpoint should be the full URL to the traces API, eg: http://collector:4318/v1/traces
+func Setup(endpoint, serviceName string, errorFunc func(error)) {
+	exporter = &otlpExporter{
+		endpoint:    endpoint,
+		serviceName: serviceName,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		queue:       make(chan *Span, queueSize),
+		done:        make(chan bool),
+		errorFunc:   errorFunc,
+	}
+	go exporter.run()
+	onLock.Lock()
+	on = true
+	onLock.Unlock()
+}
+
+// enabled will return true if tracing has been setup.
+func enabled() bool {
+	onLock.RLock()
+	defer onLock.RUnlock()
+	return on
+}
+
+// Shutdown will send any spans that are waiting and stop the exporter.
+func Shutdown() {
+	onLock.Lock()
+	if !on {
+		onLock.Unlock()
+		return
+	}
+	on = false
+	close(exporter.queue)
+	onLock.Unlock()
+	<-exporter.done
+}
+
+// StartSpan will start a new span. If parent is valid the span will be a child of it,
+// otherwise a new trace is started. It returns nil when tracing is not configured.
+func StartSpan(name string, parent SpanContext, kind int) *Span {
+	if !enabled() {
+		return nil
+	}
+	s := &Span{
+		name:       name,
+		kind:       kind,
+		start:      time.Now(),
+		attributes: make(map[string]interface{}),
+	}
+	if parent.IsValid() {
+		s.context.TraceID = parent.TraceID
+		s.parentID = parent.SpanID
+	} else {
+		rand.Read(s.context.TraceID[:])
+	}
+	rand.Read(s.context.SpanID[:])
+	return s
+}
+
+// SetAttribute will add an attribute to the span.
+// Values should be strings, bools or integers.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.attributes[key] = value
+}
+
+// SetStatus will set the status of the span. Use StatusOK or StatusError.
+func (s *Span) SetStatus(code int) {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.statusCode = code
+}
+
+// Context will return the SpanContext of the span.
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.context
+}
+
+// End will finish the span and queue it to be exported.
+// Spans are dropped rather than blocking if the export queue is full.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	s.end = time.Now()
+	s.Unlock()
+	onLock.RLock()
+	defer onLock.RUnlock()
+	if !on {
+		return
+	}
+	select {
+	case exporter.queue <- s:
+	default:
+	}
+}
+
+// ParseTraceparent will read a W3C traceparent header value into a SpanContext.
+// The bool returned will be false if the header is not valid.
+func ParseTraceparent(header string) (SpanContext, bool) {
+	sc := SpanContext{}
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return sc, false
+	}
+	traceID, err := hex.DecodeString(parts[1])
+	if err != nil || len(traceID) != 16 {
+		return sc, false
+	}
+	spanID, err := hex.DecodeString(parts[2])
+	if err != nil || len(spanID) != 8 {
+		return sc, false
+	}
+	copy(sc.TraceID[:], traceID)
+	copy(sc.SpanID[:], spanID)
+	return sc, sc.IsValid()
+}
+
+// Traceparent will return the W3C traceparent header value for the SpanContext.
+func (sc SpanContext) Traceparent() string {
+	return fmt.Sprintf("00-%s-%s-01", hex.EncodeToString(sc.TraceID[:]), hex.EncodeToString(sc.SpanID[:]))
+}
+
+// otlpExporter batches up finished spans and posts them as OTLP/HTTP JSON.
+type otlpExporter struct {
+	endpoint    string
+	serviceName string
+	client      *http.Client
+	queue       chan *Span
+	done        chan bool
+	errorFunc   func(error)
+}
+
+func (ex *otlpExporter) run() {
+	ticker := time.NewTicker(exportInterval)
+	defer ticker.Stop()
+	batch := make([]*Span, 0, exportBatchSize)
+	for {
+		select {
+		case s, ok := <-ex.queue:
+			if !ok {
+				ex.export(batch)
+				ex.done <- true
+				return
+			}
+			batch = append(batch, s)
+			if len(batch) >= exportBatchSize {
+				ex.export(batch)
+				batch = make([]*Span, 0, exportBatchSize)
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				ex.export(batch)
+				batch = make([]*Span, 0, exportBatchSize)
+			}
+		}
+	}
+}
+
+func (ex *otlpExporter) export(batch []*Span) {
+	if len(batch) == 0 {
+		return
+	}
+	body, err := json.Marshal(ex.payload(batch))
+	if err != nil {
+		ex.reportError(err)
+		return
+	}
+	res, err := ex.client.Post(ex.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		ex.reportError(err)
+		return
+	}
+	res.Body.Close()
+	if res.StatusCode >= 300 {
+		ex.reportError(fmt.Errorf("Trace exporter got status %d from %s", res.StatusCode, ex.endpoint))
+	}
+}
+
+func (ex *otlpExporter) reportError(err error) {
+	if ex.errorFunc != nil {
+		ex.errorFunc(err)
+	}
+}
+
+func (ex *otlpExporter) payload(batch []*Span) map[string]interface{} {
+	spans := make([]map[string]interface{}, 0, len(batch))
+	for _, s := range batch {
+		s.Lock()
+		span := map[string]interface{}{
+			"traceId":           hex.EncodeToString(s.context.TraceID[:]),
+			"spanId":            hex.EncodeToString(s.context.SpanID[:]),
+			"name":              s.name,
+			"kind":              s.kind,
+			"startTimeUnixNano": fmt.Sprintf("%d", s.start.UnixNano()),
+			"endTimeUnixNano":   fmt.Sprintf("%d", s.end.UnixNano()),
+			"attributes":        otlpAttributes(s.attributes),
+			"status":            map[string]int{"code": s.statusCode},
+		}
+		if s.parentID != [8]byte{} {
+			span["parentSpanId"] = hex.EncodeToString(s.parentID[:])
+		}
+		s.Unlock()
+		spans = append(spans, span)
+	}
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": otlpAttributes(map[string]interface{}{"service.name": ex.serviceName}),
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]string{"name": ex.serviceName},
+						"spans": spans,
+					},
+				},
+			},
+		},
+	}
+}
+
+func otlpAttributes(attributes map[string]interface{}) []map[string]interface{} {
+	out := make([]map[string]interface{}, 0, len(attributes))
+	for key, value := range attributes {
+		var v map[string]interface{}
+		switch typed := value.(type) {
+		case bool:
+			v = map[string]interface{}{"boolValue": typed}
+		case int:
+			v = map[string]interface{}{"intValue": fmt.Sprintf("%d", typed)}
+		case int64:
+			v = map[string]interface{}{"intValue": fmt.Sprintf("%d", typed)}
+		default:
+			v = map[string]interface{}{"stringValue": fmt.Sprint(typed)}
+		}
+		out = append(out, map[string]interface{}{"key": key, "value": v})
+	}
+	return out
+}
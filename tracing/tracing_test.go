@@ -0,0 +1,71 @@
+package tracing
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		header string
+		valid  bool
+	}{
+		{header: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", valid: true},
+		{header: "00-00000000000000000000000000000000-00f067aa0ba902b7-01", valid: false},
+		{header: "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", valid: false},
+		{header: "00-4bf92f3577b34da6-00f067aa0ba902b7-01", valid: false},
+		{header: "", valid: false},
+	}
+
+	for _, test := range tests {
+		sc, ok := ParseTraceparent(test.header)
+		if ok != test.valid {
+			t.Errorf("ParseTraceparent(%q) validity is wrong. Got: %t, Want: %t", test.header, ok, test.valid)
+		}
+		if ok && sc.Traceparent() != test.header {
+			t.Errorf("Traceparent did not round trip. Got: %s, Want: %s", sc.Traceparent(), test.header)
+		}
+	}
+}
+
+func TestNoopWhenNotSetup(t *testing.T) {
+	span := StartSpan("test", SpanContext{}, SpanKindInternal)
+	if span != nil {
+		t.Fatalf("StartSpan should return nil when tracing is not setup")
+	}
+	// None of these should panic.
+	span.SetAttribute("key", "value")
+	span.SetStatus(StatusOK)
+	span.End()
+}
+
+func TestExport(t *testing.T) {
+	received := make(chan string, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received <- string(body)
+	}))
+	defer collector.Close()
+
+	Setup(collector.URL, "chefwaiter-test", func(err error) { t.Error(err) })
+	parent, _ := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	span := StartSpan("chef_run", parent, SpanKindInternal)
+	span.SetAttribute("chefwaiter.guid", "1234")
+	span.SetAttribute("chefwaiter.exit_code", 0)
+	span.End()
+	Shutdown()
+
+	body := <-received
+	if !json.Valid([]byte(body)) {
+		t.Fatalf("Exported body is not valid json: %s", body)
+	}
+	for _, want := range []string{`"traceId":"4bf92f3577b34da6a3ce929d0e0e4736"`, `"parentSpanId":"00f067aa0ba902b7"`, `"chefwaiter.guid"`, `"chefwaiter-test"`} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Exported body is missing %s. Got: %s", want, body)
+		}
+	}
+}
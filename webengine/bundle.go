@@ -0,0 +1,92 @@
+package webengine
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// getChefRunBundle - sends a tar.gz of the run record and its log for attaching to
+// support tickets. The files are in a directory named after the guid. If the log is
+// gone a note saying so is sent in its place.
+func (e *HTTPEngine) getChefRunBundle(w http.ResponseWriter, r *http.Request) {
+	guid := mux.Vars(r)["guid"]
+	status := e.state.Read(guid)
+	if status[guid] == nil {
+		writeJSONError(w, http.StatusNotFound, "run_not_found", fmt.Sprintf("No run with guid %s", guid))
+		return
+	}
+	record, err := jsonMarshal(status)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Failed to read guid status")
+		return
+	}
+
+	logFile, err := os.Open(e.chefLogsWorker.GetLogPath(guid))
+	if err == nil {
+		defer logFile.Close()
+	}
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.tar.gz"`, guid))
+	gzipWriter := gzip.NewWriter(w)
+	tarWriter := tar.NewWriter(gzipWriter)
+	if err := writeRunBundle(tarWriter, guid, record, logFile, err); err != nil {
+		// The headers have gone so the client will see a broken archive.
+		e.requestLogger(r).Errorf("Failed to write the bundle for %s. Error: %s", guid, err)
+		return
+	}
+	if err := tarWriter.Close(); err != nil {
+		e.requestLogger(r).Errorf("Failed to write the bundle for %s. Error: %s", guid, err)
+		return
+	}
+	gzipWriter.Close()
+}
+
+// writeRunBundle writes the run record and the log to the archive. logErr is the
+// error from opening the log, a note is written in place of the log if it is set.
+func writeRunBundle(tarWriter *tar.Writer, guid string, record []byte, logFile *os.File, logErr error) error {
+	now := time.Now()
+	if err := writeTarFile(tarWriter, guid+"/"+guid+".json", int64(len(record)), now, func(w io.Writer) error {
+		_, err := w.Write(record)
+		return err
+	}); err != nil {
+		return err
+	}
+
+	if logErr != nil {
+		note := []byte(fmt.Sprintf("The log for %s could not be read: %s\n", guid, logErr))
+		return writeTarFile(tarWriter, guid+"/NOTE.txt", int64(len(note)), now, func(w io.Writer) error {
+			_, err := w.Write(note)
+			return err
+		})
+	}
+	info, err := logFile.Stat()
+	if err != nil {
+		return err
+	}
+	// Only the part of the log written so far is sent if chef is still running.
+	return writeTarFile(tarWriter, guid+"/"+guid+".log", info.Size(), info.ModTime(), func(w io.Writer) error {
+		_, err := io.CopyN(w, logFile, info.Size())
+		return err
+	})
+}
+
+func writeTarFile(tarWriter *tar.Writer, name string, size int64, modTime time.Time, write func(io.Writer) error) error {
+	err := tarWriter.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    size,
+		ModTime: modTime,
+	})
+	if err != nil {
+		return err
+	}
+	return write(tarWriter)
+}
@@ -0,0 +1,88 @@
+package webengine
+
+import (
+	"crypto/tls"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/morfien101/chef-waiter/logs"
+)
+
+// certCheckInterval is how often the certificate files are looked at for changes.
+// Handshakes between checks use the certificate already loaded.
+const certCheckInterval = 30 * time.Second
+
+// certReloader serves the TLS certificate and key from disk so that a renewed
+// certificate is used without restarting. The files are loaded again when either of
+// them changes. If the new files can not be loaded the old certificate is kept.
+type certReloader struct {
+	certPath string
+	keyPath  string
+	logger   logs.SysLogger
+
+	sync.Mutex
+	cert    *tls.Certificate
+	certMod time.Time
+	keyMod  time.Time
+	checked time.Time
+}
+
+// newCertReloader loads the certificate and key. An error is returned if they can not be loaded.
+func newCertReloader(certPath, keyPath string, logger logs.SysLogger) (*certReloader, error) {
+	c := &certReloader{certPath: certPath, keyPath: keyPath, logger: logger}
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Reload loads the certificate and key from disk now.
+func (c *certReloader) Reload() error {
+	c.Lock()
+	defer c.Unlock()
+	return c.load(time.Now())
+}
+
+// GetCertificate is used as tls.Config.GetCertificate.
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.Lock()
+	defer c.Unlock()
+	now := time.Now()
+	if now.Sub(c.checked) >= certCheckInterval {
+		c.checked = now
+		certMod, keyMod := modTime(c.certPath), modTime(c.keyPath)
+		if !certMod.Equal(c.certMod) || !keyMod.Equal(c.keyMod) {
+			if err := c.load(now); err != nil {
+				c.logger.Warningf("Failed to reload the TLS certificate, the old one is still in use. Error: %s", err)
+			}
+		}
+	}
+	return c.cert, nil
+}
+
+// load must be called with the lock held.
+func (c *certReloader) load(now time.Time) error {
+	// The times are read first so that a change made while loading is picked up next time.
+	certMod, keyMod := modTime(c.certPath), modTime(c.keyPath)
+	cert, err := tls.LoadX509KeyPair(c.certPath, c.keyPath)
+	if err != nil {
+		return err
+	}
+	if c.cert != nil {
+		c.logger.Infof("Loaded a new TLS certificate from %s", c.certPath)
+	}
+	c.cert = &cert
+	c.certMod = certMod
+	c.keyMod = keyMod
+	c.checked = now
+	return nil
+}
+
+func modTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
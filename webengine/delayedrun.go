@@ -0,0 +1,50 @@
+package webengine
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// maxRunDelay is the longest that a run can be delayed for.
+const maxRunDelay = 24 * time.Hour
+
+// readDelay will return when a run should start from the delay URL parameter, eg
+// delay=5m, or 0 if no delay was asked for. If the delay is not valid a 400 is written
+// and ok is false.
+func readDelay(w http.ResponseWriter, r *http.Request, now time.Time) (scheduledStart int64, ok bool) {
+	value := r.URL.Query().Get("delay")
+	if value == "" {
+		return 0, true
+	}
+	delay, err := time.ParseDuration(value)
+	if err != nil || delay < time.Second || delay > maxRunDelay {
+		writeJSONError(w, http.StatusBadRequest, "invalid_delay", fmt.Sprintf("delay must be a duration from 1s to %s, eg 5m", maxRunDelay))
+		return 0, false
+	}
+	return now.Add(delay).Unix(), true
+}
+
+// cancelChefRun will cancel a delayed run that is still waiting to start.
+func (e *HTTPEngine) cancelChefRun(w http.ResponseWriter, r *http.Request) {
+	setContentJSON(w)
+	guid := mux.Vars(r)["guid"]
+	found, cancelled := e.state.CancelDelayedRun(guid, "cancelled before its scheduled start")
+	if !found {
+		writeJSONError(w, http.StatusNotFound, "run_not_found", fmt.Sprintf("No run with guid %s", guid))
+		return
+	}
+	if !cancelled {
+		writeJSONError(w, http.StatusConflict, "not_cancellable", "Only a delayed run that has not started can be cancelled")
+		return
+	}
+	e.requestLogger(r).Infof("Delayed run %s was cancelled from %s", guid, r.RemoteAddr)
+	jsonBytes, err := jsonMarshal(e.state.Read(guid))
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Failed to read guid status")
+		return
+	}
+	printJSON(w, jsonBytes)
+}
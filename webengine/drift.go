@@ -0,0 +1,64 @@
+package webengine
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/morfien101/chef-waiter/internalstate"
+)
+
+// drift is the body of /chef/drift. The previous fields are null until there have been
+// two successful runs.
+type drift struct {
+	GUID                     string `json:"guid"`
+	RunEndTime               int64  `json:"run_end_time"`
+	ResourcesUpdated         int    `json:"resources_updated"`
+	ResourcesTotal           int    `json:"resources_total"`
+	ConvergedClean           bool   `json:"converged_clean"`
+	PreviousGUID             string `json:"previous_guid,omitempty"`
+	PreviousResourcesUpdated *int   `json:"previous_resources_updated"`
+	ResourcesUpdatedDelta    *int   `json:"resources_updated_delta"`
+}
+
+// getDrift - shows how many resources the last successful run updated. A node that
+// still updates resources on every run has drifted or has resources that flap.
+// Custom runs are left out as they only converge part of the run list.
+func (e *HTTPEngine) getDrift(w http.ResponseWriter, r *http.Request) {
+	setContentJSON(w)
+	json.NewEncoder(w).Encode(lastDrift(e.state.ReadAllJobs()))
+}
+
+// lastDrift works out the drift from the two most recent successful runs in jobs.
+func lastDrift(jobs map[string]internalstate.JobDetails) drift {
+	var lastGUID, previousGUID string
+	for guid, job := range jobs {
+		if job.Status != "complete" || job.CustomRun {
+			continue
+		}
+		switch {
+		case lastGUID == "" || job.RunEndTime > jobs[lastGUID].RunEndTime:
+			lastGUID, previousGUID = guid, lastGUID
+		case previousGUID == "" || job.RunEndTime > jobs[previousGUID].RunEndTime:
+			previousGUID = guid
+		}
+	}
+
+	d := drift{}
+	if lastGUID == "" {
+		return d
+	}
+	last := jobs[lastGUID]
+	d.GUID = lastGUID
+	d.RunEndTime = last.RunEndTime
+	d.ResourcesUpdated = last.ResourcesUpdated
+	d.ResourcesTotal = last.ResourcesTotal
+	d.ConvergedClean = last.ResourcesUpdated == 0
+	if previousGUID != "" {
+		previous := jobs[previousGUID].ResourcesUpdated
+		delta := last.ResourcesUpdated - previous
+		d.PreviousGUID = previousGUID
+		d.PreviousResourcesUpdated = &previous
+		d.ResourcesUpdatedDelta = &delta
+	}
+	return d
+}
@@ -0,0 +1,44 @@
+package webengine
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// errorResponse is the body of every error response, eg
+// {"error": {"code": "locked", "message": "Chefwaiter is locked"}}.
+type errorResponse struct {
+	Error jsonError `json:"error"`
+}
+
+// jsonError describes an error. Code is stable so that clients can act on it.
+// Command is only set when a custom run was rejected by the whitelist.
+type jsonError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Command string `json:"command,omitempty"`
+}
+
+// writeJSONError writes an error response with the given status.
+func writeJSONError(w http.ResponseWriter, status int, code, message string) {
+	writeErrorResponse(w, status, jsonError{Code: code, Message: message})
+}
+
+// writeNotWhitelisted writes the response for a custom run that is not on the whitelist.
+// It is a 422 as the request is understood but fails validation.
+func writeNotWhitelisted(w http.ResponseWriter, command string) {
+	writeErrorResponse(w, http.StatusUnprocessableEntity, jsonError{
+		Code:    "not_whitelisted",
+		Message: fmt.Sprintf("Whitelist does not contain '%s'", command),
+		Command: command,
+	})
+}
+
+func writeErrorResponse(w http.ResponseWriter, status int, jsonErr jsonError) {
+	// Encoding a struct of strings can not fail.
+	jsonBytes, _ := json.Marshal(errorResponse{Error: jsonErr})
+	setContentJSON(w)
+	w.WriteHeader(status)
+	printJSON(w, jsonBytes)
+}
@@ -0,0 +1,63 @@
+package webengine
+
+import (
+	"fmt"
+	"time"
+)
+
+// healthSubsystem is the health of one part of chef waiter in the verbose healthcheck.
+type healthSubsystem struct {
+	Healthy bool   `json:"healthy"`
+	Detail  string `json:"detail,omitempty"`
+}
+
+// verboseHealth is the body of /healthcheck?verbose=true.
+// LastRunAge is the seconds since the last run finished. It is null if no run has finished.
+type verboseHealth struct {
+	State      string          `json:"state"`
+	StateFile  healthSubsystem `json:"state_file"`
+	LogDir     healthSubsystem `json:"log_dir"`
+	ChefClient healthSubsystem `json:"chef_client"`
+	LastRunAge *int64          `json:"last_run_age"`
+	QueueDepth int             `json:"queue_depth"`
+}
+
+// checkHealth will look at each part of chef waiter. The state is DEGRADED if any part
+// is unhealthy as chef waiter itself is still up to answer.
+func (e *HTTPEngine) checkHealth(now time.Time) verboseHealth {
+	health := verboseHealth{
+		State:      "OK",
+		StateFile:  healthSubsystem{Healthy: true},
+		LogDir:     healthSubsystem{Healthy: true},
+		ChefClient: healthSubsystem{Healthy: true},
+		QueueDepth: e.worker.QueueDepth(),
+	}
+
+	if persist := e.state.ReadPersistStatus(); persist.FailingSince != 0 {
+		health.StateFile = healthSubsystem{
+			Detail: fmt.Sprintf("saving the state has failed since %s: %s", time.Unix(persist.FailingSince, 0).String(), persist.LastError),
+		}
+	}
+	if err := e.chefLogsWorker.CheckLogDir(); err != nil {
+		health.LogDir = healthSubsystem{Detail: err.Error()}
+	}
+	if version := e.appState.ChefVersion(); version != "" {
+		health.ChefClient.Detail = version
+	} else {
+		health.ChefClient = healthSubsystem{Detail: "chef-client could not be found"}
+	}
+
+	if guid := e.state.ReadLastRunGUID(); guid != "" {
+		if details := e.state.Read(guid)[guid]; details != nil && details.RunEndTime > 0 {
+			age := now.Unix() - details.RunEndTime
+			health.LastRunAge = &age
+		}
+	}
+
+	for _, subsystem := range []healthSubsystem{health.StateFile, health.LogDir, health.ChefClient} {
+		if !subsystem.Healthy {
+			health.State = "DEGRADED"
+		}
+	}
+	return health
+}
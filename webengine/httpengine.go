@@ -1,15 +1,22 @@
 package webengine
 
 import (
-	"bufio"
 	"bytes"
 	"context"
+	"crypto/subtle"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
-	"io"
+	"io/ioutil"
+	"mime"
+	"net"
 	"net/http"
 	"os"
+	"regexp"
+	"runtime"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/morfien101/chef-waiter/cheflogs"
@@ -23,8 +30,35 @@ import (
 type customRunWhitelist struct {
 	whitelist []string
 	use       bool
+	// requireReason holds the whitelisted custom runs that must be given a reason.
+	requireReason []string
 }
 
+// customRunRequest is the JSON body that can be sent to create a custom run.
+type customRunRequest struct {
+	RunList    string   `json:"run_list"`
+	ExtraFlags []string `json:"extra_flags"`
+	Label      string   `json:"label"`
+	Retry      bool     `json:"retry"`
+	RunAs      string   `json:"run_as"`
+	Reason     string   `json:"reason"`
+	NodeName   string   `json:"node_name"`
+}
+
+// maxLabelLength is the longest label that can be put on a run.
+const maxLabelLength = 256
+
+// nodeNamePattern is what a node name override can be made of. It keeps to the
+// characters that chef allows in node names so that nothing else reaches chef-client.
+var nodeNamePattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,255}$`)
+
+// invalidNodeNameMessage says why a node name override was turned away.
+const invalidNodeNameMessage = "node_name can only use letters, numbers, '.', '_', ':' and '-' and be at most 255 characters"
+
+// defaultMaxRequestBodyBytes is the largest request body that is read until
+// SetMaxRequestBodyBytes is called. It matches the configuration default.
+const defaultMaxRequestBodyBytes = 64 * 1024
+
 // HTTPEngine holds all the requires types and functions for the API to work.
 type HTTPEngine struct {
 	router         *mux.Router
@@ -32,19 +66,56 @@ type HTTPEngine struct {
 	state          internalstate.StateTableReadWriter
 	appState       internalstate.AppStatusReader
 	worker         chefrunner.Worker
-	chefLogsWorker cheflogs.WorkerReader
+	chefLogsWorker cheflogs.WorkerReadWriter
 	server         *http.Server
+	socketPath     string
 	whitelists     *customRunWhitelist
+	extraFlags     []string
+	runAsUsers     []string
+	adminToken     string
+	networkPolicy  *networkPolicy
+	shutdownFunc   func()
+	shutdownOnce   sync.Once
+	ready          chan struct{}
+	readyOnce      sync.Once
+	// maxBodyBytes is the largest request body that will be read.
+	maxBodyBytes int64
+	// certs serves the TLS certificate while the HTTPS engine is running.
+	certs     *certReloader
+	certsLock sync.Mutex
+	// disabledGroups are kept so that the read only listener leaves them out too.
+	disabledGroups []string
+	// readOnlyServer is the read only listener. readOnlyStopped is set once
+	// StopHTTPEngine has run so that a listener that starts late is not left running.
+	readOnlyServer  *http.Server
+	readOnlyStopped bool
+	readOnlyLock    sync.Mutex
+	// blockInMaintenance turns away on demand and custom runs during maintenance.
+	blockInMaintenance bool
 }
 
+// Endpoint groups that can be disabled when the HTTPEngine is made.
+// /healthcheck and /readiness are not in a group and are always available.
+const (
+	// ReadEndpoints only show the state of chef waiter and its runs.
+	ReadEndpoints = "read"
+	// TriggerEndpoints start chef runs.
+	TriggerEndpoints = "trigger"
+	// AdminEndpoints change how chef waiter runs, like the lock, maintenance and interval,
+	// along with the endpoints that need the admin token.
+	AdminEndpoints = "admin"
+)
+
 // New returns a struct that holds the required details for the API engine.
+// The routes in disabledGroups are not registered.
 // You still need to start it with StartHTTPEngine()
 func New(
 	state internalstate.StateTableReadWriter,
 	appState internalstate.AppStatusReader,
 	worker chefrunner.Worker,
-	chefLogsWorker cheflogs.WorkerReader,
+	chefLogsWorker cheflogs.WorkerReadWriter,
 	logger logs.SysLogger,
+	disabledGroups []string,
 ) (e *HTTPEngine) {
 	httpEngine := &HTTPEngine{
 		logger:         logger,
@@ -52,33 +123,76 @@ func New(
 		appState:       appState,
 		worker:         worker,
 		chefLogsWorker: chefLogsWorker,
-		router:         mux.NewRouter(),
 		whitelists:     &customRunWhitelist{whitelist: []string{}},
+		ready:          make(chan struct{}),
+		maxBodyBytes:   defaultMaxRequestBodyBytes,
+		disabledGroups: disabledGroups,
 	}
+	httpEngine.router = httpEngine.newRouter(disabledGroups)
+	return httpEngine
+}
 
-	httpEngine.router.HandleFunc("/chefclient", httpEngine.registerChefRun).Methods("Get")
-	httpEngine.router.HandleFunc("/chefclient", httpEngine.registerChefCustomRun).Methods("Post")
-	httpEngine.router.HandleFunc("/chefclient/{guid}", httpEngine.getChefStatus).Methods("Get")
-	httpEngine.router.HandleFunc("/cheflogs/{guid}", httpEngine.getChefLogs).Methods("Get")
-	httpEngine.router.HandleFunc("/chef/nextrun", httpEngine.getNextChefRun).Methods("Get")
-	httpEngine.router.HandleFunc("/chef/interval", httpEngine.getChefRunInterval).Methods("Get")
-	httpEngine.router.HandleFunc("/chef/interval/{i}", httpEngine.setChefRunInterval).Methods("Get")
-	httpEngine.router.HandleFunc("/chef/on", httpEngine.setChefRunEnabled).Methods("Get")
-	httpEngine.router.HandleFunc("/chef/off", httpEngine.setChefRunDisabled).Methods("Get")
-	httpEngine.router.HandleFunc("/chef/lastrun", httpEngine.getLastRunGUID).Methods("Get")
-	httpEngine.router.HandleFunc("/chef/allruns", httpEngine.getAllRuns).Methods("Get")
-	httpEngine.router.HandleFunc("/chef/enabled", httpEngine.getChefPeridoicRunStatus).Methods("Get")
-	httpEngine.router.HandleFunc("/chef/maintenance", httpEngine.getChefMaintenance).Methods("Get")
-	httpEngine.router.HandleFunc("/chef/maintenance/start/{i}", httpEngine.setChefMaintenance).Methods("Get")
-	httpEngine.router.HandleFunc("/chef/maintenance/end", httpEngine.removeChefMaintenance).Methods("Get")
-	httpEngine.router.HandleFunc("/chef/lock", httpEngine.getChefLock).Methods("Get")
-	httpEngine.router.HandleFunc("/chef/lock/set", httpEngine.setChefLock).Methods("Get")
-	httpEngine.router.HandleFunc("/chef/lock/remove", httpEngine.removeChefLock).Methods("Get")
-	httpEngine.router.HandleFunc("/status", httpEngine.getStatus).Methods("Get")
-	httpEngine.router.HandleFunc("/_status", httpEngine.getStatus).Methods("Get")
-	httpEngine.router.HandleFunc("/healthcheck", httpEngine.healthCheck).Methods("Get")
+// newRouter returns a router for the API. Routes in a disabled group are not
+// registered at all so they can not be reached.
+func (e *HTTPEngine) newRouter(disabledGroups []string) *mux.Router {
+	router := mux.NewRouter()
+	disabled := make(map[string]bool, len(disabledGroups))
+	for _, group := range disabledGroups {
+		disabled[group] = true
+	}
+	handle := func(group, path string, handler http.HandlerFunc, methods ...string) {
+		if !disabled[group] {
+			router.HandleFunc(path, handler).Methods(methods...)
+		}
+	}
 
-	return httpEngine
+	handle(TriggerEndpoints, "/chefclient", e.checkWriteNetwork(e.registerChefRun), "Get")
+	handle(TriggerEndpoints, "/chefclient", e.checkWriteNetwork(e.registerChefCustomRun), "Post")
+	handle(ReadEndpoints, "/chefclient/status", e.getChefStatuses, "Post")
+	handle(ReadEndpoints, "/chefclient/validate", e.validateChefCustomRun, "Post")
+	handle(ReadEndpoints, "/chefclient/{guid}", e.getChefStatus, "Get")
+	handle(TriggerEndpoints, "/chefclient/{guid}", e.checkWriteNetwork(e.cancelChefRun), "Delete")
+	handle(ReadEndpoints, "/chefclient/{guid}/bundle", e.getChefRunBundle, "Get")
+	handle(ReadEndpoints, "/cheflogs", e.listChefLogs, "Get")
+	handle(AdminEndpoints, "/cheflogs", e.checkWriteNetwork(e.requireAdmin(e.purgeChefLogs)), "Delete")
+	handle(ReadEndpoints, "/cheflogs/search", e.searchChefLogs, "Get")
+	handle(ReadEndpoints, "/cheflogs/{guid}", e.getChefLogs, "Get")
+	handle(ReadEndpoints, "/chef/nextrun", e.getNextChefRun, "Get")
+	handle(TriggerEndpoints, "/chef/runnow", e.checkWriteNetwork(e.registerPeriodicRun), "Get")
+	handle(ReadEndpoints, "/chef/interval", e.getChefRunInterval, "Get")
+	handle(AdminEndpoints, "/chef/interval", e.checkWriteNetwork(e.postChefRunInterval), "Post")
+	handle(AdminEndpoints, "/chef/interval/{i}", e.checkWriteNetwork(e.setChefRunInterval), "Get", "Post")
+	handle(AdminEndpoints, "/chef/on", e.checkWriteNetwork(e.setChefRunEnabled), "Get", "Post")
+	handle(AdminEndpoints, "/chef/off", e.checkWriteNetwork(e.setChefRunDisabled), "Get", "Post")
+	handle(ReadEndpoints, "/chef/lastrun", e.getLastRunGUID, "Get")
+	handle(ReadEndpoints, "/chef/lastsuccess", e.getLastSuccessfulRun, "Get")
+	handle(ReadEndpoints, "/chef/drift", e.getDrift, "Get")
+	handle(ReadEndpoints, "/chef/stats", e.getRunStats, "Get")
+	handle(ReadEndpoints, "/chef/allruns", e.getAllRuns, "Get")
+	handle(ReadEndpoints, "/chef/runs", e.getRuns, "Get")
+	handle(ReadEndpoints, "/chef/enabled", e.getChefPeridoicRunStatus, "Get")
+	handle(ReadEndpoints, "/chef/maintenance", e.getChefMaintenance, "Get")
+	handle(AdminEndpoints, "/chef/maintenance/start/{i}", e.checkWriteNetwork(e.setChefMaintenance), "Get", "Post")
+	handle(AdminEndpoints, "/chef/maintenance/end", e.checkWriteNetwork(e.removeChefMaintenance), "Get", "Post")
+	handle(ReadEndpoints, "/chef/lock", e.getChefLock, "Get")
+	handle(AdminEndpoints, "/chef/lock/set", e.checkWriteNetwork(e.setChefLock), "Get", "Post")
+	handle(AdminEndpoints, "/chef/lock/remove", e.checkWriteNetwork(e.removeChefLock), "Get", "Post")
+	handle(AdminEndpoints, "/chef/backoff/reset", e.checkWriteNetwork(e.requireAdmin(e.resetFailureStreak)), "Post")
+	handle(AdminEndpoints, "/admin/logs/sweep", e.checkWriteNetwork(e.requireAdmin(e.sweepChefLogs)), "Post")
+	handle(AdminEndpoints, "/admin/state", e.requireAdmin(e.getStateDump), "Get")
+	handle(AdminEndpoints, "/admin/shutdown", e.checkWriteNetwork(e.requireAdmin(e.shutdown)), "Post")
+	handle(ReadEndpoints, "/status", e.getStatus, "Get")
+	handle(ReadEndpoints, "/_status", e.getStatus, "Get")
+	router.HandleFunc("/healthcheck", e.healthCheck).Methods("Get")
+	router.HandleFunc("/readiness", e.readiness).Methods("Get")
+	handle(ReadEndpoints, "/version", e.getVersion, "Get")
+
+	router.Use(e.timeRequest)
+	router.Use(e.traceRequest)
+	router.Use(e.checkReadNetwork)
+	router.Use(e.limitRequestBody)
+
+	return router
 }
 
 // SetWhitelist is used to tell the server what custom runs are allowed.
@@ -87,31 +201,274 @@ func (e *HTTPEngine) SetWhitelist(whitelist []string) {
 	e.whitelists.use = true
 }
 
+// SetBlockOnDemandInMaintenance is used to stop on demand and custom runs from being
+// started while in maintenance mode, unless they are forced.
+func (e *HTTPEngine) SetBlockOnDemandInMaintenance(block bool) {
+	e.blockInMaintenance = block
+}
+
+// SetReasonRequiredRuns is used to tell the server which whitelisted custom runs must
+// be sent with a reason.
+func (e *HTTPEngine) SetReasonRequiredRuns(runs []string) {
+	e.whitelists.requireReason = runs
+}
+
+// SetAllowedExtraFlags is used to tell the server which chef-client flags can be
+// asked for on a custom run.
+func (e *HTTPEngine) SetAllowedExtraFlags(flags []string) {
+	e.extraFlags = flags
+}
+
+// SetAllowedRunAsUsers is used to tell the server which users a custom run can be
+// asked to run as.
+func (e *HTTPEngine) SetAllowedRunAsUsers(users []string) {
+	e.runAsUsers = users
+}
+
+// runAsAllowed returns true if a custom run can run as the user. If not a 403 is written.
+// An empty user runs as chef waiter's own user so it is always allowed.
+func (e *HTTPEngine) runAsAllowed(w http.ResponseWriter, r *http.Request, runAs string) bool {
+	if e.runAsUserAllowed(runAs) {
+		return true
+	}
+	e.requestLogger(r).Warningf("Rejected custom run as %q from %s, the user is not allowed", runAs, r.RemoteAddr)
+	writeJSONError(w, http.StatusForbidden, "run_as_not_allowed", fmt.Sprintf("Running as %s is not allowed", runAs))
+	return false
+}
+
+// runAsUserAllowed reports if a custom run can be run as the user. An empty user is
+// the user that chef waiter runs as and is always allowed.
+func (e *HTTPEngine) runAsUserAllowed(runAs string) bool {
+	if runAs == "" {
+		return true
+	}
+	for _, allowedUser := range e.runAsUsers {
+		if runAs == allowedUser {
+			return true
+		}
+	}
+	return false
+}
+
+// whitelisted reports if the custom run can be run. Everything is allowed when the
+// whitelist is not in use.
+func (e *HTTPEngine) whitelisted(customRunText string) bool {
+	if !e.whitelists.use {
+		return true
+	}
+	for _, whitelistText := range e.whitelists.whitelist {
+		if customRunText == whitelistText {
+			return true
+		}
+	}
+	return false
+}
+
+// reasonRequired reports if the whitelisted custom run must be sent with a reason.
+func (e *HTTPEngine) reasonRequired(customRunText string) bool {
+	for _, run := range e.whitelists.requireReason {
+		if customRunText == run {
+			return true
+		}
+	}
+	return false
+}
+
+// notAllowedExtraFlags returns the requested flags that are not in the allowed extra flags.
+func (e *HTTPEngine) notAllowedExtraFlags(requested []string) []string {
+	notAllowed := make([]string, 0)
+	for _, flag := range requested {
+		allowed := false
+		for _, allowedFlag := range e.extraFlags {
+			if flag == allowedFlag {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			notAllowed = append(notAllowed, flag)
+		}
+	}
+	return notAllowed
+}
+
+// isJSONRequest reports if the client said that it sent a JSON body.
+func isJSONRequest(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "application/json"
+}
+
+// isFormRequest reports if the client said that it sent a URL encoded form.
+func isFormRequest(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "application/x-www-form-urlencoded"
+}
+
+// SetMaxRequestBodyBytes is used to set the largest request body that will be read.
+// Larger bodies are rejected with a 413.
+func (e *HTTPEngine) SetMaxRequestBodyBytes(max int64) {
+	e.maxBodyBytes = max
+}
+
+// SetAdminToken is used to set the bearer token that administrative endpoints require.
+// Administrative endpoints are refused while no token is set.
+func (e *HTTPEngine) SetAdminToken(token string) {
+	e.adminToken = token
+}
+
+// SetShutdownFunc is used to set what is called to shut chef waiter down when asked
+// to through the API. It is only ever called once.
+func (e *HTTPEngine) SetShutdownFunc(shutdown func()) {
+	e.shutdownFunc = shutdown
+}
+
+// requireAdmin wraps a handler so that it is only called when the request carries
+// the configured admin token as a bearer token.
+func (e *HTTPEngine) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		setContentJSON(w)
+		if e.adminToken == "" {
+			writeJSONError(w, http.StatusForbidden, "admin_disabled", "Administrative endpoints are disabled. No admin token configured")
+			return
+		}
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(e.adminToken)) != 1 {
+			e.requestLogger(r).Warningf("Rejected administrative request to %s from %s", r.URL.Path, r.RemoteAddr)
+			writeJSONError(w, http.StatusUnauthorized, "unauthorized", "Unauthorized")
+			return
+		}
+		next(w, r)
+	}
+}
+
 // StartHTTPEngine will start the web server in a nonTLS mode.
 // It also requires that the listening address be passes in as a string.
 // Should be used in a go routine.
 func (e *HTTPEngine) StartHTTPEngine(listenerAddress string) error {
+	listener, err := net.Listen("tcp", listenerAddress)
+	if err != nil {
+		return err
+	}
 	// Start the HTTP Engine
 	e.server = &http.Server{Addr: listenerAddress, Handler: e.router}
-	return e.server.ListenAndServe()
+	e.markReady()
+	return e.server.Serve(listener)
 }
 
 // StartHTTPSEngine will start the web server with TLS support using the given cert and key values.
 // It also requires that the listening address be passes in as a string.
 // Should be used in a go routine.
+// The certificate and key are loaded again when they change on disk or when
+// ReloadCertificates is called, so renewed certificates are used without a restart.
 func (e *HTTPEngine) StartHTTPSEngine(listenerAddress, certPath, keyPath string) error {
+	// Make sure the certificates load before we say that we are ready.
+	certs, err := e.certificates(certPath, keyPath)
+	if err != nil {
+		return err
+	}
+	listener, err := net.Listen("tcp", listenerAddress)
+	if err != nil {
+		return err
+	}
 	// Start the HTTP Engine
-	e.server = &http.Server{Addr: listenerAddress, Handler: e.router}
-	return e.server.ListenAndServeTLS(certPath, keyPath)
+	e.server = &http.Server{Addr: listenerAddress, Handler: e.router, TLSConfig: httpsConfig(certs.GetCertificate)}
+	e.markReady()
+	return e.server.ServeTLS(listener, "", "")
+}
+
+// httpsConfig is the TLS configuration for the web server. HTTP/2 is offered first so
+// that clients can follow logs and poll for status over a single connection.
+func httpsConfig(getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)) *tls.Config {
+	return &tls.Config{
+		GetCertificate: getCertificate,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}
+}
+
+// certificates returns the certificate reloader that the HTTPS listeners share.
+// The certificate is loaded the first time.
+func (e *HTTPEngine) certificates(certPath, keyPath string) (*certReloader, error) {
+	e.certsLock.Lock()
+	defer e.certsLock.Unlock()
+	if e.certs == nil {
+		certs, err := newCertReloader(certPath, keyPath, e.logger)
+		if err != nil {
+			return nil, err
+		}
+		e.certs = certs
+	}
+	return e.certs, nil
+}
+
+// ReloadCertificates loads the TLS certificate and key from disk now rather than
+// waiting for the change to be noticed. The old certificate is kept if the new one
+// can not be loaded. It does nothing if the HTTPS engine is not running.
+func (e *HTTPEngine) ReloadCertificates() error {
+	e.certsLock.Lock()
+	certs := e.certs
+	e.certsLock.Unlock()
+	if certs == nil {
+		return nil
+	}
+	return certs.Reload()
+}
+
+// StartHTTPEngineUnix will start the web server in a nonTLS mode listening on a unix socket.
+// Any stale socket file left at socketPath is removed first and on linux the new socket
+// is only accessible to the owner and group.
+// Should be used in a go routine.
+func (e *HTTPEngine) StartHTTPEngineUnix(socketPath string) error {
+	if info, err := os.Lstat(socketPath); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return fmt.Errorf("%s exists and is not a socket", socketPath)
+		}
+		if err := os.Remove(socketPath); err != nil {
+			return fmt.Errorf("Failed to remove stale socket %s. Error: %s", socketPath, err)
+		}
+	}
+	listener, err := listenUnix(socketPath)
+	if err != nil {
+		return err
+	}
+	e.socketPath = socketPath
+	// Start the HTTP Engine
+	e.server = &http.Server{Handler: e.router}
+	e.markReady()
+	return e.server.Serve(listener)
+}
+
+// Ready returns a channel that is closed once the web server is listening for requests.
+func (e *HTTPEngine) Ready() <-chan struct{} {
+	return e.ready
+}
+
+func (e *HTTPEngine) markReady() {
+	e.readyOnce.Do(func() { close(e.ready) })
 }
 
 // StopHTTPEngine will stop the web server grafefully.
-// It will give the server 5 seconds before just terminating it.
-func (e *HTTPEngine) StopHTTPEngine() error {
+// It will give requests in flight up to timeout to finish before just terminating it.
+// If the server was listening on a unix socket the socket file is removed.
+func (e *HTTPEngine) StopHTTPEngine(timeout time.Duration) error {
 	// Stop the HTTP Engine
-	ctx, cancelFunc := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancelFunc := context.WithTimeout(context.Background(), timeout)
 	defer cancelFunc()
-	return e.server.Shutdown(ctx)
+	err := e.server.Shutdown(ctx)
+	e.readOnlyLock.Lock()
+	e.readOnlyStopped = true
+	readOnlyServer := e.readOnlyServer
+	e.readOnlyLock.Unlock()
+	if readOnlyServer != nil {
+		if roErr := readOnlyServer.Shutdown(ctx); roErr != nil && err == nil {
+			err = roErr
+		}
+	}
+	if e.socketPath != "" {
+		if rmErr := os.Remove(e.socketPath); rmErr != nil && !os.IsNotExist(rmErr) {
+			e.logger.Errorf("Failed to remove socket %s. Error: %s", e.socketPath, rmErr)
+		}
+	}
+	return err
 }
 
 // ServeHTTP is used to allow the router to start accepting requests before the start is started up. This will help with testing.
@@ -123,6 +480,11 @@ func setContentJSON(w http.ResponseWriter) {
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 }
 
+// setCoalescedHeader tells the client if their run request was folded into an existing run.
+func setCoalescedHeader(w http.ResponseWriter, coalesced bool) {
+	w.Header().Set("X-Chefwaiter-Coalesced", strconv.FormatBool(coalesced))
+}
+
 func jsonMarshal(x interface{}) ([]byte, error) {
 	return json.MarshalIndent(x, "", "  ")
 }
@@ -131,21 +493,58 @@ func printJSON(w http.ResponseWriter, jsonbytes []byte) (int, error) {
 	return fmt.Fprint(w, string(jsonbytes), "\n")
 }
 
+// requestLogger will return a logger that tags messages with details of the request.
+// The X-Request-ID header is used as the request id when the client sends one.
+func (e *HTTPEngine) requestLogger(r *http.Request) logs.SysLogger {
+	fields := logs.Fields{"remote_addr": r.RemoteAddr}
+	if requestID := r.Header.Get("X-Request-ID"); requestID != "" {
+		fields["request_id"] = requestID
+	}
+	return logs.WithFields(e.logger, fields)
+}
+
+// forceRequested will return true if the request asked for the lock to be ignored
+// with the force=true URL parameter.
+func forceRequested(r *http.Request) bool {
+	value, ok := r.URL.Query()["force"]
+	return ok && value[0] == "true"
+}
+
+// retryRequested will return true if the request asked for the run to be retried
+// if it fails with the retry=true URL parameter.
+func retryRequested(r *http.Request) bool {
+	return r.URL.Query().Get("retry") == "true"
+}
+
 // RegisterChefRun is called to run chef on the server.
 func (e *HTTPEngine) registerChefRun(w http.ResponseWriter, r *http.Request) {
 	setContentJSON(w)
-	if e.state.ReadRunLock() {
-		w.WriteHeader(http.StatusForbidden)
-		fmt.Fprint(w, "{\"Error\":\"Chefwaiter is locked\"}\n")
+
+	// Check if the server is locked unless we have an override URL parameter available.
+	if forceRequested(r) {
+		logs.DebugMessage(fmt.Sprintln("registerChefRun() running regardless of lock."))
+		e.requestLogger(r).Infof("Running a chef job regardless of lock from %s\n", r.RemoteAddr)
+	} else if e.state.ReadRunLock() {
+		writeJSONError(w, http.StatusForbidden, "locked", "Chefwaiter is locked")
+		return
+	} else if e.blockedByMaintenance(w) {
 		return
 	}
-	guid := e.worker.OnDemandRun()
+	label := r.URL.Query().Get("label")
+	if !validLabel(w, label) {
+		return
+	}
+	scheduledStart, ok := readDelay(w, r, time.Now())
+	if !ok {
+		return
+	}
+	guid, coalesced := e.worker.OnDemandRun(internalstate.RunOptions{Label: label, Retry: retryRequested(r), ScheduledStart: scheduledStart})
 	logs.DebugMessage(fmt.Sprintf("registerChefRun() - %s", guid))
+	setCoalescedHeader(w, coalesced)
 	state := e.state.Read(guid)
 	jsonBytes, err := json.MarshalIndent(state, "", "  ")
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprint(w, "{\"Error\":\"Failed to read guid status\"}\n")
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Failed to read guid status")
 		return
 	}
 	printJSON(w, jsonBytes)
@@ -154,64 +553,156 @@ func (e *HTTPEngine) registerChefRun(w http.ResponseWriter, r *http.Request) {
 func (e *HTTPEngine) registerChefCustomRun(w http.ResponseWriter, r *http.Request) {
 	setContentJSON(w)
 
-	checklock := true
-
 	// Check if the server is locked unless we have an override URL parameter available.
-	if value, ok := r.URL.Query()["force"]; ok {
-		if value[0] == "true" {
-			checklock = false
-			logs.DebugMessage(fmt.Sprintln("registerChefCustomRun() running regardless of lock."))
-			e.logger.Infof("Running a custom job regardless of lock from %s\n", r.RemoteAddr)
-		}
+	if forceRequested(r) {
+		logs.DebugMessage(fmt.Sprintln("registerChefCustomRun() running regardless of lock."))
+		e.requestLogger(r).Infof("Running a custom job regardless of lock from %s\n", r.RemoteAddr)
+	} else if e.state.ReadRunLock() {
+		writeJSONError(w, http.StatusForbidden, "locked", "Chefwaiter is locked")
+		return
+	} else if e.blockedByMaintenance(w) {
+		return
 	}
 
-	if checklock {
-		if e.state.ReadRunLock() {
-			w.WriteHeader(http.StatusForbidden)
-			fmt.Fprint(w, "{\"Error\":\"Chefwaiter is locked\"}\n")
-			return
-		}
+	options := internalstate.RunOptions{
+		Label:    r.URL.Query().Get("label"),
+		Retry:    retryRequested(r),
+		RunAs:    r.URL.Query().Get("run_as"),
+		Reason:   r.URL.Query().Get("reason"),
+		NodeName: r.URL.Query().Get("node_name"),
 	}
-
-	defer r.Body.Close()
-	bodySlurp := make([]byte, 513)
-	n, err := r.Body.Read(bodySlurp)
-	if err != nil && err != io.EOF {
-		w.WriteHeader(http.StatusBadRequest)
-		e.logger.Errorf("Request to custom job failed while reading the body. Error: %s", err)
+	customRunText, ok := e.readCustomRun(w, r, &options)
+	if !ok {
 		return
 	}
-	if n > 512 {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprint(w, "{\"Error\":\"Body sent is too large. Max size 512 bytes\"}\n")
+	if !validLabel(w, options.Label) {
 		return
 	}
-	customRunText := string(bytes.TrimRight(bodySlurp, "\x00"))
-	if e.whitelists.use {
-		matched := false
-		for _, whitelistText := range e.whitelists.whitelist {
-			if customRunText == whitelistText {
-				matched = true
-				break
-			}
-		}
-		if !matched {
-			w.WriteHeader(http.StatusForbidden)
-			fmt.Fprintf(w, "{\"Error\":\"Whitelist does not contain '%s'\"}\n", customRunText)
-			return
-		}
+	if !validNodeName(options.NodeName) {
+		writeJSONError(w, http.StatusBadRequest, "invalid_node_name", invalidNodeNameMessage)
+		return
+	}
+	if options.ScheduledStart, ok = readDelay(w, r, time.Now()); !ok {
+		return
+	}
+	if !e.whitelisted(customRunText) {
+		writeNotWhitelisted(w, customRunText)
+		return
 	}
-	guid := e.worker.CustomRun(customRunText)
+	if e.reasonRequired(customRunText) && strings.TrimSpace(options.Reason) == "" {
+		writeJSONError(w, http.StatusBadRequest, "missing_reason", fmt.Sprintf("A reason is required to run '%s'", customRunText))
+		return
+	}
+	if notAllowed := e.notAllowedExtraFlags(options.ExtraFlags); len(notAllowed) > 0 {
+		writeJSONError(w, http.StatusBadRequest, "extra_flags_not_allowed", fmt.Sprintf("Extra flags are not allowed: %s", strings.Join(notAllowed, ", ")))
+		return
+	}
+	if !e.runAsAllowed(w, r, options.RunAs) {
+		return
+	}
+	if options.Reason != "" {
+		e.requestLogger(r).Infof("Custom run %s requested from %s with reason: %s", customRunText, r.RemoteAddr, options.Reason)
+	}
+	guid, coalesced := e.worker.CustomRun(customRunText, options)
 	logs.DebugMessage(fmt.Sprintf("registerChefCustomRun() - %s", guid))
+	setCoalescedHeader(w, coalesced)
 	jsonbytes, err := jsonMarshal(e.state.Read(guid))
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprint(w, "{\"Error\":\"Failed to read guid status\"}\n")
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Failed to read guid status")
 		return
 	}
 	printJSON(w, jsonbytes)
 }
 
+// blockedByMaintenance returns true if a run can not be started as chef waiter is in
+// maintenance mode and block_ondemand_in_maintenance is on. If so a 503 is written.
+func (e *HTTPEngine) blockedByMaintenance(w http.ResponseWriter) bool {
+	if !e.blockInMaintenance || !e.state.InMaintenceMode() {
+		return false
+	}
+	writeJSONError(w, http.StatusServiceUnavailable, "in_maintenance", fmt.Sprintf("Chefwaiter is in maintenance mode until %s", time.Unix(e.state.ReadMaintenanceTimeEnd(), 0).String()))
+	return true
+}
+
+// readCustomRun will read the run list of a custom run from the body of the request.
+// The body can be the raw run list, JSON or a form. Options sent in a JSON body are
+// added to options. If the body can not be used a 400 is written and ok is false.
+func (e *HTTPEngine) readCustomRun(w http.ResponseWriter, r *http.Request, options *internalstate.RunOptions) (runList string, ok bool) {
+	defer r.Body.Close()
+	if isFormRequest(r) {
+		return e.readCustomRunForm(w, r)
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		if e.bodyTooLarge(w, err) {
+			return "", false
+		}
+		e.logger.Errorf("Request to custom job failed while reading the body. Error: %s", err)
+		writeJSONError(w, http.StatusBadRequest, "invalid_body", "The body could not be read")
+		return "", false
+	}
+	customRunText := string(body)
+	if isJSONRequest(r) {
+		runRequest := &customRunRequest{}
+		if err := json.Unmarshal(body, runRequest); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_json", "Body is not valid JSON")
+			return "", false
+		}
+		if runRequest.RunList == "" {
+			writeJSONError(w, http.StatusBadRequest, "missing_run_list", "run_list is required")
+			return "", false
+		}
+		customRunText = runRequest.RunList
+		options.ExtraFlags = runRequest.ExtraFlags
+		if runRequest.Label != "" {
+			options.Label = runRequest.Label
+		}
+		options.Retry = options.Retry || runRequest.Retry
+		if runRequest.RunAs != "" {
+			options.RunAs = runRequest.RunAs
+		}
+		if runRequest.Reason != "" {
+			options.Reason = runRequest.Reason
+		}
+		if runRequest.NodeName != "" {
+			options.NodeName = runRequest.NodeName
+		}
+	}
+	return customRunText, true
+}
+
+// readCustomRunForm will read the run list from the command field of a form.
+func (e *HTTPEngine) readCustomRunForm(w http.ResponseWriter, r *http.Request) (runList string, ok bool) {
+	if err := r.ParseForm(); err != nil {
+		if e.bodyTooLarge(w, err) {
+			return "", false
+		}
+		writeJSONError(w, http.StatusBadRequest, "invalid_form", "Body is not a valid form")
+		return "", false
+	}
+	command := r.PostForm.Get("command")
+	if command == "" {
+		writeJSONError(w, http.StatusBadRequest, "missing_command", "command is required")
+		return "", false
+	}
+	return command, true
+}
+
+// validLabel returns true if the label can be put on a run. If not a 400 is written.
+func validLabel(w http.ResponseWriter, label string) bool {
+	if len(label) <= maxLabelLength {
+		return true
+	}
+	writeJSONError(w, http.StatusBadRequest, "invalid_label", fmt.Sprintf("label must be at most %d characters", maxLabelLength))
+	return false
+}
+
+// validNodeName returns true if the node name override can be passed to chef-client.
+// An empty name is valid as it means that no override was asked for.
+func validNodeName(nodeName string) bool {
+	return nodeName == "" || nodeNamePattern.MatchString(nodeName)
+}
+
 // GetChefStatus - writes the state of the requested guid.
 func (e *HTTPEngine) getChefStatus(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
@@ -220,8 +711,49 @@ func (e *HTTPEngine) getChefStatus(w http.ResponseWriter, r *http.Request) {
 	status := e.state.Read(vars["guid"])
 	jsonBytes, err := jsonMarshal(status)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprint(w, "{\"Error\":\"Failed to read guid status\"}\n")
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Failed to read guid status")
+		return
+	}
+	printJSON(w, jsonBytes)
+}
+
+// bulkStatusMaxGUIDs is the most guids that can be asked for in one bulk status request.
+const bulkStatusMaxGUIDs = 100
+
+// bulkStatusNotFound is returned in place of the job details of guids that are not known.
+var bulkStatusNotFound = map[string]string{"status": "not_found"}
+
+// getChefStatuses will write the status of each guid in the JSON array sent in the body.
+// Unknown guids are marked as not_found rather than failing the request.
+func (e *HTTPEngine) getChefStatuses(w http.ResponseWriter, r *http.Request) {
+	setContentJSON(w)
+	defer r.Body.Close()
+	guids := []string{}
+	if err := json.NewDecoder(r.Body).Decode(&guids); err != nil {
+		if e.bodyTooLarge(w, err) {
+			return
+		}
+		writeJSONError(w, http.StatusBadRequest, "invalid_body", "Body must be a JSON array of guids")
+		return
+	}
+	if len(guids) > bulkStatusMaxGUIDs {
+		writeJSONError(w, http.StatusBadRequest, "too_many_guids", fmt.Sprintf("Too many guids. Max %d", bulkStatusMaxGUIDs))
+		return
+	}
+	logs.DebugMessage(fmt.Sprintf("getChefStatuses() - %d guids", len(guids)))
+
+	statuses := make(map[string]interface{}, len(guids))
+	for _, guid := range guids {
+		details := e.state.Read(guid)[guid]
+		if details == nil {
+			statuses[guid] = bulkStatusNotFound
+			continue
+		}
+		statuses[guid] = details
+	}
+	jsonBytes, err := jsonMarshal(statuses)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Failed to read guid status")
 		return
 	}
 	printJSON(w, jsonBytes)
@@ -238,67 +770,349 @@ func (e *HTTPEngine) getStatus(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprint(w, "\n")
 }
 
+// shutdown - Starts a clean shut down of chef waiter. The shut down happens in the
+// background so the request is answered straight away.
+func (e *HTTPEngine) shutdown(w http.ResponseWriter, r *http.Request) {
+	setContentJSON(w)
+	if e.shutdownFunc == nil {
+		writeJSONError(w, http.StatusServiceUnavailable, "shutdown_unavailable", "Shutting down through the API is not available")
+		return
+	}
+	e.requestLogger(r).Warningf("Shut down requested from %s", r.RemoteAddr)
+	e.shutdownOnce.Do(func() { go e.shutdownFunc() })
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprint(w, "{\"shutting_down\":true}\n")
+}
+
+// getStateDump - Writes the whole state table. Nothing is redacted as it is only
+// available to administrators.
+func (e *HTTPEngine) getStateDump(w http.ResponseWriter, r *http.Request) {
+	setContentJSON(w)
+	jsonBytes, err := jsonMarshal(e.state.Dump())
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Failed to gather the state")
+		return
+	}
+	printJSON(w, jsonBytes)
+}
+
+// readiness - Writes if the chef waiter is fit to be relied on. It is not ready when
+// saving the state to disk has kept failing as run history would be lost on restart,
+// or when the chef-client self test keeps failing.
+func (e *HTTPEngine) readiness(w http.ResponseWriter, r *http.Request) {
+	setContentJSON(w)
+	ready := &struct {
+		Ready  bool   `json:"ready"`
+		Reason string `json:"reason,omitempty"`
+	}{Ready: true}
+	if e.state.PersistFailing(time.Now()) {
+		persist := e.state.ReadPersistStatus()
+		ready.Ready = false
+		ready.Reason = fmt.Sprintf(
+			"saving the state to disk has been failing since %s: %s",
+			time.Unix(persist.FailingSince, 0).String(),
+			persist.LastError,
+		)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	} else if reason := e.appState.SelfTestFailure(); reason != "" {
+		ready.Ready = false
+		ready.Reason = reason
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(ready)
+}
+
 // HealthCheck - Writes a HealthCheck message that can be used to check the state
 // of the chef waiter.
+// With respect_maintenance=true a 503 is returned during maintenance so that load
+// balancers can drain the server. With verbose=true the health of each part of chef
+// waiter is written instead. With details=true the cached chef version is added so that
+// monitoring does not need a second call. It is empty if chef-client was not found.
 func (e *HTTPEngine) healthCheck(w http.ResponseWriter, r *http.Request) {
 	setContentJSON(w)
+	if r.URL.Query().Get("respect_maintenance") == "true" && e.state.InMaintenceMode() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(w, "{\"state\": \"Maintenance\"}")
+		return
+	}
+	if r.URL.Query().Get("verbose") == "true" {
+		json.NewEncoder(w).Encode(e.checkHealth(time.Now()))
+		return
+	}
+	if r.URL.Query().Get("details") == "true" {
+		json.NewEncoder(w).Encode(&struct {
+			State       string `json:"state"`
+			ChefVersion string `json:"chef_version"`
+		}{State: "OK", ChefVersion: e.appState.ChefVersion()})
+		return
+	}
 	fmt.Fprint(w, "{\"state\": \"OK\"}")
 }
 
+// listChefLogs - lists the chef logs that are on disk, newest first.
+func (e *HTTPEngine) listChefLogs(w http.ResponseWriter, r *http.Request) {
+	setContentJSON(w)
+	filter, err := parseListFilter(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_filter", err.Error())
+		return
+	}
+	logFiles, err := e.chefLogsWorker.ListLogs()
+	if err != nil {
+		e.logger.Errorf("Failed to list the chef logs. Error: %s", err)
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Failed to list the chef logs")
+		return
+	}
+	filtered := make([]cheflogs.LogFile, 0, len(logFiles))
+	for _, logFile := range logFiles {
+		if filter.limit > 0 && len(filtered) >= filter.limit {
+			break
+		}
+		if logFile.Modified >= filter.since {
+			filtered = append(filtered, logFile)
+		}
+	}
+	jsonBytes, err := jsonMarshal(filtered)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Failed to encode the chef logs")
+		return
+	}
+	printJSON(w, jsonBytes)
+}
+
+// searchChefLogs - looks through the recent chef logs for lines containing q.
+// The match is case insensitive. With regex=true q is used as a regular expression.
+func (e *HTTPEngine) searchChefLogs(w http.ResponseWriter, r *http.Request) {
+	setContentJSON(w)
+	query := r.URL.Query().Get("q")
+	if query == "" {
+		writeJSONError(w, http.StatusBadRequest, "missing_query", "q is required")
+		return
+	}
+
+	limit := 20
+	if limitString := r.URL.Query().Get("limit"); limitString != "" {
+		var err error
+		limit, err = strconv.Atoi(limitString)
+		if err != nil || limit < 1 || limit > 100 {
+			writeJSONError(w, http.StatusBadRequest, "invalid_limit", "limit must be a number between 1 and 100")
+			return
+		}
+	}
+
+	var match func(string) bool
+	if r.URL.Query().Get("regex") == "true" {
+		re, err := regexp.Compile("(?i)" + query)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_regex", fmt.Sprintf("q is not a valid regular expression: %s", err))
+			return
+		}
+		match = re.MatchString
+	} else {
+		lowerQuery := strings.ToLower(query)
+		match = func(line string) bool {
+			return strings.Contains(strings.ToLower(line), lowerQuery)
+		}
+	}
+
+	results, err := e.chefLogsWorker.SearchLogs(match, limit)
+	if err != nil {
+		e.logger.Errorf("Failed to search the chef logs. Error: %s", err)
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Failed to search the chef logs")
+		return
+	}
+	jsonBytes, err := jsonMarshal(struct {
+		Query   string                  `json:"query"`
+		Results []cheflogs.SearchResult `json:"results"`
+	}{Query: query, Results: results})
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Failed to encode the search results")
+		return
+	}
+	printJSON(w, jsonBytes)
+}
+
+// getVersion - writes the versions of chef waiter, chef and go along with where
+// chef waiter was built from.
+func (e *HTTPEngine) getVersion(w http.ResponseWriter, r *http.Request) {
+	setContentJSON(w)
+	jsonBytes, err := jsonMarshal(map[string]string{
+		"version":      e.appState.Version(),
+		"git_commit":   e.appState.GitCommit(),
+		"build_date":   e.appState.BuildDate(),
+		"chef_version": e.appState.ChefVersion(),
+		"go_version":   runtime.Version(),
+	})
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Failed to encode the versions")
+		return
+	}
+	printJSON(w, jsonBytes)
+}
+
 // getChefLogs - is responsible for displaying the chef logs that have been created
 // by a chef run.
 func (e *HTTPEngine) getChefLogs(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	// Set the content type
-	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	// stream=stderr reads the stderr log kept when separate_stderr_log is on.
+	logPath := e.chefLogsWorker.GetLogPath(vars["guid"])
+	switch r.URL.Query().Get("stream") {
+	case "", "stdout":
+	case "stderr":
+		logPath = e.chefLogsWorker.GetErrLogPath(vars["guid"])
+	default:
+		writeJSONError(w, http.StatusBadRequest, "invalid_stream", "stream must be stdout or stderr")
+		return
+	}
 	// We first need to look for the log file.
 	// Throw a 404 if the file is not there
-	if err := e.chefLogsWorker.IsLogAvailable(vars["guid"]); err != nil {
-		w.WriteHeader(http.StatusNotFound)
-		logs.DebugMessage(fmt.Sprintf("Unavailable: %s, %s", e.chefLogsWorker.GetLogPath(vars["guid"]), err))
-		fmt.Fprintf(w, "404 - %s not found\n", vars["guid"])
+	if _, err := os.Stat(logPath); err != nil {
+		logs.DebugMessage(fmt.Sprintf("Unavailable: %s, %s", logPath, err))
+		writeJSONError(w, http.StatusNotFound, "log_not_found", fmt.Sprintf("There is no log for %s", vars["guid"]))
 		return
 	}
-	logs.DebugMessage(fmt.Sprintf("Found: %s", e.chefLogsWorker.GetLogPath(vars["guid"])))
+	logs.DebugMessage(fmt.Sprintf("Found: %s", logPath))
 
 	// If it is there then we need to read it out.
-	file, err := os.Open(e.chefLogsWorker.GetLogPath(vars["guid"]))
+	file, err := os.Open(logPath)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		e.logger.Errorf("Failed to open %s: %v", e.chefLogsWorker.GetLogPath(vars["guid"]), err)
+		e.logger.Errorf("Failed to open %s: %v", logPath, err)
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Failed to read the log")
 		return
 	}
 	// remember to close it at the end.
 	defer file.Close()
 
-	// At this point we are about to read out the file so it is safe to
-	// write the headers for OK Status.
-	w.WriteHeader(http.StatusOK)
+	info, err := file.Stat()
+	if err != nil {
+		e.logger.Errorf("Failed to read file: %s, Error: %s", file.Name(), err)
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Failed to read the log")
+		return
+	}
+	// Only the log itself is sent as plain text.
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	// The log of a run that has finished will not change so it can be cached. Runs that
+	// are no longer in the state table finished long ago.
+	if details := e.state.Read(vars["guid"])[vars["guid"]]; details != nil && (details.Status == "registered" || details.Status == "running") {
+		w.Header().Set("Cache-Control", "no-store")
+	} else {
+		w.Header().Set("Cache-Control", "max-age=31536000, immutable")
+		w.Header().Set("ETag", fmt.Sprintf(`W/"%x-%x"`, info.Size(), info.ModTime().UnixNano()))
+	}
+	// ServeContent handles Range and conditional requests so clients can read the log in chunks.
+	http.ServeContent(w, r, "", info.ModTime(), file)
+}
 
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		fmt.Fprintln(w, scanner.Text())
+// purgeChefLogs - removes all the chef logs from the log directory. It can also remove
+// the state records of the finished runs if include_state=true is passed in the URL.
+func (e *HTTPEngine) purgeChefLogs(w http.ResponseWriter, r *http.Request) {
+	setContentJSON(w)
+	// A run that starts after this check is safe too as PurgeLogs keeps open logs.
+	for _, job := range e.state.ReadAllJobs() {
+		if job.Status == "running" {
+			writeJSONError(w, http.StatusConflict, "run_active", "A chef run is active. Logs can not be purged")
+			return
+		}
 	}
-	if err := scanner.Err(); err != nil {
-		e.logger.Errorf("Failed to read file: %s, Error: %s", file.Name(), err)
+
+	e.requestLogger(r).Infof("Purge of chef logs requested from %s", r.RemoteAddr)
+	removed, err := e.chefLogsWorker.PurgeLogs()
+	if err != nil {
+		e.logger.Errorf("Failed to purge chef logs. Error: %s", err)
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Failed to purge chef logs")
+		return
+	}
+
+	statesRemoved := 0
+	if r.URL.Query().Get("include_state") == "true" {
+		statesRemoved = e.state.RemoveFinishedStates()
+	}
+
+	summary := &struct {
+		LogsRemoved   int `json:"logs_removed"`
+		StatesRemoved int `json:"state_records_removed"`
+	}{
+		LogsRemoved:   removed,
+		StatesRemoved: statesRemoved,
+	}
+	json.NewEncoder(w).Encode(summary)
+}
+
+// sweepChefLogs - removes the logs of runs that are no longer in the state table now
+// rather than waiting for the next sweep.
+func (e *HTTPEngine) sweepChefLogs(w http.ResponseWriter, r *http.Request) {
+	setContentJSON(w)
+	e.requestLogger(r).Infof("Sweep of chef logs requested from %s", r.RemoteAddr)
+	removed, err := e.chefLogsWorker.SweepLogs(e.state.GetAllStateTimes())
+	if err != nil {
+		e.logger.Errorf("Failed to sweep chef logs. Error: %s", err)
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Failed to sweep chef logs")
+		return
+	}
+	summary := &struct {
+		LogsRemoved int `json:"logs_removed"`
+	}{
+		LogsRemoved: removed,
 	}
+	json.NewEncoder(w).Encode(summary)
 }
 
 func (e *HTTPEngine) getNextChefRun(w http.ResponseWriter, r *http.Request) {
 	setContentJSON(w)
 	w.WriteHeader(http.StatusOK)
 	// json string with epoch and string time
-	epoch := e.state.GetlastRunStartTime() + e.state.ReadChefRunTimer()
 	next := &struct {
-		Epoch int64  `json:"epoch"`
-		Str   string `json:"human"`
-	}{
-		Epoch: epoch,
-		Str:   time.Unix(epoch, 0).String(),
+		Scheduled bool   `json:"scheduled"`
+		Reason    string `json:"reason,omitempty"`
+		Epoch     int64  `json:"epoch,omitempty"`
+		Str       string `json:"human,omitempty"`
+		Schedule  string `json:"schedule,omitempty"`
+	}{Schedule: e.state.ReadRunSchedule()}
+	// Periodic runs will not start if there is a reason so there is no next run to show.
+	if next.Reason = e.periodicBlockedReason(); next.Reason == "" {
+		epoch := e.state.NextPeriodicRunTime()
+		next.Scheduled = true
+		next.Epoch = epoch
+		next.Str = time.Unix(epoch, 0).String()
 	}
 	json.NewEncoder(w).Encode(next)
 }
 
+// periodicBlockedReason returns why the periodic scheduler would not start a run now,
+// or an empty string if it would.
+func (e *HTTPEngine) periodicBlockedReason() string {
+	switch {
+	case !e.state.ReadPeriodicRuns():
+		return "periodic runs are disabled"
+	case e.state.InMaintenceMode():
+		return "maintenance mode is active"
+	case e.state.ReadRunLock():
+		return "runs are locked"
+	}
+	return ""
+}
+
+// registerPeriodicRun - requests a run as if the periodic scheduler had fired. Unlike
+// /chefclient it is held back by the same things that hold back periodic runs and
+// the reason is returned instead of a run.
+func (e *HTTPEngine) registerPeriodicRun(w http.ResponseWriter, r *http.Request) {
+	setContentJSON(w)
+	if reason := e.periodicBlockedReason(); reason != "" {
+		logs.DebugMessage(fmt.Sprintf("registerPeriodicRun() suppressed: %s", reason))
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]interface{}{"started": false, "reason": reason})
+		return
+	}
+	guid := e.worker.PeriodicRun()
+	logs.DebugMessage(fmt.Sprintf("registerPeriodicRun() - %s", guid))
+	jsonBytes, err := jsonMarshal(e.state.Read(guid))
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Failed to read guid status")
+		return
+	}
+	printJSON(w, jsonBytes)
+}
+
 func (e *HTTPEngine) setChefRunInterval(w http.ResponseWriter, r *http.Request) {
 	// check if the string is a number and is positive
 	setContentJSON(w)
@@ -306,24 +1120,71 @@ func (e *HTTPEngine) setChefRunInterval(w http.ResponseWriter, r *http.Request)
 	i, err := strconv.Atoi(vars["i"])
 	if err != nil || i < 0 {
 		e.logger.Errorf("/chef/interval/%s is not a positive number", vars["i"])
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprint(w, "{\"Error\":\"Only a positive number will be accepted\"}\n")
+		writeJSONError(w, http.StatusBadRequest, "invalid_interval", "Only a positive number will be accepted")
 		return
 	}
 	if i <= 0 {
 		e.logger.Errorf("/chef/interval/%s is not a positive number", vars["i"])
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprint(w, "{\"Error\":\"Only a positive number will be accepted\"}\n")
+		writeJSONError(w, http.StatusBadRequest, "invalid_interval", "Only a positive number will be accepted")
 		return
 	}
 
 	e.state.WriteChefRunTimer(int64(i))
+	e.getChefRunInterval(w, r)
+}
+
+// intervalRequest is the body of a POST to /chef/interval.
+// Only one of Seconds or Duration should be set.
+type intervalRequest struct {
+	Seconds  int64  `json:"seconds"`
+	Duration string `json:"duration"`
+}
+
+// postChefRunInterval - sets the time between periodic runs from a JSON body like
+// {"seconds": 1800} or {"duration": "30m"}. The interval must be in whole minutes.
+func (e *HTTPEngine) postChefRunInterval(w http.ResponseWriter, r *http.Request) {
+	setContentJSON(w)
+	defer r.Body.Close()
+	request := &intervalRequest{}
+	if err := json.NewDecoder(r.Body).Decode(request); err != nil {
+		if e.bodyTooLarge(w, err) {
+			return
+		}
+		writeJSONError(w, http.StatusBadRequest, "invalid_json", "Body is not valid JSON")
+		return
+	}
+	interval := time.Duration(request.Seconds) * time.Second
+	if request.Duration != "" {
+		if request.Seconds != 0 {
+			writeJSONError(w, http.StatusBadRequest, "invalid_interval", "Only one of seconds or duration can be set")
+			return
+		}
+		d, err := time.ParseDuration(request.Duration)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_interval", "duration is not a valid duration, eg 30m")
+			return
+		}
+		interval = d
+	}
+	if interval <= 0 {
+		writeJSONError(w, http.StatusBadRequest, "invalid_interval", "Only a positive interval will be accepted")
+		return
+	}
+	if interval%time.Minute != 0 {
+		writeJSONError(w, http.StatusBadRequest, "invalid_interval", "The interval must be a whole number of minutes")
+		return
+	}
+
+	e.state.WriteChefRunTimer(int64(interval / time.Minute))
+	e.getChefRunInterval(w, r)
 }
 
+// getChefRunInterval - returns the time between periodic runs. It is also the reply
+// when the interval is set so that clients can see the value that was taken.
 func (e *HTTPEngine) getChefRunInterval(w http.ResponseWriter, r *http.Request) {
 	i := e.state.ReadChefRunTimer()
 	setContentJSON(w)
-	fmt.Fprintf(w, "{\"current_interval\":\"%d minutes\"}\n", i/60)
+	fmt.Fprintf(w, "{\"current_interval\":\"%d minutes\",\"interval_seconds\":%d}\n", i/60, i)
 }
 
 // setChefRunEnabled - enables periodic runs
@@ -351,19 +1212,90 @@ func (e *HTTPEngine) getLastRunGUID(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "{\"last_run_guid\":\"%s\"}\n", e.state.ReadLastRunGUID())
 }
 
+// getLastSuccessfulRun - writes the guid and finish time of the last run that exited with 0.
+// The guid is empty and the time 0 if no run has succeeded.
+func (e *HTTPEngine) getLastSuccessfulRun(w http.ResponseWriter, r *http.Request) {
+	setContentJSON(w)
+	lastSuccess := &struct {
+		GUID  string `json:"last_successful_run_guid"`
+		Epoch int64  `json:"last_successful_run_time"`
+		Str   string `json:"human,omitempty"`
+	}{
+		GUID:  e.state.ReadLastSuccessfulRunGUID(),
+		Epoch: e.state.ReadLastSuccessfulRunTime(),
+	}
+	if lastSuccess.Epoch != 0 {
+		lastSuccess.Str = time.Unix(lastSuccess.Epoch, 0).String()
+	}
+	json.NewEncoder(w).Encode(lastSuccess)
+}
+
 func (e *HTTPEngine) getAllRuns(w http.ResponseWriter, r *http.Request) {
 	setContentJSON(w)
+	filter, err := parseListFilter(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_filter", err.Error())
+		return
+	}
+	order, err := parseRunSort(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_sort", err.Error())
+		return
+	}
 	jobs := e.state.ReadAllJobs()
+	guids := filter.filterJobs(jobs, order)
+
+	switch r.URL.Query().Get("format") {
+	case "", "json":
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", "attachment; filename=\"chefwaiter-runs.csv\"")
+		if err := writeRunsCSV(w, guids, jobs); err != nil {
+			e.requestLogger(r).Errorf("Failed to write the runs as CSV. Error: %s", err)
+		}
+		return
+	default:
+		writeJSONError(w, http.StatusBadRequest, "invalid_format", "format must be json or csv")
+		return
+	}
 
-	jsonJobs, err := json.MarshalIndent(jobs, "", "  ")
+	jsonJobs, err := orderedJobsJSON(guids, jobs)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprint(w, "{\"Error\":\"Failed to gather jobs\"}\n")
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Failed to gather jobs")
 		return
 	}
 	fmt.Fprint(w, string(jsonJobs), "\n")
 }
 
+// orderedJobsJSON encodes the jobs as a JSON object keyed by guid like
+// json.MarshalIndent would, but with the guids in the given order rather than sorted.
+func orderedJobsJSON(guids []string, jobs map[string]internalstate.JobDetails) ([]byte, error) {
+	if len(guids) == 0 {
+		return []byte("{}"), nil
+	}
+	buf := &bytes.Buffer{}
+	buf.WriteString("{")
+	for i, guid := range guids {
+		key, err := json.Marshal(guid)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.MarshalIndent(jobs[guid], "  ", "  ")
+		if err != nil {
+			return nil, err
+		}
+		if i > 0 {
+			buf.WriteString(",")
+		}
+		buf.WriteString("\n  ")
+		buf.Write(key)
+		buf.WriteString(": ")
+		buf.Write(value)
+	}
+	buf.WriteString("\n}")
+	return buf.Bytes(), nil
+}
+
 func (e *HTTPEngine) getChefMaintenance(w http.ResponseWriter, r *http.Request) {
 	setContentJSON(w)
 	fmt.Fprintf(w, "{\"end_time\":\"%s\", \"in_maintenance\":%v}\n", time.Unix(e.state.ReadMaintenanceTimeEnd(), 0), e.state.InMaintenceMode())
@@ -374,7 +1306,7 @@ func (e *HTTPEngine) setChefMaintenance(w http.ResponseWriter, r *http.Request)
 	vars := mux.Vars(r)
 	minutes, err := strconv.Atoi(vars["i"])
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		writeJSONError(w, http.StatusBadRequest, "invalid_maintenance", "The maintenance window must be a whole number of minutes")
 		return
 	}
 	endTime := time.Now().Unix() + int64(minutes*60)
@@ -389,14 +1321,34 @@ func (e *HTTPEngine) removeChefMaintenance(w http.ResponseWriter, r *http.Reques
 	fmt.Fprintf(w, "{\"end_time\":\"%s\"}\n", time.Unix(e.state.ReadMaintenanceTimeEnd(), 0))
 }
 
+// getChefLock - returns the lock status. When locked it also shows who set the lock and when.
 func (e *HTTPEngine) getChefLock(w http.ResponseWriter, r *http.Request) {
 	setContentJSON(w)
-	fmt.Fprintf(w, "{\"Locked\": %t}\n", e.state.ReadRunLock())
+	details := e.state.ReadLockDetails()
+	lock := &struct {
+		Locked        bool    `json:"Locked"`
+		LockedBy      *string `json:"locked_by"`
+		LockedTime    int64   `json:"locked_time"`
+		LockedTimeStr *string `json:"locked_time_human"`
+		Reason        string  `json:"reason,omitempty"`
+		AutoLocked    bool    `json:"auto_locked"`
+	}{
+		Locked:     details.Locked,
+		Reason:     details.Reason,
+		AutoLocked: details.AutoLocked,
+	}
+	if details.Locked {
+		human := time.Unix(details.LockedTime, 0).String()
+		lock.LockedBy = &details.LockedBy
+		lock.LockedTime = details.LockedTime
+		lock.LockedTimeStr = &human
+	}
+	json.NewEncoder(w).Encode(lock)
 }
 
 func (e *HTTPEngine) setChefLock(w http.ResponseWriter, r *http.Request) {
 	setContentJSON(w)
-	e.state.LockRuns(true)
+	e.state.LockRunsBy(r.RemoteAddr)
 	fmt.Fprintf(w, "{\"Locked\": %t}\n", e.state.ReadRunLock())
 }
 
@@ -405,3 +1357,17 @@ func (e *HTTPEngine) removeChefLock(w http.ResponseWriter, r *http.Request) {
 	e.state.LockRuns(false)
 	fmt.Fprintf(w, "{\"Locked\": %t}\n", e.state.ReadRunLock())
 }
+
+// resetFailureStreak - Clears the runs that failed in a row so that the count towards
+// auto_lock_failures starts again. It does not remove a lock that is already set.
+func (e *HTTPEngine) resetFailureStreak(w http.ResponseWriter, r *http.Request) {
+	setContentJSON(w)
+	e.requestLogger(r).Infof("Reset of the failure streak requested from %s", r.RemoteAddr)
+	e.state.ResetFailureStreak()
+	streak := &struct {
+		ConsecutiveFailures int `json:"consecutive_failures"`
+	}{
+		ConsecutiveFailures: e.state.ReadFailureStreak(),
+	}
+	json.NewEncoder(w).Encode(streak)
+}
@@ -1,24 +1,47 @@
 package webengine
 
 import (
+	"archive/tar"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/morfien101/chef-waiter/cheflogs"
 	"github.com/morfien101/chef-waiter/chefrunner"
 	"github.com/morfien101/chef-waiter/config"
 	"github.com/morfien101/chef-waiter/internalstate"
 	"github.com/morfien101/chef-waiter/logs"
+	"github.com/morfien101/chef-waiter/metrics"
 )
 
 type FakeAppStatus struct {
-	jsonError bool
+	jsonError      bool
+	noChef         bool
+	selfTestFailed bool
 }
 
 // NewFakeAppStatus will create an app status that is constant with your supplied
@@ -34,6 +57,32 @@ func (fa *FakeAppStatus) JSONEncoded() ([]byte, error) {
 	return []byte(`{"service_name":"ChefWaiter","hostname":"randy-laptop","uptime":1520949021,"version":"17.10.200","chef_version":"13.6.4","healthy":true,"in_maintenance_mode":false,"last_run_id":"88527564-4919-4933-8c7d-0b4bdb81dc18"}`), nil
 }
 
+func (fa *FakeAppStatus) Version() string {
+	return "17.10.200"
+}
+
+func (fa *FakeAppStatus) GitCommit() string {
+	return "0123abc"
+}
+
+func (fa *FakeAppStatus) BuildDate() string {
+	return "2019-03-19T10:00:00Z"
+}
+
+func (fa *FakeAppStatus) ChefVersion() string {
+	if fa.noChef {
+		return ""
+	}
+	return "13.6.4"
+}
+
+func (fa *FakeAppStatus) SelfTestFailure() string {
+	if fa.selfTestFailed {
+		return "the chef-client self test has failed 3 times in a row"
+	}
+	return ""
+}
+
 func cleanup(f *os.File, t *testing.T) {
 	if err := os.Remove(f.Name()); err != nil {
 		t.Fatalf("Deleting file %s failed, Error: %s", f.Name(), err)
@@ -74,10 +123,10 @@ func genNewHTTPServer(t *testing.T, logOutput bool, debuglogs bool) *HTTPEngine
 		t.Fatalf("Failed to create the config handler. Error: %s", err)
 	}
 	cheflogsworker := cheflogs.NewFakeChefLogWorker("")
-	internalstate := internalstate.New(config, cheflogsworker, logger)
+	internalstate := internalstate.NewInMemory(config, cheflogsworker, logger)
 	appstate := NewFakeAppStatus()
 	worker := chefrunner.NewFakeChefRunnerWorker(false)
-	return New(internalstate, appstate, worker, cheflogsworker, logger)
+	return New(internalstate, appstate, worker, cheflogsworker, logger, nil)
 }
 
 func TestStatus(t *testing.T) {
@@ -144,15 +193,15 @@ func TestLock(t *testing.T) {
 			)
 		}
 		if tc.registerChef {
-			JSONResponce := &struct{ Error string }{}
+			JSONResponce := &errorResponse{}
 			if err := json.Unmarshal(body, JSONResponce); err != nil {
 				t.Errorf("%s: failed to pull the body out the request. Error: %s", tc.name, err)
 			} else {
-				if errMsg := "Chefwaiter is locked"; JSONResponce.Error != errMsg {
+				if errMsg := "Chefwaiter is locked"; JSONResponce.Error.Message != errMsg {
 					t.Errorf("%s: Error message is not correct. Want: %s, Got: %s",
 						tc.name,
 						errMsg,
-						JSONResponce.Error,
+						JSONResponce.Error.Message,
 					)
 				}
 			}
@@ -173,6 +222,7 @@ func TestLock(t *testing.T) {
 
 func TestCustomJob(t *testing.T) {
 	webEngine := genNewHTTPServer(t, true, true)
+	webEngine.SetMaxRequestBodyBytes(512)
 	makeBytes := func(n int) []byte {
 		retVal := make([]byte, n)
 		for i := 0; i < n; i++ {
@@ -192,7 +242,7 @@ func TestCustomJob(t *testing.T) {
 		},
 		{
 			name:         "Too Large",
-			expectedCode: http.StatusBadRequest,
+			expectedCode: http.StatusRequestEntityTooLarge,
 			bytesToSend:  makeBytes(600),
 		},
 	}
@@ -314,7 +364,7 @@ func TestCustomJobWhiteList(t *testing.T) {
 			whitelistEnabled: true,
 			bytesToSend:      []byte(`recipe[chefwaiter::test]`),
 			whitelist:        []string{"block"},
-			expectedCode:     403,
+			expectedCode:     422,
 		},
 		{
 			name:             "Pass With whitelist",
@@ -327,7 +377,7 @@ func TestCustomJobWhiteList(t *testing.T) {
 			name:             "Fail no whitelist set",
 			whitelistEnabled: true,
 			bytesToSend:      []byte(`recipe[chefwaiter::test]`),
-			expectedCode:     403,
+			expectedCode:     422,
 		},
 	}
 
@@ -359,3 +409,2060 @@ func TestCustomJobWhiteList(t *testing.T) {
 		}
 	}
 }
+
+// failingReader is a request body that can not be read.
+type failingReader struct{}
+
+func (failingReader) Read(p []byte) (int, error) {
+	return 0, fmt.Errorf("connection reset")
+}
+
+func TestErrorResponses(t *testing.T) {
+	tests := []struct {
+		name         string
+		method       string
+		path         string
+		body         string
+		bodyReader   io.Reader
+		contentType  string
+		token        string
+		setup        func(e *HTTPEngine)
+		expectedCode int
+		expectedErr  string
+	}{
+		{name: "Locked", method: http.MethodGet, path: "/chefclient", setup: func(e *HTTPEngine) { e.state.LockRuns(true) }, expectedCode: 403, expectedErr: "locked"},
+		{name: "Locked custom run", method: http.MethodPost, path: "/chefclient", body: "recipe[test]", setup: func(e *HTTPEngine) { e.state.LockRuns(true) }, expectedCode: 403, expectedErr: "locked"},
+		{name: "Not whitelisted", method: http.MethodPost, path: "/chefclient", body: "recipe[test]", setup: func(e *HTTPEngine) { e.SetWhitelist([]string{"recipe[other]"}) }, expectedCode: 422, expectedErr: "not_whitelisted"},
+		{name: "Extra flags", method: http.MethodPost, path: "/chefclient", body: `{"run_list":"recipe[test]","extra_flags":["--no-fork"]}`, contentType: "application/json", expectedCode: 400, expectedErr: "extra_flags_not_allowed"},
+		{name: "Run as", method: http.MethodPost, path: "/chefclient?run_as=nobody", body: "recipe[test]", expectedCode: 403, expectedErr: "run_as_not_allowed"},
+		{name: "Invalid JSON", method: http.MethodPost, path: "/chefclient", body: `{`, contentType: "application/json", expectedCode: 400, expectedErr: "invalid_json"},
+		{name: "Missing run list", method: http.MethodPost, path: "/chefclient", body: `{}`, contentType: "application/json", expectedCode: 400, expectedErr: "missing_run_list"},
+		{name: "Invalid form", method: http.MethodPost, path: "/chefclient", body: "%zz", contentType: "application/x-www-form-urlencoded", expectedCode: 400, expectedErr: "invalid_form"},
+		{name: "Missing command", method: http.MethodPost, path: "/chefclient", body: "label=x", contentType: "application/x-www-form-urlencoded", expectedCode: 400, expectedErr: "missing_command"},
+		{name: "Label too long", method: http.MethodGet, path: "/chefclient?label=" + strings.Repeat("a", maxLabelLength+1), expectedCode: 400, expectedErr: "invalid_label"},
+		{name: "Bulk status body", method: http.MethodPost, path: "/chefclient/status", body: `{}`, expectedCode: 400, expectedErr: "invalid_body"},
+		{name: "Too many guids", method: http.MethodPost, path: "/chefclient/status", body: `[` + strings.Repeat(`"a",`, bulkStatusMaxGUIDs) + `"a"]`, expectedCode: 400, expectedErr: "too_many_guids"},
+		{name: "Body too large", method: http.MethodPost, path: "/chefclient/status", body: `["` + strings.Repeat("a", 2048) + `"]`, expectedCode: 413, expectedErr: "body_too_large"},
+		{name: "Log list filter", method: http.MethodGet, path: "/cheflogs?limit=x", expectedCode: 400, expectedErr: "invalid_filter"},
+		{name: "All runs filter", method: http.MethodGet, path: "/chef/allruns?limit=x", expectedCode: 400, expectedErr: "invalid_filter"},
+		{name: "All runs format", method: http.MethodGet, path: "/chef/allruns?format=xml", expectedCode: 400, expectedErr: "invalid_format"},
+		{name: "All runs sort", method: http.MethodGet, path: "/chef/allruns?sort=name", expectedCode: 400, expectedErr: "invalid_sort"},
+		{name: "Runs source", method: http.MethodGet, path: "/chef/runs?source=cron", expectedCode: 400, expectedErr: "invalid_filter"},
+		{name: "Runs label", method: http.MethodGet, path: "/chef/runs?label=" + strings.Repeat("a", maxLabelLength+1), expectedCode: 400, expectedErr: "invalid_label"},
+		{name: "Search without q", method: http.MethodGet, path: "/cheflogs/search", expectedCode: 400, expectedErr: "missing_query"},
+		{name: "Run delay", method: http.MethodGet, path: "/chefclient?delay=soon", expectedCode: 400, expectedErr: "invalid_delay"},
+		{name: "Run delay too long", method: http.MethodGet, path: "/chefclient?delay=48h", expectedCode: 400, expectedErr: "invalid_delay"},
+		{name: "Log stream", method: http.MethodGet, path: "/cheflogs/x?stream=both", expectedCode: 400, expectedErr: "invalid_stream"},
+		{
+			name:         "Log not found",
+			method:       http.MethodGet,
+			path:         "/cheflogs/x",
+			setup:        func(e *HTTPEngine) { e.chefLogsWorker = cheflogs.NewFakeChefLogWorker(filepath.Join(os.TempDir(), "chefwaiter-missing.log")) },
+			expectedCode: 404,
+			expectedErr:  "log_not_found",
+		},
+		{name: "Unreadable custom run body", method: http.MethodPost, path: "/chefclient", bodyReader: failingReader{}, expectedCode: 400, expectedErr: "invalid_body"},
+		{name: "Maintenance minutes", method: http.MethodPost, path: "/chef/maintenance/start/soon", expectedCode: 400, expectedErr: "invalid_maintenance"},
+		{name: "Search limit", method: http.MethodGet, path: "/cheflogs/search?q=a&limit=0", expectedCode: 400, expectedErr: "invalid_limit"},
+		{name: "Search regex", method: http.MethodGet, path: "/cheflogs/search?q=(&regex=true", expectedCode: 400, expectedErr: "invalid_regex"},
+		{name: "Interval path", method: http.MethodPost, path: "/chef/interval/-1", expectedCode: 400, expectedErr: "invalid_interval"},
+		{name: "Interval JSON", method: http.MethodPost, path: "/chef/interval", body: `{`, expectedCode: 400, expectedErr: "invalid_json"},
+		{name: "Interval both", method: http.MethodPost, path: "/chef/interval", body: `{"seconds":60,"duration":"1m"}`, expectedCode: 400, expectedErr: "invalid_interval"},
+		{name: "Interval duration", method: http.MethodPost, path: "/chef/interval", body: `{"duration":"soon"}`, expectedCode: 400, expectedErr: "invalid_interval"},
+		{name: "Interval negative", method: http.MethodPost, path: "/chef/interval", body: `{"seconds":-60}`, expectedCode: 400, expectedErr: "invalid_interval"},
+		{name: "Interval minutes", method: http.MethodPost, path: "/chef/interval", body: `{"seconds":90}`, expectedCode: 400, expectedErr: "invalid_interval"},
+		{
+			name:   "Missing reason",
+			method: http.MethodPost,
+			path:   "/chefclient",
+			body:   "recipe[test]",
+			setup: func(e *HTTPEngine) {
+				e.SetWhitelist([]string{"recipe[test]"})
+				e.SetReasonRequiredRuns([]string{"recipe[test]"})
+			},
+			expectedCode: 400,
+			expectedErr:  "missing_reason",
+		},
+		{name: "Admin disabled", method: http.MethodPost, path: "/admin/shutdown", setup: func(e *HTTPEngine) { e.SetAdminToken("") }, expectedCode: 403, expectedErr: "admin_disabled"},
+		{name: "Unauthorized", method: http.MethodPost, path: "/admin/shutdown", token: "wrong", expectedCode: 401, expectedErr: "unauthorized"},
+		{name: "Shutdown unavailable", method: http.MethodPost, path: "/admin/shutdown", token: "secret", expectedCode: 503, expectedErr: "shutdown_unavailable"},
+		{
+			name:   "Purge with a run active",
+			method: http.MethodDelete,
+			path:   "/cheflogs",
+			token:  "secret",
+			setup: func(e *HTTPEngine) {
+				e.state.Add("running-guid", true)
+				e.state.UpdateStatus("running-guid", "running")
+			},
+			expectedCode: 409,
+			expectedErr:  "run_active",
+		},
+		{
+			name:   "Network not allowed",
+			method: http.MethodGet,
+			path:   "/status",
+			setup: func(e *HTTPEngine) {
+				e.SetNetworkPolicy(NetworkPolicy{ReadAllowed: []string{"10.0.0.0/8"}})
+			},
+			expectedCode: 403,
+			expectedErr:  "network_not_allowed",
+		},
+	}
+
+	for _, test := range tests {
+		webEngine := genNewHTTPServer(t, false, false)
+		webEngine.SetAdminToken("secret")
+		webEngine.SetMaxRequestBodyBytes(1024)
+		if test.setup != nil {
+			test.setup(webEngine)
+		}
+
+		w := httptest.NewRecorder()
+		body := test.bodyReader
+		if body == nil {
+			body = strings.NewReader(test.body)
+		}
+		r := httptest.NewRequest(test.method, url(test.path), body)
+		if test.contentType != "" {
+			r.Header.Set("Content-Type", test.contentType)
+		}
+		if test.token != "" {
+			r.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		webEngine.ServeHTTP(w, r)
+
+		if w.Code != test.expectedCode {
+			t.Errorf("Test %s did not return expected Status Code. Got: %d, Want: %d", test.name, w.Code, test.expectedCode)
+		}
+		if contentType := w.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "application/json") {
+			t.Errorf("Test %s did not return JSON. Got Content-Type: %s", test.name, contentType)
+		}
+		response := &errorResponse{}
+		decoder := json.NewDecoder(w.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(response); err != nil {
+			t.Errorf("Test %s did not return the error shape. Error: %s", test.name, err)
+			continue
+		}
+		if response.Error.Code != test.expectedErr || response.Error.Message == "" {
+			t.Errorf("Test %s returned the wrong error. Got: %+v, Want code: %s", test.name, response.Error, test.expectedErr)
+		}
+	}
+}
+
+func TestNotWhitelistedCommand(t *testing.T) {
+	webEngine := genNewHTTPServer(t, false, false)
+	webEngine.SetWhitelist([]string{"recipe[chefwaiter::other]"})
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, url("/chefclient"), strings.NewReader(`recipe[chefwaiter::test]`))
+	webEngine.ServeHTTP(w, r)
+
+	want := `{"error":{"code":"not_whitelisted","message":"Whitelist does not contain 'recipe[chefwaiter::test]'","command":"recipe[chefwaiter::test]"}}`
+	if body := strings.TrimSpace(w.Body.String()); body != want {
+		t.Errorf("The rejected command was not returned. Got: %s, Want: %s", body, want)
+	}
+}
+
+func TestDisabledEndpointGroups(t *testing.T) {
+	base := genNewHTTPServer(t, false, false)
+	webEngine := New(base.state, base.appState, base.worker, base.chefLogsWorker, base.logger, []string{TriggerEndpoints, AdminEndpoints})
+	tests := []struct {
+		name         string
+		method       string
+		path         string
+		expectedCode int
+	}{
+		{name: "Status", method: http.MethodGet, path: "/status", expectedCode: http.StatusOK},
+		{name: "Lock state", method: http.MethodGet, path: "/chef/lock", expectedCode: http.StatusOK},
+		{name: "Healthcheck", method: http.MethodGet, path: "/healthcheck", expectedCode: http.StatusOK},
+		{name: "Trigger run", method: http.MethodGet, path: "/chefclient", expectedCode: http.StatusNotFound},
+		{name: "Custom run", method: http.MethodPost, path: "/chefclient", expectedCode: http.StatusNotFound},
+		{name: "Run now", method: http.MethodGet, path: "/chef/runnow", expectedCode: http.StatusNotFound},
+		{name: "Set lock", method: http.MethodPost, path: "/chef/lock/set", expectedCode: http.StatusNotFound},
+		{name: "Set interval", method: http.MethodPost, path: "/chef/interval", expectedCode: http.StatusMethodNotAllowed},
+		{name: "Purge logs", method: http.MethodDelete, path: "/cheflogs", expectedCode: http.StatusMethodNotAllowed},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(test.method, url(test.path), nil)
+		webEngine.ServeHTTP(w, r)
+		if w.Code != test.expectedCode {
+			t.Errorf("Test %s did not return expected Status Code. Got: %d, Want: %d", test.name, w.Code, test.expectedCode)
+		}
+	}
+	if base.state.ReadRunLock() {
+		t.Errorf("A disabled endpoint changed the state")
+	}
+}
+
+func TestReadOnlyListener(t *testing.T) {
+	webEngine := genNewHTTPServer(t, false, false)
+	freeAddress := func() string {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Failed to find a free port. Error: %s", err)
+		}
+		defer l.Close()
+		return l.Addr().String()
+	}
+	address, readOnlyAddress := freeAddress(), freeAddress()
+
+	errChan := make(chan error, 2)
+	go func() { errChan <- webEngine.StartHTTPEngine(address) }()
+	go func() { errChan <- webEngine.StartReadOnlyHTTPEngine(readOnlyAddress, "", "") }()
+	select {
+	case <-webEngine.Ready():
+	case err := <-errChan:
+		t.Fatalf("Failed to start the server. Error: %s", err)
+	}
+
+	tests := []struct {
+		name         string
+		address      string
+		method       string
+		path         string
+		expectedCode int
+	}{
+		{name: "Status on the read only listener", address: readOnlyAddress, method: http.MethodGet, path: "/status", expectedCode: http.StatusOK},
+		{name: "Healthcheck on the read only listener", address: readOnlyAddress, method: http.MethodGet, path: "/healthcheck", expectedCode: http.StatusOK},
+		{name: "Trigger run on the read only listener", address: readOnlyAddress, method: http.MethodGet, path: "/chefclient", expectedCode: http.StatusNotFound},
+		{name: "Set lock on the read only listener", address: readOnlyAddress, method: http.MethodPost, path: "/chef/lock/set", expectedCode: http.StatusNotFound},
+		{name: "Set lock on the main listener", address: address, method: http.MethodPost, path: "/chef/lock/set", expectedCode: http.StatusOK},
+	}
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	for _, test := range tests {
+		var result *http.Response
+		var err error
+		// The read only listener may still be starting.
+		for i := 0; i < 50; i++ {
+			req, _ := http.NewRequest(test.method, "http://"+test.address+test.path, nil)
+			if result, err = client.Do(req); err == nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err != nil {
+			t.Fatalf("Test %s failed to reach the server. Error: %s", test.name, err)
+		}
+		result.Body.Close()
+		if result.StatusCode != test.expectedCode {
+			t.Errorf("Test %s did not return expected Status Code. Got: %d, Want: %d", test.name, result.StatusCode, test.expectedCode)
+		}
+	}
+
+	if err := webEngine.StopHTTPEngine(5 * time.Second); err != nil {
+		t.Errorf("Failed to stop the servers. Error: %s", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-errChan; err != http.ErrServerClosed {
+			t.Errorf("Unexpected error from the server. Error: %s", err)
+		}
+	}
+}
+
+
+func TestReadOnlyListenerAfterStop(t *testing.T) {
+	webEngine := genNewHTTPServer(t, false, false)
+	errChan := make(chan error, 1)
+	go func() { errChan <- webEngine.StartHTTPEngine("127.0.0.1:0") }()
+	<-webEngine.Ready()
+	if err := webEngine.StopHTTPEngine(5 * time.Second); err != nil {
+		t.Fatalf("Failed to stop the server. Error: %s", err)
+	}
+	<-errChan
+
+	// The read only listener started too late to be shut down so it must not serve.
+	if err := webEngine.StartReadOnlyHTTPEngine("127.0.0.1:0", "", ""); err != http.ErrServerClosed {
+		t.Errorf("A read only listener started after the stop should not serve. Got: %v", err)
+	}
+}
+func TestPurgeChefLogs(t *testing.T) {
+	tests := []struct {
+		name         string
+		adminToken   string
+		sendToken    string
+		running      bool
+		includeState bool
+		expectedCode int
+		expectedBody string
+		expectedKept []string
+	}{
+		{name: "No token configured", expectedCode: http.StatusForbidden},
+		{name: "Bad token", adminToken: "secret", sendToken: "wrong", expectedCode: http.StatusUnauthorized},
+		{
+			name:         "Good token",
+			adminToken:   "secret",
+			sendToken:    "secret",
+			expectedCode: http.StatusOK,
+			expectedBody: `{"logs_removed":0,"state_records_removed":0}`,
+			expectedKept: []string{"abandoned", "cancelled", "complete", "conflicted", "failed", "interrupted", "registered", "timed_out"},
+		},
+		{
+			name:         "Include state",
+			adminToken:   "secret",
+			sendToken:    "secret",
+			includeState: true,
+			expectedCode: http.StatusOK,
+			expectedBody: `{"logs_removed":0,"state_records_removed":7}`,
+			expectedKept: []string{"registered"},
+		},
+		{name: "Run active", adminToken: "secret", sendToken: "secret", running: true, expectedCode: http.StatusConflict},
+	}
+
+	for _, test := range tests {
+		webEngine := genNewHTTPServer(t, false, false)
+		webEngine.SetAdminToken(test.adminToken)
+		// A run of each status that it can be left in. The guid is the status.
+		for _, status := range []string{"registered", "complete", "failed", "timed_out", "conflicted", "interrupted", "abandoned", "cancelled"} {
+			webEngine.state.Add(status, true)
+			if status != "registered" {
+				webEngine.state.UpdateStatus(status, status)
+			}
+		}
+		if test.running {
+			webEngine.state.Add("running-guid", true)
+			webEngine.state.UpdateStatus("running-guid", "running")
+		}
+
+		w := httptest.NewRecorder()
+		path := "/cheflogs"
+		if test.includeState {
+			path += "?include_state=true"
+		}
+		r := httptest.NewRequest(http.MethodDelete, url(path), nil)
+		if test.sendToken != "" {
+			r.Header.Set("Authorization", "Bearer "+test.sendToken)
+		}
+		webEngine.ServeHTTP(w, r)
+		result := w.Result()
+		result.Body.Close()
+
+		if result.StatusCode != test.expectedCode {
+			t.Errorf("Test %s did not return expected Status Code. Got: %d, Want: %d", test.name, result.StatusCode, test.expectedCode)
+		}
+		if test.expectedBody == "" {
+			continue
+		}
+		if body := strings.TrimSpace(w.Body.String()); body != test.expectedBody {
+			t.Errorf("Test %s returned the wrong summary. Got: %s, Want: %s", test.name, body, test.expectedBody)
+		}
+		kept := []string{}
+		for guid := range webEngine.state.ReadAllJobs() {
+			kept = append(kept, guid)
+		}
+		sort.Strings(kept)
+		if !reflect.DeepEqual(kept, test.expectedKept) {
+			t.Errorf("Test %s kept the wrong runs. Got: %v, Want: %v", test.name, kept, test.expectedKept)
+		}
+	}
+}
+
+func TestUnixSocketListener(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Unix sockets are not tested on windows")
+	}
+	webEngine := genNewHTTPServer(t, false, false)
+	socketDir, err := ioutil.TempDir("", "chefwaiter")
+	if err != nil {
+		t.Fatalf("Failed to create a directory for the socket. Error: %s", err)
+	}
+	defer os.RemoveAll(socketDir)
+	socketPath := filepath.Join(socketDir, "chefwaiter.sock")
+
+	// Leave a stale socket behind to make sure it is cleaned up.
+	stale, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("Failed to create a stale socket. Error: %s", err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- webEngine.StartHTTPEngineUnix(socketPath)
+	}()
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(_ context.Context, _, _ string) (net.Conn, error) {
+				return net.Dial("unix", socketPath)
+			},
+		},
+	}
+	var result *http.Response
+	for i := 0; i < 50; i++ {
+		result, err = client.Get("http://chefwaiter/healthcheck")
+		if err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("Failed to reach the server on the unix socket. Error: %s", err)
+	}
+	result.Body.Close()
+	if result.StatusCode != http.StatusOK {
+		t.Errorf("/healthcheck over the unix socket did not return a 200. Got: %d", result.StatusCode)
+	}
+	if runtime.GOOS == "linux" {
+		info, err := os.Stat(socketPath)
+		if err != nil {
+			t.Fatalf("Failed to stat the socket. Error: %s", err)
+		}
+		if info.Mode().Perm() != 0660 {
+			t.Errorf("Socket should only be open to the owner and group. Got: %v", info.Mode().Perm())
+		}
+	}
+
+	if err := webEngine.StopHTTPEngine(5 * time.Second); err != nil {
+		t.Errorf("Failed to stop the server. Error: %s", err)
+	}
+	if err := <-errChan; err != http.ErrServerClosed {
+		t.Errorf("Unexpected error from the server. Error: %s", err)
+	}
+	if _, err := os.Stat(socketPath); !os.IsNotExist(err) {
+		t.Errorf("Socket file was not removed on shutdown")
+	}
+}
+
+func TestLockWithChefRun(t *testing.T) {
+	webEngine := genNewHTTPServer(t, false, false)
+
+	tests := []struct {
+		name         string
+		expectedCode int
+		locked       bool
+		force        string
+	}{
+		{name: "Override lock", expectedCode: http.StatusOK, locked: true, force: "true"},
+		{name: "Override lock with bad string", expectedCode: http.StatusForbidden, locked: true, force: "something_else"},
+		{name: "Rejected locked", expectedCode: http.StatusForbidden, locked: true},
+		{name: "Accepted not locked", expectedCode: http.StatusOK, locked: false},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, url("/chefclient"), nil)
+		if test.force != "" {
+			qString := r.URL.Query()
+			qString.Add("force", test.force)
+			r.URL.RawQuery = qString.Encode()
+		}
+
+		webEngine.state.LockRuns(test.locked)
+		webEngine.ServeHTTP(w, r)
+		result := w.Result()
+		result.Body.Close()
+
+		if result.StatusCode != test.expectedCode {
+			t.Errorf("Test %s did not return expected Status Code. Got: %d, Want: %d", test.name, result.StatusCode, test.expectedCode)
+		}
+	}
+}
+
+func TestLockDetails(t *testing.T) {
+	webEngine := genNewHTTPServer(t, false, false)
+
+	type lockJSON struct {
+		Locked     bool    `json:"Locked"`
+		LockedBy   *string `json:"locked_by"`
+		LockedTime int64   `json:"locked_time"`
+	}
+	readLock := func() *lockJSON {
+		w := httptest.NewRecorder()
+		webEngine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url("/chef/lock"), nil))
+		lock := &lockJSON{}
+		if err := json.NewDecoder(w.Result().Body).Decode(lock); err != nil {
+			t.Fatalf("Failed to decode the lock details. Error: %s", err)
+		}
+		return lock
+	}
+
+	r := httptest.NewRequest(http.MethodGet, url("/chef/lock/set"), nil)
+	r.RemoteAddr = "10.0.0.1:4321"
+	webEngine.ServeHTTP(httptest.NewRecorder(), r)
+
+	lock := readLock()
+	if !lock.Locked || lock.LockedBy == nil || *lock.LockedBy != "10.0.0.1:4321" || lock.LockedTime == 0 {
+		t.Errorf("Lock details were not recorded. Got: %+v", lock)
+	}
+
+	webEngine.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, url("/chef/lock/remove"), nil))
+	lock = readLock()
+	if lock.Locked || lock.LockedBy != nil || lock.LockedTime != 0 {
+		t.Errorf("Lock details should be empty when unlocked. Got: %+v", lock)
+	}
+}
+
+func TestHealthCheckMaintenance(t *testing.T) {
+	webEngine := genNewHTTPServer(t, false, false)
+
+	tests := []struct {
+		name         string
+		query        string
+		maintenance  bool
+		expectedCode int
+	}{
+		{name: "Plain", expectedCode: http.StatusOK},
+		{name: "Plain in maintenance", maintenance: true, expectedCode: http.StatusOK},
+		{name: "Respect maintenance", query: "?respect_maintenance=true", expectedCode: http.StatusOK},
+		{name: "Respect maintenance in maintenance", query: "?respect_maintenance=true", maintenance: true, expectedCode: http.StatusServiceUnavailable},
+	}
+
+	for _, test := range tests {
+		if test.maintenance {
+			webEngine.state.WriteMaintenanceTimeEnd(time.Now().Add(time.Hour).Unix())
+		} else {
+			webEngine.state.WriteMaintenanceTimeEnd(0)
+		}
+		w := httptest.NewRecorder()
+		webEngine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url("/healthcheck"+test.query), nil))
+		if w.Result().StatusCode != test.expectedCode {
+			t.Errorf("Test %s did not return expected Status Code. Got: %d, Want: %d", test.name, w.Result().StatusCode, test.expectedCode)
+		}
+	}
+}
+
+func TestHealthCheckDetails(t *testing.T) {
+	webEngine := genNewHTTPServer(t, false, false)
+
+	tests := []struct {
+		name         string
+		query        string
+		noChef       bool
+		expectedBody string
+	}{
+		{name: "Plain", expectedBody: `{"state": "OK"}`},
+		{name: "Details", query: "?details=true", expectedBody: `{"state":"OK","chef_version":"13.6.4"}`},
+		{name: "Details without chef-client", query: "?details=true", noChef: true, expectedBody: `{"state":"OK","chef_version":""}`},
+	}
+
+	for _, test := range tests {
+		webEngine.appState = &FakeAppStatus{noChef: test.noChef}
+		w := httptest.NewRecorder()
+		webEngine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url("/healthcheck"+test.query), nil))
+		if w.Result().StatusCode != http.StatusOK {
+			t.Errorf("Test %s did not return expected Status Code. Got: %d, Want: %d", test.name, w.Result().StatusCode, http.StatusOK)
+		}
+		if body := strings.TrimSpace(w.Body.String()); body != test.expectedBody {
+			t.Errorf("Test %s returned the wrong body. Got: %s, Want: %s", test.name, body, test.expectedBody)
+		}
+	}
+}
+
+func TestTimeRequest(t *testing.T) {
+	webEngine := genNewHTTPServer(t, false, false)
+	fake := metrics.SetupFake()
+	defer metrics.StopFake()
+
+	w := httptest.NewRecorder()
+	webEngine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url("/cheflogs/1234"), nil))
+
+	var timings []metrics.FakeMetric
+	for _, metric := range fake.Sent() {
+		if metric.Stat == "http_request_time" {
+			timings = append(timings, metric)
+		}
+	}
+	if len(timings) != 1 {
+		t.Fatalf("Expected 1 request timing. Got: %+v", timings)
+	}
+	want := map[string]string{"route": "/cheflogs/{guid}", "method": http.MethodGet, "status": strconv.Itoa(w.Result().StatusCode)}
+	if timings[0].Kind != "Timing" || !reflect.DeepEqual(timings[0].Tags, want) {
+		t.Errorf("The request was timed with the wrong tags. Got: %+v, Want: %v", timings[0], want)
+	}
+}
+
+func TestVerboseHealthCheck(t *testing.T) {
+	webEngine := genNewHTTPServer(t, false, false)
+	webEngine.state.Add("finished-run", true)
+	webEngine.state.UpdateStatus("finished-run", "complete")
+	webEngine.state.WriteLastRunGUID("finished-run")
+
+	tests := []struct {
+		name          string
+		noChef        bool
+		expectedState string
+	}{
+		{name: "Healthy", expectedState: "OK"},
+		{name: "No chef-client", noChef: true, expectedState: "DEGRADED"},
+	}
+
+	for _, test := range tests {
+		webEngine.appState = &FakeAppStatus{noChef: test.noChef}
+		w := httptest.NewRecorder()
+		webEngine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url("/healthcheck?verbose=true"), nil))
+		if w.Result().StatusCode != http.StatusOK {
+			t.Errorf("Test %s did not return expected Status Code. Got: %d, Want: %d", test.name, w.Result().StatusCode, http.StatusOK)
+			continue
+		}
+		health := verboseHealth{}
+		if err := json.NewDecoder(w.Result().Body).Decode(&health); err != nil {
+			t.Errorf("Test %s returned bad json. Error: %s", test.name, err)
+			continue
+		}
+		if health.State != test.expectedState || health.ChefClient.Healthy == test.noChef {
+			t.Errorf("Test %s returned the wrong health. Got: %+v", test.name, health)
+		}
+		if health.LastRunAge == nil {
+			t.Errorf("Test %s did not return the age of the last run", test.name)
+		}
+	}
+}
+
+func TestSearchChefLogs(t *testing.T) {
+	webEngine := genNewHTTPServer(t, false, false)
+
+	tests := []struct {
+		name         string
+		query        string
+		expectedCode int
+		results      int
+	}{
+		{name: "Match", query: "?q=EXITED", expectedCode: http.StatusOK, results: 1},
+		{name: "No match", query: "?q=nothing+here", expectedCode: http.StatusOK, results: 0},
+		{name: "Regex", query: "?q=chef.*something&regex=true", expectedCode: http.StatusOK, results: 1},
+		{name: "Bad regex", query: "?q=(&regex=true", expectedCode: http.StatusBadRequest},
+		{name: "No query", query: "", expectedCode: http.StatusBadRequest},
+		{name: "Bad limit", query: "?q=chef&limit=0", expectedCode: http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		webEngine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url("/cheflogs/search"+test.query), nil))
+		result := w.Result()
+		if result.StatusCode != test.expectedCode {
+			t.Errorf("Test %s did not return expected Status Code. Got: %d, Want: %d", test.name, result.StatusCode, test.expectedCode)
+			continue
+		}
+		if test.expectedCode != http.StatusOK {
+			continue
+		}
+		body := struct {
+			Results []cheflogs.SearchResult `json:"results"`
+		}{}
+		if err := json.NewDecoder(result.Body).Decode(&body); err != nil {
+			t.Errorf("Test %s returned bad json. Error: %s", test.name, err)
+			continue
+		}
+		if len(body.Results) != test.results {
+			t.Errorf("Test %s returned the wrong number of results. Got: %d, Want: %d", test.name, len(body.Results), test.results)
+		}
+	}
+}
+
+func TestNextChefRun(t *testing.T) {
+	webEngine := genNewHTTPServer(t, false, false)
+
+	type nextRun struct {
+		Scheduled bool   `json:"scheduled"`
+		Reason    string `json:"reason"`
+		Epoch     int64  `json:"epoch"`
+	}
+	readNextRun := func() *nextRun {
+		w := httptest.NewRecorder()
+		webEngine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url("/chef/nextrun"), nil))
+		next := &nextRun{}
+		if err := json.NewDecoder(w.Result().Body).Decode(next); err != nil {
+			t.Fatalf("Failed to decode the next run. Error: %s", err)
+		}
+		return next
+	}
+
+	webEngine.state.WritePeriodicRuns(true)
+	if next := readNextRun(); !next.Scheduled || next.Epoch == 0 {
+		t.Errorf("Next run should be scheduled. Got: %+v", next)
+	}
+
+	webEngine.state.WriteMaintenanceTimeEnd(time.Now().Add(time.Hour).Unix())
+	if next := readNextRun(); next.Scheduled || next.Epoch != 0 || next.Reason == "" {
+		t.Errorf("Next run should not be scheduled during maintenance. Got: %+v", next)
+	}
+	webEngine.state.WriteMaintenanceTimeEnd(0)
+
+	webEngine.state.WritePeriodicRuns(false)
+	if next := readNextRun(); next.Scheduled || next.Reason == "" {
+		t.Errorf("Next run should not be scheduled when periodic runs are off. Got: %+v", next)
+	}
+}
+
+func TestVersion(t *testing.T) {
+	webEngine := genNewHTTPServer(t, false, false)
+
+	w := httptest.NewRecorder()
+	webEngine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url("/version"), nil))
+	if w.Result().StatusCode != http.StatusOK {
+		t.Fatalf("/version did not return a 200. Got: %d", w.Result().StatusCode)
+	}
+	version := map[string]string{}
+	if err := json.NewDecoder(w.Result().Body).Decode(&version); err != nil {
+		t.Fatalf("Failed to decode the version. Error: %s", err)
+	}
+	want := map[string]string{
+		"version":      "17.10.200",
+		"git_commit":   "0123abc",
+		"build_date":   "2019-03-19T10:00:00Z",
+		"chef_version": "13.6.4",
+		"go_version":   runtime.Version(),
+	}
+	for key, value := range want {
+		if version[key] != value {
+			t.Errorf("%s is wrong. Got: %q, Want: %q", key, version[key], value)
+		}
+	}
+}
+
+func TestGetChefLogsRange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chefwaiter-logs")
+	if err != nil {
+		t.Fatalf("Failed to make a temp dir. Error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	logPath := filepath.Join(dir, "range.log")
+	if err := ioutil.WriteFile(logPath, []byte("0123456789\n"), 0644); err != nil {
+		t.Fatalf("Failed to write the log. Error: %s", err)
+	}
+	webEngine := genNewHTTPServer(t, false, false)
+	webEngine.chefLogsWorker = cheflogs.NewFakeChefLogWorker(logPath)
+
+	tests := []struct {
+		name         string
+		rangeHeader  string
+		expectedCode int
+		expectedBody string
+	}{
+		{name: "Whole log", expectedCode: http.StatusOK, expectedBody: "0123456789\n"},
+		{name: "Range", rangeHeader: "bytes=2-5", expectedCode: http.StatusPartialContent, expectedBody: "2345"},
+		{name: "Suffix range", rangeHeader: "bytes=-3", expectedCode: http.StatusPartialContent, expectedBody: "89\n"},
+		{name: "Range past the end", rangeHeader: "bytes=100-", expectedCode: http.StatusRequestedRangeNotSatisfiable},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, url("/cheflogs/range"), nil)
+		if test.rangeHeader != "" {
+			r.Header.Set("Range", test.rangeHeader)
+		}
+		webEngine.ServeHTTP(w, r)
+		result := w.Result()
+		if result.StatusCode != test.expectedCode {
+			t.Errorf("Test %s did not return expected Status Code. Got: %d, Want: %d", test.name, result.StatusCode, test.expectedCode)
+			continue
+		}
+		if test.expectedBody == "" {
+			continue
+		}
+		body, _ := ioutil.ReadAll(result.Body)
+		if string(body) != test.expectedBody {
+			t.Errorf("Test %s returned the wrong part of the log. Got: %q, Want: %q", test.name, body, test.expectedBody)
+		}
+		if result.Header.Get("Content-Length") != fmt.Sprint(len(test.expectedBody)) {
+			t.Errorf("Test %s returned the wrong Content-Length. Got: %s", test.name, result.Header.Get("Content-Length"))
+		}
+	}
+}
+
+func TestGetChefLogsCaching(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chefwaiter-logs")
+	if err != nil {
+		t.Fatalf("Failed to make a temp dir. Error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	logPath := filepath.Join(dir, "cache.log")
+	if err := ioutil.WriteFile(logPath, []byte("chef output\n"), 0644); err != nil {
+		t.Fatalf("Failed to write the log. Error: %s", err)
+	}
+	webEngine := genNewHTTPServer(t, false, false)
+	webEngine.chefLogsWorker = cheflogs.NewFakeChefLogWorker(logPath)
+	webEngine.state.Add("complete-run", true)
+	webEngine.state.UpdateStatus("complete-run", "complete")
+	webEngine.state.Add("running-run", true)
+	webEngine.state.UpdateStatus("running-run", "running")
+
+	w := httptest.NewRecorder()
+	webEngine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url("/cheflogs/complete-run"), nil))
+	etag := w.Result().Header.Get("ETag")
+	if !strings.HasPrefix(etag, `W/"`) || !strings.Contains(w.Result().Header.Get("Cache-Control"), "immutable") {
+		t.Fatalf("A finished run should have a weak ETag and be immutable. Got ETag: %q, Cache-Control: %q", etag, w.Result().Header.Get("Cache-Control"))
+	}
+
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, url("/cheflogs/complete-run"), nil)
+	r.Header.Set("If-None-Match", etag)
+	webEngine.ServeHTTP(w, r)
+	if w.Result().StatusCode != http.StatusNotModified {
+		t.Errorf("Matching ETag did not return expected Status Code. Got: %d, Want: %d", w.Result().StatusCode, http.StatusNotModified)
+	}
+
+	w = httptest.NewRecorder()
+	webEngine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url("/cheflogs/running-run"), nil))
+	if w.Result().Header.Get("Cache-Control") != "no-store" || w.Result().Header.Get("ETag") != "" {
+		t.Errorf("A running run should not be cached. Got ETag: %q, Cache-Control: %q", w.Result().Header.Get("ETag"), w.Result().Header.Get("Cache-Control"))
+	}
+}
+
+func TestGetChefRunBundle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chefwaiter-logs")
+	if err != nil {
+		t.Fatalf("Failed to make a temp dir. Error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	logPath := filepath.Join(dir, "bundle.log")
+	if err := ioutil.WriteFile(logPath, []byte("chef output\n"), 0644); err != nil {
+		t.Fatalf("Failed to write the log. Error: %s", err)
+	}
+	webEngine := genNewHTTPServer(t, false, false)
+	webEngine.state.Add("bundle-run", true)
+	webEngine.state.UpdateStatus("bundle-run", "complete")
+
+	tests := []struct {
+		name          string
+		guid          string
+		logPath       string
+		expectedCode  int
+		expectedFiles map[string]string
+	}{
+		{
+			name:         "Run with a log",
+			guid:         "bundle-run",
+			logPath:      logPath,
+			expectedCode: http.StatusOK,
+			expectedFiles: map[string]string{
+				"bundle-run/bundle-run.json": `"status": "complete"`,
+				"bundle-run/bundle-run.log":  "chef output\n",
+			},
+		},
+		{
+			name:         "Run without a log",
+			guid:         "bundle-run",
+			logPath:      filepath.Join(dir, "missing.log"),
+			expectedCode: http.StatusOK,
+			expectedFiles: map[string]string{
+				"bundle-run/bundle-run.json": `"status": "complete"`,
+				"bundle-run/NOTE.txt":        "could not be read",
+			},
+		},
+		{name: "Unknown run", guid: "unknown", logPath: logPath, expectedCode: http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		webEngine.chefLogsWorker = cheflogs.NewFakeChefLogWorker(test.logPath)
+		w := httptest.NewRecorder()
+		webEngine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url("/chefclient/"+test.guid+"/bundle"), nil))
+		result := w.Result()
+		if result.StatusCode != test.expectedCode {
+			t.Errorf("Test %s did not return expected Status Code. Got: %d, Want: %d", test.name, result.StatusCode, test.expectedCode)
+			continue
+		}
+		if test.expectedFiles == nil {
+			continue
+		}
+		if result.Header.Get("Content-Type") != "application/gzip" || !strings.Contains(result.Header.Get("Content-Disposition"), test.guid+".tar.gz") {
+			t.Errorf("Test %s returned the wrong headers. Got: %v", test.name, result.Header)
+		}
+
+		gzipReader, err := gzip.NewReader(result.Body)
+		if err != nil {
+			t.Errorf("Test %s did not return a gzip. Error: %s", test.name, err)
+			continue
+		}
+		files := map[string]string{}
+		tarReader := tar.NewReader(gzipReader)
+		for {
+			header, err := tarReader.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("Test %s returned a broken tar. Error: %s", test.name, err)
+			}
+			content, _ := ioutil.ReadAll(tarReader)
+			files[header.Name] = string(content)
+		}
+		if len(files) != len(test.expectedFiles) {
+			t.Errorf("Test %s returned the wrong files. Got: %v", test.name, files)
+		}
+		for name, want := range test.expectedFiles {
+			if !strings.Contains(files[name], want) {
+				t.Errorf("Test %s returned the wrong %s. Got: %q, Want it to contain: %q", test.name, name, files[name], want)
+			}
+		}
+	}
+}
+
+func TestListChefLogs(t *testing.T) {
+	webEngine := genNewHTTPServer(t, false, false)
+
+	tests := []struct {
+		name         string
+		query        string
+		expectedCode int
+		guids        []string
+	}{
+		{name: "All", expectedCode: http.StatusOK, guids: []string{"newest", "oldest"}},
+		{name: "Limit", query: "?limit=1", expectedCode: http.StatusOK, guids: []string{"newest"}},
+		{name: "Since", query: "?since=150", expectedCode: http.StatusOK, guids: []string{"newest"}},
+		{name: "Bad limit", query: "?limit=-1", expectedCode: http.StatusBadRequest},
+		{name: "Bad since", query: "?since=yesterday", expectedCode: http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		webEngine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url("/cheflogs"+test.query), nil))
+		result := w.Result()
+		if result.StatusCode != test.expectedCode {
+			t.Errorf("Test %s did not return expected Status Code. Got: %d, Want: %d", test.name, result.StatusCode, test.expectedCode)
+			continue
+		}
+		if test.expectedCode != http.StatusOK {
+			continue
+		}
+		logFiles := []cheflogs.LogFile{}
+		if err := json.NewDecoder(result.Body).Decode(&logFiles); err != nil {
+			t.Errorf("Test %s returned bad json. Error: %s", test.name, err)
+			continue
+		}
+		got := make([]string, 0)
+		for _, logFile := range logFiles {
+			got = append(got, logFile.GUID)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(test.guids) {
+			t.Errorf("Test %s returned the wrong logs. Got: %v, Want: %v", test.name, got, test.guids)
+		}
+	}
+}
+
+func TestAllRunsFilter(t *testing.T) {
+	webEngine := genNewHTTPServer(t, false, false)
+	for i := int64(1); i <= 3; i++ {
+		guid := fmt.Sprintf("run-%d", i)
+		webEngine.state.Add(guid, true)
+		webEngine.state.ReadAll()[guid].RegisteredTime = i * 100
+	}
+
+	tests := []struct {
+		name  string
+		query string
+		guids []string
+	}{
+		{name: "All", guids: []string{"run-1", "run-2", "run-3"}},
+		{name: "Limit", query: "?limit=2", guids: []string{"run-2", "run-3"}},
+		{name: "Since", query: "?since=200", guids: []string{"run-2", "run-3"}},
+		{name: "Limit and since", query: "?limit=1&since=100", guids: []string{"run-3"}},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		webEngine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url("/chef/allruns"+test.query), nil))
+		jobs := map[string]internalstate.JobDetails{}
+		if err := json.NewDecoder(w.Result().Body).Decode(&jobs); err != nil {
+			t.Errorf("Test %s returned bad json. Error: %s", test.name, err)
+			continue
+		}
+		if len(jobs) != len(test.guids) {
+			t.Errorf("Test %s returned the wrong runs. Got: %v, Want: %v", test.name, jobs, test.guids)
+			continue
+		}
+		for _, guid := range test.guids {
+			if _, ok := jobs[guid]; !ok {
+				t.Errorf("Test %s is missing %s. Got: %v", test.name, guid, jobs)
+			}
+		}
+	}
+}
+
+func TestAllRunsSort(t *testing.T) {
+	webEngine := genNewHTTPServer(t, false, false)
+	for i, details := range []struct {
+		duration int64
+		status   string
+	}{{30, "failed"}, {10, "complete"}, {20, "running"}} {
+		guid := fmt.Sprintf("run-%d", i+1)
+		webEngine.state.Add(guid, true)
+		job := webEngine.state.ReadAll()[guid]
+		job.RegisteredTime = int64(i+1) * 100
+		job.DurationSeconds = details.duration
+		job.Status = details.status
+	}
+
+	tests := []struct {
+		name  string
+		query string
+		guids []string
+	}{
+		{name: "Default", guids: []string{"run-3", "run-2", "run-1"}},
+		{name: "Oldest first", query: "?order=asc", guids: []string{"run-1", "run-2", "run-3"}},
+		{name: "Slowest first", query: "?sort=duration", guids: []string{"run-1", "run-3", "run-2"}},
+		{name: "Status", query: "?sort=status&order=asc", guids: []string{"run-2", "run-1", "run-3"}},
+		{name: "Sorted before the limit", query: "?sort=duration&order=asc&limit=2", guids: []string{"run-2", "run-3"}},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		webEngine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url("/chef/allruns"+test.query), nil))
+		// The order of the keys is read from the raw JSON as a map would lose it.
+		guids := []string{}
+		decoder := json.NewDecoder(w.Result().Body)
+		decoder.Token()
+		for decoder.More() {
+			key, err := decoder.Token()
+			if err != nil {
+				t.Fatalf("Test %s returned bad json. Error: %s", test.name, err)
+			}
+			guids = append(guids, key.(string))
+			if err := decoder.Decode(&internalstate.JobDetails{}); err != nil {
+				t.Fatalf("Test %s returned bad json. Error: %s", test.name, err)
+			}
+		}
+		if strings.Join(guids, ",") != strings.Join(test.guids, ",") {
+			t.Errorf("Test %s returned the runs in the wrong order. Got: %v, Want: %v", test.name, guids, test.guids)
+		}
+	}
+
+	jobs := webEngine.state.ReadAllJobs()
+	want, _ := json.MarshalIndent(jobs, "", "  ")
+	got, err := orderedJobsJSON([]string{"run-1", "run-2", "run-3"}, jobs)
+	if err != nil || string(got) != string(want) {
+		t.Errorf("Ordered JSON should match json.MarshalIndent for sorted guids. Got:\n%s\nWant:\n%s", got, want)
+	}
+}
+
+func TestCustomJobExtraFlags(t *testing.T) {
+	webEngine := genNewHTTPServer(t, false, false)
+	webEngine.SetAllowedExtraFlags([]string{"--no-fork", "-l debug"})
+
+	tests := []struct {
+		name         string
+		expectedCode int
+		body         string
+	}{
+		{name: "Allowed flags", expectedCode: http.StatusOK, body: `{"run_list":"recipe[test]","extra_flags":["--no-fork","-l debug"]}`},
+		{name: "No flags", expectedCode: http.StatusOK, body: `{"run_list":"recipe[test]"}`},
+		{name: "Flag not allowed", expectedCode: http.StatusBadRequest, body: `{"run_list":"recipe[test]","extra_flags":["--no-fork","-j /tmp/evil.json"]}`},
+		{name: "No run list", expectedCode: http.StatusBadRequest, body: `{"extra_flags":["--no-fork"]}`},
+		{name: "Bad JSON", expectedCode: http.StatusBadRequest, body: `{"run_list":`},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, url("/chefclient"), bytes.NewReader([]byte(test.body)))
+		r.Header.Set("Content-Type", "application/json")
+		webEngine.ServeHTTP(w, r)
+		if w.Result().StatusCode != test.expectedCode {
+			t.Errorf("Test %s did not return expected Status Code. Got: %d, Want: %d", test.name, w.Result().StatusCode, test.expectedCode)
+		}
+	}
+}
+
+func TestBulkChefStatus(t *testing.T) {
+	webEngine := genNewHTTPServer(t, false, false)
+	_, guid := webEngine.state.RegisterRun(true, false, "", internalstate.RunOptions{})
+
+	tests := []struct {
+		name         string
+		expectedCode int
+		body         string
+	}{
+		{name: "Known and unknown guids", expectedCode: http.StatusOK, body: fmt.Sprintf(`["%s","unknown"]`, guid)},
+		{name: "Not an array", expectedCode: http.StatusBadRequest, body: `{"guid":"unknown"}`},
+		{name: "Too many guids", expectedCode: http.StatusBadRequest, body: `[` + strings.Repeat(`"a",`, bulkStatusMaxGUIDs) + `"a"]`},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, url("/chefclient/status"), strings.NewReader(test.body))
+		webEngine.ServeHTTP(w, r)
+		if w.Result().StatusCode != test.expectedCode {
+			t.Errorf("Test %s did not return expected Status Code. Got: %d, Want: %d", test.name, w.Result().StatusCode, test.expectedCode)
+			continue
+		}
+		if test.expectedCode != http.StatusOK {
+			continue
+		}
+		statuses := map[string]map[string]interface{}{}
+		if err := json.NewDecoder(w.Result().Body).Decode(&statuses); err != nil {
+			t.Fatalf("Test %s returned invalid JSON. Error: %s", test.name, err)
+		}
+		if statuses[guid]["status"] != "registered" {
+			t.Errorf("Test %s got the wrong status for a known guid. Got: %v", test.name, statuses[guid]["status"])
+		}
+		if statuses["unknown"]["status"] != "not_found" {
+			t.Errorf("Test %s got the wrong status for an unknown guid. Got: %v", test.name, statuses["unknown"]["status"])
+		}
+	}
+}
+
+func TestPostChefRunInterval(t *testing.T) {
+	webEngine := genNewHTTPServer(t, false, false)
+
+	tests := []struct {
+		name         string
+		body         string
+		expectedCode int
+		wantTimer    int64
+	}{
+		{name: "Seconds", body: `{"seconds": 1800}`, expectedCode: http.StatusOK, wantTimer: 1800},
+		{name: "Duration", body: `{"duration": "1h"}`, expectedCode: http.StatusOK, wantTimer: 3600},
+		{name: "Zero", body: `{"seconds": 0}`, expectedCode: http.StatusBadRequest, wantTimer: 3600},
+		{name: "Negative duration", body: `{"duration": "-5m"}`, expectedCode: http.StatusBadRequest, wantTimer: 3600},
+		{name: "Part of a minute", body: `{"seconds": 90}`, expectedCode: http.StatusBadRequest, wantTimer: 3600},
+		{name: "Both set", body: `{"seconds": 60, "duration": "1m"}`, expectedCode: http.StatusBadRequest, wantTimer: 3600},
+		{name: "Bad duration", body: `{"duration": "soon"}`, expectedCode: http.StatusBadRequest, wantTimer: 3600},
+		{name: "Bad JSON", body: `1800`, expectedCode: http.StatusBadRequest, wantTimer: 3600},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, url("/chef/interval"), strings.NewReader(test.body))
+		webEngine.ServeHTTP(w, r)
+		if w.Result().StatusCode != test.expectedCode {
+			t.Errorf("Test %s did not return expected Status Code. Got: %d, Want: %d", test.name, w.Result().StatusCode, test.expectedCode)
+		}
+		if got := webEngine.state.ReadChefRunTimer(); got != test.wantTimer {
+			t.Errorf("Test %s left the wrong run timer. Got: %d, Want: %d", test.name, got, test.wantTimer)
+		}
+	}
+}
+
+func TestSetChefRunIntervalResponse(t *testing.T) {
+	webEngine := genNewHTTPServer(t, false, false)
+
+	for _, path := range []string{"/chef/interval/45", "/chef/interval"} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, url(path), strings.NewReader(`{"duration": "45m"}`))
+		webEngine.ServeHTTP(w, r)
+		if w.Result().StatusCode != http.StatusOK {
+			t.Fatalf("%s did not return expected Status Code. Got: %d, Want: %d", path, w.Result().StatusCode, http.StatusOK)
+		}
+		interval := struct {
+			Current string `json:"current_interval"`
+			Seconds int64  `json:"interval_seconds"`
+		}{}
+		if err := json.NewDecoder(w.Result().Body).Decode(&interval); err != nil {
+			t.Fatalf("%s did not return JSON. Error: %s", path, err)
+		}
+		if interval.Current != "45 minutes" || interval.Seconds != 45*60 {
+			t.Errorf("%s did not confirm the new interval. Got: %+v", path, interval)
+		}
+	}
+}
+
+func TestStateChangingPost(t *testing.T) {
+	webEngine := genNewHTTPServer(t, false, false)
+
+	tests := []struct {
+		name  string
+		path  string
+		check func() bool
+	}{
+		{name: "Interval", path: "/chef/interval/45", check: func() bool { return webEngine.state.ReadChefRunTimer() == 45*60 }},
+		{name: "Off", path: "/chef/off", check: func() bool { return !webEngine.state.ReadPeriodicRuns() }},
+		{name: "On", path: "/chef/on", check: func() bool { return webEngine.state.ReadPeriodicRuns() }},
+		{name: "Maintenance start", path: "/chef/maintenance/start/10", check: func() bool { return webEngine.state.InMaintenceMode() }},
+		{name: "Maintenance end", path: "/chef/maintenance/end", check: func() bool { return !webEngine.state.InMaintenceMode() }},
+		{name: "Lock set", path: "/chef/lock/set", check: func() bool { return webEngine.state.ReadRunLock() }},
+		{name: "Lock remove", path: "/chef/lock/remove", check: func() bool { return !webEngine.state.ReadRunLock() }},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, url(test.path), nil)
+		webEngine.ServeHTTP(w, r)
+		if w.Result().StatusCode != http.StatusOK {
+			t.Errorf("Test %s did not return expected Status Code. Got: %d, Want: %d", test.name, w.Result().StatusCode, http.StatusOK)
+		}
+		if !test.check() {
+			t.Errorf("Test %s did not change the state", test.name)
+		}
+	}
+}
+
+func TestRunNow(t *testing.T) {
+	webEngine := genNewHTTPServer(t, false, false)
+
+	tests := []struct {
+		name         string
+		setup        func()
+		expectedCode int
+		reason       string
+	}{
+		{
+			name:         "Periodic runs disabled",
+			setup:        func() { webEngine.state.WritePeriodicRuns(false) },
+			expectedCode: http.StatusConflict,
+			reason:       "periodic runs are disabled",
+		},
+		{
+			name: "Maintenance",
+			setup: func() {
+				webEngine.state.WritePeriodicRuns(true)
+				webEngine.state.WriteMaintenanceTimeEnd(time.Now().Add(time.Hour).Unix())
+			},
+			expectedCode: http.StatusConflict,
+			reason:       "maintenance mode is active",
+		},
+		{
+			name: "Locked",
+			setup: func() {
+				webEngine.state.WriteMaintenanceTimeEnd(0)
+				webEngine.state.LockRuns(true)
+			},
+			expectedCode: http.StatusConflict,
+			reason:       "runs are locked",
+		},
+		{
+			name:         "Allowed",
+			setup:        func() { webEngine.state.LockRuns(false) },
+			expectedCode: http.StatusOK,
+		},
+	}
+
+	for _, test := range tests {
+		test.setup()
+		w := httptest.NewRecorder()
+		webEngine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url("/chef/runnow"), nil))
+		if w.Result().StatusCode != test.expectedCode {
+			t.Errorf("Test %s did not return expected Status Code. Got: %d, Want: %d", test.name, w.Result().StatusCode, test.expectedCode)
+			continue
+		}
+		if test.reason == "" {
+			continue
+		}
+		suppressed := &struct {
+			Reason string `json:"reason"`
+		}{}
+		if err := json.NewDecoder(w.Result().Body).Decode(suppressed); err != nil || suppressed.Reason != test.reason {
+			t.Errorf("Test %s returned the wrong reason. Got: %q, Want: %q", test.name, suppressed.Reason, test.reason)
+		}
+	}
+}
+
+func TestLastSuccessfulRun(t *testing.T) {
+	webEngine := genNewHTTPServer(t, false, false)
+
+	type lastSuccess struct {
+		GUID  string `json:"last_successful_run_guid"`
+		Epoch int64  `json:"last_successful_run_time"`
+	}
+	readLastSuccess := func() *lastSuccess {
+		w := httptest.NewRecorder()
+		webEngine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url("/chef/lastsuccess"), nil))
+		last := &lastSuccess{}
+		if err := json.NewDecoder(w.Result().Body).Decode(last); err != nil {
+			t.Fatalf("Failed to decode the last successful run. Error: %s", err)
+		}
+		return last
+	}
+
+	if last := readLastSuccess(); last.GUID != "" || last.Epoch != 0 {
+		t.Errorf("There should be no last successful run yet. Got: %+v", last)
+	}
+
+	webEngine.state.WriteLastRunGUID("failed-guid")
+	webEngine.state.WriteLastSuccessfulRun("good-guid", 1500000000)
+	if last := readLastSuccess(); last.GUID != "good-guid" || last.Epoch != 1500000000 {
+		t.Errorf("Got the wrong last successful run. Got: %+v", last)
+	}
+}
+
+func TestDrift(t *testing.T) {
+	webEngine := genNewHTTPServer(t, false, false)
+	w := httptest.NewRecorder()
+	webEngine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url("/chef/drift"), nil))
+	if w.Result().StatusCode != http.StatusOK {
+		t.Fatalf("Test drift did not return expected Status Code. Got: %d, Want: %d", w.Result().StatusCode, http.StatusOK)
+	}
+	empty := &drift{}
+	if err := json.NewDecoder(w.Result().Body).Decode(empty); err != nil || empty.GUID != "" || empty.ConvergedClean {
+		t.Errorf("There should be no drift without a successful run. Got: %+v, Error: %v", empty, err)
+	}
+
+	jobs := map[string]internalstate.JobDetails{
+		"old":     {Status: "complete", RunEndTime: 100, ResourcesUpdated: 7},
+		"middle":  {Status: "complete", RunEndTime: 200, ResourcesUpdated: 3, ResourcesTotal: 50},
+		"custom":  {Status: "complete", RunEndTime: 300, CustomRun: true},
+		"failed":  {Status: "failed", RunEndTime: 400},
+		"running": {Status: "running"},
+	}
+	d := lastDrift(jobs)
+	if d.GUID != "middle" || d.ResourcesUpdated != 3 || d.ResourcesTotal != 50 || d.ConvergedClean {
+		t.Errorf("The last successful run was not used. Got: %+v", d)
+	}
+	if d.PreviousGUID != "old" || d.ResourcesUpdatedDelta == nil || *d.ResourcesUpdatedDelta != -4 {
+		t.Errorf("The delta from the previous run is wrong. Got: %+v", d)
+	}
+
+	jobs["new"] = internalstate.JobDetails{Status: "complete", RunEndTime: 500}
+	if d := lastDrift(jobs); d.GUID != "new" || !d.ConvergedClean || d.PreviousGUID != "middle" {
+		t.Errorf("A run that updated nothing should have converged clean. Got: %+v", d)
+	}
+}
+
+func TestRunStats(t *testing.T) {
+	webEngine := genNewHTTPServer(t, false, false)
+	webEngine.state.Add("passed", true)
+	webEngine.state.UpdateStatus("passed", "running")
+	webEngine.state.UpdateStatus("passed", "complete")
+
+	w := httptest.NewRecorder()
+	webEngine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url("/chef/stats"), nil))
+	if w.Result().StatusCode != http.StatusOK {
+		t.Fatalf("Test stats did not return expected Status Code. Got: %d, Want: %d", w.Result().StatusCode, http.StatusOK)
+	}
+	stats := internalstate.RunStats{}
+	if err := json.NewDecoder(w.Result().Body).Decode(&stats); err != nil {
+		t.Fatalf("Failed to decode the stats. Error: %s", err)
+	}
+	if stats.WindowSeconds != 86400 || stats.TotalRuns != 1 || stats.Runs["demand"] != 1 || stats.SuccessRate == nil || *stats.SuccessRate != 1 {
+		t.Errorf("The stats did not show the run. Got: %+v", stats)
+	}
+}
+
+func TestCancelDelayedRun(t *testing.T) {
+	webEngine := genNewHTTPServer(t, false, false)
+	_, delayed := webEngine.state.RegisterRun(true, false, "", internalstate.RunOptions{ScheduledStart: time.Now().Add(time.Hour).Unix()})
+	_, queued := webEngine.state.RegisterRun(true, true, "recipe[test]", internalstate.RunOptions{})
+
+	tests := []struct {
+		name         string
+		guid         string
+		expectedCode int
+	}{
+		{name: "Delayed run", guid: delayed, expectedCode: http.StatusOK},
+		{name: "Delayed run already cancelled", guid: delayed, expectedCode: http.StatusConflict},
+		{name: "Run without a delay", guid: queued, expectedCode: http.StatusConflict},
+		{name: "Unknown run", guid: "unknown", expectedCode: http.StatusNotFound},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		webEngine.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, url("/chefclient/"+test.guid), nil))
+		if w.Result().StatusCode != test.expectedCode {
+			t.Errorf("Test %s did not return expected Status Code. Got: %d, Want: %d", test.name, w.Result().StatusCode, test.expectedCode)
+		}
+	}
+	if job := webEngine.state.Read(delayed)[delayed]; job.Status != "cancelled" || job.StatusReason == "" {
+		t.Errorf("The delayed run was not cancelled. Got: %s, %q", job.Status, job.StatusReason)
+	}
+	if webEngine.state.ReleaseDelayedRun(delayed) {
+		t.Errorf("A cancelled run should not be released")
+	}
+}
+
+func TestRunsByLabel(t *testing.T) {
+	webEngine := genNewHTTPServer(t, false, false)
+	_, demand := webEngine.state.RegisterRun(true, false, "", internalstate.RunOptions{Label: "TICKET-123"})
+	_, custom := webEngine.state.RegisterRun(true, true, "recipe[test]", internalstate.RunOptions{Label: "TICKET-123"})
+	webEngine.state.RegisterRun(true, true, "recipe[other]", internalstate.RunOptions{Label: "TICKET-456"})
+	webEngine.state.UpdateStatus(custom, "running")
+
+	tests := []struct {
+		name  string
+		query string
+		guids []string
+	}{
+		{name: "Label", query: "?label=TICKET-123", guids: []string{custom, demand}},
+		{name: "Label and status", query: "?label=TICKET-123&status=running", guids: []string{custom}},
+		{name: "Label and source", query: "?label=TICKET-123&source=demand", guids: []string{demand}},
+		{name: "No match", query: "?label=TICKET-789", guids: []string{}},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		webEngine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url("/chef/runs"+test.query), nil))
+		if w.Result().StatusCode != http.StatusOK {
+			t.Fatalf("Test %s did not return expected Status Code. Got: %d, Want: %d", test.name, w.Result().StatusCode, http.StatusOK)
+		}
+		runs := []runEntry{}
+		if err := json.NewDecoder(w.Result().Body).Decode(&runs); err != nil {
+			t.Fatalf("Test %s did not return a JSON array. Error: %s", test.name, err)
+		}
+		guids := []string{}
+		for _, run := range runs {
+			guids = append(guids, run.GUID)
+		}
+		sort.Strings(guids)
+		want := append([]string{}, test.guids...)
+		sort.Strings(want)
+		if !reflect.DeepEqual(guids, want) {
+			t.Errorf("Test %s returned the wrong runs. Got: %v, Want: %v", test.name, guids, want)
+		}
+	}
+}
+
+func TestNetworkPolicy(t *testing.T) {
+	webEngine := genNewHTTPServer(t, false, false)
+	err := webEngine.SetNetworkPolicy(NetworkPolicy{
+		ReadDenied:     []string{"203.0.113.0/24"},
+		WriteAllowed:   []string{"10.1.0.0/16", "127.0.0.1"},
+		TrustedProxies: []string{"192.0.2.1"},
+	})
+	if err != nil {
+		t.Fatalf("SetNetworkPolicy failed. Error: %s", err)
+	}
+
+	tests := []struct {
+		name         string
+		path         string
+		remoteAddr   string
+		forwardedFor string
+		expectedCode int
+	}{
+		{name: "Read from anywhere", path: "/chef/lock", remoteAddr: "198.51.100.7:1234", expectedCode: http.StatusOK},
+		{name: "Read from denied network", path: "/chef/lock", remoteAddr: "203.0.113.9:1234", expectedCode: http.StatusForbidden},
+		{name: "Write from allowed network", path: "/chef/on", remoteAddr: "10.1.2.3:1234", expectedCode: http.StatusOK},
+		{name: "Write from allowed IP", path: "/chef/on", remoteAddr: "127.0.0.1:1234", expectedCode: http.StatusOK},
+		{name: "Write from other network", path: "/chef/on", remoteAddr: "198.51.100.7:1234", expectedCode: http.StatusForbidden},
+		{name: "Write through trusted proxy", path: "/chef/on", remoteAddr: "192.0.2.1:1234", forwardedFor: "198.51.100.7, 10.1.2.3", expectedCode: http.StatusOK},
+		{name: "Write through trusted proxy from other network", path: "/chef/on", remoteAddr: "192.0.2.1:1234", forwardedFor: "10.1.2.3, 198.51.100.7", expectedCode: http.StatusForbidden},
+		{name: "Forwarded for from untrusted client", path: "/chef/on", remoteAddr: "198.51.100.7:1234", forwardedFor: "10.1.2.3", expectedCode: http.StatusForbidden},
+		{name: "Unix socket", path: "/chef/on", remoteAddr: "@", expectedCode: http.StatusOK},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, url(test.path), nil)
+		if test.path == "/chef/lock" {
+			r.Method = http.MethodGet
+		}
+		r.RemoteAddr = test.remoteAddr
+		if test.forwardedFor != "" {
+			r.Header.Set("X-Forwarded-For", test.forwardedFor)
+		}
+		webEngine.ServeHTTP(w, r)
+		if w.Result().StatusCode != test.expectedCode {
+			t.Errorf("Test %s did not return expected Status Code. Got: %d, Want: %d", test.name, w.Result().StatusCode, test.expectedCode)
+		}
+	}
+
+	if err := webEngine.SetNetworkPolicy(NetworkPolicy{ReadAllowed: []string{"not-a-network"}}); err == nil {
+		t.Errorf("SetNetworkPolicy should reject networks that are not valid")
+	}
+}
+
+// writeTestCertificate creates a self signed certificate for 127.0.0.1 in dir and
+// returns the paths to the certificate and key.
+func writeTestCertificate(t *testing.T, dir, commonName string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to create a key. Error: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create a certificate. Error: %s", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Failed to marshal the key. Error: %s", err)
+	}
+	certPath := filepath.Join(dir, "cert.crt")
+	keyPath := filepath.Join(dir, "cert.key")
+	if err := ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatalf("Failed to write the certificate. Error: %s", err)
+	}
+	if err := ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatalf("Failed to write the key. Error: %s", err)
+	}
+	return certPath, keyPath
+}
+
+func TestHTTPSEngineHTTP2(t *testing.T) {
+	webEngine := genNewHTTPServer(t, false, false)
+	dir, err := ioutil.TempDir("", "chefwaiter_tls")
+	if err != nil {
+		t.Fatalf("Failed to create a temp directory. Error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	certPath, keyPath := writeTestCertificate(t, dir, "chefwaiter")
+
+	// Find a free port for the server.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to find a free port. Error: %s", err)
+	}
+	address := l.Addr().String()
+	l.Close()
+
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- webEngine.StartHTTPSEngine(address, certPath, keyPath)
+	}()
+	select {
+	case <-webEngine.Ready():
+	case err := <-errChan:
+		t.Fatalf("Failed to start the server. Error: %s", err)
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+			ForceAttemptHTTP2: true,
+		},
+	}
+	result, err := client.Get("https://" + address + "/healthcheck")
+	if err != nil {
+		t.Fatalf("Failed to reach the server. Error: %s", err)
+	}
+	result.Body.Close()
+	if result.ProtoMajor != 2 {
+		t.Errorf("The server did not negotiate HTTP/2. Got: %s", result.Proto)
+	}
+
+	if err := webEngine.StopHTTPEngine(5 * time.Second); err != nil {
+		t.Errorf("Failed to stop the server. Error: %s", err)
+	}
+	if err := <-errChan; err != http.ErrServerClosed {
+		t.Errorf("Unexpected error from the server. Error: %s", err)
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chefwaiter_tls")
+	if err != nil {
+		t.Fatalf("Failed to create a temp directory. Error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	certPath, keyPath := writeTestCertificate(t, dir, "first")
+
+	reloader, err := newCertReloader(certPath, keyPath, logs.NewFakeLogger(false))
+	if err != nil {
+		t.Fatalf("Failed to load the certificate. Error: %s", err)
+	}
+	servedName := func() string {
+		cert, err := reloader.GetCertificate(nil)
+		if err != nil {
+			t.Fatalf("GetCertificate returned an error: %s", err)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatalf("Failed to parse the served certificate. Error: %s", err)
+		}
+		return leaf.Subject.CommonName
+	}
+
+	// Renew the certificate. The change is not looked for until the check interval has passed.
+	writeTestCertificate(t, dir, "renewed")
+	renewed := time.Now().Add(time.Minute)
+	os.Chtimes(certPath, renewed, renewed)
+	if name := servedName(); name != "first" {
+		t.Errorf("The certificate was loaded before the check interval. Got: %s", name)
+	}
+	reloader.checked = time.Time{}
+	if name := servedName(); name != "renewed" {
+		t.Errorf("The renewed certificate was not served. Got: %s", name)
+	}
+
+	// A broken certificate is not used.
+	if err := ioutil.WriteFile(certPath, []byte("not a certificate"), 0600); err != nil {
+		t.Fatalf("Failed to break the certificate. Error: %s", err)
+	}
+	if err := reloader.Reload(); err == nil {
+		t.Errorf("Reload should fail with a broken certificate")
+	}
+	broken := time.Now().Add(2 * time.Minute)
+	os.Chtimes(certPath, broken, broken)
+	reloader.checked = time.Time{}
+	if name := servedName(); name != "renewed" {
+		t.Errorf("The old certificate should be kept when the new one is broken. Got: %s", name)
+	}
+}
+
+func TestReadiness(t *testing.T) {
+	webEngine := genNewHTTPServer(t, false, false)
+	w := httptest.NewRecorder()
+	webEngine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url("/readiness"), nil))
+	if w.Result().StatusCode != http.StatusOK {
+		t.Errorf("/readiness did not return expected Status Code. Got: %d, Want: %d", w.Result().StatusCode, http.StatusOK)
+	}
+
+	webEngine.appState = &FakeAppStatus{selfTestFailed: true}
+	w = httptest.NewRecorder()
+	webEngine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url("/readiness"), nil))
+	if w.Result().StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("/readiness did not return expected Status Code. Got: %d, Want: %d", w.Result().StatusCode, http.StatusServiceUnavailable)
+	}
+	if !strings.Contains(w.Body.String(), "self test") {
+		t.Errorf("/readiness should give the self test as the reason. Got: %s", w.Body.String())
+	}
+}
+
+func TestAdminShutdown(t *testing.T) {
+	webEngine := genNewHTTPServer(t, false, false)
+	webEngine.SetAdminToken("secret")
+
+	shutdown := func(token string) int {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, url("/admin/shutdown"), nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		webEngine.ServeHTTP(w, r)
+		return w.Result().StatusCode
+	}
+
+	if code := shutdown("wrong"); code != http.StatusUnauthorized {
+		t.Errorf("Shut down with the wrong token did not return expected Status Code. Got: %d, Want: %d", code, http.StatusUnauthorized)
+	}
+	if code := shutdown("secret"); code != http.StatusServiceUnavailable {
+		t.Errorf("Shut down with no shut down function did not return expected Status Code. Got: %d, Want: %d", code, http.StatusServiceUnavailable)
+	}
+
+	called := make(chan struct{}, 2)
+	webEngine.SetShutdownFunc(func() { called <- struct{}{} })
+	for i := 0; i < 2; i++ {
+		if code := shutdown("secret"); code != http.StatusAccepted {
+			t.Errorf("Shut down did not return expected Status Code. Got: %d, Want: %d", code, http.StatusAccepted)
+		}
+	}
+	select {
+	case <-called:
+	case <-time.After(time.Second):
+		t.Fatalf("The shut down function was not called")
+	}
+	select {
+	case <-called:
+		t.Errorf("The shut down function should only be called once")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestStateDump(t *testing.T) {
+	webEngine := genNewHTTPServer(t, false, false)
+	webEngine.SetAdminToken("secret")
+	webEngine.state.Add("dump-guid", true)
+	webEngine.state.LockRunsBy("tester")
+
+	w := httptest.NewRecorder()
+	webEngine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url("/admin/state"), nil))
+	if w.Result().StatusCode != http.StatusUnauthorized {
+		t.Errorf("State dump without a token did not return expected Status Code. Got: %d, Want: %d", w.Result().StatusCode, http.StatusUnauthorized)
+	}
+
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, url("/admin/state"), nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	webEngine.ServeHTTP(w, r)
+	if w.Result().StatusCode != http.StatusOK {
+		t.Fatalf("State dump did not return expected Status Code. Got: %d, Want: %d", w.Result().StatusCode, http.StatusOK)
+	}
+	dump := internalstate.StateDump{}
+	if err := json.NewDecoder(w.Result().Body).Decode(&dump); err != nil {
+		t.Fatalf("State dump did not return valid JSON. Error: %s", err)
+	}
+	if _, ok := dump.Runs["dump-guid"]; !ok {
+		t.Errorf("State dump is missing the run. Got: %+v", dump.Runs)
+	}
+	if !dump.Locked || dump.LockedBy != "tester" {
+		t.Errorf("State dump is missing the lock. Got locked: %v, by: %q", dump.Locked, dump.LockedBy)
+	}
+}
+
+func TestResetFailureStreak(t *testing.T) {
+	webEngine := genNewHTTPServer(t, false, false)
+	webEngine.SetAdminToken("secret")
+	webEngine.state.RecordRunFailure(time.Now(), time.Hour)
+	webEngine.state.RecordRunFailure(time.Now(), time.Hour)
+
+	w := httptest.NewRecorder()
+	webEngine.ServeHTTP(w, httptest.NewRequest(http.MethodPost, url("/chef/backoff/reset"), nil))
+	if w.Result().StatusCode != http.StatusUnauthorized {
+		t.Errorf("Reset without a token did not return expected Status Code. Got: %d, Want: %d", w.Result().StatusCode, http.StatusUnauthorized)
+	}
+	if failures := webEngine.state.ReadFailureStreak(); failures != 2 {
+		t.Errorf("Reset without a token should not clear the failures. Got: %d", failures)
+	}
+
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, url("/chef/backoff/reset"), nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	webEngine.ServeHTTP(w, r)
+	if w.Result().StatusCode != http.StatusOK {
+		t.Fatalf("Reset did not return expected Status Code. Got: %d, Want: %d", w.Result().StatusCode, http.StatusOK)
+	}
+	if failures := webEngine.state.ReadFailureStreak(); failures != 0 {
+		t.Errorf("Reset should clear the failures. Got: %d", failures)
+	}
+	if body := strings.TrimSpace(w.Body.String()); body != `{"consecutive_failures":0}` {
+		t.Errorf("Reset returned the wrong body. Got: %s", body)
+	}
+}
+
+func TestSweepChefLogs(t *testing.T) {
+	webEngine := genNewHTTPServer(t, false, false)
+	webEngine.SetAdminToken("secret")
+
+	w := httptest.NewRecorder()
+	webEngine.ServeHTTP(w, httptest.NewRequest(http.MethodPost, url("/admin/logs/sweep"), nil))
+	if w.Result().StatusCode != http.StatusUnauthorized {
+		t.Errorf("Sweep without a token did not return expected Status Code. Got: %d, Want: %d", w.Result().StatusCode, http.StatusUnauthorized)
+	}
+
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, url("/admin/logs/sweep"), nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	webEngine.ServeHTTP(w, r)
+	if w.Result().StatusCode != http.StatusOK {
+		t.Fatalf("Sweep did not return expected Status Code. Got: %d, Want: %d", w.Result().StatusCode, http.StatusOK)
+	}
+	summary := map[string]int{}
+	if err := json.NewDecoder(w.Result().Body).Decode(&summary); err != nil {
+		t.Fatalf("Sweep did not return valid JSON. Error: %s", err)
+	}
+	if _, ok := summary["logs_removed"]; !ok {
+		t.Errorf("Sweep did not return the logs removed. Got: %v", summary)
+	}
+}
+
+// optionsRecordingWorker remembers the options of the last custom run.
+type optionsRecordingWorker struct {
+	*chefrunner.FakeChefRunnerWorker
+	options internalstate.RunOptions
+	runs    int
+}
+
+func (w *optionsRecordingWorker) CustomRun(jobDetails string, options internalstate.RunOptions) (string, bool) {
+	w.options = options
+	w.runs++
+	return w.FakeChefRunnerWorker.CustomRun(jobDetails, options)
+}
+
+func TestCustomRunReason(t *testing.T) {
+	webEngine := genNewHTTPServer(t, false, false)
+	worker := &optionsRecordingWorker{FakeChefRunnerWorker: chefrunner.NewFakeChefRunnerWorker(false)}
+	webEngine.worker = worker
+	webEngine.SetWhitelist([]string{"recipe[audited]", "recipe[open]"})
+	webEngine.SetReasonRequiredRuns([]string{"recipe[audited]"})
+	tests := []struct {
+		name           string
+		url            string
+		body           string
+		contentType    string
+		expectedCode   int
+		expectedReason string
+	}{
+		{name: "Reason not required", url: "/chefclient", body: "recipe[open]", expectedCode: http.StatusOK},
+		{name: "Missing reason", url: "/chefclient", body: "recipe[audited]", expectedCode: http.StatusBadRequest},
+		{name: "Blank reason", url: "/chefclient?reason=%20", body: "recipe[audited]", expectedCode: http.StatusBadRequest},
+		{name: "Reason in the URL", url: "/chefclient?reason=INC-1", body: "recipe[audited]", expectedCode: http.StatusOK, expectedReason: "INC-1"},
+		{name: "Reason in JSON", url: "/chefclient", body: `{"run_list":"recipe[audited]","reason":"INC-2"}`, contentType: "application/json", expectedCode: http.StatusOK, expectedReason: "INC-2"},
+	}
+
+	for _, test := range tests {
+		worker.options = internalstate.RunOptions{}
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, url(test.url), strings.NewReader(test.body))
+		if test.contentType != "" {
+			r.Header.Set("Content-Type", test.contentType)
+		}
+		webEngine.ServeHTTP(w, r)
+		if w.Result().StatusCode != test.expectedCode {
+			t.Errorf("Test %s did not return expected Status Code. Got: %d, Want: %d", test.name, w.Result().StatusCode, test.expectedCode)
+		}
+		if worker.options.Reason != test.expectedReason {
+			t.Errorf("Test %s did not pass on the reason. Got: %q, Want: %q", test.name, worker.options.Reason, test.expectedReason)
+		}
+	}
+}
+
+func TestValidateCustomRun(t *testing.T) {
+	webEngine := genNewHTTPServer(t, false, false)
+	worker := &optionsRecordingWorker{FakeChefRunnerWorker: chefrunner.NewFakeChefRunnerWorker(false)}
+	webEngine.worker = worker
+	webEngine.SetWhitelist([]string{"recipe[audited]", "recipe[open]"})
+	webEngine.SetReasonRequiredRuns([]string{"recipe[audited]"})
+	webEngine.SetAllowedExtraFlags([]string{"-l debug"})
+	tests := []struct {
+		name            string
+		body            string
+		contentType     string
+		expectedCode    int
+		expectedCommand []string
+		expectedCodes   []string
+	}{
+		{
+			name:            "Valid run",
+			body:            `{"run_list":"recipe[open]","extra_flags":["-l debug"]}`,
+			contentType:     "application/json",
+			expectedCode:    http.StatusOK,
+			expectedCommand: []string{"chef-client", "-o", "recipe[open]", "-l debug"},
+		},
+		{
+			name:            "Not whitelisted",
+			body:            "recipe[other]",
+			expectedCode:    http.StatusOK,
+			expectedCommand: []string{"chef-client", "-o", "recipe[other]"},
+			expectedCodes:   []string{"not_whitelisted"},
+		},
+		{
+			name:            "Every problem",
+			body:            `{"run_list":"recipe[audited]","extra_flags":["--why-run"],"run_as":"root","node_name":"bad name"}`,
+			contentType:     "application/json",
+			expectedCode:    http.StatusOK,
+			expectedCommand: []string{"chef-client", "-o", "recipe[audited]", "--why-run"},
+			expectedCodes:   []string{"invalid_node_name", "missing_reason", "extra_flags_not_allowed", "run_as_not_allowed"},
+		},
+		{name: "Bad JSON", body: "{", contentType: "application/json", expectedCode: http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, url("/chefclient/validate"), strings.NewReader(test.body))
+		if test.contentType != "" {
+			r.Header.Set("Content-Type", test.contentType)
+		}
+		webEngine.ServeHTTP(w, r)
+		if w.Result().StatusCode != test.expectedCode {
+			t.Errorf("Test %s did not return expected Status Code. Got: %d, Want: %d", test.name, w.Result().StatusCode, test.expectedCode)
+			continue
+		}
+		if worker.runs != 0 {
+			t.Errorf("Test %s registered a run", test.name)
+		}
+		if test.expectedCode != http.StatusOK {
+			continue
+		}
+		plan := customRunPlan{}
+		if err := json.NewDecoder(w.Result().Body).Decode(&plan); err != nil {
+			t.Fatalf("Test %s did not return a plan. Error: %s", test.name, err)
+		}
+		if strings.Join(plan.Command, " ") != strings.Join(test.expectedCommand, " ") {
+			t.Errorf("Test %s returned the wrong command. Got: %q, Want: %q", test.name, plan.Command, test.expectedCommand)
+		}
+		codes := make([]string, 0)
+		for _, problem := range plan.Problems {
+			codes = append(codes, problem.Code)
+		}
+		if strings.Join(codes, ",") != strings.Join(test.expectedCodes, ",") || plan.Valid != (len(codes) == 0) {
+			t.Errorf("Test %s returned the wrong problems. Got: %v, Want: %v", test.name, codes, test.expectedCodes)
+		}
+	}
+}
+
+func TestRunLabel(t *testing.T) {
+	webEngine := genNewHTTPServer(t, true, true)
+	longLabel := strings.Repeat("a", maxLabelLength+1)
+	tests := []struct {
+		name         string
+		method       string
+		url          string
+		body         string
+		contentType  string
+		expectedCode int
+	}{
+		{name: "On demand with label", method: http.MethodGet, url: "/chefclient?label=CHG-1", expectedCode: http.StatusOK},
+		{name: "On demand label too long", method: http.MethodGet, url: "/chefclient?label=" + longLabel, expectedCode: http.StatusBadRequest},
+		{name: "Custom with label", method: http.MethodPost, url: "/chefclient?label=CHG-1", body: "recipe[chefwaiter::test]", expectedCode: http.StatusOK},
+		{name: "JSON with label", method: http.MethodPost, url: "/chefclient", body: `{"run_list":"recipe[chefwaiter::test]","label":"CHG-1"}`, contentType: "application/json", expectedCode: http.StatusOK},
+		{name: "JSON label too long", method: http.MethodPost, url: "/chefclient", body: `{"run_list":"recipe[chefwaiter::test]","label":"` + strings.Repeat("a", 300) + `"}`, contentType: "application/json", expectedCode: http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(test.method, url(test.url), strings.NewReader(test.body))
+		if test.contentType != "" {
+			r.Header.Set("Content-Type", test.contentType)
+		}
+		webEngine.ServeHTTP(w, r)
+		if w.Result().StatusCode != test.expectedCode {
+			t.Errorf("Test %s did not return expected Status Code. Got: %d, Want: %d", test.name, w.Result().StatusCode, test.expectedCode)
+		}
+	}
+}
+func TestCustomRunNodeName(t *testing.T) {
+	webEngine := genNewHTTPServer(t, false, false)
+	worker := &optionsRecordingWorker{FakeChefRunnerWorker: chefrunner.NewFakeChefRunnerWorker(false)}
+	webEngine.worker = worker
+	tests := []struct {
+		name             string
+		url              string
+		body             string
+		contentType      string
+		expectedCode     int
+		expectedNodeName string
+	}{
+		{name: "No node name", url: "/chefclient", body: "recipe[test]", expectedCode: http.StatusOK},
+		{name: "Node name in the URL", url: "/chefclient?node_name=test-node.example.com", body: "recipe[test]", expectedCode: http.StatusOK, expectedNodeName: "test-node.example.com"},
+		{name: "Node name in JSON", url: "/chefclient", body: `{"run_list":"recipe[test]","node_name":"test_node:2"}`, contentType: "application/json", expectedCode: http.StatusOK, expectedNodeName: "test_node:2"},
+		{name: "Node name with a space", url: "/chefclient?node_name=test%20-c%20x", body: "recipe[test]", expectedCode: http.StatusBadRequest},
+		{name: "Node name with a slash", url: "/chefclient", body: `{"run_list":"recipe[test]","node_name":"../node"}`, contentType: "application/json", expectedCode: http.StatusBadRequest},
+		{name: "Node name too long", url: "/chefclient?node_name=" + strings.Repeat("a", 256), body: "recipe[test]", expectedCode: http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		worker.options = internalstate.RunOptions{}
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, url(test.url), strings.NewReader(test.body))
+		if test.contentType != "" {
+			r.Header.Set("Content-Type", test.contentType)
+		}
+		webEngine.ServeHTTP(w, r)
+		if w.Result().StatusCode != test.expectedCode {
+			t.Errorf("Test %s did not return expected Status Code. Got: %d, Want: %d", test.name, w.Result().StatusCode, test.expectedCode)
+		}
+		if worker.options.NodeName != test.expectedNodeName {
+			t.Errorf("Test %s did not pass on the node name. Got: %q, Want: %q", test.name, worker.options.NodeName, test.expectedNodeName)
+		}
+	}
+}
+
+func TestBlockOnDemandInMaintenance(t *testing.T) {
+	tests := []struct {
+		name         string
+		block        bool
+		method       string
+		path         string
+		expectedCode int
+	}{
+		{name: "On demand allowed by default", method: http.MethodGet, path: "/chefclient", expectedCode: http.StatusOK},
+		{name: "On demand blocked", block: true, method: http.MethodGet, path: "/chefclient", expectedCode: http.StatusServiceUnavailable},
+		{name: "On demand forced", block: true, method: http.MethodGet, path: "/chefclient?force=true", expectedCode: http.StatusOK},
+		{name: "Custom run blocked", block: true, method: http.MethodPost, path: "/chefclient", expectedCode: http.StatusServiceUnavailable},
+		{name: "Custom run forced", block: true, method: http.MethodPost, path: "/chefclient?force=true", expectedCode: http.StatusOK},
+	}
+
+	for _, test := range tests {
+		webEngine := genNewHTTPServer(t, false, false)
+		webEngine.SetBlockOnDemandInMaintenance(test.block)
+		webEngine.state.WriteMaintenanceTimeEnd(time.Now().Add(time.Hour).Unix())
+		w := httptest.NewRecorder()
+		webEngine.ServeHTTP(w, httptest.NewRequest(test.method, url(test.path), strings.NewReader("recipe[test]")))
+		if w.Result().StatusCode != test.expectedCode {
+			t.Errorf("Test %s did not return expected Status Code. Got: %d, Want: %d", test.name, w.Result().StatusCode, test.expectedCode)
+			continue
+		}
+		if test.expectedCode == http.StatusServiceUnavailable {
+			errResp := &errorResponse{}
+			if err := json.NewDecoder(w.Result().Body).Decode(errResp); err != nil || errResp.Error.Code != "in_maintenance" {
+				t.Errorf("Test %s returned the wrong error. Got: %+v, Error: %v", test.name, errResp, err)
+			}
+		}
+	}
+}
+
+func TestCustomRunAs(t *testing.T) {
+	webEngine := genNewHTTPServer(t, false, false)
+	webEngine.SetAllowedRunAsUsers([]string{"deploy"})
+	tests := []struct {
+		name         string
+		url          string
+		body         string
+		contentType  string
+		expectedCode int
+	}{
+		{name: "Service user", url: "/chefclient", body: "recipe[chefwaiter::test]", expectedCode: http.StatusOK},
+		{name: "Allowed user", url: "/chefclient?run_as=deploy", body: "recipe[chefwaiter::test]", expectedCode: http.StatusOK},
+		{name: "User not allowed", url: "/chefclient?run_as=root", body: "recipe[chefwaiter::test]", expectedCode: http.StatusForbidden},
+		{name: "JSON allowed user", url: "/chefclient", body: `{"run_list":"recipe[chefwaiter::test]","run_as":"deploy"}`, contentType: "application/json", expectedCode: http.StatusOK},
+		{name: "JSON user not allowed", url: "/chefclient", body: `{"run_list":"recipe[chefwaiter::test]","run_as":"admin"}`, contentType: "application/json", expectedCode: http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, url(test.url), strings.NewReader(test.body))
+		if test.contentType != "" {
+			r.Header.Set("Content-Type", test.contentType)
+		}
+		webEngine.ServeHTTP(w, r)
+		if w.Result().StatusCode != test.expectedCode {
+			t.Errorf("Test %s did not return expected Status Code. Got: %d, Want: %d", test.name, w.Result().StatusCode, test.expectedCode)
+		}
+	}
+}
+
+func TestCustomRunForm(t *testing.T) {
+	webEngine := genNewHTTPServer(t, false, false)
+	webEngine.SetWhitelist([]string{"recipe[chefwaiter::test]"})
+	webEngine.SetMaxRequestBodyBytes(512)
+	tests := []struct {
+		name         string
+		body         string
+		expectedCode int
+	}{
+		{name: "Whitelisted command", body: "command=recipe%5Bchefwaiter%3A%3Atest%5D", expectedCode: http.StatusOK},
+		{name: "Command not in whitelist", body: "command=recipe%5Bother%5D", expectedCode: http.StatusUnprocessableEntity},
+		{name: "Missing command", body: "run=recipe%5Bchefwaiter%3A%3Atest%5D", expectedCode: http.StatusBadRequest},
+		{name: "Body too large", body: "command=" + strings.Repeat("a", 513), expectedCode: http.StatusRequestEntityTooLarge},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, url("/chefclient"), strings.NewReader(test.body))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		webEngine.ServeHTTP(w, r)
+		if w.Result().StatusCode != test.expectedCode {
+			t.Errorf("Test %s did not return expected Status Code. Got: %d, Want: %d", test.name, w.Result().StatusCode, test.expectedCode)
+		}
+	}
+}
+
+func TestAllRunsCSV(t *testing.T) {
+	webEngine := genNewHTTPServer(t, false, false)
+	for i := int64(1); i <= 2; i++ {
+		guid := fmt.Sprintf("run-%d", i)
+		webEngine.state.Add(guid, true)
+		job := webEngine.state.ReadAll()[guid]
+		job.RegisteredTime = i * 100
+		job.Status = "complete"
+		job.ExitCode = 0
+		job.RunStartTime = 1542124125
+		job.RunEndTime = 1542124188
+	}
+
+	w := httptest.NewRecorder()
+	webEngine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url("/chef/allruns?format=csv&limit=1"), nil))
+	result := w.Result()
+	if result.StatusCode != http.StatusOK {
+		t.Fatalf("CSV export did not return expected Status Code. Got: %d, Want: %d", result.StatusCode, http.StatusOK)
+	}
+	if contentType := result.Header.Get("Content-Type"); !strings.HasPrefix(contentType, "text/csv") {
+		t.Errorf("CSV export has the wrong Content-Type. Got: %s", contentType)
+	}
+	if disposition := result.Header.Get("Content-Disposition"); !strings.HasPrefix(disposition, "attachment") {
+		t.Errorf("CSV export should be an attachment. Got: %s", disposition)
+	}
+	body, _ := ioutil.ReadAll(result.Body)
+	want := "guid,status,source,start,end,duration,exit_code\n" +
+		"run-2,complete,demand,2018-11-13T15:48:45Z,2018-11-13T15:49:48Z,63,0\n"
+	if string(body) != want {
+		t.Errorf("CSV export is wrong. Got:\n%s\nWant:\n%s", body, want)
+	}
+
+	w = httptest.NewRecorder()
+	webEngine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url("/chef/allruns?format=xml"), nil))
+	if w.Result().StatusCode != http.StatusBadRequest {
+		t.Errorf("Unknown format did not return expected Status Code. Got: %d, Want: %d", w.Result().StatusCode, http.StatusBadRequest)
+	}
+}
+
+func TestMaxRequestBody(t *testing.T) {
+	webEngine := genNewHTTPServer(t, false, false)
+	webEngine.SetMaxRequestBodyBytes(64)
+	tests := []struct {
+		name         string
+		path         string
+		body         string
+		expectedCode int
+	}{
+		{name: "Bulk status", path: "/chefclient/status", body: `["` + strings.Repeat("a", 64) + `"]`, expectedCode: http.StatusRequestEntityTooLarge},
+		{name: "Bulk status under the limit", path: "/chefclient/status", body: `["guid"]`, expectedCode: http.StatusOK},
+		{name: "Interval", path: "/chef/interval", body: `{"duration":"30m","padding":"` + strings.Repeat("a", 64) + `"}`, expectedCode: http.StatusRequestEntityTooLarge},
+		{name: "Interval under the limit", path: "/chef/interval", body: `{"duration":"30m"}`, expectedCode: http.StatusOK},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, url(test.path), strings.NewReader(test.body))
+		r.Header.Set("Content-Type", "application/json")
+		webEngine.ServeHTTP(w, r)
+		if w.Result().StatusCode != test.expectedCode {
+			t.Errorf("Test %s did not return expected Status Code. Got: %d, Want: %d", test.name, w.Result().StatusCode, test.expectedCode)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package webengine
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/morfien101/chef-waiter/internalstate"
+)
+
+// listFilter holds the limit and since query parameters used by the endpoints that list things.
+// A zero value means that the filter was not asked for.
+type listFilter struct {
+	limit int
+	since int64
+}
+
+// parseListFilter reads ?limit=N and ?since=<epoch> from the request.
+func parseListFilter(r *http.Request) (listFilter, error) {
+	filter := listFilter{}
+	if limit := r.URL.Query().Get("limit"); limit != "" {
+		value, err := strconv.Atoi(limit)
+		if err != nil || value < 1 {
+			return filter, fmt.Errorf("limit must be a positive number")
+		}
+		filter.limit = value
+	}
+	if since := r.URL.Query().Get("since"); since != "" {
+		value, err := strconv.ParseInt(since, 10, 64)
+		if err != nil || value < 0 {
+			return filter, fmt.Errorf("since must be an epoch time")
+		}
+		filter.since = value
+	}
+	return filter, nil
+}
+
+// runSortKeys holds how the runs are compared for each ?sort= key. start is when the
+// run was registered, which is its starttime.
+var runSortKeys = map[string]func(a, b internalstate.JobDetails) int{
+	"start":    func(a, b internalstate.JobDetails) int { return compareInt64(a.RegisteredTime, b.RegisteredTime) },
+	"duration": func(a, b internalstate.JobDetails) int { return compareInt64(a.DurationSeconds, b.DurationSeconds) },
+	"status":   func(a, b internalstate.JobDetails) int { return strings.Compare(a.Status, b.Status) },
+}
+
+// runSort is the order that runs are listed in. The zero value is newest first.
+type runSort struct {
+	key       string
+	ascending bool
+}
+
+// parseRunSort reads ?sort=start|duration|status and ?order=asc|desc from the request.
+func parseRunSort(r *http.Request) (runSort, error) {
+	order := runSort{key: "start"}
+	if key := r.URL.Query().Get("sort"); key != "" {
+		if _, ok := runSortKeys[key]; !ok {
+			return order, fmt.Errorf("sort must be start, duration or status")
+		}
+		order.key = key
+	}
+	switch r.URL.Query().Get("order") {
+	case "", "desc":
+	case "asc":
+		order.ascending = true
+	default:
+		return order, fmt.Errorf("order must be asc or desc")
+	}
+	return order, nil
+}
+
+// filterJobs will return the guids of the jobs registered at or after since in the
+// given order. If there are more than limit jobs only the first limit are kept.
+// Runs that are equal on the sort key are listed newest first.
+func (f listFilter) filterJobs(jobs map[string]internalstate.JobDetails, order runSort) []string {
+	guids := make([]string, 0, len(jobs))
+	for guid, job := range jobs {
+		if job.RegisteredTime >= f.since {
+			guids = append(guids, guid)
+		}
+	}
+	compare := runSortKeys[order.key]
+	if compare == nil {
+		compare = runSortKeys["start"]
+	}
+	sort.Slice(guids, func(i, j int) bool {
+		a, b := jobs[guids[i]], jobs[guids[j]]
+		if c := compare(a, b); c != 0 {
+			return (c < 0) == order.ascending
+		}
+		if a.RegisteredTime != b.RegisteredTime {
+			return a.RegisteredTime > b.RegisteredTime
+		}
+		return guids[i] < guids[j]
+	})
+	if f.limit > 0 && len(guids) > f.limit {
+		guids = guids[:f.limit]
+	}
+	return guids
+}
+
+func compareInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
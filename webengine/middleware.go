@@ -0,0 +1,104 @@
+package webengine
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/morfien101/chef-waiter/metrics"
+	"github.com/morfien101/chef-waiter/tracing"
+)
+
+// statusRecorder keeps hold of the status code written to a response so that
+// middleware can report on it.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(code int) {
+	sr.status = code
+	sr.ResponseWriter.WriteHeader(code)
+}
+
+// Flush allows handlers that stream to keep working through the recorder.
+func (sr *statusRecorder) Flush() {
+	if f, ok := sr.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// routeName will return the template of the route that matched the request
+// so that guids in the path don't create a new name for every request.
+func routeName(r *http.Request) string {
+	if route := mux.CurrentRoute(r); route != nil {
+		if tmpl, err := route.GetPathTemplate(); err == nil {
+			return tmpl
+		}
+	}
+	return "unknown"
+}
+
+// traceRequest starts a server span for each request. Any trace context sent in the
+// traceparent header is used as the parent of the span.
+func (e *HTTPEngine) traceRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parent, _ := tracing.ParseTraceparent(r.Header.Get("traceparent"))
+		span := tracing.StartSpan(r.Method+" "+routeName(r), parent, tracing.SpanKindServer)
+		if span == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+
+		span.SetAttribute("http.method", r.Method)
+		span.SetAttribute("http.route", routeName(r))
+		span.SetAttribute("http.status_code", recorder.status)
+		if guid, ok := mux.Vars(r)["guid"]; ok {
+			span.SetAttribute("chefwaiter.guid", guid)
+		}
+		if recorder.status >= 500 {
+			span.SetStatus(tracing.StatusError)
+		}
+		span.End()
+	})
+}
+
+// timeRequest sends the time taken to answer each request as a metric tagged with the
+// route template, so that all the guids of a route are timed together.
+func (e *HTTPEngine) timeRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+		metrics.Timing("http_request_time", int64(time.Since(start)/time.Millisecond), map[string]string{
+			"route":  routeName(r),
+			"method": r.Method,
+			"status": strconv.Itoa(recorder.status),
+		})
+	})
+}
+
+// limitRequestBody stops a request body from being read past the max body size.
+// Handlers use bodyTooLarge to turn the error from reading too far into a 413.
+func (e *HTTPEngine) limitRequestBody(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, e.maxBodyBytes)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// bodyTooLarge will write a 413 and return true if err came from reading past the max
+// body size. The error is matched on its text as http.MaxBytesError is not in older
+// versions of Go.
+func (e *HTTPEngine) bodyTooLarge(w http.ResponseWriter, err error) bool {
+	if err == nil || err.Error() != "http: request body too large" {
+		return false
+	}
+	writeJSONError(w, http.StatusRequestEntityTooLarge, "body_too_large", fmt.Sprintf("Body sent is too large. Max size %d bytes", e.maxBodyBytes))
+	return true
+}
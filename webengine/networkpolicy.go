@@ -0,0 +1,158 @@
+package webengine
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// NetworkPolicy holds the networks, as CIDRs or single IPs, that may use the API.
+// Read lists apply to every request. Write lists also apply to the endpoints that
+// change state or start runs so they can be held to a tighter policy.
+// Deny lists win over allow lists. An empty allow list allows everyone.
+// TrustedProxies are the proxies whose X-Forwarded-For header is believed.
+type NetworkPolicy struct {
+	ReadAllowed    []string
+	ReadDenied     []string
+	WriteAllowed   []string
+	WriteDenied    []string
+	TrustedProxies []string
+}
+
+// ipPolicy is an allow and deny list of networks.
+type ipPolicy struct {
+	allowed []*net.IPNet
+	denied  []*net.IPNet
+}
+
+// networkPolicy is the parsed NetworkPolicy.
+type networkPolicy struct {
+	read           ipPolicy
+	write          ipPolicy
+	trustedProxies []*net.IPNet
+}
+
+// SetNetworkPolicy is used to restrict which networks can use the API.
+// The policy does nothing while all the lists are empty.
+func (e *HTTPEngine) SetNetworkPolicy(policy NetworkPolicy) error {
+	parsed := &networkPolicy{}
+	for _, list := range []struct {
+		networks []string
+		parsed   *[]*net.IPNet
+	}{
+		{networks: policy.ReadAllowed, parsed: &parsed.read.allowed},
+		{networks: policy.ReadDenied, parsed: &parsed.read.denied},
+		{networks: policy.WriteAllowed, parsed: &parsed.write.allowed},
+		{networks: policy.WriteDenied, parsed: &parsed.write.denied},
+		{networks: policy.TrustedProxies, parsed: &parsed.trustedProxies},
+	} {
+		for _, network := range list.networks {
+			ipNet, err := ParseNetwork(network)
+			if err != nil {
+				return err
+			}
+			*list.parsed = append(*list.parsed, ipNet)
+		}
+	}
+	e.networkPolicy = parsed
+	return nil
+}
+
+// ParseNetwork will read a CIDR such as 10.0.0.0/8. A single IP is read as a network
+// holding only that IP.
+func ParseNetwork(network string) (*net.IPNet, error) {
+	if !strings.Contains(network, "/") {
+		ip := net.ParseIP(network)
+		if ip == nil {
+			return nil, fmt.Errorf("%q is not a valid IP or CIDR", network)
+		}
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip = ip.To4()
+			bits = 8 * net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, ipNet, err := net.ParseCIDR(network)
+	if err != nil {
+		return nil, fmt.Errorf("%q is not a valid IP or CIDR", network)
+	}
+	return ipNet, nil
+}
+
+// checkReadNetwork is middleware that turns away clients outside of the read policy.
+func (e *HTTPEngine) checkReadNetwork(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if e.networkPolicy != nil && !e.allowedByPolicy(w, r, e.networkPolicy.read) {
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// checkWriteNetwork wraps a handler that changes state so that it is only called for
+// clients inside of the write policy.
+func (e *HTTPEngine) checkWriteNetwork(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if e.networkPolicy != nil && !e.allowedByPolicy(w, r, e.networkPolicy.write) {
+			return
+		}
+		next(w, r)
+	}
+}
+
+// allowedByPolicy returns true if the client may make the request. If not a 403 is written.
+// Requests that do not come from an IP, like those on a unix socket, are allowed as
+// access to the socket is controlled by its file permissions.
+func (e *HTTPEngine) allowedByPolicy(w http.ResponseWriter, r *http.Request, policy ipPolicy) bool {
+	if len(policy.allowed) == 0 && len(policy.denied) == 0 {
+		return true
+	}
+	ip := e.clientIP(r)
+	if ip == nil {
+		return true
+	}
+	if !inNetworks(ip, policy.denied) && (len(policy.allowed) == 0 || inNetworks(ip, policy.allowed)) {
+		return true
+	}
+	e.requestLogger(r).Warningf("Rejected request to %s from %s by the network policy", r.URL.Path, ip)
+	setContentJSON(w)
+	writeJSONError(w, http.StatusForbidden, "network_not_allowed", "Your network is not allowed to use this endpoint")
+	return false
+}
+
+// clientIP returns the IP of the client. X-Forwarded-For is only followed while the
+// request came through a trusted proxy. It is read from the right as anything to the
+// left of the last trusted proxy could have been made up by the client.
+func (e *HTTPEngine) clientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !inNetworks(ip, e.networkPolicy.trustedProxies) {
+		return ip
+	}
+	forwarded := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !inNetworks(ip, e.networkPolicy.trustedProxies) {
+			break
+		}
+	}
+	return ip
+}
+
+func inNetworks(ip net.IP, networks []*net.IPNet) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
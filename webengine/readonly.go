@@ -0,0 +1,50 @@
+package webengine
+
+import (
+	"net"
+	"net/http"
+)
+
+// readOnlyDisabledGroups are the endpoint groups that the read only listener never serves.
+var readOnlyDisabledGroups = []string{TriggerEndpoints, AdminEndpoints}
+
+// ReadOnlyHandler returns a handler that only serves the read endpoints, along with
+// /healthcheck and /readiness. Groups disabled on the engine stay disabled.
+func (e *HTTPEngine) ReadOnlyHandler() http.Handler {
+	return e.newRouter(append(append([]string{}, e.disabledGroups...), readOnlyDisabledGroups...))
+}
+
+// StartReadOnlyHTTPEngine will start a second web server that only serves the read
+// endpoints, so that a monitoring network can see the state of chef waiter without
+// being able to change it. It shares the state and worker with the main web server.
+// TLS is used when certPath is set, with the same certificate as the main web server.
+// It is stopped by StopHTTPEngine. If StopHTTPEngine has already run it returns
+// http.ErrServerClosed without serving.
+// Should be used in a go routine.
+func (e *HTTPEngine) StartReadOnlyHTTPEngine(listenerAddress, certPath, keyPath string) error {
+	server := &http.Server{Addr: listenerAddress, Handler: e.ReadOnlyHandler()}
+	if certPath != "" {
+		certs, err := e.certificates(certPath, keyPath)
+		if err != nil {
+			return err
+		}
+		server.TLSConfig = httpsConfig(certs.GetCertificate)
+	}
+	listener, err := net.Listen("tcp", listenerAddress)
+	if err != nil {
+		return err
+	}
+	e.readOnlyLock.Lock()
+	if e.readOnlyStopped {
+		e.readOnlyLock.Unlock()
+		listener.Close()
+		return http.ErrServerClosed
+	}
+	// A Shutdown from here on makes Serve return straight away.
+	e.readOnlyServer = server
+	e.readOnlyLock.Unlock()
+	if certPath != "" {
+		return server.ServeTLS(listener, "", "")
+	}
+	return server.Serve(listener)
+}
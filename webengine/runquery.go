@@ -0,0 +1,83 @@
+package webengine
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/morfien101/chef-waiter/internalstate"
+)
+
+// runQuery holds the label, status and source query parameters of /chef/runs.
+// An empty value matches every run.
+type runQuery struct {
+	label  string
+	status string
+	source string
+}
+
+// runEntry is a run in the list returned by /chef/runs.
+type runEntry struct {
+	GUID string `json:"guid"`
+	internalstate.JobDetails
+}
+
+// parseRunQuery reads ?label=, ?status= and ?source= from the request.
+func parseRunQuery(r *http.Request) (runQuery, error) {
+	query := runQuery{
+		label:  r.URL.Query().Get("label"),
+		status: r.URL.Query().Get("status"),
+		source: r.URL.Query().Get("source"),
+	}
+	switch query.source {
+	case "", "demand", "periodic", "custom":
+	default:
+		return query, fmt.Errorf("source must be demand, periodic or custom")
+	}
+	return query, nil
+}
+
+// matches returns true if the job has the label, status and source that were asked for.
+func (q runQuery) matches(job internalstate.JobDetails) bool {
+	return (q.label == "" || job.Label == q.label) &&
+		(q.status == "" || job.Status == q.status) &&
+		(q.source == "" || job.Source == q.source)
+}
+
+// getRuns - lists the runs that match the query as a JSON array. The state table is
+// small so the runs are scanned rather than indexed. The list filter and sort of
+// /chef/allruns also apply. An empty array is returned when nothing matches.
+func (e *HTTPEngine) getRuns(w http.ResponseWriter, r *http.Request) {
+	setContentJSON(w)
+	query, err := parseRunQuery(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_filter", err.Error())
+		return
+	}
+	if !validLabel(w, query.label) {
+		return
+	}
+	filter, err := parseListFilter(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_filter", err.Error())
+		return
+	}
+	order, err := parseRunSort(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_sort", err.Error())
+		return
+	}
+
+	jobs := e.state.ReadAllJobs()
+	for guid, job := range jobs {
+		if !query.matches(job) {
+			delete(jobs, guid)
+		}
+	}
+	guids := filter.filterJobs(jobs, order)
+	runs := make([]runEntry, 0, len(guids))
+	for _, guid := range guids {
+		runs = append(runs, runEntry{GUID: guid, JobDetails: jobs[guid]})
+	}
+	json.NewEncoder(w).Encode(runs)
+}
@@ -0,0 +1,51 @@
+package webengine
+
+import (
+	"encoding/csv"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/morfien101/chef-waiter/internalstate"
+)
+
+// runsCSVHeader is the first row of the CSV export of the runs.
+var runsCSVHeader = []string{"guid", "status", "source", "start", "end", "duration", "exit_code"}
+
+// writeRunsCSV writes the jobs as CSV in the order of guids.
+// Times are written in RFC 3339 in UTC and the duration is in seconds. Times and
+// durations that are not known yet are left blank.
+func writeRunsCSV(w io.Writer, guids []string, jobs map[string]internalstate.JobDetails) error {
+	csvWriter := csv.NewWriter(w)
+	if err := csvWriter.Write(runsCSVHeader); err != nil {
+		return err
+	}
+	for _, guid := range guids {
+		job := jobs[guid]
+		duration := ""
+		if job.RunStartTime != 0 && job.RunEndTime != 0 {
+			duration = strconv.FormatInt(job.RunEndTime-job.RunStartTime, 10)
+		}
+		err := csvWriter.Write([]string{
+			guid,
+			job.Status,
+			job.Source,
+			csvTime(job.RunStartTime),
+			csvTime(job.RunEndTime),
+			duration,
+			strconv.Itoa(job.ExitCode),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	csvWriter.Flush()
+	return csvWriter.Error()
+}
+
+func csvTime(epoch int64) string {
+	if epoch == 0 {
+		return ""
+	}
+	return time.Unix(epoch, 0).UTC().Format(time.RFC3339)
+}
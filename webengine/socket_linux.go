@@ -0,0 +1,19 @@
+package webengine
+
+import (
+	"net"
+	"syscall"
+)
+
+// socketUmask leaves the socket readable and writable by the owner and group only.
+const socketUmask = 0117
+
+// listenUnix listens on a unix socket at socketPath. The umask is tightened while the
+// socket is created so that it is never open to other users, not even for the moment
+// before a chmod. The umask is for the whole process, so files created by other go
+// routines in that moment are also only open to the owner and group.
+func listenUnix(socketPath string) (net.Listener, error) {
+	oldUmask := syscall.Umask(socketUmask)
+	defer syscall.Umask(oldUmask)
+	return net.Listen("unix", socketPath)
+}
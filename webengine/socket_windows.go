@@ -0,0 +1,11 @@
+package webengine
+
+import (
+	"net"
+)
+
+// listenUnix listens on a unix socket at socketPath. Windows has no umask, access to the
+// socket comes from the ACL of the directory it is created in.
+func listenUnix(socketPath string) (net.Listener, error) {
+	return net.Listen("unix", socketPath)
+}
@@ -0,0 +1,17 @@
+package webengine
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// statsWindow is how far back /chef/stats looks.
+const statsWindow = 24 * time.Hour
+
+// getRunStats - shows counts and rates of the runs from the last day for a quick view
+// of the health of the node without reading every run.
+func (e *HTTPEngine) getRunStats(w http.ResponseWriter, r *http.Request) {
+	setContentJSON(w)
+	json.NewEncoder(w).Encode(e.state.ReadRunStats(time.Now(), statsWindow))
+}
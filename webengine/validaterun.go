@@ -0,0 +1,74 @@
+package webengine
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/morfien101/chef-waiter/chefrunner"
+	"github.com/morfien101/chef-waiter/internalstate"
+)
+
+// customRunPlan is the answer to a custom run validation. Problems holds everything
+// that would stop the run from being accepted, using the same codes as the errors
+// that the custom run endpoint returns.
+type customRunPlan struct {
+	RunList        string      `json:"run_list"`
+	Whitelisted    bool        `json:"whitelisted"`
+	ReasonRequired bool        `json:"reason_required"`
+	Valid          bool        `json:"valid"`
+	Problems       []jsonError `json:"problems"`
+	chefrunner.CommandPlan
+}
+
+// validateChefCustomRun - takes the same request as a custom run and shows how it
+// would be run and if it would be accepted. Nothing is registered or run. The lock
+// is not checked as it changes over time.
+func (e *HTTPEngine) validateChefCustomRun(w http.ResponseWriter, r *http.Request) {
+	setContentJSON(w)
+	options := internalstate.RunOptions{
+		Label:    r.URL.Query().Get("label"),
+		Retry:    retryRequested(r),
+		RunAs:    r.URL.Query().Get("run_as"),
+		Reason:   r.URL.Query().Get("reason"),
+		NodeName: r.URL.Query().Get("node_name"),
+	}
+	customRunText, ok := e.readCustomRun(w, r, &options)
+	if !ok {
+		return
+	}
+
+	plan := customRunPlan{
+		RunList:        customRunText,
+		Whitelisted:    e.whitelisted(customRunText),
+		ReasonRequired: e.reasonRequired(customRunText),
+		Problems:       make([]jsonError, 0),
+		CommandPlan:    e.worker.PlanCustomRun(customRunText, options),
+	}
+	if len(options.Label) > maxLabelLength {
+		plan.Problems = append(plan.Problems, jsonError{Code: "invalid_label", Message: fmt.Sprintf("label must be at most %d characters", maxLabelLength)})
+	}
+	if !validNodeName(options.NodeName) {
+		plan.Problems = append(plan.Problems, jsonError{Code: "invalid_node_name", Message: invalidNodeNameMessage})
+	}
+	if !plan.Whitelisted {
+		plan.Problems = append(plan.Problems, jsonError{Code: "not_whitelisted", Message: fmt.Sprintf("Whitelist does not contain '%s'", customRunText), Command: customRunText})
+	}
+	if plan.ReasonRequired && strings.TrimSpace(options.Reason) == "" {
+		plan.Problems = append(plan.Problems, jsonError{Code: "missing_reason", Message: fmt.Sprintf("A reason is required to run '%s'", customRunText)})
+	}
+	if notAllowed := e.notAllowedExtraFlags(options.ExtraFlags); len(notAllowed) > 0 {
+		plan.Problems = append(plan.Problems, jsonError{Code: "extra_flags_not_allowed", Message: fmt.Sprintf("Extra flags are not allowed: %s", strings.Join(notAllowed, ", "))})
+	}
+	if !e.runAsUserAllowed(options.RunAs) {
+		plan.Problems = append(plan.Problems, jsonError{Code: "run_as_not_allowed", Message: fmt.Sprintf("Running as %s is not allowed", options.RunAs)})
+	}
+	plan.Valid = len(plan.Problems) == 0
+
+	jsonBytes, err := jsonMarshal(plan)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Failed to encode the plan")
+		return
+	}
+	printJSON(w, jsonBytes)
+}